@@ -0,0 +1,60 @@
+package cbornode
+
+import (
+	"bytes"
+	"fmt"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// AppendToArray appends elems to the encoded CBOR array b and returns the
+// encoding of the extended array, without decoding the existing elements
+// into Go values: they are copied verbatim after a new length header, and
+// only elems are encoded. This keeps appending to large dag-cbor logs cheap.
+//
+// If b is canonical dag-cbor, as produced by DumpObject or WrapObject, so is
+// the result. Indefinite length arrays aren't dag-cbor and are refused with
+// an ErrNotDagCBOR error. The result can be hashed with cid.Prefix.Sum.
+func AppendToArray(b []byte, elems ...interface{}) ([]byte, error) {
+	var root encoding.Token
+	err := encoding.TokenWalk(b, func(tok encoding.Token) error {
+		root = tok
+		return encoding.SkipItem
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root.Major != encoding.MajArray {
+		return nil, fmt.Errorf("cannot append to a CBOR item of major type %d", root.Major)
+	}
+	if root.Indefinite {
+		return nil, fmt.Errorf("%w: indefinite length array", ErrNotDagCBOR)
+	}
+
+	var buf bytes.Buffer
+	writeCanonHeader(&buf, encoding.MajArray, root.Value+uint64(len(elems)))
+	buf.Write(b[headerLen(root.Info):])
+	for _, e := range elems {
+		if err := encodeTo(e, &buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// headerLen returns the length of a CBOR header with the given additional
+// information.
+func headerLen(info byte) int {
+	switch info {
+	case 24:
+		return 2
+	case 25:
+		return 3
+	case 26:
+		return 5
+	case 27:
+		return 9
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,151 @@
+package cbornode
+
+import (
+	"context"
+	"sync"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// AsyncStore is an IpldStore that writes to an inner store in the background.
+//
+// Put still encodes and hashes objects before returning, as it must return
+// their CID, but the write to the inner store is handed to one of a bounded
+// number of workers. Objects put but not yet written can be read back with
+// Get. Call Flush before publishing a root CID to make sure everything it
+// references has been written.
+type AsyncStore struct {
+	inner IpldStore
+	sem   chan struct{}
+
+	lk      sync.Mutex
+	pending map[cid.Cid][]byte
+	// Writes are numbered in the order of the Put calls, next being the
+	// number of the next one. inflight holds the numbers of the writes not
+	// done yet, and written is closed, then replaced, whenever one is done.
+	next     uint64
+	inflight map[uint64]struct{}
+	written  chan struct{}
+	err      error
+}
+
+var _ IpldStore = &AsyncStore{}
+
+// NewAsyncStore returns an AsyncStore writing to inner with at most workers
+// concurrent writes. Put blocks while all workers are busy.
+func NewAsyncStore(inner IpldStore, workers int) *AsyncStore {
+	if workers < 1 {
+		workers = 1
+	}
+	return &AsyncStore{
+		inner:    inner,
+		sem:      make(chan struct{}, workers),
+		pending:  make(map[cid.Cid][]byte),
+		inflight: make(map[uint64]struct{}),
+		written:  make(chan struct{}),
+	}
+}
+
+// Get reads and unmarshals the content at `c` into `out`, including objects
+// whose write is still pending.
+func (s *AsyncStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	s.lk.Lock()
+	data, ok := s.pending[c]
+	s.lk.Unlock()
+	if !ok {
+		return s.inner.Get(ctx, c, out)
+	}
+
+	return decodeForStore(s.inner, data, out)
+}
+
+// Put encodes `v` and queues it to be written to the inner store, returning
+// its CID. Errors writing it are reported by the next call to Flush. The write
+// uses ctx, so it must stay valid until the object has been flushed.
+func (s *AsyncStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	data, c, err := encodeForStore(s.inner, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if bs, ok := asBasic(s.inner); ok {
+		if err := bs.checkPolicy(c.Prefix().Codec, c.Prefix().MhType); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return cid.Undef, ctx.Err()
+	}
+
+	s.lk.Lock()
+	seq := s.next
+	s.next++
+	s.inflight[seq] = struct{}{}
+	s.pending[c] = data
+	s.lk.Unlock()
+
+	go func() {
+		err := s.write(ctx, data, c)
+		<-s.sem
+
+		s.lk.Lock()
+		defer s.lk.Unlock()
+		delete(s.pending, c)
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		delete(s.inflight, seq)
+		close(s.written)
+		s.written = make(chan struct{})
+	}()
+	return c, nil
+}
+
+// Flush waits until every object put before it was called has been written
+// to the inner store, and returns the first write error since the last Flush.
+// Objects put meanwhile are not waited for, so Flush returns even while other
+// goroutines keep putting objects.
+func (s *AsyncStore) Flush(ctx context.Context) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for end := s.next; s.writing(end); {
+		written := s.written
+		s.lk.Unlock()
+		select {
+		case <-written:
+		case <-ctx.Done():
+			s.lk.Lock()
+			return ctx.Err()
+		}
+		s.lk.Lock()
+	}
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// writing reports whether a write numbered below end is not done yet. The
+// workers bound the number of writes in flight, so it is cheap to scan them.
+func (s *AsyncStore) writing(end uint64) bool {
+	for seq := range s.inflight {
+		if seq < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AsyncStore) write(ctx context.Context, data []byte, c cid.Cid) error {
+	if bs, ok := asBasic(s.inner); ok {
+		blk, err := block.NewBlockWithCid(data, c)
+		if err != nil {
+			return err
+		}
+		return bs.Blocks.Put(ctx, blk)
+	}
+	_, err := s.inner.Put(ctx, &rawObject{data: data, cid: c})
+	return err
+}
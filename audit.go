@@ -0,0 +1,74 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrUnstableEncoding is returned in encode audit mode when an object doesn't
+// survive a decode and re-encode unchanged.
+var ErrUnstableEncoding = errors.New("encoding is not roundtrip stable")
+
+// SetEncodeAudit makes every encoding decode its output back into a fresh
+// value of the encoded type, encode that value again and check that both
+// encodings are identical, failing with an ErrUnstableEncoding error naming
+// the first difference otherwise. This catches atlases and transforms that
+// lose or reorder data, at the cost of a decode and an encode per call, so it
+// is meant for tests and CI rather than production.
+//
+// Encodings already running when the audit is switched on or off finish as
+// they started.
+func SetEncodeAudit(on bool) {
+	updateSettings(func(s *settings) {
+		s.encodeAudit = on
+	})
+}
+
+// auditEncoding checks that b, the encoding of obj, is roundtrip stable.
+func (cs *codecs) auditEncoding(obj interface{}, b []byte) error {
+	t := reflect.TypeOf(obj)
+	if t == nil {
+		return nil
+	}
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+	back := reflect.New(t)
+	if err := cs.unmarshaller.Unmarshal(b, back.Interface()); err != nil {
+		return fmt.Errorf("%w: %T does not decode back: %s", ErrUnstableEncoding, obj, err)
+	}
+	again := back.Interface()
+	if !ptr {
+		again = back.Elem().Interface()
+	}
+	b2, err := cs.marshaller.Marshal(again)
+	if err == nil {
+		b2, err = spliceRaw(b2)
+	}
+	if err == nil {
+		b2, err = rewriteUndefinedCids(b2, cs.undefinedCids)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %T does not encode again: %s", ErrUnstableEncoding, obj, err)
+	}
+	if bytes.Equal(b, b2) {
+		return nil
+	}
+	i := 0
+	for i < len(b) && i < len(b2) && b[i] == b2[i] {
+		i++
+	}
+	return fmt.Errorf("%w: %T re-encodes differently from offset %d: %x then %x",
+		ErrUnstableEncoding, obj, i, auditSnippet(b, i), auditSnippet(b2, i))
+}
+
+func auditSnippet(b []byte, i int) []byte {
+	end := i + 16
+	if end > len(b) {
+		end = len(b)
+	}
+	return b[i:end]
+}
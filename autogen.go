@@ -0,0 +1,429 @@
+package cbornode
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	cid "github.com/ipfs/go-cid"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// autogenerateEntry builds the atlas entry RegisterCborType uses for a struct
+// that wasn't given an explicit entry.
+//
+// Structs without embedded fields use refmt's autogeneration as is. For
+// structs with embedded fields, the fields of embedded structs are promoted
+// into the parent map following encoding/json: the shallowest field wins, and
+// among fields at the same depth a tagged one wins. Unlike encoding/json,
+// ambiguous names are reported as an error instead of being dropped.
+//
+// Fields promoted from embedded struct pointers have routes refmt can't
+// follow through nil pointers, see nilSafeEntries.
+func autogenerateEntry(t reflect.Type) (*atlas.AtlasEntry, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot autogenerate an atlas entry for %s, which is kind %s", t, t.Kind())
+	}
+	var entry *atlas.AtlasEntry
+	if !hasEmbeddedFields(t) {
+		entry = atlas.BuildEntry(reflect.Zero(t).Interface()).StructMap().AutogenerateWithSortingScheme(atlas.KeySortMode_RFC7049).Complete()
+	} else {
+		fields, err := promotedFields(t)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(atlas.StructMapEntry_RFC7049(fields))
+		entry = &atlas.AtlasEntry{
+			Type:      t,
+			StructMap: &atlas.StructMap{Fields: fields},
+		}
+	}
+	if err := checkFieldTypes(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// checkFieldTypes rejects entries with fields that can't be encoded, such as
+// channels or functions, which would otherwise only fail, or panic, on the
+// first encoding of a value. Types with atlas entries of their own are
+// accepted whatever their kind.
+func checkFieldTypes(entry *atlas.AtlasEntry) error {
+	for _, f := range entry.StructMap.Fields {
+		if f.Ignore {
+			continue
+		}
+		sf := entry.Type.FieldByIndex(f.ReflectRoute)
+		if reason := unsupportedType(sf.Type); reason != "" {
+			return fmt.Errorf("cannot register %s: field %s (key %q) of type %s %s", entry.Type, sf.Name, f.SerialName, sf.Type, reason)
+		}
+	}
+	return nil
+}
+
+// unsupportedType returns why values of t can't be encoded, or "" if they
+// may be. Structs are checked when they are registered.
+func unsupportedType(t reflect.Type) string {
+	if findAtlasEntry(t) != nil {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Chan:
+		return "is a channel"
+	case reflect.Func:
+		return "is a function"
+	case reflect.UnsafePointer:
+		return "is an unsafe pointer"
+	case reflect.Complex64, reflect.Complex128:
+		return "is a complex number"
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		if reason := unsupportedType(t.Elem()); reason != "" {
+			return "holds a " + t.Elem().String() + ", which " + reason
+		}
+	case reflect.Map:
+		if k := t.Key(); k.Kind() != reflect.String {
+			return "has " + k.String() + " keys, which are not strings"
+		}
+		if reason := unsupportedType(t.Elem()); reason != "" {
+			return "holds a " + t.Elem().String() + ", which " + reason
+		}
+	}
+	return ""
+}
+
+func hasEmbeddedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Anonymous {
+			return true
+		}
+	}
+	return false
+}
+
+type fieldCandidate struct {
+	entry  atlas.StructMapEntry
+	tagged bool
+	goName string
+}
+
+func promotedFields(t reflect.Type) ([]atlas.StructMapEntry, error) {
+	type embedded struct {
+		typ   reflect.Type
+		route []int
+	}
+
+	var out []atlas.StructMapEntry
+	claimed := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+	next := []embedded{{typ: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		// Types seen at a shallower level are fully shadowed already.
+		for _, e := range current {
+			visited[e.typ] = true
+		}
+
+		level := map[string][]fieldCandidate{}
+		for _, e := range current {
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag := sf.Tag.Get("refmt")
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseFieldTag(tag)
+
+				route := make([]int, len(e.route)+1)
+				copy(route, e.route)
+				route[len(e.route)] = i
+
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+						// Routes go through pointers, see nilSafeEntries.
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						if !visited[ft] {
+							next = append(next, embedded{typ: ft, route: route})
+						}
+						continue
+					}
+				}
+				if !sf.IsExported() {
+					continue
+				}
+
+				tagged := name != ""
+				if !tagged {
+					name = downcaseFirstLetter(sf.Name)
+				}
+				level[name] = append(level[name], fieldCandidate{
+					entry: atlas.StructMapEntry{
+						SerialName:   name,
+						ReflectRoute: route,
+						Type:         sf.Type,
+						OmitEmpty:    hasTagOption(opts, "omitempty"),
+					},
+					tagged: tagged,
+					goName: sf.Name,
+				})
+			}
+		}
+
+		names := make([]string, 0, len(level))
+		for name := range level {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if claimed[name] {
+				continue
+			}
+			claimed[name] = true
+			field, err := dominantField(t, name, level[name])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, field)
+		}
+	}
+	return out, nil
+}
+
+// nilSafeStructs maps the types given entries by nilSafeEntries to the struct
+// map entries they were built from.
+var nilSafeStructs sync.Map
+
+// nilSafeEntries returns the entries to register for the struct map entry
+// built by autogenerateEntry: entry itself, unless some of its fields are
+// promoted from embedded struct pointers. refmt can't follow their routes
+// when the pointers are nil, so values are then copied to and from a flat
+// struct instead, as encoding/json does: fields under a nil pointer are left
+// out of the encoding, and the pointer is allocated on decode when one of
+// them is present. The first entry is the one of entry.Type, the second the
+// one of the flat struct.
+func nilSafeEntries(entry *atlas.AtlasEntry) []*atlas.AtlasEntry {
+	t := entry.Type
+	fields := entry.StructMap.Fields
+	via := make([]bool, len(fields))
+	nilable := false
+	for i, f := range fields {
+		via[i] = routeViaPointer(t, f.ReflectRoute)
+		nilable = nilable || via[i]
+	}
+	if !nilable {
+		return []*atlas.AtlasEntry{entry}
+	}
+
+	// Fields under pointers are pointers in the flat struct, nil when the
+	// embedded pointer is.
+	sfs := make([]reflect.StructField, len(fields))
+	flat := make([]atlas.StructMapEntry, len(fields))
+	for i, f := range fields {
+		ft := f.Type
+		if via[i] {
+			ft = reflect.PointerTo(ft)
+		}
+		sfs[i] = reflect.StructField{Name: "F" + strconv.Itoa(i), Type: ft}
+		flat[i] = atlas.StructMapEntry{
+			SerialName:   f.SerialName,
+			ReflectRoute: atlas.ReflectRoute{i},
+			Type:         ft,
+			OmitEmpty:    f.OmitEmpty || via[i],
+			Ignore:       f.Ignore,
+		}
+	}
+	st := reflect.StructOf(sfs)
+
+	live := atlas.BuildEntry(reflect.Zero(t).Interface()).Transform().
+		TransformMarshal(func(v reflect.Value) (reflect.Value, error) {
+			out := reflect.New(st).Elem()
+			for i, f := range fields {
+				fv := f.ReflectRoute.TraverseToValue(v)
+				switch {
+				case !fv.IsValid():
+					// Under a nil pointer.
+				case !via[i]:
+					out.Field(i).Set(fv)
+				case !f.OmitEmpty || !emptyValue(fv):
+					p := reflect.New(f.Type)
+					p.Elem().Set(fv)
+					out.Field(i).Set(p)
+				}
+			}
+			return out, nil
+		}, st).
+		TransformUnmarshal(func(v reflect.Value) (reflect.Value, error) {
+			out := reflect.New(t).Elem()
+			for i, f := range fields {
+				fv := v.Field(i)
+				if via[i] {
+					if fv.IsNil() {
+						continue
+					}
+					fv = fv.Elem()
+				}
+				dst, err := allocRoute(out, f.ReflectRoute)
+				if err != nil {
+					return out, err
+				}
+				dst.Set(fv)
+			}
+			return out, nil
+		}, st).
+		Complete()
+	nilSafeStructs.Store(t, entry)
+	return []*atlas.AtlasEntry{live, {Type: st, StructMap: &atlas.StructMap{Fields: flat}}}
+}
+
+// routeViaPointer reports whether route goes through a pointer to reach the
+// field it leads to in t.
+func routeViaPointer(t reflect.Type, route []int) bool {
+	for _, i := range route[:len(route)-1] {
+		t = t.Field(i).Type
+		if t.Kind() == reflect.Ptr {
+			return true
+		}
+		// Promoted routes only cross structs and pointers to structs.
+	}
+	return false
+}
+
+// allocRoute returns the field route leads to in v, allocating the nil
+// pointers on the way.
+func allocRoute(v reflect.Value, route []int) (reflect.Value, error) {
+	for _, i := range route {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, nil
+}
+
+// emptyValue mirrors the omitempty check of refmt's marshaller.
+func emptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !emptyValue(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func dominantField(t reflect.Type, name string, cands []fieldCandidate) (atlas.StructMapEntry, error) {
+	if len(cands) == 1 {
+		return cands[0].entry, nil
+	}
+	var tagged []fieldCandidate
+	for _, c := range cands {
+		if c.tagged {
+			tagged = append(tagged, c)
+		}
+	}
+	if len(tagged) == 1 {
+		return tagged[0].entry, nil
+	}
+	if len(tagged) > 1 {
+		cands = tagged
+	}
+	goNames := make([]string, len(cands))
+	for i, c := range cands {
+		goNames[i] = c.goName
+	}
+	return atlas.StructMapEntry{}, fmt.Errorf("cannot register %s: fields %s all map to key %q", t, strings.Join(goNames, ", "), name)
+}
+
+// parseFieldTag and friends mirror the tag handling of refmt's autogeneration.
+func parseFieldTag(tag string) (string, string) {
+	name, opts := tag, ""
+	if idx := strings.Index(tag, ","); idx != -1 {
+		name, opts = tag[:idx], tag[idx+1:]
+	}
+	if !isValidTagName(name) {
+		name = ""
+	}
+	return name, opts
+}
+
+func hasTagOption(opts, option string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTagName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("!#$%&()*+-./:<=>?@[]^_{|}~ ", c) && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func downcaseFirstLetter(s string) string {
+	if s == "" {
+		return ""
+	}
+	r := rune(s[0])
+	if !unicode.IsUpper(r) {
+		return s
+	}
+	return string(unicode.ToLower(r)) + s[1:]
+}
+
+var (
+	cidType    = reflect.TypeOf(cid.Cid{})
+	bigIntType = reflect.TypeOf(big.Int{})
+)
+
+// omitEmptyCidsAndBigInts marks the CID and big.Int fields of a generated
+// entry as omitempty, see OmitEmptyCidsAndBigInts.
+func omitEmptyCidsAndBigInts(entry *atlas.AtlasEntry) {
+	for i := range entry.StructMap.Fields {
+		f := &entry.StructMap.Fields[i]
+		ft := entry.Type.FieldByIndex(f.ReflectRoute).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft == cidType || ft == bigIntType {
+			f.OmitEmpty = true
+		}
+	}
+}
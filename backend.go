@@ -0,0 +1,205 @@
+package cbornode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// EncoderKind selects the CBOR backend used by the package level encoding and
+// decoding functions (Encode, EncodeWriter, DecodeInto, DecodeReader,
+// WrapObject, ...).
+type EncoderKind int
+
+const (
+	// EncoderRefmt is the default backend, built on refmt atlases.
+	EncoderRefmt EncoderKind = iota
+	// EncoderFxamacker is an experimental backend built on
+	// github.com/fxamacker/cbor. It is only available when built with the
+	// "cborfx" build tag.
+	EncoderFxamacker
+)
+
+func (k EncoderKind) String() string {
+	switch k {
+	case EncoderRefmt:
+		return "refmt"
+	case EncoderFxamacker:
+		return "fxamacker"
+	default:
+		return fmt.Sprintf("EncoderKind(%d)", int(k))
+	}
+}
+
+// codecBackend is implemented by alternative encoding backends.
+type codecBackend interface {
+	Marshal(obj interface{}) ([]byte, error)
+	Encode(obj interface{}, w io.Writer) error
+	Unmarshal(b []byte, obj interface{}) error
+	Decode(r io.Reader, obj interface{}) error
+}
+
+// backends holds the alternative backends compiled into this binary.
+var backends = map[EncoderKind]codecBackend{}
+
+// WithEncoder selects the backend used for encoding and decoding. It returns
+// an error if the requested backend was not compiled in.
+//
+// Values encoded with one backend decode with the other, so the backend can
+// be switched while other goroutines encode and decode: each call uses the
+// backend selected when it started.
+func WithEncoder(kind EncoderKind) error {
+	var b codecBackend
+	if kind != EncoderRefmt {
+		var ok bool
+		if b, ok = backends[kind]; !ok {
+			return fmt.Errorf("cbor encoder %s is not available in this build", kind)
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.backend = b
+	})
+	return nil
+}
+
+func marshal(obj interface{}) ([]byte, error) {
+	return snapshot().marshal(obj)
+}
+
+func (cs *codecs) marshal(obj interface{}) ([]byte, error) {
+	if cs.codecStats {
+		defer recordEncode(obj, time.Now())
+	}
+	var b []byte
+	var err error
+	if cm, ok := obj.(cbg.CBORMarshaler); ok {
+		buf := new(bytes.Buffer)
+		if err = cm.MarshalCBOR(buf); err != nil {
+			err = NewSerializationError(err)
+		}
+		b = buf.Bytes()
+	} else if cs.backend != nil {
+		b, err = cs.backend.Marshal(obj)
+	} else {
+		if cs.nilCollections == NilCollectionEmpty {
+			obj = emptyNilCollections(obj)
+		}
+		b, err = cs.marshaller.Marshal(obj)
+		switch {
+		case err == ErrEmptyLink:
+			if path := undefinedCidPath(reflect.ValueOf(obj), ""); path != "" {
+				err = fmt.Errorf("%w at %s", ErrEmptyLink, path)
+			}
+		case err == nil:
+			if b, err = spliceRaw(b); err == nil {
+				b, err = rewriteUndefinedCids(b, cs.undefinedCids)
+			}
+		}
+		if err == nil && cs.encodeAudit {
+			err = cs.auditEncoding(obj, b)
+		}
+	}
+	if err == nil && cs.interop {
+		err = checkInterop(b)
+	}
+	return b, err
+}
+
+func encodeTo(obj interface{}, w io.Writer) error {
+	cs := snapshot()
+	if cs.interop || cs.encodeAudit || cs.undefinedCids != UndefinedCidError ||
+		cs.nilCollections != NilCollectionNull || cs.holdsRaw(obj) {
+		b, err := cs.marshal(obj)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	if cs.codecStats {
+		defer recordEncode(obj, time.Now())
+	}
+	if cm, ok := obj.(cbg.CBORMarshaler); ok {
+		if err := cm.MarshalCBOR(w); err != nil {
+			return NewSerializationError(err)
+		}
+		return nil
+	}
+	if cs.backend != nil {
+		return cs.backend.Encode(obj, w)
+	}
+	return cs.marshaller.Encode(obj, w)
+}
+
+func unmarshal(b []byte, obj interface{}) error {
+	return snapshot().unmarshal(b, obj)
+}
+
+func (cs *codecs) unmarshal(b []byte, obj interface{}) error {
+	if cs.codecStats {
+		defer recordDecode(obj, time.Now())
+	}
+	if cs.interop {
+		if err := checkInterop(b); err != nil {
+			return err
+		}
+	}
+	if cu, ok := obj.(cbg.CBORUnmarshaler); ok {
+		if err := cu.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
+			return NewSerializationError(err)
+		}
+		return nil
+	}
+	if cs.backend != nil {
+		return cs.backend.Unmarshal(b, obj)
+	}
+	wide, err := cs.unmarshaller.UnmarshalWatch(b, obj, cs.intCheckLimit(obj))
+	if err != nil {
+		return err
+	}
+	if err := cs.checkIntegers(obj, wide); err != nil {
+		return err
+	}
+	if out, ok := obj.(*interface{}); ok && cs.stringLinks {
+		*out = normalizeStringLinks(*out)
+	}
+	return nil
+}
+
+func decodeFrom(r io.Reader, obj interface{}) error {
+	cs := snapshot()
+	if cs.interop {
+		b, err := readInterop(r)
+		if err != nil {
+			return err
+		}
+		return cs.unmarshal(b, obj)
+	}
+	if cs.codecStats {
+		defer recordDecode(obj, time.Now())
+	}
+	if cu, ok := obj.(cbg.CBORUnmarshaler); ok {
+		if err := cu.UnmarshalCBOR(r); err != nil {
+			return NewSerializationError(err)
+		}
+		return nil
+	}
+	if cs.backend != nil {
+		return cs.backend.Decode(r, obj)
+	}
+	wide, err := cs.unmarshaller.DecodeWatch(r, obj, cs.intCheckLimit(obj))
+	if err != nil {
+		return err
+	}
+	if err := cs.checkIntegers(obj, wide); err != nil {
+		return err
+	}
+	if out, ok := obj.(*interface{}); ok && cs.stringLinks {
+		*out = normalizeStringLinks(*out)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+//go:build cborfx
+
+package cbornode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	cbor "github.com/fxamacker/cbor/v2"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func init() {
+	backends[EncoderFxamacker] = newFxBackend()
+}
+
+// fxBackend encodes and decodes using fxamacker/cbor. Registered atlas entries
+// are honored by walking the object and producing a generic tree (structs
+// become maps, transforms are applied, tagged entries become cbor.Tag) which
+// is then encoded in canonical (RFC 7049) order.
+//
+// Decoding produces the same generic form as refmt, which is then cloned into
+// typed outputs through the atlas.
+type fxBackend struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newFxBackend() *fxBackend {
+	enc, err := cbor.EncOptions{
+		Sort:          cbor.SortCanonical,
+		ShortestFloat: cbor.ShortestFloatNone,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{
+		MaxNestedLevels:  65535,
+		MaxArrayElements: math.MaxInt32,
+		MaxMapPairs:      math.MaxInt32,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return &fxBackend{enc: enc, dec: dec}
+}
+
+func (b *fxBackend) Marshal(obj interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.Encode(obj, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *fxBackend) Encode(obj interface{}, w io.Writer) error {
+	if cm, ok := obj.(cbg.CBORMarshaler); ok {
+		return cm.MarshalCBOR(w)
+	}
+	v, err := fxSerializable(snapshot().atlas, reflect.ValueOf(obj))
+	if err != nil {
+		return err
+	}
+	return b.enc.NewEncoder(w).Encode(v)
+}
+
+func (b *fxBackend) Unmarshal(data []byte, obj interface{}) error {
+	return b.Decode(bytes.NewReader(data), obj)
+}
+
+func (b *fxBackend) Decode(r io.Reader, obj interface{}) error {
+	if cu, ok := obj.(cbg.CBORUnmarshaler); ok {
+		return cu.UnmarshalCBOR(r)
+	}
+	var raw interface{}
+	if err := b.dec.NewDecoder(r).Decode(&raw); err != nil {
+		return err
+	}
+	v, err := fxNormalize(raw)
+	if err != nil {
+		return err
+	}
+	if out, ok := obj.(*interface{}); ok {
+		*out = v
+		return nil
+	}
+	return snapshot().cloner.Clone(v, obj)
+}
+
+func fxSerializable(atl atlas.Atlas, v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		return fxSerializable(atl, v.Elem())
+	}
+
+	if v.Type() == rawSpliceType {
+		return cbor.RawMessage(v.Bytes()), nil
+	}
+	if entry, ok := atl.Get(reflect.ValueOf(v.Type()).Pointer()); ok {
+		out, err := fxEntry(atl, entry, v)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Tagged {
+			return cbor.Tag{Number: uint64(entry.Tag), Content: out}, nil
+		}
+		return out, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key()
+			if k.Kind() == reflect.Interface {
+				k = k.Elem()
+			}
+			if k.Kind() != reflect.String {
+				return nil, ErrInvalidKeys
+			}
+			val, err := fxSerializable(atl, iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			out[k.String()] = val
+		}
+		return out, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			out := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(out), v)
+			return out, nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			val, err := fxSerializable(atl, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = val
+		}
+		return out, nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	default:
+		return nil, fmt.Errorf("cbor: no atlas entry for type %s", v.Type())
+	}
+}
+
+func fxEntry(atl atlas.Atlas, entry *atlas.AtlasEntry, v reflect.Value) (interface{}, error) {
+	switch {
+	case entry.MarshalTransformFunc != nil:
+		sv, err := entry.MarshalTransformFunc(v)
+		if err != nil {
+			return nil, err
+		}
+		return fxSerializable(atl, sv)
+	case entry.StructMap != nil:
+		out := make(map[string]interface{}, len(entry.StructMap.Fields))
+		for _, f := range entry.StructMap.Fields {
+			if f.Ignore {
+				continue
+			}
+			fv := f.ReflectRoute.TraverseToValue(v)
+			if f.OmitEmpty && (!fv.IsValid() || fv.IsZero()) {
+				continue
+			}
+			val, err := fxSerializable(atl, fv)
+			if err != nil {
+				return nil, err
+			}
+			out[f.SerialName] = val
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("cbor: atlas entry for type %s is not supported by the fxamacker encoder", v.Type())
+	}
+}
+
+// fxNormalize converts the generic values produced by fxamacker into the
+// forms produced by refmt: string keyed maps, ints and cid.Cid links.
+func fxNormalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, ErrInvalidKeys
+			}
+			nv, err := fxNormalize(val)
+			if err != nil {
+				return nil, err
+			}
+			out[ks] = nv
+		}
+		return out, nil
+	case []interface{}:
+		for i, val := range v {
+			nv, err := fxNormalize(val)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = nv
+		}
+		return v, nil
+	case cbor.Tag:
+		if v.Number != CBORTagLink {
+			return fxRegisteredTag(v)
+		}
+		b, ok := v.Content.([]byte)
+		if !ok {
+			return nil, ErrInvalidLink
+		}
+		return castBytesToCid(b)
+	case uint64:
+		if v <= math.MaxInt {
+			return int(v), nil
+		}
+		return v, nil
+	case int64:
+		return int(v), nil
+	default:
+		return v, nil
+	}
+}
+
+// fxRegisteredTag decodes a tag registered with RegisterCborTag into its Go
+// type by running the content through the registered transform.
+func fxRegisteredTag(t cbor.Tag) (interface{}, error) {
+	entry := findTagEntry(t.Number)
+	if entry == nil {
+		return nil, fmt.Errorf("cbor: unsupported tag %d", t.Number)
+	}
+	content, err := fxNormalize(t.Content)
+	if err != nil {
+		return nil, err
+	}
+	out := reflect.New(entry.Type)
+	if err := snapshot().cloner.Clone(content, out.Interface()); err != nil {
+		return nil, err
+	}
+	return out.Elem().Interface(), nil
+}
@@ -0,0 +1,136 @@
+//go:build cborfx
+
+package cbornode
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	mh "github.com/multiformats/go-multihash"
+)
+
+type fxTestObj struct {
+	Link  cid.Cid
+	Count *big.Int
+	Name  string `refmt:"name,omitempty"`
+	Ratio float64
+}
+
+func init() {
+	RegisterCborType(fxTestObj{})
+}
+
+func withEncoder(t testing.TB, kind EncoderKind) {
+	if err := WithEncoder(kind); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { WithEncoder(EncoderRefmt) })
+}
+
+func TestFxBackendMatchesRefmt(t *testing.T) {
+	files, err := filepath.Glob("test_objects/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs := []interface{}{
+		testStruct(),
+		&fxTestObj{Link: cid.NewCidV0(u.Hash([]byte("x"))), Count: big.NewInt(100), Ratio: 0.25},
+		map[string]interface{}{
+			"link": cid.NewCidV0(u.Hash([]byte("something"))),
+			"f":    1.5,
+			"neg":  -12,
+		},
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, "expected.json") {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := FromJSON(bytes.NewReader(data), mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, nd.obj)
+	}
+
+	fx := backends[EncoderFxamacker]
+	for i, obj := range objs {
+		exp, err := snapshot().marshaller.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fx.Marshal(obj)
+		if err != nil {
+			t.Fatalf("object %d: %s", i, err)
+		}
+		if !bytes.Equal(exp, got) {
+			t.Fatalf("object %d: encodings differ: %x != %x", i, exp, got)
+		}
+
+		var back interface{}
+		if err := fx.Unmarshal(got, &back); err != nil {
+			t.Fatalf("object %d: %s", i, err)
+		}
+		again, err := snapshot().marshaller.Marshal(back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(exp, again) {
+			t.Fatalf("object %d: decode roundtrip differs: %x != %x", i, exp, again)
+		}
+	}
+}
+
+func TestFxBackendDecodeTyped(t *testing.T) {
+	withEncoder(t, EncoderFxamacker)
+
+	obj := testStruct()
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var back MyStruct
+	if err := DecodeInto(nd.RawData(), &back); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back.Items["Foo"].Bar, []byte("Bar")) || len(back.Baz) != 3 {
+		t.Fatalf("decoded wrong value: %#v", back)
+	}
+}
+
+func BenchmarkEncodeFxamacker(b *testing.B) {
+	withEncoder(b, EncoderFxamacker)
+	obj := testStruct()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Encode(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeFxamacker(b *testing.B) {
+	withEncoder(b, EncoderFxamacker)
+	data, err := Encode(testStruct())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out MyStruct
+		if err := DecodeInto(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
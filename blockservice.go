@@ -0,0 +1,36 @@
+package cbornode
+
+import (
+	"context"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// BlockService is the subset of the blockservice.BlockService interface
+// NewBlockServiceStore needs. It is declared here so that this package doesn't
+// depend on a particular blockservice implementation.
+type BlockService interface {
+	GetBlock(ctx context.Context, c cid.Cid) (block.Block, error)
+	AddBlock(ctx context.Context, o block.Block) error
+}
+
+// NewBlockServiceStore returns an IpldStore reading and writing through bsvc.
+// Blocks missing locally are fetched through the block service's exchange
+// (e.g. bitswap), so Get can read any reachable dag-cbor object.
+func NewBlockServiceStore(bsvc BlockService) IpldStore {
+	return NewCborStore(blockServiceBlocks{bsvc})
+}
+
+// blockServiceBlocks adapts a BlockService to an IpldBlockstore.
+type blockServiceBlocks struct {
+	bsvc BlockService
+}
+
+func (b blockServiceBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	return b.bsvc.GetBlock(ctx, c)
+}
+
+func (b blockServiceBlocks) Put(ctx context.Context, blk block.Block) error {
+	return b.bsvc.AddBlock(ctx, blk)
+}
@@ -0,0 +1,46 @@
+package cbornode
+
+import (
+	"errors"
+)
+
+// ErrBudgetExceeded is returned when a traversal would go over its
+// TraversalBudget.
+var ErrBudgetExceeded = errors.New("traversal budget exceeded")
+
+// TraversalBudget meters path resolution, so that callers such as virtual
+// machines can charge for it deterministically. A budget accumulates across
+// the calls it is passed to, for example the successive nodes of a path that
+// crosses links, and isn't safe for concurrent use.
+type TraversalBudget struct {
+	// MaxNodes bounds the number of data model nodes visited: the root of
+	// every node resolved from and each value a path step moves to. 0 means
+	// no limit.
+	MaxNodes int64
+	// MaxBytes bounds the total encoded size of the nodes resolved from. 0
+	// means no limit.
+	MaxBytes int64
+
+	nodes int64
+	bytes int64
+}
+
+// Used returns what has been spent so far.
+func (b *TraversalBudget) Used() (nodes, bytes int64) {
+	return b.nodes, b.bytes
+}
+
+// spend charges the given number of nodes and bytes, failing with
+// ErrBudgetExceeded if that goes over a limit. The charge is kept even then,
+// so an exhausted budget stays exhausted.
+func (b *TraversalBudget) spend(nodes, bytes int64) error {
+	if b == nil {
+		return nil
+	}
+	b.nodes += nodes
+	b.bytes += bytes
+	if b.MaxNodes > 0 && b.nodes > b.MaxNodes || b.MaxBytes > 0 && b.bytes > b.MaxBytes {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package cbornode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// CanonicalizeReport describes the changes Canonicalize made to its input.
+type CanonicalizeReport struct {
+	// ReorderedMaps counts maps whose keys were not in canonical order.
+	ReorderedMaps int
+	// ReencodedHeaders counts integers, lengths and tags whose header was not
+	// minimally encoded.
+	ReencodedHeaders int
+	// IndefiniteLengths counts indefinite length strings, arrays and maps
+	// that were rewritten with a definite length.
+	IndefiniteLengths int
+	// WidenedFloats counts 16 and 32 bit floats rewritten as 64 bit floats.
+	WidenedFloats int
+	// PrefixedLinks counts links missing their multibase prefix, which are
+	// only accepted with SetLenientLinks.
+	PrefixedLinks int
+}
+
+// Changed reports whether any change was made.
+func (r CanonicalizeReport) Changed() bool {
+	return r != CanonicalizeReport{}
+}
+
+// Canonicalize takes a single CBOR object and returns its canonical dag-cbor
+// encoding, the bytes WrapObject would produce for the same data, without
+// decoding it into Go values, hashing it or building a Node.
+//
+// It fails with an ErrNotDagCBOR error if b can't be represented in dag-cbor,
+// for example because it has non-string map keys, duplicate keys, tags other
+// than 42 or simple values other than false, true and null.
+func Canonicalize(b []byte) ([]byte, error) {
+	out, _, err := CanonicalizeX(b)
+	return out, err
+}
+
+// CanonicalizeX is like Canonicalize but also reports the changes made.
+func CanonicalizeX(b []byte) ([]byte, CanonicalizeReport, error) {
+	var report CanonicalizeReport
+	root, err := parseCanonItem(b)
+	if err != nil {
+		return nil, report, err
+	}
+	var buf bytes.Buffer
+	if err := root.encode(&buf, &report); err != nil {
+		return nil, report, err
+	}
+	return buf.Bytes(), report, nil
+}
+
+// canonItem is a parsed CBOR data item.
+type canonItem struct {
+	tok      encoding.Token
+	data     []byte
+	children []*canonItem
+}
+
+func parseCanonItem(b []byte) (*canonItem, error) {
+	var root *canonItem
+	var stack []*canonItem
+	err := encoding.TokenWalk(b, func(tok encoding.Token) error {
+		if tok.Break {
+			// Closes the indefinite length item at tok.Depth.
+			stack = stack[:tok.Depth]
+			return nil
+		}
+		stack = stack[:tok.Depth]
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			if parent.tok.Major == encoding.MajByteString || parent.tok.Major == encoding.MajTextString {
+				// A chunk of an indefinite length string.
+				parent.data = append(parent.data, tok.Bytes...)
+				return nil
+			}
+		}
+
+		it := &canonItem{tok: tok, data: tok.Bytes}
+		if len(stack) == 0 {
+			root = it
+		} else {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, it)
+		}
+		switch tok.Major {
+		case encoding.MajArray, encoding.MajMap, encoding.MajTag:
+			stack = append(stack, it)
+		case encoding.MajByteString, encoding.MajTextString:
+			if tok.Indefinite {
+				it.data = []byte{}
+				stack = append(stack, it)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (it *canonItem) encode(buf *bytes.Buffer, report *CanonicalizeReport) error {
+	tok := it.tok
+	if tok.Indefinite {
+		report.IndefiniteLengths++
+	} else if tok.Major != encoding.MajOther && !minimalHeader(tok) {
+		report.ReencodedHeaders++
+	}
+
+	switch tok.Major {
+	case encoding.MajUnsignedInt, encoding.MajNegativeInt:
+		writeCanonHeader(buf, tok.Major, tok.Value)
+	case encoding.MajByteString, encoding.MajTextString:
+		writeCanonHeader(buf, tok.Major, uint64(len(it.data)))
+		buf.Write(it.data)
+	case encoding.MajArray:
+		writeCanonHeader(buf, tok.Major, uint64(len(it.children)))
+		for _, c := range it.children {
+			if err := c.encode(buf, report); err != nil {
+				return err
+			}
+		}
+	case encoding.MajMap:
+		return it.encodeMap(buf, report)
+	case encoding.MajTag:
+		if tok.Value != CBORTagLink {
+			return fmt.Errorf("%w: unsupported tag %d at offset %d", ErrNotDagCBOR, tok.Value, tok.Offset)
+		}
+		lnk := it.children[0]
+		if lnk.tok.Major != encoding.MajByteString {
+			return fmt.Errorf("%w: link at offset %d is not a byte string", ErrNotDagCBOR, lnk.tok.Offset)
+		}
+		if len(lnk.data) == 0 {
+			return fmt.Errorf("%w: empty link at offset %d", ErrEmptyLink, lnk.tok.Offset)
+		}
+		c, err := castBytesToCid(lnk.data)
+		if err != nil {
+			return err
+		}
+		if lnk.data[0] != 0 {
+			report.PrefixedLinks++
+		}
+		data, err := castCidToBytes(c)
+		if err != nil {
+			return err
+		}
+		writeCanonHeader(buf, tok.Major, tok.Value)
+		return (&canonItem{tok: lnk.tok, data: data}).encode(buf, report)
+	case encoding.MajOther:
+		switch {
+		case tok.IsFloat():
+			if tok.Info != 27 {
+				report.WidenedFloats++
+			}
+			buf.WriteByte(0xfb)
+			var b [8]byte
+			binary.BigEndian.PutUint64(b[:], math.Float64bits(tok.Float()))
+			buf.Write(b[:])
+		case tok.Value == 20, tok.Value == 21, tok.Value == 22:
+			if tok.Info >= 24 {
+				report.ReencodedHeaders++
+			}
+			buf.WriteByte(byte(encoding.MajOther)<<5 | byte(tok.Value))
+		default:
+			return fmt.Errorf("%w: unsupported simple value %d at offset %d", ErrNotDagCBOR, tok.Value, tok.Offset)
+		}
+	}
+	return nil
+}
+
+func (it *canonItem) encodeMap(buf *bytes.Buffer, report *CanonicalizeReport) error {
+	type entry struct {
+		key []byte
+		enc []byte
+	}
+	entries := make([]entry, 0, len(it.children)/2)
+	for i := 0; i < len(it.children); i += 2 {
+		k := it.children[i]
+		if k.tok.Major != encoding.MajTextString {
+			return fmt.Errorf("%w: map key at offset %d is not a string", ErrNotDagCBOR, k.tok.Offset)
+		}
+		var eb bytes.Buffer
+		if err := k.encode(&eb, report); err != nil {
+			return err
+		}
+		if err := it.children[i+1].encode(&eb, report); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: k.data, enc: eb.Bytes()})
+	}
+
+	sorted := sort.SliceIsSorted(entries, func(i, j int) bool {
+		return canonicalKeyLess(entries[i].key, entries[j].key)
+	})
+	if !sorted {
+		report.ReorderedMaps++
+		sort.SliceStable(entries, func(i, j int) bool {
+			return canonicalKeyLess(entries[i].key, entries[j].key)
+		})
+	}
+	for i := 1; i < len(entries); i++ {
+		if bytes.Equal(entries[i-1].key, entries[i].key) {
+			return fmt.Errorf("%w: duplicate map key %q", ErrNotDagCBOR, entries[i].key)
+		}
+	}
+
+	writeCanonHeader(buf, encoding.MajMap, uint64(len(entries)))
+	for _, e := range entries {
+		buf.Write(e.enc)
+	}
+	return nil
+}
+
+// writeCanonHeader writes a minimally encoded CBOR header.
+func writeCanonHeader(buf *bytes.Buffer, major encoding.MajorType, v uint64) {
+	m := byte(major) << 5
+	switch {
+	case v < 24:
+		buf.WriteByte(m | byte(v))
+	case v <= math.MaxUint8:
+		buf.Write([]byte{m | 24, byte(v)})
+	case v <= math.MaxUint16:
+		buf.WriteByte(m | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(v)))
+	case v <= math.MaxUint32:
+		buf.WriteByte(m | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	default:
+		buf.WriteByte(m | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, v))
+	}
+}
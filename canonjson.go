@@ -0,0 +1,174 @@
+package cbornode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// MarshalCanonicalJSON encodes the Node as deterministic JSON, suitable for
+// signing: the same data always gives the same bytes, whatever the
+// implementation that produced it. It follows the JSON Canonicalization
+// Scheme (RFC 8785):
+//
+//   - map keys are sorted by their UTF-16 code units, without whitespace;
+//   - strings only escape quotes, backslashes and control characters;
+//   - floats use the shortest form that round trips, formatted as
+//     ECMAScript does, with -0 written as 0; NaN and infinities are refused.
+//
+// Integers are written exactly, even beyond 2^53. Links are written as
+// {"/": "<cid>"} with the string form of the CID, and byte strings as
+// {"/": {"bytes": "<base64>"}} with unpadded standard base64, as in dag-json.
+func (n *Node) MarshalCanonicalJSON() ([]byte, error) {
+	return appendCanonicalJSON(nil, n.obj)
+}
+
+// MarshalObjCanonicalJSON encodes v as MarshalCanonicalJSON encodes the Node
+// of v, going through the registered atlas like MarshalObjJSON.
+func MarshalObjCanonicalJSON(v interface{}) ([]byte, error) {
+	b, err := marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj interface{}
+	if err := unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return appendCanonicalJSON(nil, obj)
+}
+
+func appendCanonicalJSON(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case bool:
+		return strconv.AppendBool(buf, v), nil
+	case string:
+		return appendCanonicalString(buf, v), nil
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(buf, v, 10), nil
+	case uint64:
+		return strconv.AppendUint(buf, v, 10), nil
+	case float64:
+		return appendCanonicalFloat(buf, v)
+	case []byte:
+		buf = append(buf, `{"/":{"bytes":"`...)
+		buf = append(buf, base64.RawStdEncoding.EncodeToString(v)...)
+		return append(buf, `"}}`...), nil
+	case cid.Cid:
+		buf = append(buf, `{"/":`...)
+		buf = appendCanonicalString(buf, v.String())
+		return append(buf, '}'), nil
+	case []interface{}:
+		buf = append(buf, '[')
+		for i, e := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendCanonicalJSON(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case map[string]interface{}:
+		return appendCanonicalMap(buf, v)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, ErrInvalidKeys
+			}
+			m[ks] = e
+		}
+		return appendCanonicalMap(buf, m)
+	default:
+		return nil, fmt.Errorf("cannot encode %T as canonical JSON", v)
+	}
+}
+
+func appendCanonicalMap(buf []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return utf16Less(keys[i], keys[j])
+	})
+	buf = append(buf, '{')
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendCanonicalString(buf, k)
+		buf = append(buf, ':')
+		var err error
+		if buf, err = appendCanonicalJSON(buf, m[k]); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+// utf16Less orders strings by their UTF-16 code units, which differs from
+// byte order for characters outside the Basic Multilingual Plane.
+func utf16Less(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+func appendCanonicalString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf = append(buf, '\\', byte(r))
+		case r == '\b':
+			buf = append(buf, `\b`...)
+		case r == '\f':
+			buf = append(buf, `\f`...)
+		case r == '\n':
+			buf = append(buf, `\n`...)
+		case r == '\r':
+			buf = append(buf, `\r`...)
+		case r == '\t':
+			buf = append(buf, `\t`...)
+		case r < 0x20:
+			buf = append(buf, fmt.Sprintf(`\u%04x`, r)...)
+		default:
+			buf = utf8.AppendRune(buf, r)
+		}
+	}
+	return append(buf, '"')
+}
+
+// appendCanonicalFloat formats f as ECMAScript's Number.prototype.toString
+// does, which encoding/json already implements.
+func appendCanonicalFloat(buf []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("cannot encode %v as canonical JSON", f)
+	}
+	if f == 0 {
+		return append(buf, '0'), nil
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, b...), nil
+}
@@ -0,0 +1,178 @@
+// Package cbortest provides helpers for testing dag-cbor codecs and stores:
+// generators for random dag-cbor values and a roundtrip conformance check.
+package cbortest
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Codec is an encoder/decoder pair for generic dag-cbor values.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(b []byte) (interface{}, error)
+}
+
+// CborCodec is the Codec implemented by this package's Encode and DecodeInto.
+var CborCodec Codec = cborCodec{}
+
+type cborCodec struct{}
+
+func (cborCodec) Encode(v interface{}) ([]byte, error) {
+	return cbornode.Encode(v)
+}
+
+func (cborCodec) Decode(b []byte) (interface{}, error) {
+	var v interface{}
+	err := cbornode.DecodeInto(b, &v)
+	return v, err
+}
+
+// Generator produces random dag-cbor values, using the Go types this package
+// decodes to: nil, bool, int, float64, string, []byte, cid.Cid,
+// []interface{} and map[string]interface{}. Floats are always finite, as
+// dag-cbor forbids NaN and infinities.
+type Generator struct {
+	Rand *rand.Rand
+	// MaxDepth bounds the nesting of lists and maps, MaxLen the number of
+	// entries in lists, maps, strings and byte strings.
+	MaxDepth int
+	MaxLen   int
+}
+
+// NewGenerator returns a Generator seeded with seed and reasonable bounds.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		Rand:     rand.New(rand.NewSource(seed)),
+		MaxDepth: 4,
+		MaxLen:   8,
+	}
+}
+
+// Value returns a random value.
+func (g *Generator) Value() interface{} {
+	return g.value(0)
+}
+
+func (g *Generator) value(depth int) interface{} {
+	kinds := 9
+	if depth >= g.MaxDepth {
+		// Only scalars past the maximum depth.
+		kinds = 7
+	}
+	switch g.Rand.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return g.Rand.Intn(2) == 0
+	case 2:
+		return g.Int()
+	case 3:
+		return g.Float()
+	case 4:
+		return g.String()
+	case 5:
+		return g.Bytes()
+	case 6:
+		return g.Cid()
+	case 7:
+		l := make([]interface{}, g.Rand.Intn(g.MaxLen+1))
+		for i := range l {
+			l[i] = g.value(depth + 1)
+		}
+		return l
+	default:
+		m := make(map[string]interface{})
+		for i := g.Rand.Intn(g.MaxLen + 1); i > 0; i-- {
+			m[g.String()] = g.value(depth + 1)
+		}
+		return m
+	}
+}
+
+// Int returns a random integer, biased towards the boundaries of the CBOR
+// integer encodings.
+func (g *Generator) Int() int {
+	boundaries := []int64{0, 23, 24, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64}
+	if g.Rand.Intn(2) == 0 {
+		v := boundaries[g.Rand.Intn(len(boundaries))]
+		if g.Rand.Intn(2) == 0 {
+			v = -v - 1
+		}
+		return int(v)
+	}
+	return int(g.Rand.Int63() - g.Rand.Int63())
+}
+
+// Float returns a random finite float.
+func (g *Generator) Float() float64 {
+	return g.Rand.NormFloat64() * math.Pow(10, float64(g.Rand.Intn(20)-10))
+}
+
+// String returns a random valid UTF-8 string.
+func (g *Generator) String() string {
+	runes := make([]rune, g.Rand.Intn(g.MaxLen+1))
+	for i := range runes {
+		if g.Rand.Intn(4) == 0 {
+			runes[i] = rune(0x80 + g.Rand.Intn(0xd000))
+		} else {
+			runes[i] = rune('a' + g.Rand.Intn(26))
+		}
+	}
+	return string(runes)
+}
+
+// Bytes returns a random byte string.
+func (g *Generator) Bytes() []byte {
+	b := make([]byte, g.Rand.Intn(g.MaxLen+1))
+	g.Rand.Read(b)
+	return b
+}
+
+// Cid returns a random dag-cbor CID.
+func (g *Generator) Cid() cid.Cid {
+	hash, err := mh.Sum(g.Bytes(), mh.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.DagCBOR, hash)
+}
+
+// RoundtripValues is the number of values RoundtripCheck tries.
+var RoundtripValues = 500
+
+// RoundtripCheck encodes RoundtripValues random values with codec, decodes
+// them and checks that the decoded value equals the original and that
+// encoding it again yields the exact same bytes.
+func RoundtripCheck(t testing.TB, codec Codec) {
+	t.Helper()
+	g := NewGenerator(1)
+	for i := 0; i < RoundtripValues; i++ {
+		v := g.Value()
+		data, err := codec.Encode(v)
+		if err != nil {
+			t.Fatalf("value %d: encode: %s", i, err)
+		}
+		back, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("value %d: decode %x: %s", i, data, err)
+		}
+		if !reflect.DeepEqual(v, back) {
+			t.Fatalf("value %d: decoded value differs:\n%#v\n%#v", i, v, back)
+		}
+		again, err := codec.Encode(back)
+		if err != nil {
+			t.Fatalf("value %d: re-encode: %s", i, err)
+		}
+		if !bytes.Equal(data, again) {
+			t.Fatalf("value %d: re-encoding differs: %x != %x", i, data, again)
+		}
+	}
+}
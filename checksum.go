@@ -0,0 +1,103 @@
+package cbornode
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrChecksumMismatch is returned when a block read through a checksummed
+// blockstore doesn't match the checksum stored with it.
+var ErrChecksumMismatch = errors.New("block data does not match its checksum")
+
+// checksumMarker starts dag-cbor payloads carrying an inline checksum. It is
+// a reserved CBOR initial byte, which no encoded item can start with, and
+// differs from compressedMarker so both wrappers can be stacked. Blocks of
+// other codecs can start with any byte, so they never carry inline checksums.
+const checksumMarker = 0xfe
+
+const checksumLen = 8
+
+// NewChecksumBlockstore returns an IpldBlockstore storing an xxhash checksum
+// of every block written to inner, and checking it on Get. This detects
+// corrupted blocks, for example from disk bit rot, far faster than re-hashing
+// them with VerifyHashes, though unlike it, it offers no protection against
+// tampering.
+//
+// When inner implements IpldBlockstoreSidecar, checksums are kept there and
+// blocks are stored unchanged. Otherwise they are prepended to the stored
+// payloads, so inner must store blocks as opaque values without checking
+// their hashes. Only dag-cbor blocks get inline checksums: blocks of other
+// codecs are stored and returned unchanged and unchecked. Blocks written
+// before the store was wrapped have no checksum and are returned unchecked
+// too, which also applies to a block whose marker byte got corrupted; such a
+// block still fails to decode as dag-cbor.
+func NewChecksumBlockstore(inner IpldBlockstore) IpldBlockstore {
+	sidecar, _ := inner.(IpldBlockstoreSidecar)
+	return &checksumBlocks{inner: inner, sidecar: sidecar}
+}
+
+type checksumBlocks struct {
+	inner   IpldBlockstore
+	sidecar IpldBlockstoreSidecar
+}
+
+func blockChecksum(data []byte) []byte {
+	return binary.BigEndian.AppendUint64(nil, xxhash.Sum64(data))
+}
+
+func (cb *checksumBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	blk, err := cb.inner.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	data := blk.RawData()
+	if cb.sidecar != nil {
+		sum, err := cb.sidecar.GetSidecar(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if sum != nil && string(sum) != string(blockChecksum(data)) {
+			return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, c)
+		}
+		return blk, nil
+	}
+
+	if c.Type() != cid.DagCBOR || len(data) == 0 || data[0] != checksumMarker {
+		return blk, nil
+	}
+	if len(data) < 1+checksumLen {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, c)
+	}
+	sum, payload := data[1:1+checksumLen], data[1+checksumLen:]
+	if string(sum) != string(blockChecksum(payload)) {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, c)
+	}
+	return block.NewBlockWithCid(payload, c)
+}
+
+func (cb *checksumBlocks) Put(ctx context.Context, blk block.Block) error {
+	sum := blockChecksum(blk.RawData())
+	if cb.sidecar != nil {
+		if err := cb.inner.Put(ctx, blk); err != nil {
+			return err
+		}
+		return cb.sidecar.PutSidecar(ctx, blk.Cid(), sum)
+	}
+	if blk.Cid().Type() != cid.DagCBOR {
+		return cb.inner.Put(ctx, blk)
+	}
+
+	data := make([]byte, 0, 1+checksumLen+len(blk.RawData()))
+	data = append(append(append(data, checksumMarker), sum...), blk.RawData()...)
+	stored, err := block.NewBlockWithCid(data, blk.Cid())
+	if err != nil {
+		return err
+	}
+	return cb.inner.Put(ctx, stored)
+}
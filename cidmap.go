@@ -0,0 +1,139 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// ErrInvalidCidMap is returned when decoding a map keyed by CIDs whose
+// encoding doesn't follow its CidMapEncoding.
+var ErrInvalidCidMap = errors.New("invalid encoding of a map keyed by CIDs")
+
+// CidMapEncoding selects how CidMapAtlasEntry encodes maps keyed by CIDs.
+type CidMapEncoding int
+
+const (
+	// CidMapPairs encodes maps as arrays of [link, value] pairs, sorted by
+	// the binary form of the CIDs. Keys remain links, so they are followed
+	// by link walkers.
+	CidMapPairs CidMapEncoding = iota
+	// CidMapStrings encodes maps as maps keyed by the string form of the
+	// CIDs, as given by cid.Cid.String: multibase base32 for CIDv1 and
+	// base58btc for CIDv0. Keys are plain strings and aren't followed as
+	// links.
+	CidMapStrings
+)
+
+// CidMapAtlasEntry returns an atlas entry for the map type of typeHint, which
+// must be keyed by cid.Cid, such as map[cid.Cid]int, encoding it with enc.
+// Like BigIntAtlasEntry, it has to be registered with RegisterCborType. The
+// value type must be encodable on its own.
+//
+// The encoding is deterministic, and decoding refuses duplicate and, with
+// CidMapStrings, non-canonical keys. A nil map encodes as null.
+func CidMapAtlasEntry(typeHint interface{}, enc CidMapEncoding) *atlas.AtlasEntry {
+	mt := reflect.TypeOf(typeHint)
+	if mt == nil || mt.Kind() != reflect.Map || mt.Key() != cidType {
+		panic(fmt.Errorf("CidMapAtlasEntry requires a map keyed by cid.Cid, got %T", typeHint))
+	}
+	if enc == CidMapStrings {
+		serial := reflect.MapOf(reflect.TypeOf(""), mt.Elem())
+		return atlas.BuildEntry(typeHint).Transform().
+			TransformMarshal(func(live reflect.Value) (reflect.Value, error) {
+				return cidMapToStrings(live, serial), nil
+			}, serial).
+			TransformUnmarshal(func(s reflect.Value) (reflect.Value, error) {
+				return cidMapFromStrings(s, mt)
+			}, serial).
+			Complete()
+	}
+
+	pairs := reflect.TypeOf([]interface{}{})
+	return atlas.BuildEntry(typeHint).Transform().
+		TransformMarshal(func(live reflect.Value) (reflect.Value, error) {
+			return cidMapToPairs(live), nil
+		}, pairs).
+		TransformUnmarshal(func(s reflect.Value) (reflect.Value, error) {
+			return cidMapFromPairs(s.Interface().([]interface{}), mt)
+		}, pairs).
+		Complete()
+}
+
+func cidMapToPairs(m reflect.Value) reflect.Value {
+	if m.IsNil() {
+		return reflect.ValueOf([]interface{}(nil))
+	}
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].Interface().(cid.Cid).Bytes(), keys[j].Interface().(cid.Cid).Bytes()) < 0
+	})
+	out := make([]interface{}, len(keys))
+	for i, k := range keys {
+		out[i] = []interface{}{k.Interface(), m.MapIndex(k).Interface()}
+	}
+	return reflect.ValueOf(out)
+}
+
+func cidMapFromPairs(pairs []interface{}, mt reflect.Type) (reflect.Value, error) {
+	if pairs == nil {
+		return reflect.Zero(mt), nil
+	}
+	m := reflect.MakeMapWithSize(mt, len(pairs))
+	for i, p := range pairs {
+		pair, ok := p.([]interface{})
+		if !ok || len(pair) != 2 {
+			return reflect.Zero(mt), fmt.Errorf("%w: entry %d is not a [link, value] pair", ErrInvalidCidMap, i)
+		}
+		c, ok := pair[0].(cid.Cid)
+		if !ok {
+			return reflect.Zero(mt), fmt.Errorf("%w: key of entry %d is not a link", ErrInvalidCidMap, i)
+		}
+		if m.MapIndex(reflect.ValueOf(c)).IsValid() {
+			return reflect.Zero(mt), fmt.Errorf("%w: duplicate key %s", ErrInvalidCidMap, c)
+		}
+		v := reflect.New(mt.Elem())
+		if err := snapshot().cloner.Clone(pair[1], v.Interface()); err != nil {
+			return reflect.Zero(mt), err
+		}
+		m.SetMapIndex(reflect.ValueOf(c), v.Elem())
+	}
+	return m, nil
+}
+
+func cidMapToStrings(m reflect.Value, serial reflect.Type) reflect.Value {
+	if m.IsNil() {
+		return reflect.Zero(serial)
+	}
+	out := reflect.MakeMapWithSize(serial, m.Len())
+	iter := m.MapRange()
+	for iter.Next() {
+		out.SetMapIndex(reflect.ValueOf(iter.Key().Interface().(cid.Cid).String()), iter.Value())
+	}
+	return out
+}
+
+func cidMapFromStrings(s reflect.Value, mt reflect.Type) (reflect.Value, error) {
+	if s.IsNil() {
+		return reflect.Zero(mt), nil
+	}
+	m := reflect.MakeMapWithSize(mt, s.Len())
+	iter := s.MapRange()
+	for iter.Next() {
+		k := iter.Key().String()
+		c, err := cid.Decode(k)
+		if err != nil {
+			return reflect.Zero(mt), fmt.Errorf("%w: key %q: %s", ErrInvalidCidMap, k, err)
+		}
+		if c.String() != k {
+			return reflect.Zero(mt), fmt.Errorf("%w: key %q is not in canonical form %s", ErrInvalidCidMap, k, c)
+		}
+		m.SetMapIndex(reflect.ValueOf(c), iter.Value())
+	}
+	return m, nil
+}
@@ -0,0 +1,98 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// ErrInvalidCidSet is returned when decoding a CborCidSet whose links aren't
+// sorted or contain duplicates.
+var ErrInvalidCidSet = errors.New("invalid encoding of a set of links")
+
+// CborCidSet is a set of links, encoded as an array of links sorted by the
+// binary form of the CIDs, without duplicates, so that equal sets always
+// have the same encoding. Like CborCidList, it works both through the
+// cbor-gen fast paths and as a field of registered types.
+//
+// Values built with NewCborCidSet or decoded are sorted; other values are
+// sorted on encoding.
+type CborCidSet []cid.Cid
+
+var cidSetAtlasEntry = atlas.BuildEntry(CborCidSet{}).Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(
+		func(s CborCidSet) ([]cid.Cid, error) {
+			return NewCborCidSet(s...), nil
+		})).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+		func(cs []cid.Cid) (CborCidSet, error) {
+			if err := checkCidSet(cs); err != nil {
+				return nil, err
+			}
+			return CborCidSet(cs), nil
+		})).
+	Complete()
+
+// NewCborCidSet returns the set of cs, sorted and deduplicated.
+func NewCborCidSet(cs ...cid.Cid) CborCidSet {
+	if cs == nil {
+		return nil
+	}
+	s := append(CborCidSet{}, cs...)
+	sort.Slice(s, func(i, j int) bool {
+		return cidLess(s[i], s[j])
+	})
+	out := s[:0]
+	for i, c := range s {
+		if i == 0 || !c.Equals(s[i-1]) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Has reports whether c is in the set, which must be sorted.
+func (s CborCidSet) Has(c cid.Cid) bool {
+	i := sort.Search(len(s), func(i int) bool {
+		return !cidLess(s[i], c)
+	})
+	return i < len(s) && s[i].Equals(c)
+}
+
+func (s CborCidSet) MarshalCBOR(w io.Writer) error {
+	return CborCidList(NewCborCidSet(s...)).MarshalCBOR(w)
+}
+
+func (s *CborCidSet) UnmarshalCBOR(r io.Reader) error {
+	var l CborCidList
+	if err := l.UnmarshalCBOR(r); err != nil {
+		return err
+	}
+	if err := checkCidSet(l); err != nil {
+		return err
+	}
+	*s = CborCidSet(l)
+	return nil
+}
+
+func (s CborCidSet) Cid() (cid.Cid, error) {
+	return primitiveCid(s)
+}
+
+func checkCidSet(cs []cid.Cid) error {
+	for i := 1; i < len(cs); i++ {
+		if !cidLess(cs[i-1], cs[i]) {
+			return fmt.Errorf("%w: %s is not sorted after %s or repeated", ErrInvalidCidSet, cs[i], cs[i-1])
+		}
+	}
+	return nil
+}
+
+func cidLess(a, b cid.Cid) bool {
+	return bytes.Compare(a.Bytes(), b.Bytes()) < 0
+}
@@ -0,0 +1,288 @@
+// Command cboratlas-gen generates explicit refmt atlas entries for Go structs,
+// so that their CBOR encoding is spelled out in code instead of being derived
+// by reflection when they are registered.
+//
+// It is meant to be run with go:generate:
+//
+//	//go:generate cboratlas-gen -type Foo,Bar
+//
+// Structs may also be selected by a "cboratlas:generate" line in their doc
+// comment. Fields follow the rules of RegisterCborType: exported fields are
+// mapped to their name with the first letter downcased, or to the name given
+// by a `refmt:"name,omitempty"` tag, and keys are sorted in RFC 7049 order. A
+// "cboratlas:transform marshalFunc unmarshalFunc" doc comment line generates
+// a transform entry using the two functions instead.
+//
+// The generated file registers each entry with cbornode.RegisterCborType from
+// an init function.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+func main() {
+	types := flag.String("type", "", "comma separated list of struct types to generate entries for")
+	output := flag.String("output", "cboratlas_gen.go", "output file name")
+	dir := flag.String("dir", ".", "directory of the package to process")
+	flag.Parse()
+
+	var names []string
+	if *types != "" {
+		names = strings.Split(*types, ",")
+	}
+	src, err := generate(*dir, names, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cboratlas-gen:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, *output), src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "cboratlas-gen:", err)
+		os.Exit(1)
+	}
+}
+
+// structSpec describes the entry to generate for a struct.
+type structSpec struct {
+	name      string
+	fields    []fieldSpec
+	marshal   string
+	unmarshal string
+}
+
+type fieldSpec struct {
+	goName    string
+	key       string
+	omitEmpty bool
+}
+
+// generate parses the package in dir and returns the generated source.
+func generate(dir string, types []string, output string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != output
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected a single package in %s, found %d", dir, len(pkgs))
+	}
+
+	wanted := map[string]bool{}
+	for _, t := range types {
+		wanted[strings.TrimSpace(t)] = true
+	}
+
+	var pkgName string
+	var specs []structSpec
+	for name, pkg := range pkgs {
+		pkgName = name
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, s := range gd.Specs {
+					ts := s.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					doc := ts.Doc
+					if doc == nil && len(gd.Specs) == 1 {
+						doc = gd.Doc
+					}
+					annotated, marshal, unmarshal, err := parseDirectives(doc)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", ts.Name.Name, err)
+					}
+					if !annotated && !wanted[ts.Name.Name] {
+						continue
+					}
+					delete(wanted, ts.Name.Name)
+
+					spec := structSpec{name: ts.Name.Name, marshal: marshal, unmarshal: unmarshal}
+					if marshal == "" {
+						spec.fields, err = structFields(ts.Name.Name, st)
+						if err != nil {
+							return nil, err
+						}
+					}
+					specs = append(specs, spec)
+				}
+			}
+		}
+	}
+	for t := range wanted {
+		return nil, fmt.Errorf("struct type %s not found in %s", t, dir)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no struct types selected in %s", dir)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+
+	return render(pkgName, specs)
+}
+
+// parseDirectives reads the cboratlas directives of a doc comment.
+func parseDirectives(doc *ast.CommentGroup) (annotated bool, marshal, unmarshal string, err error) {
+	if doc == nil {
+		return false, "", "", nil
+	}
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "cboratlas:generate":
+			annotated = true
+		case "cboratlas:transform":
+			if len(fields) != 3 {
+				return false, "", "", fmt.Errorf("cboratlas:transform expects a marshal and an unmarshal function")
+			}
+			annotated = true
+			marshal, unmarshal = fields[1], fields[2]
+		}
+	}
+	return annotated, marshal, unmarshal, nil
+}
+
+func structFields(name string, st *ast.StructType) ([]fieldSpec, error) {
+	var out []fieldSpec
+	seen := map[string]string{}
+	for _, f := range st.Fields.List {
+		var tag string
+		if f.Tag != nil {
+			raw, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(raw).Get("refmt")
+		}
+		if tag == "-" {
+			continue
+		}
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded fields are not supported, register the type with RegisterCborType instead", name)
+		}
+		key, opts := parseTag(tag)
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			fs := fieldSpec{goName: n.Name, key: key, omitEmpty: hasOption(opts, "omitempty")}
+			if fs.key == "" {
+				fs.key = downcaseFirstLetter(n.Name)
+			}
+			if prev, ok := seen[fs.key]; ok {
+				return nil, fmt.Errorf("%s: fields %s and %s both map to key %q", name, prev, n.Name, fs.key)
+			}
+			seen[fs.key] = n.Name
+			out = append(out, fs)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].key, out[j].key
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	return out, nil
+}
+
+func render(pkg string, specs []structSpec) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by cboratlas-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	fmt.Fprintf(&buf, "import (\n\tcbornode \"github.com/ipfs/go-ipld-cbor\"\n\tatlas \"github.com/polydawn/refmt/obj/atlas\"\n)\n\n")
+
+	for _, s := range specs {
+		fmt.Fprintf(&buf, "// atlasEntry%s describes the CBOR encoding of %s.\n", s.name, s.name)
+		fmt.Fprintf(&buf, "var atlasEntry%s = atlas.BuildEntry(%s{}).", s.name, s.name)
+		if s.marshal != "" {
+			fmt.Fprintf(&buf, "Transform().\n")
+			fmt.Fprintf(&buf, "\tTransformMarshal(atlas.MakeMarshalTransformFunc(%s)).\n", s.marshal)
+			fmt.Fprintf(&buf, "\tTransformUnmarshal(atlas.MakeUnmarshalTransformFunc(%s)).\n", s.unmarshal)
+		} else {
+			fmt.Fprintf(&buf, "StructMap().\n")
+			for _, f := range s.fields {
+				fmt.Fprintf(&buf, "\tAddField(%q, atlas.StructMapEntry{SerialName: %q", f.goName, f.key)
+				if f.omitEmpty {
+					fmt.Fprintf(&buf, ", OmitEmpty: true")
+				}
+				fmt.Fprintf(&buf, "}).\n")
+			}
+		}
+		fmt.Fprintf(&buf, "\tComplete()\n\n")
+	}
+
+	fmt.Fprintf(&buf, "func init() {\n")
+	for _, s := range specs {
+		fmt.Fprintf(&buf, "\tcbornode.RegisterCborType(atlasEntry%s)\n", s.name)
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	return format.Source(buf.Bytes())
+}
+
+// parseTag, hasOption and downcaseFirstLetter mirror the tag handling of
+// RegisterCborType.
+func parseTag(tag string) (string, string) {
+	name, opts := tag, ""
+	if idx := strings.Index(tag, ","); idx != -1 {
+		name, opts = tag[:idx], tag[idx+1:]
+	}
+	if !isValidTagName(name) {
+		name = ""
+	}
+	return name, opts
+}
+
+func hasOption(opts, option string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTagName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("!#$%&()*+-./:<=>?@[]^_{|}~ ", c) && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func downcaseFirstLetter(s string) string {
+	if s == "" {
+		return ""
+	}
+	r := rune(s[0])
+	if !unicode.IsUpper(r) {
+		return s
+	}
+	return string(unicode.ToLower(r)) + s[1:]
+}
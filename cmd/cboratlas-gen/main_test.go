@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSource = `package things
+
+// Thing is a thing.
+//
+// cboratlas:generate
+type Thing struct {
+	Name    string
+	Count   int    ` + "`refmt:\"n,omitempty\"`" + `
+	Skipped string ` + "`refmt:\"-\"`" + `
+	private int
+	Zed     []byte
+}
+
+type Other struct {
+	A int
+}
+
+// cboratlas:transform stampToString stringToStamp
+type Stamp struct {
+	t int64
+}
+`
+
+const testOutput = `// Code generated by cboratlas-gen. DO NOT EDIT.
+
+package things
+
+import (
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// atlasEntryOther describes the CBOR encoding of Other.
+var atlasEntryOther = atlas.BuildEntry(Other{}).StructMap().
+	AddField("A", atlas.StructMapEntry{SerialName: "a"}).
+	Complete()
+
+// atlasEntryStamp describes the CBOR encoding of Stamp.
+var atlasEntryStamp = atlas.BuildEntry(Stamp{}).Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(stampToString)).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(stringToStamp)).
+	Complete()
+
+// atlasEntryThing describes the CBOR encoding of Thing.
+var atlasEntryThing = atlas.BuildEntry(Thing{}).StructMap().
+	AddField("Count", atlas.StructMapEntry{SerialName: "n", OmitEmpty: true}).
+	AddField("Zed", atlas.StructMapEntry{SerialName: "zed"}).
+	AddField("Name", atlas.StructMapEntry{SerialName: "name"}).
+	Complete()
+
+func init() {
+	cbornode.RegisterCborType(atlasEntryOther)
+	cbornode.RegisterCborType(atlasEntryStamp)
+	cbornode.RegisterCborType(atlasEntryThing)
+}
+`
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "things.go"), []byte(testSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := generate(dir, []string{"Other"}, "cboratlas_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != testOutput {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if _, err := generate(dir, []string{"Missing"}, "cboratlas_gen.go"); err == nil {
+		t.Fatal("expected an error for an unknown type")
+	}
+}
@@ -0,0 +1,109 @@
+package cbornode
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetCodecStats makes the package count, for every Go type, how many times
+// values of that type are encoded and decoded and how long it takes, as
+// reported by CodecStats. This helps finding the hot types worth migrating to
+// cbor-gen first. It costs two clock reads per call, so it is off by default.
+//
+// Switching the counters off keeps the counts gathered so far; calls running
+// at that moment may still be counted.
+func SetCodecStats(on bool) {
+	updateSettings(func(s *settings) {
+		s.codecStats = on
+	})
+}
+
+// TypeStats are the encoding and decoding counters of a type.
+type TypeStats struct {
+	// Type is the type of the encoded values, or the type pointed to by the
+	// decoding targets.
+	Type reflect.Type
+
+	Encodes    uint64
+	EncodeTime time.Duration
+	Decodes    uint64
+	DecodeTime time.Duration
+}
+
+// typeCounters are the counters of a type, updated atomically.
+type typeCounters struct {
+	encodes, encodeNanos uint64
+	decodes, decodeNanos uint64
+}
+
+// codecCounters maps types to their *typeCounters.
+var codecCounters sync.Map
+
+// CodecStats returns the counters gathered since SetCodecStats was turned on
+// or ResetCodecStats was last called, sorted by decreasing total time.
+func CodecStats() []TypeStats {
+	var out []TypeStats
+	codecCounters.Range(func(k, v interface{}) bool {
+		tc := v.(*typeCounters)
+		out = append(out, TypeStats{
+			Type:       k.(reflect.Type),
+			Encodes:    atomic.LoadUint64(&tc.encodes),
+			EncodeTime: time.Duration(atomic.LoadUint64(&tc.encodeNanos)),
+			Decodes:    atomic.LoadUint64(&tc.decodes),
+			DecodeTime: time.Duration(atomic.LoadUint64(&tc.decodeNanos)),
+		})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		ti, tj := out[i].EncodeTime+out[i].DecodeTime, out[j].EncodeTime+out[j].DecodeTime
+		if ti != tj {
+			return ti > tj
+		}
+		return out[i].Type.String() < out[j].Type.String()
+	})
+	return out
+}
+
+// ResetCodecStats clears the counters returned by CodecStats.
+func ResetCodecStats() {
+	codecCounters.Range(func(k, _ interface{}) bool {
+		codecCounters.Delete(k)
+		return true
+	})
+}
+
+func countersFor(t reflect.Type) *typeCounters {
+	if tc, ok := codecCounters.Load(t); ok {
+		return tc.(*typeCounters)
+	}
+	tc, _ := codecCounters.LoadOrStore(t, new(typeCounters))
+	return tc.(*typeCounters)
+}
+
+// recordEncode counts an encoding of obj started at start.
+func recordEncode(obj interface{}, start time.Time) {
+	t := reflect.TypeOf(obj)
+	if t == nil {
+		return
+	}
+	tc := countersFor(t)
+	atomic.AddUint64(&tc.encodes, 1)
+	atomic.AddUint64(&tc.encodeNanos, uint64(time.Since(start)))
+}
+
+// recordDecode counts a decoding into obj started at start.
+func recordDecode(obj interface{}, start time.Time) {
+	t := reflect.TypeOf(obj)
+	if t == nil {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	tc := countersFor(t)
+	atomic.AddUint64(&tc.decodes, 1)
+	atomic.AddUint64(&tc.decodeNanos, uint64(time.Since(start)))
+}
@@ -0,0 +1,257 @@
+package cbornode
+
+import (
+	"fmt"
+	"reflect"
+
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// DifferenceKind is the kind of a Difference between two struct encodings.
+type DifferenceKind int
+
+const (
+	// FieldAdded is a key only the new type encodes.
+	FieldAdded DifferenceKind = iota
+	// FieldRemoved is a key only the old type encodes.
+	FieldRemoved
+	// FieldTypeChanged is a key whose value has a different type.
+	FieldTypeChanged
+	// FieldOmitEmptyChanged is a key that is omitted when empty in only one
+	// of the types.
+	FieldOmitEmptyChanged
+	// FieldReordered is a key that is encoded at another position relative
+	// to the keys both types encode, which only happens with hand written
+	// atlas entries.
+	FieldReordered
+)
+
+func (k DifferenceKind) String() string {
+	switch k {
+	case FieldAdded:
+		return "added"
+	case FieldRemoved:
+		return "removed"
+	case FieldTypeChanged:
+		return "type changed"
+	case FieldOmitEmptyChanged:
+		return "omitempty changed"
+	case FieldReordered:
+		return "reordered"
+	default:
+		return fmt.Sprintf("DifferenceKind(%d)", int(k))
+	}
+}
+
+// Difference is a change between two struct types that changes their wire
+// encoding, as reported by CompatibleEncodings.
+type Difference struct {
+	Kind DifferenceKind
+	// Field is the path of the key, made of the keys of the nested structs
+	// leading to it, such as "header.height".
+	Field string
+	// Old and New describe the field in each type, and are empty for the
+	// type that lacks it.
+	Old, New string
+}
+
+func (d Difference) String() string {
+	switch d.Kind {
+	case FieldAdded:
+		return fmt.Sprintf("%s: added (%s)", d.Field, d.New)
+	case FieldRemoved:
+		return fmt.Sprintf("%s: removed (%s)", d.Field, d.Old)
+	default:
+		return fmt.Sprintf("%s: %s (%s -> %s)", d.Field, d.Kind, d.Old, d.New)
+	}
+}
+
+// CompatibleEncodings compares the encodings of two versions of a struct
+// type, given as values of each, and reports whether they are identical,
+// along with the differences that make values of one encode to other bytes
+// than the same values of the other: added, removed and retyped keys,
+// omitempty changes and reorderings. Nested struct fields are compared
+// recursively; other types are compared by name. It is meant as a
+// pre-release check for protocols whose encodings must stay stable.
+//
+// Registered types are compared through their registered atlas entries, and
+// other structs through the entries RegisterCborType would generate. Types
+// whose entries aren't struct maps, such as transforms, must be identical.
+func CompatibleEncodings(oldType, newType interface{}) (bool, []Difference, error) {
+	ot, nt := reflect.TypeOf(oldType), reflect.TypeOf(newType)
+	if ot == nil || nt == nil {
+		return false, nil, fmt.Errorf("cannot compare the encodings of nil types")
+	}
+	diffs, err := compareEncodings(ot, nt, "", map[[2]reflect.Type]bool{})
+	if err != nil {
+		return false, nil, err
+	}
+	return len(diffs) == 0, diffs, nil
+}
+
+func compareEncodings(ot, nt reflect.Type, prefix string, seen map[[2]reflect.Type]bool) ([]Difference, error) {
+	// Recursive types are compared once.
+	if seen[[2]reflect.Type{ot, nt}] {
+		return nil, nil
+	}
+	seen[[2]reflect.Type{ot, nt}] = true
+
+	oe, err := compatEntry(ot)
+	if err != nil {
+		return nil, err
+	}
+	ne, err := compatEntry(nt)
+	if err != nil {
+		return nil, err
+	}
+
+	oldFields := make(map[string]atlas.StructMapEntry)
+	var oldOrder []string
+	for _, f := range oe.StructMap.Fields {
+		if !f.Ignore {
+			oldFields[f.SerialName] = f
+			oldOrder = append(oldOrder, f.SerialName)
+		}
+	}
+	newFields := make(map[string]atlas.StructMapEntry)
+	var newOrder []string
+	for _, f := range ne.StructMap.Fields {
+		if !f.Ignore {
+			newFields[f.SerialName] = f
+			newOrder = append(newOrder, f.SerialName)
+		}
+	}
+
+	var diffs []Difference
+	var common []string
+	for _, name := range oldOrder {
+		of := oldFields[name]
+		path := prefix + name
+		nf, ok := newFields[name]
+		if !ok {
+			diffs = append(diffs, Difference{Kind: FieldRemoved, Field: path, Old: fingerprintType(of.Type)})
+			continue
+		}
+		common = append(common, name)
+		if of.OmitEmpty != nf.OmitEmpty {
+			diffs = append(diffs, Difference{
+				Kind:  FieldOmitEmptyChanged,
+				Field: path,
+				Old:   fmt.Sprintf("omitempty=%t", of.OmitEmpty),
+				New:   fmt.Sprintf("omitempty=%t", nf.OmitEmpty),
+			})
+		}
+		fieldDiffs, err := compareFieldTypes(of.Type, nf.Type, path, seen)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, fieldDiffs...)
+	}
+	for _, name := range newOrder {
+		if _, ok := oldFields[name]; !ok {
+			diffs = append(diffs, Difference{Kind: FieldAdded, Field: prefix + name, New: fingerprintType(newFields[name].Type)})
+		}
+	}
+
+	// Compare the relative order of the keys both types encode.
+	i := 0
+	for _, name := range newOrder {
+		if _, ok := oldFields[name]; !ok {
+			continue
+		}
+		if name != common[i] {
+			diffs = append(diffs, Difference{
+				Kind:  FieldReordered,
+				Field: prefix + name,
+				Old:   fmt.Sprintf("position %d", indexOf(common, name)),
+				New:   fmt.Sprintf("position %d", i),
+			})
+		}
+		i++
+	}
+	return diffs, nil
+}
+
+// compareFieldTypes compares the types of a field, recursing into structs
+// and the elements of pointers, slices, arrays and maps.
+func compareFieldTypes(ot, nt reflect.Type, path string, seen map[[2]reflect.Type]bool) ([]Difference, error) {
+	changed := []Difference{{Kind: FieldTypeChanged, Field: path, Old: fingerprintType(ot), New: fingerprintType(nt)}}
+	if ot == nt {
+		return nil, nil
+	}
+	// Pointers encode as what they point to, or null.
+	if ot.Kind() == reflect.Ptr || nt.Kind() == reflect.Ptr {
+		if ot.Kind() == reflect.Ptr {
+			ot = ot.Elem()
+		}
+		if nt.Kind() == reflect.Ptr {
+			nt = nt.Elem()
+		}
+		return compareFieldTypes(ot, nt, path, seen)
+	}
+	if wireKind(ot) != wireKind(nt) {
+		return changed, nil
+	}
+	switch ot.Kind() {
+	case reflect.Struct:
+		if oe, ne := findAtlasEntry(ot), findAtlasEntry(nt); oe != nil && oe.StructMap == nil || ne != nil && ne.StructMap == nil {
+			return changed, nil
+		}
+		return compareEncodings(ot, nt, path+".", seen)
+	case reflect.Slice:
+		return compareFieldTypes(ot.Elem(), nt.Elem(), path, seen)
+	case reflect.Array:
+		if ot.Len() != nt.Len() {
+			return changed, nil
+		}
+		return compareFieldTypes(ot.Elem(), nt.Elem(), path, seen)
+	case reflect.Map:
+		if wireKind(ot.Key()) != wireKind(nt.Key()) {
+			return changed, nil
+		}
+		return compareFieldTypes(ot.Elem(), nt.Elem(), path, seen)
+	default:
+		// Distinct named types of the same kind, such as enums, may encode
+		// differently through their atlas entries.
+		if findAtlasEntry(ot) != nil || findAtlasEntry(nt) != nil {
+			return changed, nil
+		}
+		return nil, nil
+	}
+}
+
+// wireKind is the kind of t, with integer kinds of any size merged as they
+// encode the same way.
+func wireKind(t reflect.Type) reflect.Kind {
+	switch k := t.Kind(); k {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return reflect.Uint
+	default:
+		return k
+	}
+}
+
+// compatEntry returns the struct map entry t is, or would be, encoded with.
+func compatEntry(t reflect.Type) (*atlas.AtlasEntry, error) {
+	if e, ok := nilSafeStructs.Load(t); ok {
+		return e.(*atlas.AtlasEntry), nil
+	}
+	if e := findAtlasEntry(t); e != nil {
+		if e.StructMap == nil {
+			return nil, fmt.Errorf("cannot compare the encodings of %s, which isn't encoded as a struct map", t)
+		}
+		return e, nil
+	}
+	return autogenerateEntry(t)
+}
+
+func indexOf(list []string, s string) int {
+	for i, e := range list {
+		if e == s {
+			return i
+		}
+	}
+	return -1
+}
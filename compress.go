@@ -0,0 +1,99 @@
+package cbornode
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// Compressor compresses block payloads for NewCompressedBlockstore.
+// Implementations wrapping zstd or snappy can be plugged in; FlateCompressor
+// only relies on the standard library.
+type Compressor interface {
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// FlateCompressor compresses with DEFLATE at the given level.
+type FlateCompressor struct {
+	Level int
+}
+
+func (f FlateCompressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, f.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f FlateCompressor) Decompress(b []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(b)))
+}
+
+// compressedMarker starts compressed dag-cbor payloads. It is a CBOR break,
+// which no encoded item can start with, so uncompressed dag-cbor blocks
+// written before the store was wrapped remain readable. Blocks of other
+// codecs can start with any byte, so they are never compressed.
+const compressedMarker = 0xff
+
+// NewCompressedBlockstore returns an IpldBlockstore compressing block
+// payloads with comp before writing them to inner, and decompressing them on
+// Get. CIDs are still computed over the uncompressed data, so inner must
+// store blocks as opaque values without checking their hashes. Payloads that
+// don't shrink are stored uncompressed, and so are blocks of other codecs
+// than dag-cbor.
+func NewCompressedBlockstore(inner IpldBlockstore, comp Compressor) IpldBlockstore {
+	return &compressedBlocks{inner: inner, comp: comp}
+}
+
+type compressedBlocks struct {
+	inner IpldBlockstore
+	comp  Compressor
+}
+
+func (cb *compressedBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	blk, err := cb.inner.Get(ctx, c)
+	if err != nil || c.Type() != cid.DagCBOR {
+		return blk, err
+	}
+	data := blk.RawData()
+	if len(data) == 0 || data[0] != compressedMarker {
+		return blk, nil
+	}
+	plain, err := cb.comp.Decompress(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	return block.NewBlockWithCid(plain, c)
+}
+
+func (cb *compressedBlocks) Put(ctx context.Context, blk block.Block) error {
+	if blk.Cid().Type() != cid.DagCBOR {
+		return cb.inner.Put(ctx, blk)
+	}
+	packed, err := cb.comp.Compress(blk.RawData())
+	if err != nil {
+		return err
+	}
+	if len(packed)+1 >= len(blk.RawData()) {
+		return cb.inner.Put(ctx, blk)
+	}
+	data := append([]byte{compressedMarker}, packed...)
+	stored, err := block.NewBlockWithCid(data, blk.Cid())
+	if err != nil {
+		return err
+	}
+	return cb.inner.Put(ctx, stored)
+}
@@ -0,0 +1,162 @@
+package cbornode
+
+import (
+	"context"
+	"sync"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// CollectBlocks returns every block reachable from roots, each exactly once,
+// in depth-first order starting with the first root. Subgraphs shared between
+// roots (or within a single DAG) are only visited once.
+//
+// Links are only followed out of dag-cbor blocks; blocks with other codecs
+// are collected but treated as leaves.
+func CollectBlocks(ctx context.Context, bs IpldBlockstore, roots []cid.Cid) ([]block.Block, error) {
+	var out []block.Block
+	seen := cid.NewSet()
+
+	// An explicit stack keeps deep DAGs from growing the goroutine stack.
+	// Links are pushed in reverse so they are popped in order.
+	stack := make([]cid.Cid, 0, len(roots))
+	for i := len(roots) - 1; i >= 0; i-- {
+		stack = append(stack, roots[i])
+	}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, blk)
+
+		if c.Type() != cid.DagCBOR {
+			continue
+		}
+		links, err := ExtractLinks(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return out, nil
+}
+
+// Prefetch reads every block reachable from root in at most depth hops
+// (depth -1 for no limit) so that a later synchronous traversal of the DAG
+// hits warm caches in store or the blockstores behind it. Blocks are read
+// breadth-first, one level at a time, with up to concurrency reads in
+// flight. Their decoded form is discarded, unless a decode cache is enabled
+// with EnableDecodeCache, in which case dag-cbor blocks are decoded into it.
+//
+// As with CollectBlocks, links are only followed out of dag-cbor blocks.
+// Prefetch stops at the first block it fails to read and returns the error.
+func Prefetch(ctx context.Context, store IpldStore, root cid.Cid, depth int, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	seen := cid.NewSet()
+	seen.Add(root)
+	level := []cid.Cid{root}
+	for d := 0; len(level) > 0; d++ {
+		links, err := prefetchLevel(ctx, cancel, store, level, depth < 0 || d < depth, concurrency)
+		if err != nil {
+			return err
+		}
+		level = level[:0:0]
+		for _, l := range links {
+			if seen.Visit(l) {
+				level = append(level, l)
+			}
+		}
+	}
+	return nil
+}
+
+// prefetchLevel reads cs with concurrency workers and returns the links of
+// the blocks read, in order, if follow is set.
+func prefetchLevel(ctx context.Context, cancel func(), store IpldStore, cs []cid.Cid, follow bool, concurrency int) ([]cid.Cid, error) {
+	links := make([][]cid.Cid, len(cs))
+	var (
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	work := make(chan int)
+	for w := 0; w < concurrency && w < len(cs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				l, err := prefetchBlock(ctx, store, cs[i], follow)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				links[i] = l
+			}
+		}()
+	}
+feed:
+	for i := range cs {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var out []cid.Cid
+	for _, l := range links {
+		out = append(out, l...)
+	}
+	return out, nil
+}
+
+func prefetchBlock(ctx context.Context, store IpldStore, c cid.Cid, follow bool) ([]cid.Cid, error) {
+	var raw rawCapture
+	if err := store.Get(ctx, c, &raw); err != nil {
+		return nil, err
+	}
+	if c.Type() != cid.DagCBOR {
+		return nil, nil
+	}
+	if snapshot().decodeCache != nil {
+		blk, err := block.NewBlockWithCid(raw, c)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := decodeBlock(blk); err != nil {
+			return nil, err
+		}
+	}
+	if !follow {
+		return nil, nil
+	}
+	return ExtractLinks(raw)
+}
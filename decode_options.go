@@ -0,0 +1,414 @@
+package cbornode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	cid "github.com/ipfs/go-cid"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// BytesMode selects how CBOR byte strings are decoded into untyped
+// (interface{}) and string values.
+type BytesMode int
+
+const (
+	// BytesAsBytes decodes byte strings to []byte. This is the default.
+	BytesAsBytes BytesMode = iota
+	// BytesAsBase64 decodes byte strings to standard base64 strings.
+	BytesAsBase64
+	// BytesError refuses to decode byte strings (other than links).
+	BytesError
+)
+
+// ErrUnexpectedBytes is returned when decoding a byte string with BytesError.
+var ErrUnexpectedBytes = errors.New("unexpected byte string")
+
+// DuplicateKeyMode selects how maps with repeated keys are decoded.
+type DuplicateKeyMode int
+
+const (
+	// DuplicateKeysDefault leaves repeated keys to the decoder, as DecodeInto
+	// does: decoding into maps fails, while decoding into structs silently
+	// keeps the last value.
+	DuplicateKeysDefault DuplicateKeyMode = iota
+	// DuplicateKeysError refuses to decode maps with repeated keys, whatever
+	// the target. Strict dag-cbor checks, such as IngestCBOR, always do.
+	DuplicateKeysError
+	// DuplicateKeysKeepFirst keeps the first value of a repeated key.
+	DuplicateKeysKeepFirst
+	// DuplicateKeysKeepLast keeps the last value of a repeated key.
+	DuplicateKeysKeepLast
+)
+
+// ErrDuplicateKey is returned when decoding a map with repeated keys with
+// DuplicateKeysError.
+var ErrDuplicateKey = errors.New("duplicate map key")
+
+// UnknownFieldMode selects how keys that don't match any field of the struct
+// they are decoded into are handled.
+type UnknownFieldMode int
+
+const (
+	// UnknownFieldsError refuses to decode unknown keys, as DecodeInto does.
+	UnknownFieldsError UnknownFieldMode = iota
+	// UnknownFieldsIgnore drops unknown keys.
+	UnknownFieldsIgnore
+	// UnknownFieldsCollect drops unknown keys after storing them in
+	// DecodeOptions.Unknown.
+	UnknownFieldsCollect
+)
+
+// DecodeOptions controls how DecodeIntoWithOptions maps CBOR data to Go
+// values. The zero value behaves like DecodeInto.
+type DecodeOptions struct {
+	// Bytes selects how byte strings are decoded when the target is
+	// interface{} or a string. Typed []byte targets always receive the bytes
+	// unchanged.
+	Bytes BytesMode
+	// DuplicateKeys selects how maps with repeated keys are handled. With
+	// DuplicateKeysKeepFirst and DuplicateKeysKeepLast, data with repeated
+	// keys is canonicalized before being decoded, so it must otherwise be
+	// valid dag-cbor.
+	DuplicateKeys DuplicateKeyMode
+	// UnknownFields selects how keys without a matching struct field are
+	// handled.
+	UnknownFields UnknownFieldMode
+	// Unknown receives the unknown keys with UnknownFieldsCollect, keyed by
+	// their slash separated path from the decoded value (e.g. "inner/key").
+	// It must be allocated by the caller.
+	Unknown map[string]interface{}
+	// Defaults maps struct types to a value of that type whose fields are
+	// used for the keys missing from the decoded data, at any depth.
+	Defaults map[reflect.Type]interface{}
+	// OnLink, when set, replaces every link decoded into an untyped target
+	// (an interface{} value, or an element of an untyped map or list) by the
+	// value it returns for the link's CID, for example a proxy loading the
+	// linked object from a store when first used. Typed cid.Cid targets still
+	// receive the CID.
+	OnLink func(c cid.Cid) interface{}
+	// StringLinks turns maps holding a single "/" key with a CID string
+	// value into links, as SetStringLinks does, for typed targets as well:
+	// cid.Cid fields receive the CID.
+	StringLinks bool
+}
+
+func (opts DecodeOptions) isZero() bool {
+	return opts.Bytes == BytesAsBytes &&
+		opts.DuplicateKeys == DuplicateKeysDefault &&
+		opts.UnknownFields == UnknownFieldsError &&
+		opts.Defaults == nil &&
+		opts.OnLink == nil &&
+		!opts.StringLinks
+}
+
+// DecodeIntoWithOptions decodes a serialized IPLD cbor object into the given
+// object, as DecodeInto does, applying opts.
+func DecodeIntoWithOptions(b []byte, v interface{}, opts DecodeOptions) error {
+	if opts.isZero() {
+		return DecodeInto(b, v)
+	}
+	if opts.UnknownFields == UnknownFieldsCollect && opts.Unknown == nil {
+		return errors.New("UnknownFieldsCollect requires DecodeOptions.Unknown to be allocated")
+	}
+
+	if opts.DuplicateKeys != DuplicateKeysDefault {
+		var err error
+		b, err = resolveDuplicateKeys(b, opts.DuplicateKeys)
+		if err != nil {
+			return err
+		}
+		rest := opts
+		rest.DuplicateKeys = DuplicateKeysDefault
+		if rest.isZero() {
+			return DecodeInto(b, v)
+		}
+	}
+
+	var generic interface{}
+	if err := DecodeInto(b, &generic); err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cannot decode into a non-pointer value")
+	}
+	generic, err := opts.apply(generic, rv.Type().Elem(), "")
+	if err != nil {
+		return err
+	}
+	if out, ok := v.(*interface{}); ok {
+		*out = generic
+	} else {
+		// Cloning truncates integers like decoding does.
+		cs := snapshot()
+		wide, err := cs.cloner.CloneWatch(generic, v, cs.intCheckLimit(v))
+		if err != nil {
+			return err
+		}
+		if err := cs.checkIntegers(v, wide); err != nil {
+			return err
+		}
+	}
+	if opts.OnLink != nil {
+		opts.proxyLinks(rv.Elem())
+	}
+	return nil
+}
+
+// proxyLinks replaces the links held in the untyped values under rv by the
+// result of opts.OnLink.
+func (opts DecodeOptions) proxyLinks(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return
+		}
+		switch elem := rv.Interface().(type) {
+		case cid.Cid:
+			if p := opts.OnLink(elem); p != nil {
+				rv.Set(reflect.ValueOf(p))
+			} else {
+				rv.Set(reflect.Zero(rv.Type()))
+			}
+		case map[string]interface{}, []interface{}:
+			opts.proxyLinks(reflect.ValueOf(elem))
+		}
+	case reflect.Ptr:
+		if !rv.IsNil() {
+			opts.proxyLinks(rv.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if f := rv.Field(i); f.CanSet() {
+				opts.proxyLinks(f)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			opts.proxyLinks(rv.Index(i))
+		}
+	case reflect.Map:
+		// Map values aren't addressable, so proxy them through a copy.
+		iter := rv.MapRange()
+		for iter.Next() {
+			val := reflect.New(rv.Type().Elem()).Elem()
+			val.Set(iter.Value())
+			opts.proxyLinks(val)
+			rv.SetMapIndex(iter.Key(), val)
+		}
+	}
+}
+
+// resolveDuplicateKeys returns b with repeated map keys handled according to
+// mode. Data without repeated keys is returned as is.
+func resolveDuplicateKeys(b []byte, mode DuplicateKeyMode) ([]byte, error) {
+	root, err := parseCanonItem(b)
+	if err != nil {
+		return nil, err
+	}
+	dup := root.dropDuplicateKeys(mode == DuplicateKeysKeepLast)
+	if dup == nil {
+		return b, nil
+	}
+	if mode == DuplicateKeysError {
+		return nil, fmt.Errorf("%w: %q", ErrDuplicateKey, dup)
+	}
+	var buf bytes.Buffer
+	if err := root.encode(&buf, &CanonicalizeReport{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dropDuplicateKeys removes the repeated keys of the maps under it, keeping
+// either the first or the last value of each, and returns the first repeated
+// key found, if any.
+func (it *canonItem) dropDuplicateKeys(keepLast bool) []byte {
+	var dup []byte
+	for _, c := range it.children {
+		if d := c.dropDuplicateKeys(keepLast); dup == nil {
+			dup = d
+		}
+	}
+	if it.tok.Major != encoding.MajMap {
+		return dup
+	}
+
+	index := make(map[string]int, len(it.children)/2)
+	kept := it.children[:0]
+	for i := 0; i < len(it.children); i += 2 {
+		k, v := it.children[i], it.children[i+1]
+		if k.tok.Major != encoding.MajTextString {
+			kept = append(kept, k, v)
+			continue
+		}
+		if j, ok := index[string(k.data)]; ok {
+			if dup == nil {
+				dup = k.data
+			}
+			if keepLast {
+				kept[j+1] = v
+			}
+			continue
+		}
+		index[string(k.data)] = len(kept)
+		kept = append(kept, k, v)
+	}
+	it.children = kept
+	return dup
+}
+
+// apply rewrites a generically decoded value according to opts, given the Go
+// type it will be decoded into and its path. A nil type means the target is
+// untyped.
+func (opts DecodeOptions) apply(v interface{}, t reflect.Type, path string) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil && t.Kind() == reflect.Interface {
+		t = nil
+	}
+
+	switch v := v.(type) {
+	case []byte:
+		if t != nil && t.Kind() != reflect.String {
+			return v, nil
+		}
+		switch opts.Bytes {
+		case BytesAsBase64:
+			return base64.StdEncoding.EncodeToString(v), nil
+		case BytesError:
+			return nil, ErrUnexpectedBytes
+		default:
+			return v, nil
+		}
+	case map[string]interface{}:
+		if opts.StringLinks {
+			if c, ok := stringLink(v); ok {
+				return c, nil
+			}
+		}
+		if err := opts.applyStruct(v, t, path); err != nil {
+			return nil, err
+		}
+		for k, val := range v {
+			nv, err := opts.apply(val, fieldType(t, k), joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = nv
+		}
+		return v, nil
+	case []interface{}:
+		var et reflect.Type
+		if t != nil {
+			et = opaqueType
+			if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+				et = t.Elem()
+			}
+		}
+		for i, val := range v {
+			nv, err := opts.apply(val, et, joinPath(path, strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = nv
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// applyStruct handles the unknown and missing keys of a map decoded into the
+// struct type t.
+func (opts DecodeOptions) applyStruct(m map[string]interface{}, t reflect.Type, path string) error {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	entry, ok := snapshot().atlas.Get(reflect.ValueOf(t).Pointer())
+	if !ok || entry.StructMap == nil {
+		return nil
+	}
+
+	if opts.UnknownFields != UnknownFieldsError {
+		known := make(map[string]bool, len(entry.StructMap.Fields))
+		for _, f := range entry.StructMap.Fields {
+			if !f.Ignore {
+				known[f.SerialName] = true
+			}
+		}
+		for k, val := range m {
+			if known[k] {
+				continue
+			}
+			if opts.UnknownFields == UnknownFieldsCollect {
+				opts.Unknown[joinPath(path, k)] = val
+			}
+			delete(m, k)
+		}
+	}
+
+	def, ok := opts.Defaults[t]
+	if !ok {
+		return nil
+	}
+	dv := reflect.ValueOf(def)
+	if dv.Type() != t {
+		return fmt.Errorf("default for %s has type %s", t, dv.Type())
+	}
+	for _, f := range entry.StructMap.Fields {
+		if f.Ignore {
+			continue
+		}
+		if _, ok := m[f.SerialName]; ok {
+			continue
+		}
+		var fv interface{}
+		if err := snapshot().clone(f.ReflectRoute.TraverseToValue(dv).Interface(), &fv); err != nil {
+			return err
+		}
+		m[f.SerialName] = fv
+	}
+	return nil
+}
+
+func joinPath(path, seg string) string {
+	if path == "" {
+		return seg
+	}
+	return path + "/" + seg
+}
+
+// opaqueType stands for targets whose shape we don't know (for example types
+// with transforms); values decoded into them are left untouched.
+var opaqueType = reflect.TypeOf(struct{}{})
+
+// fieldType returns the type the value at key k of a map decoded into t will
+// be decoded into, or nil if it is untyped.
+func fieldType(t reflect.Type, k string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		entry, ok := snapshot().atlas.Get(reflect.ValueOf(t).Pointer())
+		if !ok || entry.StructMap == nil {
+			return opaqueType
+		}
+		for _, f := range entry.StructMap.Fields {
+			if f.SerialName == k {
+				return f.Type
+			}
+		}
+	}
+	return opaqueType
+}
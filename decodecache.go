@@ -0,0 +1,63 @@
+package cbornode
+
+import (
+	"bytes"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// decodeCache memoizes the nodes built by DecodeBlock, keyed by CID.
+type decodeCache struct {
+	lk    sync.Mutex
+	size  int
+	nodes map[cid.Cid]*Node
+	order []cid.Cid
+}
+
+// EnableDecodeCache makes DecodeBlock remember the last size distinct blocks
+// it decoded and return the cached node when asked to decode a block with the
+// same CID and data again, skipping the reflection based decoding. A size of 0
+// disables the cache, which is the default.
+//
+// Cached nodes are shared between callers, so they must be treated as
+// immutable, including the values returned by Resolve.
+//
+// Every call starts a new, empty cache. Decodings running meanwhile may still
+// add their node to the previous one, which is then dropped.
+func EnableDecodeCache(size int) {
+	var dc *decodeCache
+	if size > 0 {
+		dc = &decodeCache{
+			size:  size,
+			nodes: make(map[cid.Cid]*Node, size),
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.decodeCache = dc
+	})
+}
+
+func (dc *decodeCache) get(c cid.Cid, data []byte) *Node {
+	dc.lk.Lock()
+	defer dc.lk.Unlock()
+	// DecodeBlock doesn't check that blocks match their CID, so neither can
+	// the cache: only trust a hit on identical bytes.
+	if nd, ok := dc.nodes[c]; ok && bytes.Equal(nd.raw, data) {
+		return nd
+	}
+	return nil
+}
+
+func (dc *decodeCache) add(nd *Node) {
+	dc.lk.Lock()
+	defer dc.lk.Unlock()
+	if _, ok := dc.nodes[nd.cid]; !ok {
+		if len(dc.order) >= dc.size {
+			delete(dc.nodes, dc.order[0])
+			dc.order = dc.order[1:]
+		}
+		dc.order = append(dc.order, nd.cid)
+	}
+	dc.nodes[nd.cid] = nd
+}
@@ -0,0 +1,60 @@
+package encoding
+
+import (
+	"github.com/polydawn/refmt/shared"
+	rtok "github.com/polydawn/refmt/tok"
+)
+
+// maxCaptureBuffer bounds the capacity of the buffer an unmarshaller keeps
+// between two Decode calls.
+const maxCaptureBuffer = 64 << 10
+
+// capture is a token sink forwarding the tokens to sink, keeping track on the
+// way of the byte range of the value completed by the current token. It
+// relies on refmt's decoder reading exactly the bytes of each token, no more.
+type capture struct {
+	sink   shared.TokenSink
+	reader *proxyReader
+	// starts holds the start offsets of the open arrays and maps.
+	starts []int
+	// prev is the end offset of the previous token.
+	prev       int
+	start, end int
+}
+
+func (c *capture) reset() {
+	c.starts = c.starts[:0]
+	c.prev, c.start, c.end = 0, 0, 0
+}
+
+func (c *capture) Step(tok *rtok.Token) (bool, error) {
+	// Tags are read with the item they apply to, so a token starts where
+	// the previous one ended.
+	start, end := c.prev, c.reader.n
+	c.prev = end
+	switch tok.Type {
+	case rtok.TMapOpen, rtok.TArrOpen:
+		c.starts = append(c.starts, start)
+		c.start, c.end = 0, 0
+	case rtok.TMapClose, rtok.TArrClose:
+		n := len(c.starts) - 1
+		c.start, c.end = c.starts[n], end
+		c.starts = c.starts[:n]
+	default:
+		c.start, c.end = start, end
+	}
+	return c.sink.Step(tok)
+}
+
+// captured returns the encoding of the value completed by the token being
+// unmarshalled, or nil if the token doesn't complete a value.
+func (m *Unmarshaller) captured() []byte {
+	if m.capture.end == 0 {
+		return nil
+	}
+	in := m.input
+	if in == nil {
+		in = m.reader.buf
+	}
+	return in[m.capture.start:m.capture.end]
+}
@@ -3,22 +3,65 @@ package encoding
 import (
 	"sync"
 
-	refmt "github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/obj"
 	"github.com/polydawn/refmt/obj/atlas"
+	"github.com/polydawn/refmt/shared"
 )
 
+// cloner clones values by pumping the tokens of a marshaller into an
+// unmarshaller, as refmt's cloner does, optionally watching integers.
+type cloner struct {
+	marshal   *obj.Marshaller
+	unmarshal *obj.Unmarshaller
+	watch     intWatch
+}
+
+func newCloner(atl atlas.Atlas) *cloner {
+	c := &cloner{
+		marshal:   obj.NewMarshaller(atl),
+		unmarshal: obj.NewUnmarshaller(atl),
+	}
+	c.watch.sink = c.unmarshal
+	return c
+}
+
+func (c *cloner) clone(src, dst interface{}, limit uint64) (wide []WideInt, err error) {
+	// Bind errors are returned by the first step as well.
+	_ = c.marshal.Bind(src)
+	_ = c.unmarshal.Bind(dst)
+	if limit == NoIntLimit {
+		return nil, shared.TokenPump{TokenSource: c.marshal, TokenSink: c.unmarshal}.Run()
+	}
+	c.watch.reset(limit)
+	err = shared.TokenPump{TokenSource: c.marshal, TokenSink: &c.watch}.Run()
+	wide = c.watch.wide
+	c.watch.reset(NoIntLimit)
+	return wide, err
+}
+
 // PooledCloner is a thread-safe pooled object cloner.
 type PooledCloner struct {
+	atl  atlas.Atlas
 	pool sync.Pool
+	free chan *cloner
 }
 
 // NewPooledCloner returns a PooledCloner with the given atlas. Do not copy
 // after use.
-func NewPooledCloner(atl atlas.Atlas) PooledCloner {
+//
+// When n is positive, at most n idle cloners are kept for reuse, whatever the
+// number of CPUs and the garbage collector do; extra cloners are created as
+// needed by concurrent callers and dropped afterwards. Otherwise idle cloners
+// are kept in a sync.Pool.
+func NewPooledCloner(atl atlas.Atlas, n int) PooledCloner {
+	if n > 0 {
+		return PooledCloner{atl: atl, free: make(chan *cloner, n)}
+	}
 	return PooledCloner{
+		atl: atl,
 		pool: sync.Pool{
 			New: func() interface{} {
-				return refmt.NewCloner(atl)
+				return newCloner(atl)
 			},
 		},
 	}
@@ -30,12 +73,42 @@ type selfCloner interface {
 
 // Clone clones a into b using a cloner from the pool.
 func (p *PooledCloner) Clone(a, b interface{}) error {
+	_, err := p.CloneWatch(a, b, NoIntLimit)
+	return err
+}
+
+// CloneWatch is like Clone, and also returns the integers cloned whose CBOR
+// argument is above limit, as Unmarshaller.DecodeWatch does.
+func (p *PooledCloner) CloneWatch(a, b interface{}, limit uint64) ([]WideInt, error) {
 	if self, ok := a.(selfCloner); ok {
-		return self.Clone(b)
+		return nil, self.Clone(b)
 	}
 
-	c := p.pool.Get().(refmt.Cloner)
-	err := c.Clone(a, b)
-	p.pool.Put(c)
-	return err
+	c := p.get()
+	wide, err := c.clone(a, b, limit)
+	p.put(c)
+	return wide, err
+}
+
+func (p *PooledCloner) get() *cloner {
+	if p.free == nil {
+		return p.pool.Get().(*cloner)
+	}
+	select {
+	case c := <-p.free:
+		return c
+	default:
+		return newCloner(p.atl)
+	}
+}
+
+func (p *PooledCloner) put(c *cloner) {
+	if p.free == nil {
+		p.pool.Put(c)
+		return
+	}
+	select {
+	case p.free <- c:
+	default:
+	}
 }
@@ -0,0 +1,109 @@
+package encoding
+
+import (
+	"github.com/polydawn/refmt/shared"
+	rtok "github.com/polydawn/refmt/tok"
+)
+
+// NoIntLimit makes the watching functions record no integer, so that they
+// cost as much as their plain counterparts.
+const NoIntLimit = ^uint64(0)
+
+// WideInt is an integer met by a watching decode or clone whose CBOR
+// argument, n for a positive integer n and -1-n for a negative one, is above
+// the limit it was given.
+type WideInt struct {
+	// Path leads to the integer from the decoded value: a string for the
+	// key of a map entry, an int for the index of an array element, and nil
+	// for a map key that isn't a string.
+	Path  []interface{}
+	Neg   bool
+	Value uint64
+}
+
+type intWatchFrame struct {
+	isMap bool
+	// n counts the items seen in the container, keys included.
+	n     int
+	key   string
+	keyOK bool
+}
+
+// intWatch is a token sink forwarding the tokens to sink, recording on the
+// way the integers above limit along with their paths. It follows the shape
+// of the tokens, not of the value they are decoded into, which is left to
+// the caller.
+type intWatch struct {
+	sink   shared.TokenSink
+	limit  uint64
+	frames []intWatchFrame
+	wide   []WideInt
+}
+
+func (w *intWatch) reset(limit uint64) {
+	w.limit = limit
+	w.frames = w.frames[:0]
+	w.wide = nil
+}
+
+func (w *intWatch) Step(tok *rtok.Token) (bool, error) {
+	w.observe(tok)
+	return w.sink.Step(tok)
+}
+
+func (w *intWatch) observe(tok *rtok.Token) {
+	switch tok.Type {
+	case rtok.TMapClose, rtok.TArrClose:
+		if len(w.frames) > 0 {
+			w.frames = w.frames[:len(w.frames)-1]
+		}
+		w.advance()
+		return
+	}
+	if n := len(w.frames); n > 0 {
+		if f := &w.frames[n-1]; f.isMap && f.n%2 == 0 {
+			f.key, f.keyOK = tok.Str, tok.Type == rtok.TString
+			f.n++
+			return
+		}
+	}
+	switch tok.Type {
+	case rtok.TMapOpen, rtok.TArrOpen:
+		// The parent advances when the container closes, so that its
+		// index is right for the items of the container.
+		w.frames = append(w.frames, intWatchFrame{isMap: tok.Type == rtok.TMapOpen})
+		return
+	case rtok.TUint:
+		if tok.Uint > w.limit {
+			w.record(false, tok.Uint)
+		}
+	case rtok.TInt:
+		if tok.Int >= 0 {
+			if uint64(tok.Int) > w.limit {
+				w.record(false, uint64(tok.Int))
+			}
+		} else if v := uint64(-1 - tok.Int); v > w.limit {
+			w.record(true, v)
+		}
+	}
+	w.advance()
+}
+
+func (w *intWatch) advance() {
+	if n := len(w.frames); n > 0 {
+		w.frames[n-1].n++
+	}
+}
+
+func (w *intWatch) record(neg bool, v uint64) {
+	path := make([]interface{}, len(w.frames))
+	for i, f := range w.frames {
+		switch {
+		case !f.isMap:
+			path[i] = f.n
+		case f.keyOK:
+			path[i] = f.key
+		}
+	}
+	w.wide = append(w.wide, WideInt{Path: path, Neg: neg, Value: v})
+}
@@ -0,0 +1,304 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MajorType is the major type of a CBOR data item.
+type MajorType byte
+
+const (
+	MajUnsignedInt MajorType = 0
+	MajNegativeInt MajorType = 1
+	MajByteString  MajorType = 2
+	MajTextString  MajorType = 3
+	MajArray       MajorType = 4
+	MajMap         MajorType = 5
+	MajTag         MajorType = 6
+	MajOther       MajorType = 7
+)
+
+// Additional info values with a special meaning.
+const (
+	infoUint8      = 24
+	infoUint16     = 25
+	infoUint32     = 26
+	infoUint64     = 27
+	infoIndefinite = 31
+)
+
+// maxWalkDepth bounds the nesting of arrays, maps and tags TokenWalk accepts,
+// so that adversarial input cannot exhaust the stack.
+const maxWalkDepth = 1024
+
+var (
+	// SkipItem may be returned by a TokenWalk visitor on an array, map or tag
+	// token to skip the contents of that item without visiting them.
+	SkipItem = errors.New("skip this item")
+
+	ErrTrailingBytes   = errors.New("cbor: trailing bytes after data item")
+	ErrMaxDepth        = errors.New("cbor: maximum nesting depth exceeded")
+	ErrUnexpectedBreak = errors.New("cbor: unexpected break")
+)
+
+// Token is a single CBOR data item header as surfaced by TokenWalk.
+type Token struct {
+	// Major is the major type of the item.
+	Major MajorType
+	// Info is the additional information of the header. It tells how Value
+	// was encoded (and, for major type 7, the width of floats).
+	Info byte
+	// Value is the argument of the header: the value of integers, the length
+	// of strings, arrays and maps, the tag number of tags, and the simple
+	// value or raw float bits of major type 7 items.
+	Value uint64
+	// Indefinite is set on indefinite length strings, arrays and maps.
+	Indefinite bool
+	// Break is set on the token closing an indefinite length item.
+	Break bool
+	// Bytes holds the content of definite length byte and text strings. It
+	// aliases the walked blob.
+	Bytes []byte
+	// Offset is the position of the header in the walked blob and Depth the
+	// nesting depth of the item.
+	Offset int
+	Depth  int
+}
+
+// IsFloat reports whether the token is a floating point number.
+func (t Token) IsFloat() bool {
+	return t.Major == MajOther && t.Info >= infoUint16 && t.Info <= infoUint64
+}
+
+// Float returns the value of a floating point token.
+func (t Token) Float() float64 {
+	switch t.Info {
+	case infoUint16:
+		return float16ToFloat64(uint16(t.Value))
+	case infoUint32:
+		return float64(math.Float32frombits(uint32(t.Value)))
+	default:
+		return math.Float64frombits(t.Value)
+	}
+}
+
+func (t Token) String() string {
+	switch {
+	case t.Break:
+		return "break"
+	case t.Indefinite:
+		return fmt.Sprintf("major(%d) indefinite", t.Major)
+	case t.Major == MajByteString, t.Major == MajTextString:
+		return fmt.Sprintf("major(%d) %q", t.Major, t.Bytes)
+	case t.IsFloat():
+		return fmt.Sprintf("float %v", t.Float())
+	default:
+		return fmt.Sprintf("major(%d) %d", t.Major, t.Value)
+	}
+}
+
+// TokenWalk walks the tokens of the single CBOR data item in blob, in
+// encoding order, calling visit for each of them. Tag 42 links appear as a
+// tag token followed by the byte string token carrying the link.
+//
+// If visit returns SkipItem for an array, map or tag token, the contents of
+// that item are skipped. Any other error aborts the walk and is returned.
+func TokenWalk(blob []byte, visit func(tok Token) error) error {
+	s := scanner{buf: blob}
+	if err := s.walk(0, visit); err != nil {
+		return err
+	}
+	if s.pos != len(blob) {
+		return ErrTrailingBytes
+	}
+	return nil
+}
+
+type scanner struct {
+	buf []byte
+	pos int
+}
+
+func (s *scanner) header() (Token, error) {
+	if s.pos >= len(s.buf) {
+		return Token{}, io.ErrUnexpectedEOF
+	}
+	tok := Token{Offset: s.pos}
+	b := s.buf[s.pos]
+	s.pos++
+	tok.Major = MajorType(b >> 5)
+	tok.Info = b & 0x1f
+
+	switch {
+	case tok.Info < infoUint8:
+		tok.Value = uint64(tok.Info)
+	case tok.Info <= infoUint64:
+		n := 1 << (tok.Info - infoUint8)
+		if len(s.buf)-s.pos < n {
+			return Token{}, io.ErrUnexpectedEOF
+		}
+		switch n {
+		case 1:
+			tok.Value = uint64(s.buf[s.pos])
+		case 2:
+			tok.Value = uint64(binary.BigEndian.Uint16(s.buf[s.pos:]))
+		case 4:
+			tok.Value = uint64(binary.BigEndian.Uint32(s.buf[s.pos:]))
+		case 8:
+			tok.Value = binary.BigEndian.Uint64(s.buf[s.pos:])
+		}
+		s.pos += n
+	case tok.Info == infoIndefinite:
+		switch tok.Major {
+		case MajByteString, MajTextString, MajArray, MajMap:
+			tok.Indefinite = true
+		case MajOther:
+			tok.Break = true
+		default:
+			return Token{}, fmt.Errorf("cbor: invalid indefinite length for major type %d", tok.Major)
+		}
+	default:
+		return Token{}, fmt.Errorf("cbor: invalid additional info %d", tok.Info)
+	}
+
+	if (tok.Major == MajByteString || tok.Major == MajTextString) && !tok.Indefinite {
+		if uint64(len(s.buf)-s.pos) < tok.Value {
+			return Token{}, io.ErrUnexpectedEOF
+		}
+		tok.Bytes = s.buf[s.pos : s.pos+int(tok.Value)]
+		s.pos += int(tok.Value)
+	}
+	return tok, nil
+}
+
+func (s *scanner) walk(depth int, visit func(Token) error) error {
+	if depth > maxWalkDepth {
+		return ErrMaxDepth
+	}
+	tok, err := s.header()
+	if err != nil {
+		return err
+	}
+	if tok.Break {
+		return ErrUnexpectedBreak
+	}
+	tok.Depth = depth
+	skip := false
+	if visit != nil {
+		switch err := visit(tok); err {
+		case nil:
+		case SkipItem:
+			skip = true
+		default:
+			return err
+		}
+	}
+	if skip {
+		visit = nil
+	}
+
+	var items uint64
+	switch tok.Major {
+	case MajByteString, MajTextString:
+		if tok.Indefinite {
+			return s.walkChunks(tok.Major, depth, visit)
+		}
+		return nil
+	case MajArray:
+		items = tok.Value
+	case MajMap:
+		if tok.Value > math.MaxUint64/2 {
+			return fmt.Errorf("cbor: map length %d too large", tok.Value)
+		}
+		items = tok.Value * 2
+	case MajTag:
+		items = 1
+	default:
+		return nil
+	}
+
+	if tok.Indefinite {
+		for n := 0; ; n++ {
+			if s.pos >= len(s.buf) {
+				return io.ErrUnexpectedEOF
+			}
+			if s.buf[s.pos] == 0xff {
+				if tok.Major == MajMap && n%2 == 1 {
+					return fmt.Errorf("cbor: indefinite length map with odd number of items")
+				}
+				return s.walkBreak(depth, visit)
+			}
+			if err := s.walk(depth+1, visit); err != nil {
+				return err
+			}
+		}
+	}
+	for i := uint64(0); i < items; i++ {
+		if err := s.walk(depth+1, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scanner) walkChunks(major MajorType, depth int, visit func(Token) error) error {
+	for {
+		if s.pos >= len(s.buf) {
+			return io.ErrUnexpectedEOF
+		}
+		if s.buf[s.pos] == 0xff {
+			return s.walkBreak(depth, visit)
+		}
+		tok, err := s.header()
+		if err != nil {
+			return err
+		}
+		if tok.Major != major || tok.Indefinite {
+			return fmt.Errorf("cbor: invalid chunk in indefinite length string")
+		}
+		tok.Depth = depth + 1
+		if visit != nil {
+			if err := visit(tok); err != nil && err != SkipItem {
+				return err
+			}
+		}
+	}
+}
+
+func (s *scanner) walkBreak(depth int, visit func(Token) error) error {
+	tok, err := s.header()
+	if err != nil {
+		return err
+	}
+	tok.Depth = depth
+	if visit != nil {
+		if err := visit(tok); err != nil && err != SkipItem {
+			return err
+		}
+	}
+	return nil
+}
+
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1.0
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	default:
+		return sign * math.Ldexp(frac+1024, exp-25)
+	}
+}
@@ -0,0 +1,87 @@
+package encoding
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestTokenWalk(t *testing.T) {
+	// {"a": [1, -2, h'01'], "b": 42(h'00')} followed by nothing.
+	blob, _ := hex.DecodeString("a26161830121410161" + "62d82a4100")
+
+	var toks []string
+	err := TokenWalk(blob, func(tok Token) error {
+		toks = append(toks, strings.Repeat(" ", tok.Depth)+tok.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"major(5) 2",
+		" major(3) \"a\"",
+		" major(4) 3",
+		"  major(0) 1",
+		"  major(1) 1",
+		"  major(2) \"\\x01\"",
+		" major(3) \"b\"",
+		" major(6) 42",
+		"  major(2) \"\\x00\"",
+	}
+	if strings.Join(toks, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("unexpected tokens:\n%s", strings.Join(toks, "\n"))
+	}
+}
+
+func TestTokenWalkSkip(t *testing.T) {
+	// [[1, 2], 3]
+	blob, _ := hex.DecodeString("8282010203")
+	var vals []uint64
+	err := TokenWalk(blob, func(tok Token) error {
+		if tok.Major == MajArray && tok.Depth == 1 {
+			return SkipItem
+		}
+		if tok.Major == MajUnsignedInt {
+			vals = append(vals, tok.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || vals[0] != 3 {
+		t.Fatalf("expected to only see 3, got %v", vals)
+	}
+}
+
+func TestTokenWalkErrors(t *testing.T) {
+	for name, h := range map[string]string{
+		"truncated": "8201",
+		"trailing":  "0101",
+		"bad-info":  "1c",
+		"bad-break": "ff",
+		"bad-chunk": "5f6161ff",
+	} {
+		blob, _ := hex.DecodeString(h)
+		if err := TokenWalk(blob, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Indefinite lengths and floats are fine.
+	blob, _ := hex.DecodeString("9f5f4101fff93e00ff")
+	var f float64
+	err := TokenWalk(blob, func(tok Token) error {
+		if tok.IsFloat() {
+			f = tok.Float()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 1.5 {
+		t.Fatalf("expected 1.5, got %v", f)
+	}
+}
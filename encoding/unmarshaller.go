@@ -6,27 +6,64 @@ import (
 	"sync"
 
 	cbor "github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/obj"
 	"github.com/polydawn/refmt/obj/atlas"
+	"github.com/polydawn/refmt/shared"
 )
 
 type proxyReader struct {
 	r io.Reader
+	// n counts the bytes read, which are appended to buf when tee is set.
+	n   int
+	tee bool
+	buf []byte
 }
 
 func (r *proxyReader) Read(b []byte) (int, error) {
-	return r.r.Read(b)
+	n, err := r.r.Read(b)
+	r.n += n
+	if r.tee {
+		r.buf = append(r.buf, b[:n]...)
+	}
+	return n, err
 }
 
 // Unmarshaller is a reusable CBOR unmarshaller.
 type Unmarshaller struct {
-	unmarshal *cbor.Unmarshaller
+	decoder   *cbor.Decoder
+	unmarshal *obj.Unmarshaller
+	watch     intWatch
 	reader    proxyReader
+	// capturing is set on unmarshallers made by NewUnmarshallerCapturing,
+	// input is the data being unmarshalled when it is in memory.
+	capturing bool
+	capture   capture
+	input     []byte
 }
 
 // NewUnmarshallerAtlased creates a new reusable unmarshaller.
 func NewUnmarshallerAtlased(atl atlas.Atlas) *Unmarshaller {
 	m := new(Unmarshaller)
-	m.unmarshal = cbor.NewUnmarshallerAtlased(cbor.DecodeOptions{CoerceUndefToNull: true}, &m.reader, atl)
+	m.decoder = cbor.NewDecoder(cbor.DecodeOptions{CoerceUndefToNull: true}, &m.reader)
+	m.unmarshal = obj.NewUnmarshaller(atl)
+	m.watch.sink = m.unmarshal
+	return m
+}
+
+// NewUnmarshallerCapturing creates a new reusable unmarshaller using the
+// atlas returned by build. build is handed a function returning the encoding
+// of the value the token being unmarshalled completes, which transforms of
+// the atlas may call to keep the exact bytes a value was decoded from. The
+// function returns nil when the token doesn't complete a value, and its
+// result is only valid until the transform returns.
+func NewUnmarshallerCapturing(build func(captured func() []byte) atlas.Atlas) *Unmarshaller {
+	m := new(Unmarshaller)
+	m.decoder = cbor.NewDecoder(cbor.DecodeOptions{CoerceUndefToNull: true}, &m.reader)
+	m.unmarshal = obj.NewUnmarshaller(build(m.captured))
+	m.capturing = true
+	m.capture.sink = m.unmarshal
+	m.capture.reader = &m.reader
+	m.watch.sink = &m.capture
 	return m
 }
 
@@ -36,21 +73,65 @@ type cborUnmarshaler interface {
 
 // Decode reads a CBOR object from the given reader and decodes it into the
 // given object.
-func (m *Unmarshaller) Decode(r io.Reader, obj interface{}) (err error) {
+func (m *Unmarshaller) Decode(r io.Reader, obj interface{}) error {
+	_, err := m.DecodeWatch(r, obj, NoIntLimit)
+	return err
+}
+
+// DecodeWatch is like Decode, and also returns the integers read whose CBOR
+// argument is above limit. It lets callers check the integers that may not
+// fit the values they were decoded into without walking the data again.
+func (m *Unmarshaller) DecodeWatch(r io.Reader, v interface{}, limit uint64) ([]WideInt, error) {
+	return m.decodeWatch(r, nil, v, limit)
+}
+
+// decodeWatch is DecodeWatch, reading from r the data input holds if it
+// isn't nil.
+func (m *Unmarshaller) decodeWatch(r io.Reader, input []byte, v interface{}, limit uint64) (wide []WideInt, err error) {
+	if self, ok := v.(cborUnmarshaler); ok {
+		return nil, self.UnmarshalCBOR(r)
+	}
 	m.reader.r = r
-	selfUnmarshaler, ok := obj.(cborUnmarshaler)
-	if ok {
-		err = selfUnmarshaler.UnmarshalCBOR(r)
+	var sink shared.TokenSink = m.unmarshal
+	if m.capturing {
+		sink = &m.capture
+		m.capture.reset()
+		m.input = input
+		// Captured values are sliced from what was read so far.
+		m.reader.tee = input == nil
+	}
+	// Bind errors are returned by the first step as well.
+	_ = m.unmarshal.Bind(v)
+	m.decoder.Reset()
+	if limit == NoIntLimit {
+		err = shared.TokenPump{TokenSource: m.decoder, TokenSink: sink}.Run()
 	} else {
-		err = m.unmarshal.Unmarshal(obj)
+		m.watch.reset(limit)
+		err = shared.TokenPump{TokenSource: m.decoder, TokenSink: &m.watch}.Run()
+		wide = m.watch.wide
+		m.watch.reset(NoIntLimit)
 	}
 	m.reader.r = nil
-	return err
+	m.reader.n = 0
+	m.reader.tee = false
+	if cap(m.reader.buf) > maxCaptureBuffer {
+		m.reader.buf = nil
+	}
+	m.reader.buf = m.reader.buf[:0]
+	m.input = nil
+	return wide, err
 }
 
 // Unmarshal unmarshals the given CBOR byte slice into the given object.
 func (m *Unmarshaller) Unmarshal(b []byte, obj interface{}) error {
-	return m.Decode(bytes.NewReader(b), obj)
+	_, err := m.UnmarshalWatch(b, obj, NoIntLimit)
+	return err
+}
+
+// UnmarshalWatch is like Unmarshal, returning the integers above limit as
+// DecodeWatch does.
+func (m *Unmarshaller) UnmarshalWatch(b []byte, obj interface{}, limit uint64) ([]WideInt, error) {
+	return m.decodeWatch(bytes.NewReader(b), b, obj, limit)
 }
 
 // PooledUnmarshaller is a thread-safe pooled CBOR unmarshaller.
@@ -70,6 +151,18 @@ func NewPooledUnmarshaller(atl atlas.Atlas) PooledUnmarshaller {
 	}
 }
 
+// NewPooledUnmarshallerCapturing returns a PooledUnmarshaller of unmarshallers
+// made by NewUnmarshallerCapturing with build. Do not copy after use.
+func NewPooledUnmarshallerCapturing(build func(captured func() []byte) atlas.Atlas) PooledUnmarshaller {
+	return PooledUnmarshaller{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return NewUnmarshallerCapturing(build)
+			},
+		},
+	}
+}
+
 // Decode decodes an object from the passed reader into the given object using
 // the pool of unmarshallers.
 func (p *PooledUnmarshaller) Decode(r io.Reader, obj interface{}) error {
@@ -79,6 +172,15 @@ func (p *PooledUnmarshaller) Decode(r io.Reader, obj interface{}) error {
 	return err
 }
 
+// DecodeWatch is like Decode, returning the integers above limit as
+// Unmarshaller.DecodeWatch does.
+func (p *PooledUnmarshaller) DecodeWatch(r io.Reader, obj interface{}, limit uint64) ([]WideInt, error) {
+	u := p.pool.Get().(*Unmarshaller)
+	wide, err := u.DecodeWatch(r, obj, limit)
+	p.pool.Put(u)
+	return wide, err
+}
+
 // Unmarshal unmarshals the passed object using the pool of unmarshallers.
 func (p *PooledUnmarshaller) Unmarshal(b []byte, obj interface{}) error {
 	u := p.pool.Get().(*Unmarshaller)
@@ -86,3 +188,12 @@ func (p *PooledUnmarshaller) Unmarshal(b []byte, obj interface{}) error {
 	p.pool.Put(u)
 	return err
 }
+
+// UnmarshalWatch is like Unmarshal, returning the integers above limit as
+// Unmarshaller.DecodeWatch does.
+func (p *PooledUnmarshaller) UnmarshalWatch(b []byte, obj interface{}, limit uint64) ([]WideInt, error) {
+	u := p.pool.Get().(*Unmarshaller)
+	wide, err := u.UnmarshalWatch(b, obj, limit)
+	p.pool.Put(u)
+	return wide, err
+}
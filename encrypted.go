@@ -0,0 +1,85 @@
+package cbornode
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// ErrDecrypt is returned by an encrypted store when a block can't be
+// decrypted, for example because it was encrypted with another key.
+var ErrDecrypt = errors.New("cannot decrypt block")
+
+// NewEncryptedStore returns an IpldStore that encrypts objects with aead
+// before writing them to inner, and decrypts them after reading them.
+//
+// Each object is encoded, then sealed with a random nonce, and stored as a
+// raw block whose CID is computed over the ciphertext, so neither the content
+// nor the links of objects are visible to the backing store. Consequently,
+// graph traversals over the backing store don't see the encrypted objects'
+// links either.
+func NewEncryptedStore(inner IpldStore, aead cipher.AEAD) IpldStore {
+	return &encryptedStore{inner: inner, aead: aead}
+}
+
+type encryptedStore struct {
+	inner IpldStore
+	aead  cipher.AEAD
+}
+
+func (s *encryptedStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	var sealed rawCapture
+	if err := s.inner.Get(ctx, c, &sealed); err != nil {
+		return err
+	}
+	ns := s.aead.NonceSize()
+	if len(sealed) < ns {
+		return ErrDecrypt
+	}
+	plain, err := s.aead.Open(nil, sealed[:ns], sealed[ns:], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	return decodeForStore(s.inner, plain, out)
+}
+
+func (s *encryptedStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	var plain []byte
+	if cm, ok := v.(cbg.CBORMarshaler); ok {
+		buf := new(bytes.Buffer)
+		if err := cm.MarshalCBOR(buf); err != nil {
+			return cid.Undef, NewSerializationError(err)
+		}
+		plain = buf.Bytes()
+	} else {
+		var err error
+		plain, err = Encode(v)
+		if err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return cid.Undef, err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plain, nil)
+
+	mhType, mhLen := storeHashParams(s.inner)
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   mhType,
+		MhLength: mhLen,
+	}.Sum(sealed)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return s.inner.Put(ctx, &rawObject{data: sealed, cid: c})
+}
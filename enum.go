@@ -0,0 +1,83 @@
+package cbornode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// ErrUnknownEnumValue is returned when encoding or decoding a value of an
+// enum type registered with RegisterEnum that isn't one of its values.
+var ErrUnknownEnumValue = errors.New("unknown enum value")
+
+// RegisterEnum registers the integer type of typeHint, such as
+//
+//	type Color int
+//
+//	const (
+//		Red Color = iota
+//		Green
+//	)
+//
+// as an enum whose only valid values are values, which must be of that type:
+// RegisterEnum(Red, Red, Green). Enum values encode as plain integers, and
+// encoding or decoding any other value fails with ErrUnknownEnumValue, named
+// with the String method of the type if it has one.
+//
+// The type is registered as by RegisterCborType, and likewise seen by the
+// calls starting after RegisterEnum returns.
+func RegisterEnum(typeHint interface{}, values ...interface{}) error {
+	et := reflect.TypeOf(typeHint)
+	if et == nil {
+		return errors.New("enum type must not be nil")
+	}
+	var serial reflect.Type
+	switch et.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		serial = reflect.TypeOf(int64(0))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		serial = reflect.TypeOf(uint64(0))
+	default:
+		return fmt.Errorf("enum type %s is not an integer type", et)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if findAtlasEntry(et) != nil {
+		return fmt.Errorf("enum type %s is already registered", et)
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("enum type %s needs at least one value", et)
+	}
+
+	// Values are keyed by their serial form, which is unique per value.
+	allowed := make(map[interface{}]struct{}, len(values))
+	for _, v := range values {
+		rv := reflect.ValueOf(v)
+		if rv.Type() != et {
+			return fmt.Errorf("enum value %v is a %s, not a %s", v, rv.Type(), et)
+		}
+		allowed[rv.Convert(serial).Interface()] = struct{}{}
+	}
+
+	entry := atlas.BuildEntry(typeHint).Transform().
+		TransformMarshal(func(live reflect.Value) (reflect.Value, error) {
+			s := live.Convert(serial)
+			if _, ok := allowed[s.Interface()]; !ok {
+				return s, fmt.Errorf("%w %v for %s", ErrUnknownEnumValue, live.Interface(), et)
+			}
+			return s, nil
+		}, serial).
+		TransformUnmarshal(func(s reflect.Value) (reflect.Value, error) {
+			if _, ok := allowed[s.Interface()]; !ok {
+				return reflect.Zero(et), fmt.Errorf("%w %v for %s", ErrUnknownEnumValue, s.Interface(), et)
+			}
+			return s.Convert(et), nil
+		}, serial).
+		Complete()
+
+	atlasEntries = append(atlasEntries, entry)
+	rebuildAtlas()
+	return nil
+}
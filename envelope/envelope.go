@@ -0,0 +1,119 @@
+// Package envelope signs and verifies dag-cbor objects.
+//
+// An envelope is a dag-cbor map holding the canonical encoding of a payload,
+// a signature over those bytes and the PKIX encoded public key of the signer:
+//
+//	{"payload": <payload>, "publicKey": <bytes>, "signature": <bytes>}
+//
+// ECDSA and RSA (PKCS #1 v1.5) signatures are made over the SHA-256 digest of
+// the payload, ed25519 signatures over the payload itself.
+package envelope
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+// ErrInvalidSignature is returned by Verify when the signature doesn't match
+// the payload and key.
+var ErrInvalidSignature = errors.New("envelope: invalid signature")
+
+type envelope struct {
+	Payload   cbornode.RawCBOR
+	PublicKey []byte
+	Signature []byte
+}
+
+func init() {
+	cbornode.RegisterCborType(envelope{})
+}
+
+// Sign encodes obj and returns an envelope node holding it, signed by signer.
+func Sign(obj interface{}, signer crypto.Signer) (*cbornode.Node, error) {
+	payload, err := cbornode.Encode(obj)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(payload)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cbornode.WrapObject(envelope{
+		Payload:   payload,
+		PublicKey: pub,
+		Signature: sig,
+	}, math.MaxUint64, -1)
+}
+
+// Verify checks that n is an envelope signed by pub.
+func Verify(n *cbornode.Node, pub crypto.PublicKey) error {
+	env, err := decode(n)
+	if err != nil {
+		return err
+	}
+	expected, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(env.PublicKey, expected) {
+		return fmt.Errorf("%w: envelope was signed by another key", ErrInvalidSignature)
+	}
+
+	digest := sha256.Sum256(env.Payload)
+	var ok bool
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, env.Payload, env.Signature)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], env.Signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], env.Signature) == nil
+	default:
+		return fmt.Errorf("envelope: unsupported public key type %T", pub)
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Payload decodes the payload of the envelope n into out. It does not verify
+// the signature.
+func Payload(n *cbornode.Node, out interface{}) error {
+	env, err := decode(n)
+	if err != nil {
+		return err
+	}
+	return env.Payload.Decode(out)
+}
+
+func decode(n *cbornode.Node) (*envelope, error) {
+	var env envelope
+	if err := cbornode.DecodeInto(n.RawData(), &env); err != nil {
+		return nil, fmt.Errorf("envelope: %w", err)
+	}
+	return &env, nil
+}
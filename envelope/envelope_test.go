@@ -0,0 +1,70 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math"
+	"testing"
+
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+func TestSignVerify(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, keys := range map[string]struct {
+		signer crypto.Signer
+		pub    crypto.PublicKey
+	}{
+		"ed25519": {edPriv, edPub},
+		"ecdsa":   {ecPriv, &ecPriv.PublicKey},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nd, err := Sign(map[string]interface{}{"amount": 10, "to": "bob"}, keys.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(nd, keys.pub); err != nil {
+				t.Fatal(err)
+			}
+
+			var payload map[string]interface{}
+			if err := Payload(nd, &payload); err != nil || payload["to"] != "bob" {
+				t.Fatalf("unexpected payload %v %v", payload, err)
+			}
+
+			other, _, _ := ed25519.GenerateKey(rand.Reader)
+			if err := Verify(nd, other); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected another key to be refused, got %v", err)
+			}
+
+			// Swap the payload, keeping the signature.
+			var env envelope
+			if err := cbornode.DecodeInto(nd.RawData(), &env); err != nil {
+				t.Fatal(err)
+			}
+			env.Payload, err = cbornode.Encode(map[string]interface{}{"amount": 1000, "to": "bob"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			forged, err := cbornode.WrapObject(env, math.MaxUint64, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(forged, keys.pub); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected a forged payload to be refused, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package cbornode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// CorruptBlockError reports data that isn't well-formed CBOR, such as a
+// truncated block. The same CID fetched from another source may decode.
+type CorruptBlockError struct {
+	Err error
+}
+
+func (e *CorruptBlockError) Error() string {
+	return "corrupt cbor block: " + e.Err.Error()
+}
+
+func (e *CorruptBlockError) Unwrap() error {
+	return e.Err
+}
+
+// LinkFormatError reports well-formed CBOR holding a link (tag 42) whose
+// content isn't a valid CID, see SetLenientLinks.
+type LinkFormatError struct {
+	Err error
+}
+
+func (e *LinkFormatError) Error() string {
+	return "invalid link: " + e.Err.Error()
+}
+
+func (e *LinkFormatError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaMismatchError reports valid dag-cbor that doesn't fit the type it is
+// decoded into, such as a string where the type has an integer, which
+// usually means that the data was written with another version of the type.
+type SchemaMismatchError struct {
+	// Type is the type decoded into.
+	Type reflect.Type
+	Err  error
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("cannot decode into %s: %s", e.Type, e.Err)
+}
+
+func (e *SchemaMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyDecodeError wraps err, returned by decoding b into out, in a
+// *CorruptBlockError, a *LinkFormatError or a *SchemaMismatchError depending
+// on what is wrong with b, so that callers can recover from each in their
+// own way. The original error, such as a SerializationError, stays reachable
+// with errors.Is and errors.As. Nil and already classified errors are
+// returned as is.
+//
+// BasicIpldStore.Get classifies its decoding errors this way, on both the
+// refmt and the cbor-gen paths.
+func ClassifyDecodeError(b []byte, out interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		corrupt *CorruptBlockError
+		link    *LinkFormatError
+		schema  *SchemaMismatchError
+	)
+	if errors.As(err, &corrupt) || errors.As(err, &link) || errors.As(err, &schema) {
+		return err
+	}
+	if werr := encoding.TokenWalk(b, func(encoding.Token) error { return nil }); werr != nil {
+		return &CorruptBlockError{Err: err}
+	}
+	if _, lerr := ExtractLinks(b); lerr != nil && !snapshot().lenientLinks {
+		return &LinkFormatError{Err: err}
+	}
+	return &SchemaMismatchError{Type: reflect.TypeOf(out), Err: err}
+}
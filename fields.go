@@ -0,0 +1,82 @@
+package cbornode
+
+import (
+	"fmt"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// DecodeFields decodes the values of the given keys of the CBOR encoded map b
+// into the matching entries of outs, which must be pointers, as DecodeInto
+// would. The other entries of the map are skipped without being decoded, so
+// reading a single field of a large block costs little more than scanning
+// it.
+//
+// Requested keys missing from b leave their outs untouched. Every field must
+// have an entry in outs, and b must be a map with string keys.
+func DecodeFields(b []byte, fields []string, outs map[string]interface{}) error {
+	type span struct{ start, end int }
+	wanted := make(map[string]*span, len(fields))
+	for _, f := range fields {
+		if _, ok := outs[f]; !ok {
+			return fmt.Errorf("no output given for field %q", f)
+		}
+		wanted[f] = nil
+	}
+
+	var (
+		isKey   = true
+		key     string
+		pending *span
+	)
+	err := encoding.TokenWalk(b, func(tok encoding.Token) error {
+		if pending != nil {
+			pending.end = tok.Offset
+			pending = nil
+		}
+		// Only the map, its entries and the break closing an indefinite
+		// length map are visited, values are skipped.
+		if tok.Depth == 0 {
+			if tok.Major != encoding.MajMap && !tok.Break {
+				return fmt.Errorf("cannot decode fields of a non-map value (major type %d)", tok.Major)
+			}
+			return nil
+		}
+		if isKey {
+			isKey = false
+			if tok.Major != encoding.MajTextString || tok.Indefinite {
+				return ErrInvalidKeys
+			}
+			key = string(tok.Bytes)
+			return nil
+		}
+		isKey = true
+		sp, ok := wanted[key]
+		if !ok {
+			return encoding.SkipItem
+		}
+		if sp != nil {
+			return fmt.Errorf("%w %q", ErrDuplicateKey, key)
+		}
+		pending = &span{start: tok.Offset}
+		wanted[key] = pending
+		return encoding.SkipItem
+	})
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		pending.end = len(b)
+	}
+
+	for _, f := range fields {
+		sp := wanted[f]
+		if sp == nil {
+			continue
+		}
+		if err := unmarshal(b[sp.start:sp.end], outs[f]); err != nil {
+			return fmt.Errorf("field %q: %w", f, err)
+		}
+	}
+	return nil
+}
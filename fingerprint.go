@@ -0,0 +1,120 @@
+package cbornode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// ErrRegistryDrift is returned by EnsureRegistryFingerprint when the
+// registered types don't match the expected fingerprint.
+var ErrRegistryDrift = errors.New("cbor type registry fingerprint mismatch")
+
+// RegistryFingerprint returns a fingerprint of the types registered with
+// RegisterCborType, RegisterUnion and RegisterCborTag: their names, the keys,
+// types and order of struct fields, omitempty flags, tags, union
+// discriminants and the types transforms convert to and from. It doesn't
+// depend on registration order.
+//
+// Any change to the registry that may change wire encodings changes the
+// fingerprint, so it can be recorded at release time and checked with
+// EnsureRegistryFingerprint. The code of transform functions isn't covered.
+func RegistryFingerprint() string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	descs := make([]string, 0, len(atlasEntries))
+	for _, e := range atlasEntries {
+		descs = append(descs, describeEntry(e))
+	}
+	sort.Strings(descs)
+	sum := sha256.Sum256([]byte(strings.Join(descs, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnsureRegistryFingerprint returns an ErrRegistryDrift error if the current
+// RegistryFingerprint isn't expected.
+func EnsureRegistryFingerprint(expected string) error {
+	if actual := RegistryFingerprint(); actual != expected {
+		return fmt.Errorf("%w: expected %s, got %s", ErrRegistryDrift, expected, actual)
+	}
+	return nil
+}
+
+// describeEntry returns a single line description of what e does to the
+// wire encoding of its type.
+func describeEntry(e *atlas.AtlasEntry) string {
+	var b strings.Builder
+	b.WriteString(fingerprintType(e.Type))
+	if e.Tagged {
+		fmt.Fprintf(&b, " tag(%d)", e.Tag)
+	}
+	if e.MarshalTransformFunc != nil {
+		fmt.Fprintf(&b, " marshal(%s)", fingerprintType(e.MarshalTransformTargetType))
+	}
+	if e.UnmarshalTransformFunc != nil {
+		fmt.Fprintf(&b, " unmarshal(%s)", fingerprintType(e.UnmarshalTransformTargetType))
+	}
+	if e.StructMap != nil {
+		b.WriteString(" struct{")
+		for _, f := range e.StructMap.Fields {
+			if f.Ignore {
+				fmt.Fprintf(&b, "%q ignored;", f.SerialName)
+				continue
+			}
+			fmt.Fprintf(&b, "%q %s", f.SerialName, fingerprintType(f.Type))
+			if f.OmitEmpty {
+				b.WriteString(" omitempty")
+			}
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+	}
+	if e.MapMorphism != nil {
+		fmt.Fprintf(&b, " map(%s)", e.MapMorphism.KeySortMode)
+	}
+	if e.UnionKeyedMorphism != nil {
+		keys := make([]string, 0, len(e.UnionKeyedMorphism.Elements))
+		for k := range e.UnionKeyedMorphism.Elements {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString(" union{")
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%q %s;", k, fingerprintType(e.UnionKeyedMorphism.Elements[k].Type))
+		}
+		b.WriteString("}")
+	}
+	return b.String()
+}
+
+// fingerprintType names t with its full package path, so that types of the
+// same name in different packages are told apart.
+func fingerprintType(t reflect.Type) string {
+	if t == nil {
+		return "<nil>"
+	}
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name()
+		}
+		return t.PkgPath() + "." + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + fingerprintType(t.Elem())
+	case reflect.Slice:
+		return "[]" + fingerprintType(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), fingerprintType(t.Elem()))
+	case reflect.Map:
+		return "map[" + fingerprintType(t.Key()) + "]" + fingerprintType(t.Elem())
+	default:
+		return t.String()
+	}
+}
@@ -0,0 +1,125 @@
+package cbornode
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// CidCount is a CID and how often it was fetched.
+type CidCount struct {
+	Cid   cid.Cid
+	Count uint64
+}
+
+// hotKeyBuckets is the number of buckets a HotKeyProfiler splits its window
+// into. The window slides one bucket at a time.
+const hotKeyBuckets = 8
+
+// HotKeyProfiler counts the CIDs fetched from a BasicIpldStore over a sliding
+// window of time, to find the most frequently read blocks. Set it as the
+// store's Profiler and query it with HotKeys.
+//
+// To keep its overhead low under heavy traffic, the profiler only records
+// one fetch out of every sampleRate, and scales the counts it reports
+// accordingly, so they are estimates when sampleRate is above 1.
+type HotKeyProfiler struct {
+	window     time.Duration
+	span       time.Duration
+	sampleRate uint64
+	fetches    uint64 // updated atomically
+
+	mu      sync.Mutex
+	buckets [hotKeyBuckets]hotKeyBucket
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type hotKeyBucket struct {
+	start  time.Time
+	counts map[cid.Cid]uint64
+}
+
+// NewHotKeyProfiler returns a profiler counting fetches over the last window,
+// recording one fetch out of every sampleRate. A sampleRate below 1 records
+// every fetch.
+func NewHotKeyProfiler(window time.Duration, sampleRate int) *HotKeyProfiler {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	span := window / hotKeyBuckets
+	if span <= 0 {
+		span = 1
+	}
+	return &HotKeyProfiler{
+		window:     span * hotKeyBuckets,
+		span:       span,
+		sampleRate: uint64(sampleRate),
+		now:        time.Now,
+	}
+}
+
+func (p *HotKeyProfiler) record(c cid.Cid) {
+	if atomic.AddUint64(&p.fetches, 1)%p.sampleRate != 0 {
+		return
+	}
+	now := p.now()
+	start := now.Truncate(p.span)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := &p.buckets[(start.UnixNano()/int64(p.span))%hotKeyBuckets]
+	if !b.start.Equal(start) || b.counts == nil {
+		b.start = start
+		b.counts = make(map[cid.Cid]uint64)
+	}
+	b.counts[c]++
+}
+
+// HotKeys returns the n most fetched CIDs over the profiler's window, most
+// fetched first. Ties are ordered by CID.
+func (p *HotKeyProfiler) HotKeys(n int) []CidCount {
+	if n <= 0 {
+		return nil
+	}
+	oldest := p.now().Truncate(p.span).Add(-p.window + p.span)
+
+	totals := make(map[cid.Cid]uint64)
+	p.mu.Lock()
+	for _, b := range p.buckets {
+		if b.start.Before(oldest) {
+			continue
+		}
+		for c, count := range b.counts {
+			totals[c] += count * p.sampleRate
+		}
+	}
+	p.mu.Unlock()
+
+	out := make([]CidCount, 0, len(totals))
+	for c, count := range totals {
+		out = append(out, CidCount{Cid: c, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Cid.KeyString() < out[j].Cid.KeyString()
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// HotKeys returns the n most fetched CIDs over the window of the store's
+// Profiler, or nil if the store has no profiler.
+func (s *BasicIpldStore) HotKeys(n int) []CidCount {
+	if s.Profiler == nil {
+		return nil
+	}
+	return s.Profiler.HotKeys(n)
+}
@@ -0,0 +1,106 @@
+package cbornode
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// maxIngestSize is the size of the largest object IngestCBOR reads for
+// stores without a MaxAllocation, the block size limit of bitswap.
+const maxIngestSize = 2 << 20
+
+// ErrObjectTooLarge is returned by IngestCBOR when r holds more than the
+// object size limit.
+var ErrObjectTooLarge = errors.New("object exceeds the size limit")
+
+// IngestCBOR reads an already encoded dag-cbor object from r, checks that it
+// is strictly encoded dag-cbor, hashes it while reading and stores it in
+// store under a CID built from prefix. Unlike Put, the object is never decoded
+// into Go values, so this is suited to ingesting blocks received from the
+// network or read from disk.
+//
+// The object is held in memory, so IngestCBOR reads at most the store's
+// MaxAllocation bytes, or 2 MiB if it has none, and fails with an
+// ErrObjectTooLarge error if r holds more.
+func IngestCBOR(ctx context.Context, store IpldStore, r io.Reader, prefix cid.Prefix) (cid.Cid, error) {
+	if prefix.Codec != cid.DagCBOR || prefix.Version != 1 {
+		return cid.Undef, fmt.Errorf("cannot ingest cbor as a CIDv%d with codec %d", prefix.Version, prefix.Codec)
+	}
+	limit := uint64(maxIngestSize)
+	if bs, ok := asBasic(store); ok {
+		if err := bs.checkPolicy(prefix.Codec, prefix.MhType); err != nil {
+			return cid.Undef, err
+		}
+		if bs.MaxAllocation != 0 {
+			limit = min(bs.MaxAllocation, math.MaxInt64-1)
+		}
+	}
+	hasher, err := mh.GetHasher(prefix.MhType)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(&buf, hasher), io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if uint64(n) > limit {
+		return cid.Undef, fmt.Errorf("%w: more than %d bytes", ErrObjectTooLarge, limit)
+	}
+	data := buf.Bytes()
+	if err := validateDagCBOR(data); err != nil {
+		return cid.Undef, err
+	}
+
+	digest := hasher.Sum(nil)
+	if prefix.MhLength >= 0 {
+		if prefix.MhLength > len(digest) {
+			return cid.Undef, mh.ErrLenTooLarge
+		}
+		digest = digest[:prefix.MhLength]
+	}
+	hash, err := mh.Encode(digest, prefix.MhType)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c := cid.NewCidV1(prefix.Codec, hash)
+
+	if bs, ok := asBasic(store); ok {
+		blk, err := block.NewBlockWithCid(data, c)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if err := bs.Blocks.Put(ctx, blk); err != nil {
+			return cid.Undef, err
+		}
+		return c, nil
+	}
+
+	// Other stores get the pre-encoded bytes through the cbor-gen fast path
+	// of Put.
+	return store.Put(ctx, &rawObject{data: data, cid: c})
+}
+
+// rawObject is an already encoded object with a known CID.
+type rawObject struct {
+	data []byte
+	cid  cid.Cid
+}
+
+func (o *rawObject) MarshalCBOR(w io.Writer) error {
+	_, err := w.Write(o.data)
+	return err
+}
+
+func (o *rawObject) Cid() cid.Cid {
+	return o.cid
+}
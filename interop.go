@@ -0,0 +1,120 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// ErrIntegerOutOfRange is returned in interop mode when decoding an integer
+// that doesn't fit in an int64.
+var ErrIntegerOutOfRange = errors.New("integer out of int64 range")
+
+// SetInteropMode makes encoding and decoding follow the edge-case behavior
+// of the JavaScript (@ipld/dag-cbor) and Rust (serde_ipld_dagcbor)
+// implementations, as captured by Fixtures:
+//
+//   - decoding only accepts strictly encoded dag-cbor (see IngestCBOR);
+//   - NaN and infinities are refused on both encoding and decoding;
+//   - integers outside the int64 range are refused instead of being silently
+//     wrapped, as Go values can't hold them;
+//   - -0.0 is kept as a negative zero float.
+//
+// It applies to DecodeInto, DecodeBlock, Decode and WrapObject. DecodeReader
+// reads r to EOF in interop mode.
+//
+// The mode applies to the calls starting after SetInteropMode returns.
+func SetInteropMode(on bool) {
+	updateSettings(func(s *settings) {
+		s.interop = on
+	})
+}
+
+// checkInterop checks b against the rules of interop mode.
+func checkInterop(b []byte) error {
+	if err := validateDagCBOR(b); err != nil {
+		return err
+	}
+	return encoding.TokenWalk(b, func(tok encoding.Token) error {
+		switch {
+		case tok.Major == encoding.MajUnsignedInt && tok.Value > math.MaxInt64,
+			tok.Major == encoding.MajNegativeInt && tok.Value > math.MaxInt64:
+			return fmt.Errorf("%w: at offset %d", ErrIntegerOutOfRange, tok.Offset)
+		case tok.IsFloat():
+			if f := tok.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("%w: NaN or infinite float at offset %d", ErrNotDagCBOR, tok.Offset)
+			}
+		}
+		return nil
+	})
+}
+
+func readInterop(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if err := checkInterop(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Fixture is an interoperability test vector.
+type Fixture struct {
+	Name string
+	// Data is the encoded object.
+	Data []byte
+	// Reject is set on data that decoders must refuse in interop mode. Other
+	// fixtures must decode and re-encode to exactly Data.
+	Reject bool
+}
+
+// Fixtures returns test vectors for the edge cases on which dag-cbor
+// implementations are known to diverge, modeled on the IPLD codec fixtures.
+// Downstream codecs can use them to check that they agree with this package.
+func Fixtures() []Fixture {
+	link := []byte{0xd8, 0x2a, 0x58, 0x25, 0x00, 0x01, 0x71, 0x12, 0x20}
+	link = append(link, make([]byte, 32)...)
+
+	return []Fixture{
+		{Name: "null", Data: []byte{0xf6}},
+		{Name: "true", Data: []byte{0xf5}},
+		{Name: "false", Data: []byte{0xf4}},
+		{Name: "int-zero", Data: []byte{0x00}},
+		{Name: "int-23", Data: []byte{0x17}},
+		{Name: "int-24", Data: []byte{0x18, 0x18}},
+		{Name: "int-max-int64", Data: []byte{0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{Name: "int-min-int64", Data: []byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{Name: "int-above-max-int64", Data: []byte{0x1b, 0x80, 0, 0, 0, 0, 0, 0, 0}, Reject: true},
+		{Name: "int-max-uint64", Data: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, Reject: true},
+		{Name: "int-below-min-int64", Data: []byte{0x3b, 0x80, 0, 0, 0, 0, 0, 0, 0}, Reject: true},
+		{Name: "int-min-negative-uint64", Data: []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, Reject: true},
+		{Name: "int-non-minimal", Data: []byte{0x18, 0x01}, Reject: true},
+		{Name: "float-zero", Data: []byte{0xfb, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{Name: "float-negative-zero", Data: []byte{0xfb, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{Name: "float-one-and-a-half", Data: []byte{0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{Name: "float-max", Data: []byte{0xfb, 0x7f, 0xef, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{Name: "float-32-bit", Data: []byte{0xfa, 0x3f, 0xc0, 0, 0}, Reject: true},
+		{Name: "float-nan", Data: []byte{0xfb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, Reject: true},
+		{Name: "float-infinity", Data: []byte{0xfb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, Reject: true},
+		{Name: "float-negative-infinity", Data: []byte{0xfb, 0xff, 0xf0, 0, 0, 0, 0, 0, 0}, Reject: true},
+		{Name: "string-empty", Data: []byte{0x60}},
+		{Name: "string-utf8", Data: []byte{0x63, 0xe2, 0x82, 0xac}},
+		{Name: "bytes-empty", Data: []byte{0x40}},
+		{Name: "array-nested", Data: []byte{0x82, 0x80, 0xa0}},
+		{Name: "array-indefinite", Data: []byte{0x9f, 0xff}, Reject: true},
+		{Name: "map-sorted-keys", Data: []byte{0xa2, 0x61, 'b', 0x01, 0x62, 'a', 'a', 0x02}},
+		{Name: "map-unsorted-keys", Data: []byte{0xa2, 0x62, 'a', 'a', 0x02, 0x61, 'b', 0x01}, Reject: true},
+		{Name: "map-duplicate-keys", Data: []byte{0xa2, 0x61, 'a', 0x01, 0x61, 'a', 0x02}, Reject: true},
+		{Name: "map-integer-key", Data: []byte{0xa1, 0x01, 0x01}, Reject: true},
+		{Name: "link", Data: link},
+		{Name: "undefined", Data: []byte{0xf7}, Reject: true},
+		{Name: "tag-1", Data: []byte{0xc1, 0x01}, Reject: true},
+	}
+}
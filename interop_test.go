@@ -0,0 +1,52 @@
+package cbornode
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestInteropFixtures(t *testing.T) {
+	SetInteropMode(true)
+	defer SetInteropMode(false)
+
+	for _, f := range Fixtures() {
+		t.Run(f.Name, func(t *testing.T) {
+			var v interface{}
+			err := DecodeInto(f.Data, &v)
+			if f.Reject {
+				if err == nil {
+					t.Fatalf("expected %x to be rejected, got %#v", f.Data, v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			nd, err := WrapObject(v, mh.SHA2_256, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(nd.RawData(), f.Data) {
+				t.Fatalf("expected %x to roundtrip, got %x", f.Data, nd.RawData())
+			}
+		})
+	}
+}
+
+func TestInteropEncode(t *testing.T) {
+	SetInteropMode(true)
+	defer SetInteropMode(false)
+
+	if _, err := WrapObject(math.NaN(), mh.SHA2_256, -1); err == nil {
+		t.Fatal("expected NaN to be refused")
+	}
+	if err := EncodeWriter(math.Inf(1), new(bytes.Buffer)); err == nil {
+		t.Fatal("expected infinity to be refused")
+	}
+	if _, err := WrapObject(math.Copysign(0, -1), mh.SHA2_256, -1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,284 @@
+package cbornode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// ErrIntegerOverflow is returned when decoding an integer into a Go value
+// that can't hold it, see SetIntegerOverflowMode.
+var ErrIntegerOverflow = errors.New("integer overflows its target type")
+
+// IntegerOverflowMode selects what happens when a decoded integer doesn't fit
+// the Go value it is decoded into.
+type IntegerOverflowMode int
+
+const (
+	// IntegerOverflowError refuses integers that don't fit their target
+	// with ErrIntegerOverflow: integers outside the range of a sized integer
+	// type, unsigned integers above math.MaxInt64 decoded into signed types,
+	// and integers decoded into floats that can't represent them exactly.
+	// This is the default.
+	IntegerOverflowError IntegerOverflowMode = iota
+	// IntegerOverflowWrap keeps the behavior of earlier versions, which
+	// silently truncated such integers.
+	IntegerOverflowWrap
+)
+
+// SetIntegerOverflowMode selects how DecodeInto, DecodeReader, DecodeBlock
+// and the other decoding entry points handle integers that don't fit their
+// target. The integers are checked as they are decoded, and only those that
+// may not fit the target type are compared with the values they were decoded
+// into. It applies to the default refmt decoder only: the experimental
+// fxamacker backend truncates such integers whatever the mode.
+//
+// Whatever the mode, unsigned integers above math.MaxInt64 decoded into an
+// interface{} are kept as uint64 instead of being wrapped to a negative int.
+//
+// A decoding running when the mode changes checks its integers with the mode
+// it started with.
+func SetIntegerOverflowMode(mode IntegerOverflowMode) {
+	updateSettings(func(s *settings) {
+		s.integerOverflow = mode
+	})
+}
+
+// intLimitKey keys the cache of intLimit results in a registry snapshot.
+type intLimitKey struct {
+	t      reflect.Type
+	strict bool
+}
+
+// intLimit returns the largest CBOR integer argument that fits all the
+// integers and floats a value of type t may hold, so that only the integers
+// above it, as reported by the watching decoders, need checking. Values
+// decoded into an interface{} are checked above math.MaxInt64, to be kept as
+// uint64; other values are only checked when strict.
+func (cs *codecs) intLimit(t reflect.Type, strict bool) uint64 {
+	key := intLimitKey{t, strict}
+	if l, ok := cs.intLimits.Load(key); ok {
+		return l.(uint64)
+	}
+	l := cs.typeIntLimit(t, strict, make(map[reflect.Type]bool))
+	cs.intLimits.Store(key, l)
+	return l
+}
+
+func (cs *codecs) typeIntLimit(t reflect.Type, strict bool, seen map[reflect.Type]bool) uint64 {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if seen[t] || cs.intOpaque(t) {
+		return encoding.NoIntLimit
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return math.MaxInt64
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return cs.typeIntLimit(t.Elem(), strict, seen)
+	case reflect.Struct:
+		entry, ok := cs.atlas.Get(reflect.ValueOf(t).Pointer())
+		if !ok {
+			return encoding.NoIntLimit
+		}
+		limit := encoding.NoIntLimit
+		for _, f := range entry.StructMap.Fields {
+			if !f.Ignore {
+				limit = min(limit, cs.typeIntLimit(f.Type, strict, seen))
+			}
+		}
+		return limit
+	}
+	if !strict {
+		return encoding.NoIntLimit
+	}
+	switch t.Kind() {
+	case reflect.Int8:
+		return math.MaxInt8
+	case reflect.Int16:
+		return math.MaxInt16
+	case reflect.Int32:
+		return math.MaxInt32
+	case reflect.Int, reflect.Int64:
+		return math.MaxInt64
+	case reflect.Uint8:
+		return math.MaxUint8
+	case reflect.Uint16:
+		return math.MaxUint16
+	case reflect.Uint32:
+		return math.MaxUint32
+	case reflect.Float32:
+		return 1 << 24
+	case reflect.Float64:
+		return 1 << 53
+	}
+	return encoding.NoIntLimit
+}
+
+// intCheckLimit returns the limit to watch integers above when decoding into
+// obj, or encoding.NoIntLimit when none needs checking.
+func (cs *codecs) intCheckLimit(obj interface{}) uint64 {
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return encoding.NoIntLimit
+	}
+	return cs.intLimit(rv.Type().Elem(), cs.integerOverflow == IntegerOverflowError)
+}
+
+// checkIntegers compares the integers reported by a watching decoder with
+// the values they were decoded into in obj, fixing up large unsigned integers
+// decoded into interfaces and, in IntegerOverflowError mode, refusing those
+// that were truncated.
+func (cs *codecs) checkIntegers(obj interface{}, wide []encoding.WideInt) error {
+	strict := cs.integerOverflow == IntegerOverflowError
+	rv := reflect.ValueOf(obj)
+	for _, w := range wide {
+		pv, v, seg := reflect.Value{}, rv, reflect.Value{}
+		for _, s := range w.Path {
+			if s == nil {
+				v = reflect.Value{}
+				break
+			}
+			pv, seg = v, reflect.ValueOf(s)
+			v = cs.intChild(v, seg)
+			if !v.IsValid() {
+				break
+			}
+		}
+		if !v.IsValid() {
+			continue
+		}
+		if err := cs.checkLeaf(w, pv, seg, v, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLeaf checks the integer w against v, the value it was decoded into
+// at seg in the container pv.
+func (cs *codecs) checkLeaf(w encoding.WideInt, pv, seg, v reflect.Value, strict bool) error {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if cs.intOpaque(v.Type()) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if w.Neg || w.Value <= math.MaxInt64 || v.IsNil() || v.Elem().Kind() != reflect.Int {
+			return nil
+		}
+		fixed := reflect.ValueOf(w.Value)
+		if v.CanSet() {
+			v.Set(fixed)
+		} else if pv = intDeref(pv); pv.Kind() == reflect.Map {
+			pv.SetMapIndex(seg.Convert(pv.Type().Key()), fixed)
+		}
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if w.Neg {
+			if w.Value <= math.MaxInt64 && v.Int() == -1-int64(w.Value) {
+				return nil
+			}
+		} else if w.Value <= math.MaxInt64 && v.Int() == int64(w.Value) {
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if w.Neg || v.Uint() == w.Value {
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if w.Neg {
+			if f >= math.MinInt64 && f < math.MaxInt64 && w.Value <= math.MaxInt64 && int64(f) == -1-int64(w.Value) {
+				return nil
+			}
+		} else if f >= 0 && f < math.MaxUint64 && uint64(f) == w.Value {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if !strict {
+		return nil
+	}
+	n := fmt.Sprint(w.Value)
+	if w.Neg {
+		n = "-" + new(big.Int).Add(new(big.Int).SetUint64(w.Value), big.NewInt(1)).String()
+	}
+	return fmt.Errorf("%w: %s into %s at %s", ErrIntegerOverflow, n, v.Type(), intPath(w.Path))
+}
+
+// intPath formats the path of an integer for errors.
+func intPath(path []interface{}) string {
+	if len(path) == 0 {
+		return "/"
+	}
+	var b strings.Builder
+	for _, s := range path {
+		fmt.Fprintf(&b, "/%v", s)
+	}
+	return b.String()
+}
+
+// intChild returns the value decoded from the element at seg of the
+// container decoded into v, or an invalid value if it can't be found, for
+// example because v's type has a transform.
+func (cs *codecs) intChild(v, seg reflect.Value) reflect.Value {
+	v = intDeref(v)
+	if !v.IsValid() {
+		return reflect.Value{}
+	}
+	if cs.intOpaque(v.Type()) {
+		return reflect.Value{}
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if seg.Kind() != reflect.String || v.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}
+		}
+		return v.MapIndex(seg.Convert(v.Type().Key()))
+	case reflect.Slice, reflect.Array:
+		if seg.Kind() != reflect.Int || int(seg.Int()) >= v.Len() {
+			return reflect.Value{}
+		}
+		return v.Index(int(seg.Int()))
+	case reflect.Struct:
+		entry, ok := cs.atlas.Get(reflect.ValueOf(v.Type()).Pointer())
+		if !ok || seg.Kind() != reflect.String {
+			return reflect.Value{}
+		}
+		for _, f := range entry.StructMap.Fields {
+			if !f.Ignore && f.SerialName == seg.String() {
+				return f.ReflectRoute.TraverseToValue(v)
+			}
+		}
+	}
+	return reflect.Value{}
+}
+
+// intOpaque tells whether values of type t are decoded through a transform or
+// union, so their shape doesn't follow the encoded data.
+func (cs *codecs) intOpaque(t reflect.Type) bool {
+	entry, ok := cs.atlas.Get(reflect.ValueOf(t).Pointer())
+	return ok && entry.StructMap == nil
+}
+
+// intDeref follows v through pointers and interfaces.
+func intDeref(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
@@ -0,0 +1,232 @@
+package cbornode
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrInvalidJSONL is returned by ImportJSONL for input that isn't a JSON
+// Lines export as written by ExportJSONL.
+var ErrInvalidJSONL = errors.New("invalid json lines export")
+
+// jsonlLine is a line of a JSON Lines export.
+type jsonlLine struct {
+	Cid  string          `json:"cid"`
+	Data json.RawMessage `json:"data"`
+}
+
+// ExportJSONL writes the DAG rooted at root to w as JSON Lines: one object
+// per block, {"cid": "<cid>", "data": <body>}, in the order WalkGraph visits
+// them, so the root comes first. Bodies are written as dag-json: links are
+// {"/": "<cid>"}, byte strings {"/": {"bytes": "<base64>"}} and floats
+// always carry a fraction or an exponent, so that ImportJSONL rebuilds the
+// exact blocks. The output is meant for debugging and data pipelines; it is
+// easily consumed by tools such as jq.
+func ExportJSONL(ctx context.Context, store IpldStore, root cid.Cid, w io.Writer) error {
+	var buf []byte
+	return WalkGraph(ctx, store, root, func(c cid.Cid, n *Node) error {
+		buf = append(buf[:0], `{"cid":`...)
+		buf = appendCanonicalString(buf, c.String())
+		buf = append(buf, `,"data":`...)
+		var err error
+		if buf, err = appendDagJSON(buf, n.obj); err != nil {
+			return fmt.Errorf("block %s: %w", c, err)
+		}
+		buf = append(buf, "}\n"...)
+		_, err = w.Write(buf)
+		return err
+	})
+}
+
+// ImportJSONL reads a JSON Lines export written by ExportJSONL from r and
+// puts every block into store, re-encoding the bodies with the hash function
+// of their CIDs. It fails with ErrHashMismatch if a body doesn't encode to
+// the block of its CID. It returns the CID of the first line, the root of the
+// exported DAG.
+func ImportJSONL(ctx context.Context, store IpldStore, r io.Reader) (cid.Cid, error) {
+	root := cid.Undef
+	dec := json.NewDecoder(r)
+	for {
+		var line jsonlLine
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, fmt.Errorf("%w: %s", ErrInvalidJSONL, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return cid.Undef, err
+		}
+
+		c, err := cid.Decode(line.Cid)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("%w: cid %q: %s", ErrInvalidJSONL, line.Cid, err)
+		}
+		if c.Type() != cid.DagCBOR {
+			return cid.Undef, fmt.Errorf("%w: %s is not a dag-cbor block", ErrInvalidJSONL, c)
+		}
+		obj, err := decodeDagJSON(line.Data)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("%w: block %s: %s", ErrInvalidJSONL, c, err)
+		}
+		pref := c.Prefix()
+		nd, err := WrapObject(obj, pref.MhType, pref.MhLength)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if !nd.Cid().Equals(c) {
+			return cid.Undef, fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, c, nd.Cid())
+		}
+		if _, err := store.Put(ctx, &rawObject{data: nd.RawData(), cid: c}); err != nil {
+			return cid.Undef, err
+		}
+		if !root.Defined() {
+			root = c
+		}
+	}
+	if !root.Defined() {
+		return cid.Undef, fmt.Errorf("%w: no blocks", ErrInvalidJSONL)
+	}
+	return root, nil
+}
+
+// appendDagJSON appends the dag-json form of the decoded value v to buf.
+// Unlike appendCanonicalJSON, floats with an integral value keep a ".0" so
+// that they decode back as floats.
+func appendDagJSON(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("cannot encode %v as JSON", v)
+		}
+		b := strconv.AppendFloat(nil, v, 'g', -1, 64)
+		if !bytes.ContainsAny(b, ".eE") {
+			b = append(b, ".0"...)
+		}
+		return append(buf, b...), nil
+	case []interface{}:
+		buf = append(buf, '[')
+		for i, e := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendDagJSON(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case map[string]interface{}:
+		return appendDagJSONMap(buf, v)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, ErrInvalidKeys
+			}
+			m[ks] = e
+		}
+		return appendDagJSONMap(buf, m)
+	default:
+		return appendCanonicalJSON(buf, v)
+	}
+}
+
+func appendDagJSONMap(buf []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = append(buf, '{')
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendCanonicalString(buf, k)
+		buf = append(buf, ':')
+		var err error
+		if buf, err = appendDagJSON(buf, m[k]); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+// decodeDagJSON decodes a dag-json body as written by appendDagJSON into the
+// values decoding the matching block into an interface{} gives.
+func decodeDagJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fromDagJSON(v)
+}
+
+func fromDagJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return dagJSONNumber(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			obj, err := fromDagJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = obj
+		}
+		return out, nil
+	case map[string]interface{}:
+		if slash, ok := v["/"]; ok && len(v) == 1 {
+			switch slash := slash.(type) {
+			case string:
+				return cid.Decode(slash)
+			case map[string]interface{}:
+				if s, ok := slash["bytes"].(string); ok && len(slash) == 1 {
+					return base64.RawStdEncoding.DecodeString(s)
+				}
+			}
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			obj, err := fromDagJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = obj
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// dagJSONNumber converts n to an integer if it is written as one, and to a
+// float64 otherwise.
+func dagJSONNumber(n json.Number) (interface{}, error) {
+	s := n.String()
+	if strings.ContainsAny(s, ".eE") {
+		return n.Float64()
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return u, nil
+	}
+	return nil, fmt.Errorf("integer %s overflows 64 bits", s)
+}
@@ -0,0 +1,268 @@
+package cbornode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// jsonFlushSize is the amount of output TranscodeJSON buffers before writing
+// it out.
+const jsonFlushSize = 32 << 10
+
+// TranscodeJSON converts the JSON document read from r to dag-cbor written to
+// w, producing the same bytes as the Node built by FromJSON, including
+// {"/": "<cid>"} links, without decoding the document into Go values.
+//
+// Output is written as the document is read. dag-cbor needs the length of
+// every array and map before their items and map entries sorted by key, so
+// each container is read once to count or sort its items and once more to
+// convert them, which is why r must allow reading at any offset, as files
+// do. Memory use is bounded by the nesting depth and the direct entries of
+// the largest map rather than by the size of the document, while time grows
+// with the size times the depth. Pipe the output into IngestCBOR to store the
+// result.
+func TranscodeJSON(w io.Writer, r io.ReaderAt) error {
+	t := &jsonTranscoder{r: r, w: w}
+	dec := t.decoderAt(0)
+	tok, err := dec.Token()
+	if err != nil {
+		return noEOF(err)
+	}
+	if _, ok := tok.(json.Delim); ok {
+		err = t.container(dec.InputOffset()-1, 0)
+	} else {
+		err = t.scalar(tok)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.out.WriteTo(w)
+	return err
+}
+
+type jsonTranscoder struct {
+	r   io.ReaderAt
+	w   io.Writer
+	out bytes.Buffer
+}
+
+// decoderAt returns a decoder reading the document from off, independently of
+// the other decoders.
+func (t *jsonTranscoder) decoderAt(off int64) *json.Decoder {
+	return json.NewDecoder(io.NewSectionReader(t.r, off, math.MaxInt64-off))
+}
+
+// flush writes out the buffered output once there is enough of it.
+func (t *jsonTranscoder) flush() error {
+	if t.out.Len() < jsonFlushSize {
+		return nil
+	}
+	_, err := t.out.WriteTo(t.w)
+	return err
+}
+
+// value converts the value starting with tok, read by dec from base. Nested
+// containers are skipped in dec and converted with decoders of their own.
+func (t *jsonTranscoder) value(dec *json.Decoder, base int64, tok json.Token, depth int) error {
+	if _, ok := tok.(json.Delim); !ok {
+		if err := t.scalar(tok); err != nil {
+			return err
+		}
+		return t.flush()
+	}
+	off := base + dec.InputOffset() - 1
+	if err := skipJSON(dec, depth); err != nil {
+		return err
+	}
+	return t.container(off, depth)
+}
+
+// container converts the array or map starting at off.
+func (t *jsonTranscoder) container(off int64, depth int) error {
+	if depth > maxStreamDepth {
+		return encoding.ErrMaxDepth
+	}
+	dec := t.decoderAt(off)
+	tok, err := dec.Token()
+	if err != nil {
+		return noEOF(err)
+	}
+	if tok == json.Delim('{') {
+		return t.jsonMap(dec, off, depth)
+	}
+
+	var n uint64
+	count := t.decoderAt(off)
+	if _, err := count.Token(); err != nil {
+		return noEOF(err)
+	}
+	for count.More() {
+		if err := skipJSONValue(count, depth+1); err != nil {
+			return err
+		}
+		n++
+	}
+	writeCanonHeader(&t.out, encoding.MajArray, n)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return noEOF(err)
+		}
+		if err := t.value(dec, off, tok, depth+1); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return noEOF(err)
+}
+
+// jsonEntry is a map entry: a scalar value, or the offset of a container.
+type jsonEntry struct {
+	key    string
+	scalar json.Token
+	nested bool
+	off    int64
+}
+
+// jsonMap converts the map read by dec from off, whose opening brace has
+// been read.
+func (t *jsonTranscoder) jsonMap(dec *json.Decoder, off int64, depth int) error {
+	var entries []jsonEntry
+	// As when decoding JSON into a map, the last of repeated keys wins.
+	index := make(map[string]int)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return noEOF(err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected JSON map key %v", tok)
+		}
+		if tok, err = dec.Token(); err != nil {
+			return noEOF(err)
+		}
+		e := jsonEntry{key: key, scalar: tok}
+		if _, ok := tok.(json.Delim); ok {
+			e = jsonEntry{key: key, nested: true, off: off + dec.InputOffset() - 1}
+			if err := skipJSON(dec, depth+1); err != nil {
+				return err
+			}
+		}
+		if i, ok := index[key]; ok {
+			entries[i] = e
+		} else {
+			index[key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return noEOF(err)
+	}
+
+	if len(entries) == 1 && entries[0].key == "/" {
+		s, ok := entries[0].scalar.(string)
+		if !ok {
+			return ErrNonStringLink
+		}
+		c, err := cid.Decode(s)
+		if err != nil {
+			return err
+		}
+		lnk, err := castCidToBytes(c)
+		if err != nil {
+			return err
+		}
+		writeCanonHeader(&t.out, encoding.MajTag, CBORTagLink)
+		writeCanonHeader(&t.out, encoding.MajByteString, uint64(len(lnk)))
+		t.out.Write(lnk)
+		return t.flush()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return canonicalKeyLess([]byte(entries[i].key), []byte(entries[j].key))
+	})
+	writeCanonHeader(&t.out, encoding.MajMap, uint64(len(entries)))
+	for _, e := range entries {
+		writeCanonHeader(&t.out, encoding.MajTextString, uint64(len(e.key)))
+		t.out.WriteString(e.key)
+		var err error
+		if e.nested {
+			err = t.container(e.off, depth+1)
+		} else if err = t.scalar(e.scalar); err == nil {
+			err = t.flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scalar converts a JSON token that isn't a delimiter.
+func (t *jsonTranscoder) scalar(tok json.Token) error {
+	switch tok := tok.(type) {
+	case string:
+		writeCanonHeader(&t.out, encoding.MajTextString, uint64(len(tok)))
+		t.out.WriteString(tok)
+	case float64:
+		t.out.WriteByte(0xfb)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(tok))
+		t.out.Write(b[:])
+	case bool:
+		if tok {
+			t.out.WriteByte(0xf5)
+		} else {
+			t.out.WriteByte(0xf4)
+		}
+	case nil:
+		t.out.WriteByte(0xf6)
+	default:
+		return fmt.Errorf("unexpected JSON token %v", tok)
+	}
+	return nil
+}
+
+// skipJSONValue reads past the next value of dec.
+func skipJSONValue(dec *json.Decoder, depth int) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return noEOF(err)
+	}
+	if _, ok := tok.(json.Delim); !ok {
+		return nil
+	}
+	return skipJSON(dec, depth)
+}
+
+// skipJSON reads past the end of the container whose opening delimiter dec
+// just read.
+func skipJSON(dec *json.Decoder, depth int) error {
+	open := 1
+	for open > 0 {
+		if depth+open > maxStreamDepth {
+			return encoding.ErrMaxDepth
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return noEOF(err)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			open++
+		case json.Delim('}'), json.Delim(']'):
+			open--
+		}
+	}
+	return nil
+}
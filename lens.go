@@ -0,0 +1,143 @@
+package cbornode
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	node "github.com/ipfs/go-ipld-format"
+)
+
+// Lens lets advanced data layouts, such as sharded maps and arrays, take over
+// path resolution and graph walking for the nodes they recognize, so that
+// callers see the logical structure rather than the internal buckets.
+type Lens interface {
+	// Match reports whether the lens handles n.
+	Match(n *Node) bool
+	// Resolve resolves path inside the structure rooted at n. Like
+	// Node.Resolve, it returns the value found, which may be a *node.Link to
+	// continue resolving from, and the part of path left unresolved.
+	Resolve(ctx context.Context, store IpldStore, n *Node, path []string) (interface{}, []string, error)
+	// Links returns the logical links of the structure rooted at n.
+	Links(ctx context.Context, store IpldStore, n *Node) ([]cid.Cid, error)
+}
+
+// RegisterLens registers a lens consulted by ResolvePath and WalkGraph. Lenses
+// are tried in registration order.
+//
+// Walks and resolutions already running keep to the lenses registered when
+// they started.
+func RegisterLens(l Lens) {
+	updateSettings(func(s *settings) {
+		s.lenses = append(s.lenses[:len(s.lenses):len(s.lenses)], l)
+	})
+}
+
+func lensFor(n *Node) Lens {
+	for _, l := range snapshot().lenses {
+		if l.Match(n) {
+			return l
+		}
+	}
+	return nil
+}
+
+// ResolvePath resolves path starting at the node root, loading and following
+// links through store as needed. Registered lenses take over resolution for
+// the nodes they match.
+//
+// It returns the value at the end of the path, which is a *node.Link if the
+// path ends on a link.
+func ResolvePath(ctx context.Context, store IpldStore, root cid.Cid, path []string) (interface{}, error) {
+	cur := root
+	for {
+		nd, err := GetNode(ctx, store, cur)
+		if err != nil {
+			return nil, err
+		}
+
+		var val interface{}
+		var rest []string
+		if l := lensFor(nd); l != nil {
+			val, rest, err = l.Resolve(ctx, store, nd, path)
+		} else {
+			val, rest, err = nd.Resolve(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lnk, ok := val.(*node.Link)
+		if !ok || len(rest) == 0 {
+			return val, nil
+		}
+		cur, path = lnk.Cid, rest
+	}
+}
+
+// WalkGraph walks the DAG rooted at root depth-first, calling visit once for
+// every dag-cbor node reachable from it. Registered lenses provide the links
+// of the nodes they match; links to blocks of other codecs are not followed.
+func WalkGraph(ctx context.Context, store IpldStore, root cid.Cid, visit func(c cid.Cid, n *Node) error) error {
+	seen := cid.NewSet()
+	// As in CollectBlocks, links are pushed in reverse on an explicit stack.
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if c.Type() != cid.DagCBOR || !seen.Visit(c) {
+			continue
+		}
+		nd, err := GetNode(ctx, store, c)
+		if err != nil {
+			return err
+		}
+		if err := visit(c, nd); err != nil {
+			return err
+		}
+
+		var links []cid.Cid
+		if l := lensFor(nd); l != nil {
+			links, err = l.Links(ctx, store, nd)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, lnk := range nd.LinksUnsafe() {
+				links = append(links, lnk.Cid)
+			}
+		}
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, links[i])
+		}
+	}
+	return nil
+}
+
+// GetNode loads the node c from store. It works with any IpldStore that
+// honors cbg.CBORUnmarshaler outputs, as BasicIpldStore does.
+func GetNode(ctx context.Context, store IpldStore, c cid.Cid) (*Node, error) {
+	var raw rawCapture
+	if err := store.Get(ctx, c, &raw); err != nil {
+		return nil, err
+	}
+	blk, err := blocks.NewBlockWithCid(raw, c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(blk)
+}
+
+// rawCapture captures the raw bytes of an object read from a store.
+type rawCapture []byte
+
+func (r *rawCapture) UnmarshalCBOR(rd io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rd); err != nil {
+		return err
+	}
+	*r = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,124 @@
+package cbornode
+
+import (
+	"bytes"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// SetLenientLinks makes decoding accept links encoded as bare CID bytes under
+// tag 42, without the leading 0x00 identity multibase prefix, as written by
+// some non-conforming encoders. Links are always encoded with the prefix, so
+// re-encoding decoded objects normalizes them. Strict dag-cbor checks, such
+// as IngestCBOR, still refuse such links.
+//
+// Links are checked when decoded, so a decoding running when the mode changes
+// may check some of its links in either mode.
+func SetLenientLinks(on bool) {
+	updateSettings(func(s *settings) {
+		s.lenientLinks = on
+	})
+}
+
+// SetStringLinks makes decoding into untyped values, as DecodeBlock, Decode,
+// and DecodeInto or DecodeReader with an interface{} target do, turn maps holding a single
+// "/" key with a CID string value, such as {"/": "Qm..."}, into links. Some
+// historical encoders wrote links this way instead of using tag 42; with this
+// mode their data can be traversed with Links, Resolve and WalkGraph. See
+// DecodeOptions.StringLinks for typed targets.
+//
+// It takes effect for the decodings that start after it returns.
+func SetStringLinks(on bool) {
+	updateSettings(func(s *settings) {
+		s.stringLinks = on
+	})
+}
+
+// stringLink returns the link m stands for if it is a string encoded link.
+func stringLink(m map[string]interface{}) (cid.Cid, bool) {
+	if len(m) != 1 {
+		return cid.Undef, false
+	}
+	s, ok := m["/"].(string)
+	if !ok {
+		return cid.Undef, false
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return c, true
+}
+
+// normalizeStringLinks replaces the string encoded links in the untyped value
+// v, in place, and returns the result.
+func normalizeStringLinks(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if c, ok := stringLink(v); ok {
+			return c
+		}
+		for k, e := range v {
+			v[k] = normalizeStringLinks(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeStringLinks(e)
+		}
+	}
+	return v
+}
+
+// ExtractLinks returns the CIDs of all the links (tag 42 items) contained in
+// the CBOR encoded object b, in encoding order, without decoding the rest of
+// the object.
+func ExtractLinks(b []byte) ([]cid.Cid, error) {
+	var links []cid.Cid
+	inLink := false
+	err := encoding.TokenWalk(b, func(tok encoding.Token) error {
+		if inLink {
+			inLink = false
+			if tok.Major != encoding.MajByteString || tok.Indefinite {
+				return ErrInvalidLink
+			}
+			c, err := castBytesToCid(tok.Bytes)
+			if err != nil {
+				return err
+			}
+			links = append(links, c)
+			return nil
+		}
+		if tok.Major == encoding.MajTag && tok.Value == CBORTagLink {
+			inLink = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// LinksOf returns the CIDs of all the links of v, in encoding order, as they
+// would be after storing v. v may be a value decoded into an interface{}, a
+// value of a registered type or a cbg.CBORMarshaler, which allows computing
+// the links of an object before writing it.
+func LinksOf(v interface{}) ([]cid.Cid, error) {
+	var b []byte
+	if cm, ok := v.(cbg.CBORMarshaler); ok {
+		buf := new(bytes.Buffer)
+		if err := cm.MarshalCBOR(buf); err != nil {
+			return nil, NewSerializationError(err)
+		}
+		b = buf.Bytes()
+	} else {
+		var err error
+		if b, err = marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	return ExtractLinks(b)
+}
@@ -0,0 +1,144 @@
+package cbornode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrInvalidChunk is returned when iterating over a linked list whose chunks
+// don't have the layout described in NewLinkedListIterator.
+var ErrInvalidChunk = errors.New("invalid linked list chunk")
+
+// LinkedListIterator iterates over the items of a list stored as a chain of
+// linked chunks, see NewLinkedListIterator.
+type LinkedListIterator struct {
+	ctx   context.Context
+	store IpldStore
+
+	next  *cid.Cid
+	items []interface{}
+	pos   int
+	seen  *cid.Set
+	err   error
+}
+
+// NewLinkedListIterator returns an iterator over the list whose first chunk
+// is root. Each chunk is a map holding the next items of the list under
+// "items", and a link to the following chunk under "next", which is absent or
+// null in the last chunk; PutLinkedList writes lists in this layout.
+//
+// Only the current chunk is held in memory, and the next one is loaded when
+// the current one is exhausted, so the iterator can scan lists of any
+// length:
+//
+//	it := NewLinkedListIterator(ctx, store, root)
+//	for it.Next() {
+//		use(it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func NewLinkedListIterator(ctx context.Context, store IpldStore, root cid.Cid) *LinkedListIterator {
+	return &LinkedListIterator{
+		ctx:   ctx,
+		store: store,
+		next:  &root,
+		pos:   -1,
+		seen:  cid.NewSet(),
+	}
+}
+
+// Next advances to the next item, loading chunks as needed. It returns false
+// at the end of the list or on error, which Err then reports.
+func (it *LinkedListIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.pos++
+	for it.pos >= len(it.items) {
+		if it.next == nil {
+			it.items = nil
+			return false
+		}
+		if err := it.load(*it.next); err != nil {
+			it.err = err
+			it.items = nil
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the current item, as decoded into an interface{}.
+func (it *LinkedListIterator) Value() interface{} {
+	if it.pos < 0 || it.pos >= len(it.items) {
+		return nil
+	}
+	return it.items[it.pos]
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *LinkedListIterator) Err() error {
+	return it.err
+}
+
+func (it *LinkedListIterator) load(c cid.Cid) error {
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+	if !it.seen.Visit(c) {
+		return fmt.Errorf("%w: chunk %s links back to an earlier chunk", ErrInvalidChunk, c)
+	}
+	var chunk map[string]interface{}
+	if err := it.store.Get(it.ctx, c, &chunk); err != nil {
+		return err
+	}
+
+	items, ok := chunk["items"].([]interface{})
+	if !ok && chunk["items"] != nil {
+		return fmt.Errorf("%w: items of %s are not a list", ErrInvalidChunk, c)
+	}
+	it.items, it.pos, it.next = items, 0, nil
+	switch next := chunk["next"].(type) {
+	case nil:
+	case cid.Cid:
+		it.next = &next
+	default:
+		return fmt.Errorf("%w: next of %s is not a link", ErrInvalidChunk, c)
+	}
+	return nil
+}
+
+// PutLinkedList writes items to store as a chain of chunks of at most
+// chunkSize items, in the layout NewLinkedListIterator reads, and returns
+// the CID of the first chunk. An empty list is a single empty chunk.
+func PutLinkedList(ctx context.Context, store IpldStore, items []interface{}, chunkSize int) (cid.Cid, error) {
+	if chunkSize < 1 {
+		return cid.Undef, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	// Chunks link forward, so write them from the last one.
+	var next *cid.Cid
+	last := (len(items) - 1) / chunkSize * chunkSize
+	if last < 0 {
+		last = 0
+	}
+	for start := last; start >= 0; start -= chunkSize {
+		end := start + chunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		chunk := map[string]interface{}{"items": items[start:end]}
+		if next != nil {
+			chunk["next"] = *next
+		}
+		c, err := store.Put(ctx, chunk)
+		if err != nil {
+			return cid.Undef, err
+		}
+		next = &c
+	}
+	return *next, nil
+}
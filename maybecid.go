@@ -0,0 +1,21 @@
+package cbornode
+
+import (
+	cid "github.com/ipfs/go-cid"
+)
+
+// MaybeCid is an optional link, the supported way to express optional links
+// in struct fields. A nil MaybeCid encodes as null and a non-nil one as a
+// link; decoding null yields nil.
+//
+// It is an alias, so it needs no registration and any *cid.Cid field behaves
+// the same.
+type MaybeCid = *cid.Cid
+
+// SomeCid returns a MaybeCid holding c, or nil if c is undefined.
+func SomeCid(c cid.Cid) MaybeCid {
+	if !c.Defined() {
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,156 @@
+package cbornode
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrInvalidCar is returned by MemCborStore.Load for input that isn't a
+// valid CARv1 file.
+var ErrInvalidCar = errors.New("invalid car file")
+
+// maxCarSection bounds the size of a block read by MemCborStore.Load.
+const maxCarSection = 8 << 20
+
+// MemCborStore is the in-memory IpldStore returned by
+// NewDumpableMemCborStore. Its content can be saved with Dump and restored
+// with Load, so that fixture DAGs can be checked into testdata instead of
+// being rebuilt by every test.
+type MemCborStore struct {
+	*BasicIpldStore
+	blocks *mockBlocks
+}
+
+func (s *MemCborStore) basic() *BasicIpldStore {
+	return s.BasicIpldStore
+}
+
+// Dump writes every block of the store to w as a CARv1 file listing roots in
+// its header. Blocks are sorted by CID, so the same content always gives the
+// same file. Some readers, such as go-car's NewCarReader before v0.6.0,
+// refuse files without roots.
+func (s *MemCborStore) Dump(w io.Writer, roots ...cid.Cid) error {
+	if roots == nil {
+		roots = []cid.Cid{}
+	}
+	header, err := Encode(map[string]interface{}{
+		"roots":   roots,
+		"version": 1,
+	})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeCarSection(bw, header); err != nil {
+		return err
+	}
+
+	keys := make([]cid.Cid, 0, len(s.blocks.data))
+	for c := range s.blocks.data {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cidLess(keys[i], keys[j])
+	})
+	for _, c := range keys {
+		if err := writeCarSection(bw, c.Bytes(), s.blocks.data[c].RawData()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeCarSection(w *bufio.Writer, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(n))]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load adds the blocks of the CARv1 file read from r, such as one written by
+// Dump, to the store. It checks that every block matches its CID; roots are
+// ignored.
+func (s *MemCborStore) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := readCarSection(br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	var h map[string]interface{}
+	if err := DecodeInto(header, &h); err != nil {
+		return fmt.Errorf("%w: header: %s", ErrInvalidCar, err)
+	}
+	if h["version"] != 1 {
+		return fmt.Errorf("%w: unsupported version %v", ErrInvalidCar, h["version"])
+	}
+
+	for {
+		section, err := readCarSection(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidCar, err)
+		}
+		data := section[n:]
+		actual, err := c.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+		if !actual.Equals(c) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, c, actual)
+		}
+		blk, err := block.NewBlockWithCid(data, c)
+		if err != nil {
+			return err
+		}
+		if err := s.blocks.Put(context.Background(), blk); err != nil {
+			return err
+		}
+	}
+}
+
+// readCarSection returns the next length prefixed section of r, or io.EOF
+// if there is none.
+func readCarSection(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCar, err)
+	}
+	if n == 0 || n > maxCarSection {
+		return nil, fmt.Errorf("%w: section of %d bytes", ErrInvalidCar, n)
+	}
+	section := make([]byte, n)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCar, err)
+	}
+	return section, nil
+}
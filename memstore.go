@@ -0,0 +1,115 @@
+package cbornode
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// NewShardedMemCborStore returns an IpldStore backed by an in-memory
+// blockstore split in shards, each with its own lock, so that concurrent Get
+// and Put calls rarely contend. It is meant for load tests and benchmarks of
+// data structures built on this package; a value of shards below 1 selects
+// 64.
+func NewShardedMemCborStore(shards int) IpldStore {
+	return NewCborStore(newShardedBlocks(shards))
+}
+
+type shardedBlocks struct {
+	shards []memShard
+}
+
+type memShard struct {
+	lk       sync.RWMutex
+	data     map[cid.Cid]block.Block
+	sidecars map[cid.Cid][]byte
+}
+
+var (
+	_ IpldBlockstoreViewer  = (*shardedBlocks)(nil)
+	_ IpldBlockstoreHas     = (*shardedBlocks)(nil)
+	_ IpldBlockstoreSidecar = (*shardedBlocks)(nil)
+)
+
+func newShardedBlocks(shards int) *shardedBlocks {
+	if shards < 1 {
+		shards = 64
+	}
+	sb := &shardedBlocks{shards: make([]memShard, shards)}
+	for i := range sb.shards {
+		sb.shards[i].data = make(map[cid.Cid]block.Block)
+		sb.shards[i].sidecars = make(map[cid.Cid][]byte)
+	}
+	return sb
+}
+
+// shard picks the shard of c from the end of its multihash digest, which is
+// uniformly distributed for cryptographic hashes.
+func (sb *shardedBlocks) shard(c cid.Cid) *memShard {
+	h := c.Hash()
+	start := len(h) - 4
+	if start < 0 {
+		start = 0
+	}
+	var n uint32
+	for _, b := range h[start:] {
+		n = n<<8 | uint32(b)
+	}
+	return &sb.shards[n%uint32(len(sb.shards))]
+}
+
+func (sb *shardedBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	s := sb.shard(c)
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	d, ok := s.data[c]
+	if ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("not found %s", c)
+}
+
+func (sb *shardedBlocks) View(c cid.Cid, cb func([]byte) error) error {
+	s := sb.shard(c)
+	s.lk.RLock()
+	d, ok := s.data[c]
+	s.lk.RUnlock()
+	if !ok {
+		return fmt.Errorf("not found %s", c)
+	}
+	return cb(d.RawData())
+}
+
+func (sb *shardedBlocks) Put(ctx context.Context, b block.Block) error {
+	s := sb.shard(b.Cid())
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.data[b.Cid()] = b
+	return nil
+}
+
+func (sb *shardedBlocks) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	s := sb.shard(c)
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	_, ok := s.data[c]
+	return ok, nil
+}
+
+func (sb *shardedBlocks) PutSidecar(ctx context.Context, c cid.Cid, data []byte) error {
+	s := sb.shard(c)
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.sidecars[c] = append([]byte(nil), data...)
+	return nil
+}
+
+func (sb *shardedBlocks) GetSidecar(ctx context.Context, c cid.Cid) ([]byte, error) {
+	s := sb.shard(c)
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return s.sidecars[c], nil
+}
@@ -0,0 +1,59 @@
+package cbornode
+
+import (
+	"context"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// GetFunc has the signature of IpldStore.Get.
+type GetFunc func(ctx context.Context, c cid.Cid, out interface{}) error
+
+// PutFunc has the signature of IpldStore.Put.
+type PutFunc func(ctx context.Context, v interface{}) (cid.Cid, error)
+
+// StoreMiddleware intercepts the calls made to a store built by WrapStore.
+// Each function is given the next step of the chain, which it may call,
+// possibly with different arguments, or skip. A nil function passes calls
+// through unchanged.
+type StoreMiddleware struct {
+	Get func(ctx context.Context, c cid.Cid, out interface{}, next GetFunc) error
+	Put func(ctx context.Context, v interface{}, next PutFunc) (cid.Cid, error)
+}
+
+// WrapStore returns an IpldStore passing every call through middlewares
+// before reaching inner. The first middleware is the outermost one: it sees
+// calls first and results last.
+func WrapStore(inner IpldStore, middlewares ...StoreMiddleware) IpldStore {
+	get := GetFunc(inner.Get)
+	put := PutFunc(inner.Put)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m := middlewares[i]
+		if m.Get != nil {
+			next := get
+			get = func(ctx context.Context, c cid.Cid, out interface{}) error {
+				return m.Get(ctx, c, out, next)
+			}
+		}
+		if m.Put != nil {
+			next := put
+			put = func(ctx context.Context, v interface{}) (cid.Cid, error) {
+				return m.Put(ctx, v, next)
+			}
+		}
+	}
+	return &wrappedStore{get: get, put: put}
+}
+
+type wrappedStore struct {
+	get GetFunc
+	put PutFunc
+}
+
+func (s *wrappedStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	return s.get(ctx, c, out)
+}
+
+func (s *wrappedStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	return s.put(ctx, v)
+}
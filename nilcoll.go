@@ -0,0 +1,148 @@
+package cbornode
+
+import (
+	"reflect"
+)
+
+// NilCollectionMode selects how nil slices and maps are encoded.
+type NilCollectionMode int
+
+const (
+	// NilCollectionNull encodes nil slices and maps as null, keeping them
+	// distinct from empty ones, which encode as empty lists, maps or byte
+	// strings. Decoding null yields a nil slice or map again. This is the
+	// default.
+	NilCollectionNull NilCollectionMode = iota
+	// NilCollectionEmpty encodes nil slices and maps like empty ones, so an
+	// object has the same encoding, and CID, whether or not its collections
+	// were initialized.
+	NilCollectionEmpty
+)
+
+// SetNilCollectionMode selects how nil slices and maps are encoded by
+// DumpObject, WrapObject and the other encoding entry points. It applies to
+// the default refmt encoder only. Nil pointers and interfaces still encode as
+// null in every mode.
+//
+// As the mode changes CIDs, select it before encoding anything whose CID is
+// compared with earlier ones; encodings already running keep the previous
+// mode.
+func SetNilCollectionMode(mode NilCollectionMode) {
+	updateSettings(func(s *settings) {
+		s.nilCollections = mode
+	})
+}
+
+// emptyNilCollections returns obj with every nil slice and map reachable
+// through exported fields replaced by an empty one. obj itself is never
+// modified: the values along the path to a replaced collection are copied.
+func emptyNilCollections(obj interface{}) interface{} {
+	if v, changed := emptyNils(reflect.ValueOf(obj)); changed {
+		return v.Interface()
+	}
+	return obj
+}
+
+func emptyNils(v reflect.Value) (reflect.Value, bool) {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.MakeSlice(v.Type(), 0, 0), true
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v, false
+		}
+		return emptyNilElems(v, func() reflect.Value {
+			out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(out, v)
+			return out
+		})
+	case reflect.Array:
+		return emptyNilElems(v, func() reflect.Value {
+			out := reflect.New(v.Type()).Elem()
+			out.Set(v)
+			return out
+		})
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.MakeMap(v.Type()), true
+		}
+		var out reflect.Value
+		iter := v.MapRange()
+		for iter.Next() {
+			nv, changed := emptyNils(iter.Value())
+			if !changed {
+				continue
+			}
+			if !out.IsValid() {
+				out = reflect.MakeMapWithSize(v.Type(), v.Len())
+				copyIter := v.MapRange()
+				for copyIter.Next() {
+					out.SetMapIndex(copyIter.Key(), copyIter.Value())
+				}
+			}
+			out.SetMapIndex(iter.Key(), nv)
+		}
+		if out.IsValid() {
+			return out, true
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v, false
+		}
+		if nv, changed := emptyNils(v.Elem()); changed {
+			out := reflect.New(v.Type().Elem())
+			out.Elem().Set(nv)
+			return out, true
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, false
+		}
+		if nv, changed := emptyNils(v.Elem()); changed {
+			out := reflect.New(v.Type()).Elem()
+			out.Set(nv)
+			return out, true
+		}
+	case reflect.Struct:
+		var out reflect.Value
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			nv, changed := emptyNils(v.Field(i))
+			if !changed {
+				continue
+			}
+			if !out.IsValid() {
+				out = reflect.New(v.Type()).Elem()
+				out.Set(v)
+			}
+			out.Field(i).Set(nv)
+		}
+		if out.IsValid() {
+			return out, true
+		}
+	}
+	return v, false
+}
+
+// emptyNilElems applies emptyNils to the elements of the slice or array v,
+// copying v with clone before the first change.
+func emptyNilElems(v reflect.Value, clone func() reflect.Value) (reflect.Value, bool) {
+	var out reflect.Value
+	for i := 0; i < v.Len(); i++ {
+		nv, changed := emptyNils(v.Index(i))
+		if !changed {
+			continue
+		}
+		if !out.IsValid() {
+			out = clone()
+		}
+		out.Index(i).Set(nv)
+	}
+	if out.IsValid() {
+		return out, true
+	}
+	return v, false
+}
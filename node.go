@@ -1,29 +1,46 @@
 package cbornode
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	node "github.com/ipfs/go-ipld-format"
 	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
 )
 
 // CBORTagLink is the integer used to represent tags in CBOR.
 const CBORTagLink = 42
 
 // Node represents an IPLD node.
+//
+// A Node is immutable once built and safe for concurrent use by multiple
+// goroutines. Links and Tree return copies that callers may modify, but the
+// values returned by Resolve and AsMap belong to the Node and must not be
+// modified; use Copy to get a Node that can be changed independently.
 type Node struct {
 	obj   interface{}
-	tree  []string
 	links []*node.Link
 	raw   []byte
 	cid   cid.Cid
+
+	// tree is built lazily by Tree, as few callers need every path.
+	treeOnce sync.Once
+	tree     []string
 }
 
 // Compile time check to make sure Node implements the node.Node interface
@@ -53,28 +70,76 @@ var (
 // method will pick the right decoder based on the Block's CID.
 //
 // Note: This function keeps a reference to `block` and assumes that it is
-// immutable.
+// immutable. See EnableDecodeCache to memoize repeated calls.
 func DecodeBlock(block blocks.Block) (node.Node, error) {
 	return decodeBlock(block)
 }
 
 func decodeBlock(block blocks.Block) (*Node, error) {
+	dc := snapshot().decodeCache
+	if dc != nil {
+		if nd := dc.get(block.Cid(), block.RawData()); nd != nil {
+			return nd, nil
+		}
+	}
 	var m interface{}
 	if err := DecodeInto(block.RawData(), &m); err != nil {
 		return nil, err
 	}
-	return newObject(block, m)
+	nd, err := newObject(block, m)
+	if err != nil {
+		return nil, err
+	}
+	if dc != nil {
+		dc.add(nd)
+	}
+	return nd, nil
+}
+
+// NewNodeFromParts builds a Node from the encoded bytes of an object, its CID
+// and its decoded form, as DecodeInto produces when decoding into an
+// interface{}, for callers that already hold all three. It checks that raw
+// hashes to c and that obj encodes to raw, which is cheaper than decoding raw
+// again.
+func NewNodeFromParts(raw []byte, c cid.Cid, obj interface{}) (*Node, error) {
+	if c.Type() != cid.DagCBOR {
+		return nil, fmt.Errorf("cannot build a node from a cid with codec %d", c.Type())
+	}
+	actual, err := c.Prefix().Sum(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !actual.Equals(c) {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, c, actual)
+	}
+	enc, err := marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(enc, raw) {
+		return nil, errors.New("decoded object does not match the encoded bytes")
+	}
+	return NewNodeFromPartsUnsafe(raw, c, obj)
+}
+
+// NewNodeFromPartsUnsafe is like NewNodeFromParts, without checking that the
+// parts match. Passing mismatched parts results in an inconsistent Node.
+func NewNodeFromPartsUnsafe(raw []byte, c cid.Cid, obj interface{}) (*Node, error) {
+	blk, err := blocks.NewBlockWithCid(raw, c)
+	if err != nil {
+		return nil, err
+	}
+	return newObject(blk, obj)
 }
 
 func newObject(block blocks.Block, m interface{}) (*Node, error) {
-	tree, links, err := compute(m)
+	links, err := compute(m)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Node{
 		obj:   m,
-		tree:  tree,
 		links: links,
 		raw:   block.RawData(),
 		cid:   block.Cid(),
@@ -103,33 +168,80 @@ func Decode(b []byte, mhType uint64, mhLen int) (*Node, error) {
 	return WrapObject(m, mhType, mhLen)
 }
 
-// DecodeInto decodes a serialized IPLD cbor object into the given object.
+// DecodeInto decodes a serialized IPLD cbor object into the given object. If
+// it implements cbg.CBORUnmarshaler, UnmarshalCBOR does the decoding.
 func DecodeInto(b []byte, v interface{}) error {
-	return unmarshaller.Unmarshal(b, v)
+	return unmarshal(b, v)
+}
+
+// DecodeCtx is DecodeInto for callers with a deadline: it returns ctx.Err()
+// without decoding if ctx is already done. Decoding itself never waits, as
+// decoders are taken from a sync.Pool, which allocates a new one rather than
+// block when all are in use.
+func DecodeCtx(ctx context.Context, b []byte, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return unmarshal(b, v)
 }
 
 // DecodeReader reads from the given reader and decodes a serialized IPLD cbor object into the given object.
 func DecodeReader(r io.Reader, v interface{}) error {
-	return unmarshaller.Decode(r, v)
+	return decodeFrom(r, v)
 }
 
-// WrapObject converts an arbitrary object into a Node.
+// WrapObject converts an arbitrary object into a Node. Objects implementing
+// cbg.CBORMarshaler are encoded with MarshalCBOR, as in BasicIpldStore.Put.
+//
+// Passing math.MaxUint64 as mhType selects the package default multihash
+// (SHA2-256 unless changed with SetPackageDefaults). See EnableWrapCache to
+// memoize repeated calls.
 func WrapObject(m interface{}, mhType uint64, mhLen int) (*Node, error) {
-	data, err := marshaller.Marshal(m)
+	// Encode and clone with the same atlas, even if types are registered
+	// meanwhile.
+	cs := snapshot()
+	data, err := cs.marshal(m)
 	if err != nil {
 		return nil, err
 	}
 
+	if mhType == math.MaxUint64 {
+		mhType = cs.wrapMultihash
+		if mhLen == -1 {
+			mhLen = cs.defaultMhLen
+		}
+	}
+
+	wc := cs.wrapCache
+	var key wrapCacheKey
+	if wc != nil {
+		key = wc.key(data, mhType, mhLen)
+		if nd := wc.get(key, data); nd != nil {
+			return nd, nil
+		}
+	}
+
 	var obj interface{}
-	err = cloner.Clone(m, &obj)
+	if _, ok := m.(cbg.CBORMarshaler); ok {
+		// cbor-gen types aren't in the atlas, so they can't be cloned.
+		err = cs.unmarshal(data, &obj)
+	} else {
+		var wide []encoding.WideInt
+		wide, err = cs.cloner.CloneWatch(m, &obj, cs.intCheckLimit(&obj))
+		if err == nil {
+			err = cs.checkIntegers(&obj, wide)
+		} else if errors.Is(err, ErrEmptyLink) && cs.undefinedCids != UndefinedCidError ||
+			errors.Is(err, errRawSplice) {
+			// Undefined CIDs and RawCBOR values are only rewritten in the
+			// encoding, decode it so that obj holds what it got.
+			obj = nil
+			err = cs.unmarshal(data, &obj)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if mhType == math.MaxUint64 {
-		mhType = mh.SHA2_256
-	}
-
 	hash, err := mh.Sum(data, mhType, mhLen)
 	if err != nil {
 		return nil, err
@@ -142,12 +254,136 @@ func WrapObject(m interface{}, mhType uint64, mhLen int) (*Node, error) {
 		return nil, err
 	}
 	// No need to deserialize. We can just deep copy.
-	return newObject(block, obj)
+	nd, err := newObject(block, obj)
+	if err != nil {
+		return nil, err
+	}
+	if wc != nil {
+		wc.add(key, nd)
+	}
+	return nd, nil
+}
+
+// WrapRaw builds a Node for a raw codec block holding data, such as a leaf
+// of a file, so it can be linked from and handled alongside dag-cbor Nodes.
+// data is stored verbatim, even if it happens to be CBOR, and a raw Node has
+// no links: resolving the empty path returns data itself.
+//
+// As with WrapObject, passing math.MaxUint64 as mhType selects the package
+// default multihash and digest length.
+func WrapRaw(data []byte, mhType uint64) (*Node, error) {
+	mhLen := -1
+	if mhType == math.MaxUint64 {
+		cs := snapshot()
+		mhType, mhLen = cs.wrapMultihash, cs.defaultMhLen
+	}
+	data = append([]byte{}, data...)
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   mhType,
+		MhLength: mhLen,
+	}.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{obj: data, raw: data, cid: c}, nil
+}
+
+// EncodeStats describes the encoding of an object.
+type EncodeStats struct {
+	// Size is the length of the encoding in bytes.
+	Size int
+	// Links, Maps and Arrays count the links, maps and arrays in the object.
+	Links  int
+	Maps   int
+	Arrays int
+	// MaxDepth is the deepest nesting of maps, arrays and links; a scalar
+	// has a depth of 0.
+	MaxDepth int
+}
+
+// WrapObjectWithStats is like WrapObject, but also returns statistics about
+// the encoding of the object, for example to enforce protocol limits before
+// storing it.
+func WrapObjectWithStats(m interface{}, mhType uint64, mhLen int) (*Node, EncodeStats, error) {
+	nd, err := WrapObject(m, mhType, mhLen)
+	if err != nil {
+		return nil, EncodeStats{}, err
+	}
+	stats := EncodeStats{Size: len(nd.raw)}
+	err = encoding.TokenWalk(nd.raw, func(tok encoding.Token) error {
+		switch tok.Major {
+		case encoding.MajMap:
+			stats.Maps++
+		case encoding.MajArray:
+			stats.Arrays++
+		case encoding.MajTag:
+			if tok.Value == CBORTagLink {
+				stats.Links++
+			}
+		default:
+			return nil
+		}
+		if tok.Depth+1 > stats.MaxDepth {
+			stats.MaxDepth = tok.Depth + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, EncodeStats{}, err
+	}
+	return nd, stats, nil
 }
 
 // Resolve resolves a given path, and returns the object found at the end, as well
 // as the possible tail of the path that was not resolved.
 func (n *Node) Resolve(path []string) (interface{}, []string, error) {
+	return n.resolve(path, false, nil)
+}
+
+// ResolveInto resolves path like Resolve and decodes the value found into out,
+// which must be a pointer, as DecodeInto would decode its encoding: through
+// the registered atlas, or UnmarshalCBOR for cbor-gen types. A path ending on
+// a link decodes the link itself, into a cid.Cid for example; paths going
+// further fail, as the linked node isn't available to the Node.
+func (n *Node) ResolveInto(path []string, out interface{}) error {
+	v, rest, err := n.resolve(path, false, nil)
+	if err != nil {
+		return err
+	}
+	if lnk, ok := v.(*node.Link); ok {
+		if len(rest) > 0 {
+			return fmt.Errorf("cannot resolve %s: path crosses link %s", strings.Join(path, "/"), lnk.Cid)
+		}
+		v = lnk.Cid
+	}
+	b, err := marshal(v)
+	if err != nil {
+		return err
+	}
+	return unmarshal(b, out)
+}
+
+// ResolvePartial is like Resolve, but when the path continues past a value
+// that is neither a map, a list nor a link, it returns that value and the
+// rest of the path instead of ErrNoLinks, as gateways do.
+func (n *Node) ResolvePartial(path []string) (interface{}, []string, error) {
+	return n.resolve(path, true, nil)
+}
+
+// ResolveWithBudget is like Resolve, but charges the traversal to budget and
+// fails with ErrBudgetExceeded once it goes over it. The size of the node and
+// its root are charged first, then every path step. A nil budget doesn't
+// limit anything.
+func (n *Node) ResolveWithBudget(path []string, budget *TraversalBudget) (interface{}, []string, error) {
+	if err := budget.spend(1, int64(len(n.raw))); err != nil {
+		return nil, nil, err
+	}
+	return n.resolve(path, false, budget)
+}
+
+func (n *Node) resolve(path []string, partial bool, budget *TraversalBudget) (interface{}, []string, error) {
 	var cur interface{} = n.obj
 	for i, val := range path {
 		switch curv := cur.(type) {
@@ -179,8 +415,14 @@ func (n *Node) Resolve(path []string) (interface{}, []string, error) {
 		case cid.Cid:
 			return &node.Link{Cid: curv}, path[i:], nil
 		default:
+			if partial {
+				return cur, path[i:], nil
+			}
 			return nil, nil, ErrNoLinks
 		}
+		if err := budget.spend(1, 0); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	lnk, ok := cur.(cid.Cid)
@@ -196,22 +438,101 @@ func (n *Node) Resolve(path []string) (interface{}, []string, error) {
 	return jsonish, nil, nil
 }
 
+// AsMap returns the decoded object if it is a map. Links are represented as
+// cid.Cid values.
+//
+// The map is shared with the Node, not copied: it must not be modified.
+func (n *Node) AsMap() (map[string]interface{}, bool) {
+	switch obj := n.obj.(type) {
+	case map[string]interface{}:
+		return obj, true
+	case map[interface{}]interface{}:
+		m, err := toSaneMap(obj)
+		if err != nil {
+			return nil, false
+		}
+		sane, ok := m.(map[string]interface{})
+		return sane, ok
+	default:
+		return nil, false
+	}
+}
+
+// ForEachEntry calls fn for each entry of the map at path, in canonical
+// (encoded) key order: shorter keys first, then bytewise. Links are passed as
+// cid.Cid values. Iteration stops at the first error returned by fn, which is
+// returned.
+//
+// The values are shared with the Node, not copied: they must not be modified.
+func (n *Node) ForEachEntry(path []string, fn func(key string, value interface{}) error) error {
+	var cur interface{} = n.obj
+	for _, val := range path {
+		switch curv := cur.(type) {
+		case map[string]interface{}:
+			next, ok := curv[val]
+			if !ok {
+				return ErrNoSuchLink
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return err
+			}
+			if i < 0 || i >= len(curv) {
+				return ErrArrayOutOfRange
+			}
+			cur = curv[i]
+		default:
+			return fmt.Errorf("cannot iterate over %s: path crosses a non-map, non-list value", strings.Join(path, "/"))
+		}
+	}
+
+	if im, ok := cur.(map[interface{}]interface{}); ok {
+		sane, err := toSaneMap(im)
+		if err != nil {
+			return err
+		}
+		cur = sane
+	}
+	m, ok := cur.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cannot iterate over %s: not a map", strings.Join(path, "/"))
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return canonicalKeyLess([]byte(keys[i]), []byte(keys[j]))
+	})
+	for _, k := range keys {
+		if err := fn(k, m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AsList returns the decoded object if it is a list. Links are represented as
+// cid.Cid values.
+//
+// The slice is shared with the Node, not copied: it must not be modified.
+func (n *Node) AsList() ([]interface{}, bool) {
+	l, ok := n.obj.([]interface{})
+	return l, ok
+}
+
 // Copy creates a copy of the Node.
 func (n *Node) Copy() node.Node {
-	links := make([]*node.Link, len(n.links))
-	copy(links, n.links)
-
 	raw := make([]byte, len(n.raw))
 	copy(raw, n.raw)
 
-	tree := make([]string, len(n.tree))
-	copy(tree, n.tree)
-
 	return &Node{
 		obj:   copyObj(n.obj),
-		links: links,
+		links: copyLinks(n.links),
 		raw:   raw,
-		tree:  tree,
 		cid:   n.cid,
 	}
 }
@@ -236,6 +557,10 @@ func copyObj(i interface{}) interface{} {
 			out = append(out, copyObj(v))
 		}
 		return out
+	case []byte:
+		out := make([]byte, len(i))
+		copy(out, i)
+		return out
 	default:
 		// TODO: do not be lazy
 		// being lazy for now
@@ -262,56 +587,199 @@ func (n *Node) ResolveLink(path []string) (*node.Link, []string, error) {
 
 // Tree returns a flattend array of paths at the given path for the given depth.
 func (n *Node) Tree(path string, depth int) []string {
+	path = strings.Trim(path, "/")
 	if path == "" && depth == -1 {
-		return n.tree
+		n.treeOnce.Do(func() {
+			n.tree = computeTree(n.obj)
+		})
+		return append([]string(nil), n.tree...)
 	}
 
-	var out []string
-	for _, t := range n.tree {
-		if !strings.HasPrefix(t, path) {
-			continue
+	// Only walk the requested subtree, so that exploring a large node level
+	// by level doesn't cost a walk of the whole node every time.
+	sub := n.obj
+	if path != "" {
+		var ok bool
+		if sub, ok = lookupPath(n.obj, path); !ok {
+			return nil
 		}
+	}
+	var out []string
+	subTree(sub, "", depth, &out)
+	return out
+}
 
-		sub := strings.TrimLeft(t[len(path):], "/")
-		if sub == "" {
-			continue
+// subTree appends to out the paths under obj, prefixed with prefix, down to
+// depth levels, or all of them if depth is negative.
+func subTree(obj interface{}, prefix string, depth int, out *[]string) {
+	if depth == 0 {
+		return
+	}
+	visit := func(key string, v interface{}) {
+		p := key
+		if prefix != "" {
+			p = prefix + "/" + key
 		}
-
-		if depth < 0 {
-			out = append(out, sub)
-			continue
+		*out = append(*out, p)
+		subTree(v, p, depth-1, out)
+	}
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		for k, v := range obj {
+			visit(k, v)
 		}
-
-		parts := strings.Split(sub, "/")
-		if len(parts) <= depth {
-			out = append(out, sub)
+	case map[interface{}]interface{}:
+		for k, v := range obj {
+			if ks, ok := k.(string); ok {
+				visit(ks, v)
+			}
+		}
+	case []interface{}:
+		for i, v := range obj {
+			visit(strconv.Itoa(i), v)
 		}
 	}
-	return out
 }
 
-func compute(obj interface{}) (tree []string, links []*node.Link, err error) {
-	err = traverse(obj, "", func(name string, val interface{}) error {
-		if name != "" {
-			tree = append(tree, name[1:])
+// HasPath reports whether path, a slash separated path as returned by Tree,
+// exists in the Node. Unlike Tree, it walks the decoded object directly and
+// doesn't build the list of every path in the Node.
+func (n *Node) HasPath(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, ok := lookupPath(n.obj, path)
+	return ok
+}
+
+// lookupPath returns the value at a non-empty slash separated path in obj.
+func lookupPath(obj interface{}, path string) (interface{}, bool) {
+	cur := obj
+	for _, seg := range strings.Split(path, "/") {
+		switch curv := cur.(type) {
+		case map[string]interface{}:
+			next, ok := curv[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case map[interface{}]interface{}:
+			next, ok := curv[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(curv) || strconv.Itoa(i) != seg {
+				return nil, false
+			}
+			cur = curv[i]
+		default:
+			return nil, false
 		}
+	}
+	return cur, true
+}
+
+func compute(obj interface{}) (links []*node.Link, err error) {
+	err = walkObj(obj, func(val interface{}) error {
 		if lnk, ok := val.(cid.Cid); ok {
 			links = append(links, &node.Link{Cid: lnk})
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return tree, links, nil
+	return links, nil
+}
+
+func computeTree(obj interface{}) (tree []string) {
+	// The object was already walked successfully by compute, so this can't
+	// fail.
+	_ = traverse(obj, "", func(name string, val interface{}) error {
+		if name != "" {
+			tree = append(tree, name[1:])
+		}
+		return nil
+	})
+	return tree
 }
 
-// Links lists all known links of the Node.
+// Links lists all known links of the Node. The returned links are copies,
+// see LinksUnsafe to avoid the allocations. A CID linked several times is
+// listed several times, and the order of links in maps varies between calls;
+// see UniqueLinks for a deterministic list.
 func (n *Node) Links() []*node.Link {
+	return copyLinks(n.links)
+}
+
+// UniqueLinks lists the links of the Node once per CID, in the order they
+// first appear when visiting the Node in canonical order: array elements by
+// index and map entries sorted as in canonical dag-cbor, shorter keys first.
+// The result only depends on the data of the Node.
+func (n *Node) UniqueLinks() []*node.Link {
+	var links []*node.Link
+	seen := make(map[cid.Cid]struct{}, len(n.links))
+	walkCanonical(n.obj, func(c cid.Cid) {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			links = append(links, &node.Link{Cid: c})
+		}
+	})
+	return links
+}
+
+// walkCanonical calls cb on the links of obj, visiting maps in canonical key
+// order. obj must have been walked successfully by compute.
+func walkCanonical(obj interface{}, cb func(cid.Cid)) {
+	switch obj := obj.(type) {
+	case cid.Cid:
+		cb(obj)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return canonicalKeyLess([]byte(keys[i]), []byte(keys[j]))
+		})
+		for _, k := range keys {
+			walkCanonical(obj[k], cb)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(obj))
+		for k, v := range obj {
+			m[k.(string)] = v
+		}
+		walkCanonical(m, cb)
+	case []interface{}:
+		for _, v := range obj {
+			walkCanonical(v, cb)
+		}
+	}
+}
+
+// LinksUnsafe is like Links, but returns the Node's own links, which callers
+// must not modify.
+func (n *Node) LinksUnsafe() []*node.Link {
 	return n.links
 }
 
+func copyLinks(links []*node.Link) []*node.Link {
+	if links == nil {
+		return nil
+	}
+	out := make([]*node.Link, len(links))
+	for i, l := range links {
+		lnk := *l
+		out[i] = &lnk
+	}
+	return out
+}
+
 func traverse(obj interface{}, cur string, cb func(string, interface{}) error) error {
 	if err := cb(cur, obj); err != nil {
 		return err
@@ -351,6 +819,42 @@ func traverse(obj interface{}, cur string, cb func(string, interface{}) error) e
 	}
 }
 
+// walkObj is like traverse, without building the path of every value.
+func walkObj(obj interface{}, cb func(interface{}) error) error {
+	if err := cb(obj); err != nil {
+		return err
+	}
+
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		for _, v := range obj {
+			if err := walkObj(v, cb); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[interface{}]interface{}:
+		for k, v := range obj {
+			if _, ok := k.(string); !ok {
+				return errors.New("map key was not a string")
+			}
+			if err := walkObj(v, cb); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for _, v := range obj {
+			if err := walkObj(v, cb); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
 // RawData returns the raw bytes that represent the Node as serialized CBOR.
 func (n *Node) RawData() []byte {
 	return n.raw
@@ -361,6 +865,12 @@ func (n *Node) Cid() cid.Cid {
 	return n.cid
 }
 
+// Codec returns the multicodec of the Node's CID: cid.DagCBOR, or cid.Raw
+// for Nodes built with WrapRaw.
+func (n *Node) Codec() uint64 {
+	return n.cid.Type()
+}
+
 // Loggable returns a loggable representation of the Node.
 func (n *Node) Loggable() map[string]interface{} {
 	return map[string]interface{}{
@@ -395,6 +905,27 @@ func (n *Node) MarshalJSON() ([]byte, error) {
 	return json.Marshal(out)
 }
 
+// MarshalObjJSON encodes v as JSON the way Node.MarshalJSON encodes the Node
+// of v: v goes through the registered atlas, so registered transforms and
+// field names apply, and links are encoded as {"/": "<cid>"} as in dag-json.
+// It doesn't hash the encoding, making it cheaper than WrapObject for APIs
+// and logs.
+func MarshalObjJSON(v interface{}) ([]byte, error) {
+	b, err := marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj interface{}
+	if err := unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	out, err := convertToJSONIsh(obj)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
 // DumpObject marshals any object into its CBOR serialized byte representation
 // Deprecated: use Encode instead.
 func DumpObject(obj interface{}) (out []byte, err error) {
@@ -402,13 +933,55 @@ func DumpObject(obj interface{}) (out []byte, err error) {
 }
 
 // Encode marshals any object into its CBOR serialized byte representation
+//
+// Encode and DecodeObject are the lightweight entry points for callers who
+// only need canonical dag-cbor bytes: they use the registered atlas directly,
+// without hashing the result or building a Node.
 func Encode(obj interface{}) (out []byte, err error) {
-	return marshaller.Marshal(obj)
+	return marshal(obj)
+}
+
+// DecodeObject unmarshals the CBOR serialized object b into out, which must be
+// a pointer. It is the counterpart of Encode and is equivalent to DecodeInto.
+func DecodeObject(b []byte, out interface{}) error {
+	return unmarshal(b, out)
 }
 
 // EncodeWriter marshals into the writer any object as its CBOR serialized byte representation.
 func EncodeWriter(obj interface{}, w io.Writer) error {
-	return marshaller.Encode(obj, w)
+	return encodeTo(obj, w)
+}
+
+// Clone deep-copies src into dst, which must be a pointer, using the
+// registered atlas. It is equivalent to encoding src and decoding the result
+// into dst, without the intermediate bytes. Cloners are pooled, see
+// SetClonerPoolSize.
+func Clone(src, dst interface{}) error {
+	return snapshot().clone(src, dst)
+}
+
+// clone copies src into dst with a cloner, or by encoding and decoding src
+// if it holds a RawCBOR, which cloners can't copy.
+func (cs *codecs) clone(src, dst interface{}) error {
+	err := cs.cloner.Clone(src, dst)
+	if !errors.Is(err, errRawSplice) {
+		return err
+	}
+	b, err := cs.marshal(src)
+	if err != nil {
+		return err
+	}
+	if dv := reflect.ValueOf(dst); dv.Kind() == reflect.Ptr && !dv.IsNil() {
+		dv.Elem().Set(reflect.Zero(dv.Elem().Type()))
+	}
+	return cs.unmarshal(b, dst)
+}
+
+// CloneObject is the former name of Clone.
+//
+// Deprecated: use Clone instead.
+func CloneObject(src, dst interface{}) error {
+	return Clone(src, dst)
 }
 
 func toSaneMap(n map[interface{}]interface{}) (interface{}, error) {
@@ -466,6 +1039,60 @@ func convertToJSONIsh(v interface{}) (interface{}, error) {
 	}
 }
 
+// Normalize converts a value as returned by Resolve or decoded into an
+// interface{} into the form used by Resolve results: maps are converted to
+// map[string]interface{}, failing with ErrInvalidKeys on non-string keys, and
+// maps holding only a "/" key with a bytes value are converted to links with
+// a cid.Cid value. The input is not modified.
+func Normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if lnk, ok := v["/"]; ok && len(v) == 1 {
+			if lnkb, ok := lnk.([]byte); ok {
+				c, err := cid.Cast(lnkb)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]interface{}{"/": c}, nil
+			}
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			obj, err := Normalize(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = obj
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, ErrInvalidKeys
+			}
+			m[ks] = e
+		}
+		return Normalize(m)
+	case []interface{}:
+		if v == nil {
+			return nil, nil
+		}
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			obj, err := Normalize(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = obj
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
 // FromJSON converts incoming JSON into a Node.
 func FromJSON(r io.Reader, mhType uint64, mhLen int) (*Node, error) {
 	var m interface{}
@@ -530,6 +1157,12 @@ func convertToCborIshObj(i interface{}) (interface{}, error) {
 }
 
 func castBytesToCid(x []byte) (cid.Cid, error) {
+	return parseLinkBytes(x, snapshot().lenientLinks)
+}
+
+// parseLinkBytes parses the content of a tag 42 link. When lenient is set,
+// bare CID bytes without the identity multibase prefix are accepted too.
+func parseLinkBytes(x []byte, lenient bool) (cid.Cid, error) {
 	if len(x) == 0 {
 		return cid.Cid{}, ErrEmptyLink
 	}
@@ -537,6 +1170,11 @@ func castBytesToCid(x []byte) (cid.Cid, error) {
 	// TODO: manually doing multibase checking here since our deps don't
 	// support binary multibase yet
 	if x[0] != 0 {
+		if lenient {
+			if c, err := cid.Cast(x); err == nil {
+				return c, nil
+			}
+		}
 		return cid.Cid{}, ErrInvalidMultibase
 	}
 
@@ -2,24 +2,58 @@ package cbornode
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	u "github.com/ipfs/go-ipfs-util"
+	node "github.com/ipfs/go-ipld-format"
 	mh "github.com/multiformats/go-multihash"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
 )
 
 func init() {
 	RegisterCborType(BigIntAtlasEntry)
+	RegisterCborType(testDupKeys{})
+	RegisterCborType(testEvolved{})
+	RegisterCborType(testSigned{})
+	RegisterCborType(testOptionalLink{})
+	RegisterCborType(testMaybeLink{})
+	RegisterCborType(testProxyHolder{})
+	RegisterCborType(BigRatAtlasEntry)
+	RegisterCborType(testOmitEmpty{}, OmitEmptyCidsAndBigInts())
+	RegisterCborType(testCollections{})
+	RegisterCborType(testIntegers{})
+	RegisterCborType(CidMapAtlasEntry(map[cid.Cid]int{}, CidMapPairs))
+	RegisterCborType(CidMapAtlasEntry(map[cid.Cid]string{}, CidMapStrings))
+	RegisterCborType(testCidMaps{})
+	RegisterCborType(Uint256AtlasEntry)
+	RegisterCborType(atlas.BuildEntry(testLossy("")).Transform().
+		TransformMarshal(atlas.MakeMarshalTransformFunc(
+			func(s testLossy) (string, error) {
+				return string(s) + "!", nil
+			})).
+		TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+			func(s string) (testLossy, error) {
+				return testLossy(s), nil
+			})).
+		Complete())
 }
 
 func assertCid(c cid.Cid, exp string) error {
@@ -66,6 +100,24 @@ func TestDecodeInto(t *testing.T) {
 	}
 }
 
+func TestDecodeCtx(t *testing.T) {
+	b, err := Encode(map[string]string{"name": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]string
+	if err := DecodeCtx(context.Background(), b, &m); err != nil || m["name"] != "foo" {
+		t.Fatalf("unexpected decoding %v %v", m, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	m = nil
+	if err := DecodeCtx(ctx, b, &m); err != context.DeadlineExceeded || m != nil {
+		t.Fatalf("expected the deadline to be honored, got %v %v", m, err)
+	}
+}
+
 func TestDecodeIntoNonObject(t *testing.T) {
 	nd, err := WrapObject("foobar", mh.SHA2_256, -1)
 	if err != nil {
@@ -271,6 +323,12 @@ func TestTree(t *testing.T) {
 
 	assertStringsEqual(t, toplevel, nd.Tree("", 1))
 	assertStringsEqual(t, []string{}, nd.Tree("", 0))
+
+	qux := []string{"boo", "baa", "bee", "bii", "buu"}
+	assertStringsEqual(t, qux, nd.Tree("cats/qux", 1))
+	assertStringsEqual(t, []string{"0", "1", "2"}, nd.Tree("baz", 2))
+	// Paths match whole segments only.
+	assertStringsEqual(t, []string{}, nd.Tree("ca", -1))
 }
 
 func TestParsing(t *testing.T) {
@@ -646,3 +704,2746 @@ func TestBigIntRoundtrip(t *testing.T) {
 	}
 
 }
+
+func TestSetPackageDefaults(t *testing.T) {
+	defer func(saved settings) {
+		updateSettings(func(s *settings) {
+			s.wrapMultihash, s.storeMultihash, s.defaultMhLen =
+				saved.wrapMultihash, saved.storeMultihash, saved.defaultMhLen
+		})
+	}(snapshot().settings)
+
+	SetPackageDefaults(mh.SHA2_512, -1)
+
+	nd, err := WrapObject("hello", math.MaxUint64, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Prefix().MhType != mh.SHA2_512 {
+		t.Fatalf("expected sha2-512, got %d", nd.Cid().Prefix().MhType)
+	}
+
+	c, err := NewMemCborStore().Put(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(nd.Cid()) {
+		t.Fatalf("store and WrapObject disagree: %s != %s", c, nd.Cid())
+	}
+
+	// The package length only applies along with the package hash function.
+	SetPackageDefaults(mh.SHA2_512, 20)
+	c, err = NewMemCborStore().Put(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref := c.Prefix(); pref.MhType != mh.SHA2_512 || pref.MhLength != 20 {
+		t.Fatalf("unexpected prefix %+v", pref)
+	}
+	own := NewCborStore(newMockBlocks())
+	own.DefaultMultihash = mh.SHA2_256
+	c, err = own.Put(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref := c.Prefix(); pref.MhType != mh.SHA2_256 || pref.MhLength != 32 {
+		t.Fatalf("unexpected prefix %+v", pref)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	c1 := cid.NewCidV0(u.Hash([]byte("something1")))
+	c2 := cid.NewCidV0(u.Hash([]byte("something2")))
+
+	nd, err := WrapObject(map[string]interface{}{
+		"a": c1,
+		"b": []interface{}{c2, "c", map[string]interface{}{"d": c1}},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := ExtractLinks(nd.RawData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 3 || !links[0].Equals(c1) || !links[1].Equals(c2) || !links[2].Equals(c1) {
+		t.Fatalf("unexpected links: %v", links)
+	}
+
+	if _, err := ExtractLinks([]byte{0xd8, 0x2a, 0x01}); err != ErrInvalidLink {
+		t.Fatalf("expected ErrInvalidLink, got %v", err)
+	}
+}
+
+func TestEncodeDecodeObject(t *testing.T) {
+	c := cid.NewCidV0(u.Hash([]byte("something1")))
+	in := testOptionalLink{Name: "a", Link: c, Links: []cid.Cid{c}}
+	b, err := Encode(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(&in, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, nd.RawData()) {
+		t.Fatal("expected Encode to produce the node encoding")
+	}
+
+	var out testOptionalLink
+	if err := DecodeObject(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("got %#v, expected %#v", out, in)
+	}
+}
+
+func TestWrapObjectWithStats(t *testing.T) {
+	c := cid.NewCidV0(u.Hash([]byte("something1")))
+	nd, stats, err := WrapObjectWithStats(map[string]interface{}{
+		"a": []interface{}{c, map[string]interface{}{"b": c}},
+		"n": 1,
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := EncodeStats{Size: len(nd.RawData()), Links: 2, Maps: 2, Arrays: 1, MaxDepth: 4}
+	if stats != expected {
+		t.Fatalf("got %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestTranscodeJSON(t *testing.T) {
+	c := cid.NewCidV0(u.Hash([]byte("something1")))
+	for _, doc := range []string{
+		`{"a": 1, "bb": [1.5, -3, 1e300, null, true, false, "x"], "c": {}, "d": [], "n": null}`,
+		`{"link": {"/": "` + c.String() + `"}, "notlink": {"/": "x", "y": 1}, "z": "dup", "z": "last"}`,
+		`[[[{"é": "ü"}]], {"b": [{"/": "` + c.String() + `"}], "a": {"c": [[]]}}]`,
+		` "scalar"`,
+	} {
+		expected, err := FromJSON(strings.NewReader(doc), mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := TranscodeJSON(&out, strings.NewReader(doc)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), expected.RawData()) {
+			t.Fatalf("%s: got %x, expected %x", doc, out.Bytes(), expected.RawData())
+		}
+	}
+
+	// Output is written out while the document is converted.
+	var doc strings.Builder
+	doc.WriteString(`{"items": [`)
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `{"i": %d, "s": "item"}`, i)
+	}
+	doc.WriteString(`]}`)
+	expected, err := FromJSON(strings.NewReader(doc.String()), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &countingWriter{}
+	if err := TranscodeJSON(out, strings.NewReader(doc.String())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), expected.RawData()) || out.writes < 2 {
+		t.Fatalf("expected the dag-cbor of FromJSON in several writes, got %d bytes in %d writes", out.Len(), out.writes)
+	}
+
+	var sink bytes.Buffer
+	if err := TranscodeJSON(&sink, strings.NewReader(`{"/": 1}`)); err != ErrNonStringLink {
+		t.Fatalf("expected ErrNonStringLink, got %v", err)
+	}
+	if err := TranscodeJSON(&sink, strings.NewReader(`{"a": [1`)); err == nil {
+		t.Fatal("expected truncated JSON to be refused")
+	}
+	deep := strings.Repeat("[", maxStreamDepth+2) + strings.Repeat("]", maxStreamDepth+2)
+	if err := TranscodeJSON(&sink, strings.NewReader(deep)); !errors.Is(err, encoding.ErrMaxDepth) {
+		t.Fatalf("expected ErrMaxDepth, got %v", err)
+	}
+}
+
+// countingWriter is a bytes.Buffer counting the calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestLinksOf(t *testing.T) {
+	c1 := cid.NewCidV0(u.Hash([]byte("something1")))
+	c2 := cid.NewCidV0(u.Hash([]byte("something2")))
+
+	links, err := LinksOf(&testOptionalLink{Name: "a", Link: c1, Links: []cid.Cid{c2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys are sorted by length first, so "link" comes before "links".
+	if len(links) != 2 || !links[0].Equals(c1) || !links[1].Equals(c2) {
+		t.Fatalf("unexpected links: %v", links)
+	}
+
+	links, err = LinksOf(map[string]interface{}{"b": c2, "a": []interface{}{c1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || !links[0].Equals(c1) || !links[1].Equals(c2) {
+		t.Fatalf("unexpected links: %v", links)
+	}
+}
+
+type testShape interface {
+	Area() int
+}
+
+type testSquare struct {
+	Side int
+}
+
+func (s testSquare) Area() int { return s.Side * s.Side }
+
+type testRect struct {
+	W, H int
+}
+
+func (r testRect) Area() int { return r.W * r.H }
+
+type testDrawing struct {
+	Shapes []testShape
+	Main   testShape
+}
+
+func TestRegisterUnion(t *testing.T) {
+	RegisterCborType(testRect{})
+	err := RegisterUnion((*testShape)(nil), map[uint64]reflect.Type{
+		1: reflect.TypeOf(testSquare{}),
+		2: reflect.TypeOf(testRect{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterCborType(testDrawing{})
+
+	d := testDrawing{
+		Shapes: []testShape{testSquare{Side: 2}, testRect{W: 2, H: 3}},
+		Main:   testRect{W: 1, H: 5},
+	}
+	data, err := Encode(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var back testDrawing
+	if err := DecodeInto(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Shapes) != 2 || back.Shapes[0].Area() != 4 || back.Shapes[1].Area() != 6 || back.Main.Area() != 5 {
+		t.Fatalf("union roundtrip failed: %#v", back)
+	}
+	if _, ok := back.Shapes[0].(testSquare); !ok {
+		t.Fatalf("expected a testSquare, got %T", back.Shapes[0])
+	}
+
+	if err := RegisterUnion(testSquare{}, nil); err == nil {
+		t.Fatal("expected an error for a non-interface union")
+	}
+}
+
+func TestCloneObject(t *testing.T) {
+	orig := testStruct()
+
+	var cpy MyStruct
+	if err := CloneObject(orig, &cpy); err != nil {
+		t.Fatal(err)
+	}
+
+	cpy.Items["Foo"].Baz[0] = 100
+	cpy.Baz[0] = 100
+	if orig.Items["Foo"].Baz[0] != 1 || orig.Baz[0] != 5 {
+		t.Fatal("clone shares memory with the original")
+	}
+
+	a, err := Encode(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back MyStruct
+	if err := CloneObject(orig, &back); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Encode(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("clone encodes differently from the original")
+	}
+}
+
+type testEmbedBase struct {
+	ID   int
+	Name string
+}
+
+type testEmbedMeta struct {
+	Name    string
+	Comment string
+}
+
+type testEmbedded struct {
+	testEmbedBase
+	Meta testEmbedMeta
+	Size int
+}
+
+type testEmbedShadow struct {
+	testEmbedBase
+	Name string
+}
+
+type testEmbedCollision struct {
+	testEmbedBase
+	testEmbedMeta
+}
+
+// TestEmbedTimes is exported so that decoding can allocate it when embedded
+// by pointer, as with encoding/json.
+type TestEmbedTimes struct {
+	Created int
+	Updated int `refmt:",omitempty"`
+}
+
+type testEmbedPointer struct {
+	*TestEmbedTimes
+	Size int
+}
+
+func TestEmbeddedStructFields(t *testing.T) {
+	RegisterCborType(testEmbedMeta{})
+	RegisterCborType(testEmbedded{})
+	RegisterCborType(testEmbedShadow{})
+
+	obj := testEmbedded{
+		testEmbedBase: testEmbedBase{ID: 1, Name: "foo"},
+		Meta:          testEmbedMeta{Name: "m"},
+		Size:          3,
+	}
+	data, err := Encode(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic map[string]interface{}
+	if err := DecodeInto(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if len(generic) != 4 || generic["iD"] != 1 || generic["name"] != "foo" || generic["size"] != 3 {
+		t.Fatalf("embedded fields weren't promoted: %v", generic)
+	}
+
+	var back testEmbedded
+	if err := DecodeInto(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.ID != 1 || back.Name != "foo" || back.Meta.Name != "m" || back.Size != 3 {
+		t.Fatalf("roundtrip failed: %+v", back)
+	}
+
+	data, err = Encode(testEmbedShadow{testEmbedBase: testEmbedBase{ID: 2, Name: "hidden"}, Name: "outer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	if err := DecodeInto(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["name"] != "outer" {
+		t.Fatalf("shallower field should win: %v", generic)
+	}
+
+	for _, v := range []interface{}{testEmbedCollision{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %T to panic", v)
+				}
+			}()
+			RegisterCborType(v)
+		}()
+	}
+}
+
+func TestEmbeddedPointerFields(t *testing.T) {
+	RegisterCborType(testEmbedPointer{})
+
+	data, err := Encode(testEmbedPointer{Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	if err := DecodeInto(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if len(generic) != 1 || generic["size"] != 3 {
+		t.Fatalf("fields under a nil pointer should be left out: %v", generic)
+	}
+	var back testEmbedPointer
+	if err := DecodeInto(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.TestEmbedTimes != nil || back.Size != 3 {
+		t.Fatalf("pointer shouldn't be allocated without its fields: %+v", back)
+	}
+
+	data, err = Encode(testEmbedPointer{TestEmbedTimes: &TestEmbedTimes{}, Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	if err := DecodeInto(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if len(generic) != 2 || generic["created"] != 0 {
+		t.Fatalf("omitempty should still apply under the pointer: %v", generic)
+	}
+
+	data, err = Encode(testEmbedPointer{TestEmbedTimes: &TestEmbedTimes{Created: 1, Updated: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back = testEmbedPointer{}
+	if err := DecodeInto(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.TestEmbedTimes == nil || *back.TestEmbedTimes != (TestEmbedTimes{Created: 1, Updated: 2}) {
+		t.Fatalf("roundtrip failed: %+v", back)
+	}
+
+	nd, err := WrapObject(testEmbedPointer{TestEmbedTimes: &TestEmbedTimes{Created: 1}}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := nd.Resolve([]string{"created"}); err != nil || v != 1 {
+		t.Fatalf("resolve through the pointer: %v %v", v, err)
+	}
+}
+
+func TestRegisterUnsupportedFields(t *testing.T) {
+	type withChan struct {
+		Name    string
+		Updates chan int
+	}
+	type withFunc struct {
+		Handlers map[string]func()
+	}
+	type withIntKeys struct {
+		ByID map[int]string
+	}
+	type withIgnored struct {
+		Name string
+		Done chan struct{} `refmt:"-"`
+	}
+
+	for _, tc := range []struct {
+		v   interface{}
+		msg string
+	}{
+		{withChan{}, "field Updates (key \"updates\") of type chan int is a channel"},
+		{withFunc{}, "field Handlers (key \"handlers\") of type map[string]func() holds a func(), which is a function"},
+		{withIntKeys{}, "field ByID (key \"byID\") of type map[int]string has int keys, which are not strings"},
+	} {
+		v, msg := tc.v, tc.msg
+		func() {
+			defer func() {
+				r := recover()
+				err, _ := r.(error)
+				if err == nil || !strings.Contains(err.Error(), msg) {
+					t.Errorf("expected registering %T to panic with %q, got %v", v, msg, r)
+				}
+			}()
+			RegisterCborType(v)
+		}()
+	}
+
+	RegisterCborType(withIgnored{})
+	if _, err := Encode(withIgnored{Name: "ok", Done: make(chan struct{})}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsMapAsList(t *testing.T) {
+	c := cid.NewCidV0(u.Hash([]byte("something")))
+	nd, err := WrapObject(map[string]interface{}{"a": 1, "l": c}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := DecodeBlock(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := back.(*Node).AsMap()
+	if !ok || m["a"] != 1 || m["l"] != c {
+		t.Fatalf("unexpected map view: %v", m)
+	}
+	if _, ok := back.(*Node).AsList(); ok {
+		t.Fatal("a map should not be a list")
+	}
+
+	nd, err = WrapObject([]interface{}{"x", c}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := nd.AsList()
+	if !ok || len(l) != 2 || l[0] != "x" || l[1] != c {
+		t.Fatalf("unexpected list view: %v", l)
+	}
+	if _, ok := nd.AsMap(); ok {
+		t.Fatal("a list should not be a map")
+	}
+}
+
+func TestDecodeBytesOptions(t *testing.T) {
+	type Msg struct {
+		Text string
+		Data []byte
+		Any  interface{}
+	}
+	RegisterCborType(Msg{})
+
+	raw, err := Encode(map[string]interface{}{
+		"text": []byte("hello"),
+		"data": []byte{0, 1, 2, 255},
+		"any":  []byte("world"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DecodeInto keeps bytes as they are.
+	var generic map[string]interface{}
+	if err := DecodeInto(raw, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generic["data"].([]byte), []byte{0, 1, 2, 255}) {
+		t.Fatalf("bytes were not preserved: %v", generic["data"])
+	}
+
+	var msg Msg
+	if err := DecodeIntoWithOptions(raw, &msg, DecodeOptions{Bytes: BytesAsBase64}); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "aGVsbG8=" || msg.Any != "d29ybGQ=" || !bytes.Equal(msg.Data, []byte{0, 1, 2, 255}) {
+		t.Fatalf("unexpected decode: %#v", msg)
+	}
+
+	var untyped interface{}
+	if err := DecodeIntoWithOptions(raw, &untyped, DecodeOptions{Bytes: BytesError}); err != ErrUnexpectedBytes {
+		t.Fatalf("expected ErrUnexpectedBytes, got %v", err)
+	}
+}
+
+func TestWrapCache(t *testing.T) {
+	EnableWrapCache(2)
+	defer EnableWrapCache(0)
+
+	a, err := WrapObject(map[string]interface{}{"a": 1}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := WrapObject(map[string]interface{}{"a": 1}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != a {
+		t.Fatal("expected the cached node")
+	}
+
+	other, err := WrapObject(map[string]interface{}{"a": 1}, mh.SHA2_512, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == a || other.Cid().Prefix().MhType != mh.SHA2_512 {
+		t.Fatal("expected a node hashed with the requested function")
+	}
+
+	// Two more entries evict the first one.
+	if _, err := WrapObject(map[string]interface{}{"b": 1}, mh.SHA2_256, -1); err != nil {
+		t.Fatal(err)
+	}
+	evicted, err := WrapObject(map[string]interface{}{"a": 1}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted == a || !evicted.Cid().Equals(a.Cid()) {
+		t.Fatal("expected a fresh but equal node after eviction")
+	}
+}
+
+func TestDecodeCache(t *testing.T) {
+	EnableDecodeCache(1)
+	defer EnableDecodeCache(0)
+
+	a, err := WrapObject(map[string]interface{}{"a": 1}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := DecodeBlock(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DecodeBlock(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatal("expected the cached node")
+	}
+
+	// A block with the same CID but different data is decoded afresh.
+	bogus, err := blocks.NewBlockWithCid([]byte{0xa0}, a.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := DecodeBlock(bogus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := nd.(*Node).AsMap(); nd == first || len(m) != 0 {
+		t.Fatal("expected a node decoded from the block data")
+	}
+}
+
+func TestRegisterCborTag(t *testing.T) {
+	err := RegisterCborTag(0, time.Time{},
+		func(t time.Time) (string, error) {
+			return t.UTC().Format(time.RFC3339Nano), nil
+		},
+		func(s string) (time.Time, error) {
+			return time.Parse(time.RFC3339Nano, s)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCborTag(0, time.Time{}, nil, nil); err == nil {
+		t.Fatal("expected registering a tag twice to fail")
+	}
+	if err := RegisterCborTag(CBORTagLink, time.Time{}, nil, nil); err == nil {
+		t.Fatal("expected the link tag to be refused")
+	}
+	if err := RegisterCborTag(1, time.Duration(0), "bogus", nil); err == nil {
+		t.Fatal("expected malformed transforms to be refused")
+	}
+
+	when := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	nd, err := WrapObject(map[string]interface{}{"when": when}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"when": 0("2020-05-17T10:30:00Z")}
+	if !bytes.HasPrefix(nd.RawData()[6:], []byte{0xc0, 0x74}) {
+		t.Fatalf("unexpected encoding %x", nd.RawData())
+	}
+
+	val, _, err := nd.Resolve([]string{"when"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := val.(time.Time); !ok || !got.Equal(when) {
+		t.Fatalf("expected %s, got %#v", when, val)
+	}
+
+	// Decoding again re-encodes deterministically.
+	nd2, err := Decode(nd.RawData(), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd2.Cid().Equals(nd.Cid()) {
+		t.Fatal("expected the same cid after a roundtrip")
+	}
+
+	if err := validateDagCBOR(nd.RawData()); !errors.Is(err, ErrNotDagCBOR) {
+		t.Fatalf("expected strict dag-cbor to reject the tag, got %v", err)
+	}
+}
+
+func TestCanonicalizeBytes(t *testing.T) {
+	// {"b": 1, "a": [_ 1.5, 0x18 0x02], "c": (_ "he" "llo")}, with a float32,
+	// a non-minimal int, an indefinite array and an indefinite string.
+	in := []byte{
+		0xa3,
+		0x61, 'b', 0x01,
+		0x61, 'a', 0x9f, 0xfa, 0x3f, 0xc0, 0x00, 0x00, 0x18, 0x02, 0xff,
+		0x61, 'c', 0x7f, 0x62, 'h', 'e', 0x63, 'l', 'l', 'o', 0xff,
+	}
+	out, report, err := CanonicalizeX(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic interface{}
+	if err := DecodeInto(in, &generic); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(generic, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, nd.RawData()) {
+		t.Fatalf("expected %x, got %x", nd.RawData(), out)
+	}
+	expected := CanonicalizeReport{ReorderedMaps: 1, ReencodedHeaders: 1, IndefiniteLengths: 2, WidenedFloats: 1}
+	if report != expected {
+		t.Fatalf("expected report %+v, got %+v", expected, report)
+	}
+
+	again, report, err := CanonicalizeX(out)
+	if err != nil || !bytes.Equal(again, out) || report.Changed() {
+		t.Fatalf("expected canonical input to be unchanged, got %x %+v %v", again, report, err)
+	}
+
+	for _, bad := range [][]byte{
+		{0xa1, 0x01, 0x01},                       // integer key
+		{0xa2, 0x61, 'a', 0x01, 0x61, 'a', 0x02}, // duplicate key
+		{0xc1, 0x01},                             // tag 1
+		{0xf7},                                   // undefined
+	} {
+		if _, err := Canonicalize(bad); !errors.Is(err, ErrNotDagCBOR) {
+			t.Fatalf("expected ErrNotDagCBOR for %x, got %v", bad, err)
+		}
+	}
+
+	fixture, err := os.ReadFile("test_objects/non-canon.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err = Decode(fixture, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = Canonicalize(fixture)
+	if err != nil || !bytes.Equal(out, nd.RawData()) {
+		t.Fatalf("expected the fixture to canonicalize as Decode does, got %v", err)
+	}
+}
+
+type testDupKeys struct {
+	A int
+	B map[string]int
+}
+
+func TestDecodeDuplicateKeys(t *testing.T) {
+	// {"a": 1, "b": {"x": 1, "x": 2}, "a": 2}
+	b := []byte{
+		0xa3,
+		0x61, 'a', 0x01,
+		0x61, 'b', 0xa2, 0x61, 'x', 0x01, 0x61, 'x', 0x02,
+		0x61, 'a', 0x02,
+	}
+
+	var strict testDupKeys
+	err := DecodeIntoWithOptions(b, &strict, DecodeOptions{DuplicateKeys: DuplicateKeysError})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	var first testDupKeys
+	if err := DecodeIntoWithOptions(b, &first, DecodeOptions{DuplicateKeys: DuplicateKeysKeepFirst}); err != nil {
+		t.Fatal(err)
+	}
+	if first.A != 1 || first.B["x"] != 1 {
+		t.Fatalf("expected the first values, got %+v", first)
+	}
+
+	var last interface{}
+	if err := DecodeIntoWithOptions(b, &last, DecodeOptions{DuplicateKeys: DuplicateKeysKeepLast}); err != nil {
+		t.Fatal(err)
+	}
+	m := last.(map[string]interface{})
+	if m["a"] != 2 || m["b"].(map[string]interface{})["x"] != 2 {
+		t.Fatalf("expected the last values, got %v", last)
+	}
+
+	var clean testDupKeys
+	if err := DecodeIntoWithOptions([]byte{0xa1, 0x61, 'a', 0x05}, &clean, DecodeOptions{DuplicateKeys: DuplicateKeysError}); err != nil || clean.A != 5 {
+		t.Fatalf("expected data without duplicates to decode, got %+v %v", clean, err)
+	}
+}
+
+func TestResolvePartial(t *testing.T) {
+	nd, err := WrapObject(map[string]interface{}{
+		"a": map[string]interface{}{"b": "leaf"},
+		"n": 3,
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := nd.Resolve([]string{"a", "b", "c"}); err != ErrNoLinks {
+		t.Fatalf("expected ErrNoLinks from Resolve, got %v", err)
+	}
+	v, rest, err := nd.ResolvePartial([]string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "leaf" || !reflect.DeepEqual(rest, []string{"c", "d"}) {
+		t.Fatalf("got %v, %v", v, rest)
+	}
+	v, rest, err = nd.ResolvePartial([]string{"a"})
+	if err != nil || len(rest) != 0 || !reflect.DeepEqual(v, map[string]interface{}{"b": "leaf"}) {
+		t.Fatalf("got %v, %v, %v", v, rest, err)
+	}
+	if _, _, err := nd.ResolvePartial([]string{"missing", "x"}); err != ErrNoSuchLink {
+		t.Fatalf("expected ErrNoSuchLink, got %v", err)
+	}
+}
+
+func TestHasPath(t *testing.T) {
+	leaf, err := WrapObject("leaf", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(map[string]interface{}{
+		"a":    map[string]interface{}{"b": []interface{}{"x", "y"}},
+		"link": leaf.Cid(),
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a", "a/b", "a/b/1", "link"} {
+		if !nd.HasPath(p) {
+			t.Errorf("expected path %q", p)
+		}
+	}
+	for _, p := range []string{"", "b", "a/c", "a/b/2", "a/b/01", "a/b/-1", "link/foo"} {
+		if nd.HasPath(p) {
+			t.Errorf("unexpected path %q", p)
+		}
+	}
+
+	tree := nd.Tree("", -1)
+	for _, p := range tree {
+		if !nd.HasPath(p) {
+			t.Errorf("expected tree entry %q to exist", p)
+		}
+	}
+	if len(tree) != 5 {
+		t.Fatalf("unexpected tree %v", tree)
+	}
+}
+
+func TestForEachEntry(t *testing.T) {
+	nd, err := WrapObject(map[string]interface{}{
+		"list": []interface{}{
+			map[string]interface{}{"bb": 1, "a": 2, "ab": 3, "c": 4},
+		},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = nd.ForEachEntry([]string{"list", "0"}, func(k string, v interface{}) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a,c,ab,bb" {
+		t.Fatalf("unexpected order %v", keys)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = nd.ForEachEntry([]string{"list", "0"}, func(k string, v interface{}) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Fatalf("expected iteration to stop, got %v after %d entries", err, n)
+	}
+
+	if err := nd.ForEachEntry([]string{"list"}, func(string, interface{}) error { return nil }); err == nil {
+		t.Fatal("expected an error iterating over a list")
+	}
+	if err := nd.ForEachEntry([]string{"missing"}, func(string, interface{}) error { return nil }); err != ErrNoSuchLink {
+		t.Fatalf("expected ErrNoSuchLink, got %v", err)
+	}
+}
+
+func TestLenientLinks(t *testing.T) {
+	leaf, err := WrapObject("leaf", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := leaf.Cid().Bytes()
+	// {"l": 42(h'<cid without prefix>')}
+	b := append([]byte{0xa1, 0x61, 'l', 0xd8, 0x2a, 0x58, byte(len(cb))}, cb...)
+
+	var out map[string]cid.Cid
+	if err := DecodeInto(b, &out); err != ErrInvalidMultibase {
+		t.Fatalf("expected ErrInvalidMultibase, got %v", err)
+	}
+
+	SetLenientLinks(true)
+	defer SetLenientLinks(false)
+
+	var lenient map[string]cid.Cid
+	if err := DecodeInto(b, &lenient); err != nil {
+		t.Fatal(err)
+	}
+	if !lenient["l"].Equals(leaf.Cid()) {
+		t.Fatalf("expected %s, got %s", leaf.Cid(), lenient["l"])
+	}
+
+	nd, err := Decode(b, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := WrapObject(map[string]interface{}{"l": leaf.Cid()}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nd.RawData(), expected.RawData()) {
+		t.Fatalf("expected the link to be normalized, got %x", nd.RawData())
+	}
+
+	canon, report, err := CanonicalizeX(b)
+	if err != nil || !bytes.Equal(canon, expected.RawData()) || report.PrefixedLinks != 1 {
+		t.Fatalf("unexpected canonicalization %x %+v %v", canon, report, err)
+	}
+
+	if err := validateDagCBOR(b); err == nil {
+		t.Fatal("expected strict validation to refuse the link")
+	}
+}
+
+func TestDecodeArrayStream(t *testing.T) {
+	var elems []interface{}
+	for i := 0; i < 30; i++ {
+		elems = append(elems, map[string]interface{}{"i": i, "s": strings.Repeat("x", i)})
+	}
+	b, err := Encode(elems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, errc := DecodeArrayStream(bytes.NewReader(b), func() interface{} { return new(map[string]interface{}) })
+	n := 0
+	for v := range out {
+		m := *v.(*map[string]interface{})
+		if m["i"] != n {
+			t.Fatalf("expected element %d, got %v", n, m)
+		}
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != 30 {
+		t.Fatalf("expected 30 elements, got %d", n)
+	}
+
+	// [_ 1, "a"]
+	out, errc = DecodeArrayStream(bytes.NewReader([]byte{0x9f, 0x01, 0x61, 'a', 0xff}), nil)
+	var got []interface{}
+	for v := range out {
+		got = append(got, v)
+	}
+	if err := <-errc; err != nil || len(got) != 2 || got[0] != 1 || got[1] != "a" {
+		t.Fatalf("unexpected elements %v %v", got, err)
+	}
+
+	out, errc = DecodeArrayStream(bytes.NewReader(b[:len(b)-3]), nil)
+	for range out {
+	}
+	if err := <-errc; err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+type testEvolved struct {
+	Name  string
+	Level int
+	Inner testDupKeys
+}
+
+type testLazyLink struct {
+	c cid.Cid
+}
+
+type testProxyHolder struct {
+	Any  interface{}
+	Link cid.Cid
+}
+
+func TestDecodeOnLink(t *testing.T) {
+	c := cid.NewCidV0(u.Hash([]byte("something1")))
+	b, err := Encode(map[string]interface{}{
+		"any":  []interface{}{c, "x"},
+		"link": c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DecodeOptions{OnLink: func(c cid.Cid) interface{} { return &testLazyLink{c: c} }}
+
+	var generic interface{}
+	if err := DecodeIntoWithOptions(b, &generic, opts); err != nil {
+		t.Fatal(err)
+	}
+	m := generic.(map[string]interface{})
+	if p, ok := m["link"].(*testLazyLink); !ok || !p.c.Equals(c) {
+		t.Fatalf("expected a proxy, got %#v", m["link"])
+	}
+	if p, ok := m["any"].([]interface{})[0].(*testLazyLink); !ok || !p.c.Equals(c) {
+		t.Fatalf("expected a proxy in the list, got %#v", m["any"])
+	}
+
+	var typed testProxyHolder
+	if err := DecodeIntoWithOptions(b, &typed, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !typed.Link.Equals(c) {
+		t.Fatalf("expected the typed field to keep the cid, got %v", typed.Link)
+	}
+	if p, ok := typed.Any.([]interface{})[0].(*testLazyLink); !ok || !p.c.Equals(c) {
+		t.Fatalf("expected a proxy in the untyped field, got %#v", typed.Any)
+	}
+}
+
+func TestDecodeSchemaEvolution(t *testing.T) {
+	b, err := Encode(map[string]interface{}{
+		"name":  "v2",
+		"added": true,
+		"inner": map[string]interface{}{"a": 1, "extra": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strict testEvolved
+	if err := DecodeIntoWithOptions(b, &strict, DecodeOptions{}); err == nil {
+		t.Fatal("expected unknown fields to be refused by default")
+	}
+
+	var ignored testEvolved
+	if err := DecodeIntoWithOptions(b, &ignored, DecodeOptions{UnknownFields: UnknownFieldsIgnore}); err != nil {
+		t.Fatal(err)
+	}
+	if ignored.Name != "v2" || ignored.Inner.A != 1 {
+		t.Fatalf("unexpected value %+v", ignored)
+	}
+
+	opts := DecodeOptions{
+		UnknownFields: UnknownFieldsCollect,
+		Unknown:       map[string]interface{}{},
+		Defaults: map[reflect.Type]interface{}{
+			reflect.TypeOf(testEvolved{}): testEvolved{Name: "unnamed", Level: 3},
+			reflect.TypeOf(testDupKeys{}): testDupKeys{B: map[string]int{"default": 1}},
+		},
+	}
+	var collected testEvolved
+	if err := DecodeIntoWithOptions(b, &collected, opts); err != nil {
+		t.Fatal(err)
+	}
+	if collected.Name != "v2" || collected.Level != 3 || collected.Inner.A != 1 || collected.Inner.B["default"] != 1 {
+		t.Fatalf("unexpected value %+v", collected)
+	}
+	if len(opts.Unknown) != 2 || opts.Unknown["added"] != true || opts.Unknown["inner/extra"] != "x" {
+		t.Fatalf("unexpected unknown fields %v", opts.Unknown)
+	}
+}
+
+type testSigned struct {
+	Payload   RawCBOR
+	Signature []byte
+}
+
+func TestRawCBOR(t *testing.T) {
+	payload, err := Encode(map[string]interface{}{"b": 2, "a": []interface{}{1, "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Encode(testSigned{Payload: payload, Signature: []byte("sig")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, payload) {
+		t.Fatalf("expected %x to embed %x", b, payload)
+	}
+
+	var out testSigned
+	if err := DecodeInto(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Payload, payload) {
+		t.Fatalf("expected the payload bytes %x, got %x", payload, out.Payload)
+	}
+	var m map[string]interface{}
+	if err := out.Payload.Decode(&m); err != nil || m["b"] != 2 {
+		t.Fatalf("unexpected payload %v %v", m, err)
+	}
+
+	empty, err := Encode(testSigned{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emptyOut testSigned
+	if err := DecodeInto(empty, &emptyOut); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(emptyOut.Payload, []byte{0xf6}) {
+		t.Fatalf("expected an empty payload to encode as null, got %x", emptyOut.Payload)
+	}
+
+	// A payload that isn't canonical, here 1 encoded on two bytes, is
+	// captured verbatim, but can't be encoded into dag-cbor.
+	short, err := Encode(testSigned{Payload: RawCBOR{0x01}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := bytes.Replace(short, []byte("payload\x01"), []byte("payload\x18\x01"), 1)
+	if bytes.Equal(long, short) {
+		t.Fatalf("expected %x to embed the payload after its key", short)
+	}
+	var longOut testSigned
+	if err := DecodeInto(long, &longOut); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(longOut.Payload, []byte{0x18, 0x01}) {
+		t.Fatalf("expected the payload 1801, got %x", longOut.Payload)
+	}
+	var streamed testSigned
+	if err := DecodeReader(bytes.NewReader(long), &streamed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed.Payload, []byte{0x18, 0x01}) {
+		t.Fatalf("expected the streamed payload 1801, got %x", streamed.Payload)
+	}
+	if _, err := Encode(longOut); !errors.Is(err, ErrNotDagCBOR) {
+		t.Fatalf("expected ErrNotDagCBOR, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeWriter(&out, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("expected EncodeWriter to write %x, got %x", b, buf.Bytes())
+	}
+	nd, err := WrapObject(out, DefaultMultihash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nd.RawData(), b) {
+		t.Fatalf("expected WrapObject to encode %x, got %x", b, nd.RawData())
+	}
+	if v, _, err := nd.Resolve([]string{"payload", "b"}); err != nil || v != 2 {
+		t.Fatalf("unexpected payload value %v %v", v, err)
+	}
+	var cloned testSigned
+	if err := Clone(&out, &cloned); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cloned.Payload, payload) || string(cloned.Signature) != "sig" {
+		t.Fatalf("unexpected clone %+v", cloned)
+	}
+}
+
+func TestNewNodeFromParts(t *testing.T) {
+	nd, err := WrapObject(map[string]interface{}{"a": []interface{}{1, "b"}}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj interface{}
+	if err := DecodeInto(nd.RawData(), &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := NewNodeFromParts(nd.RawData(), nd.Cid(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !built.Cid().Equals(nd.Cid()) || !reflect.DeepEqual(built.Tree("", -1), nd.Tree("", -1)) {
+		t.Fatal("expected an equivalent node")
+	}
+
+	other := map[string]interface{}{"a": "other"}
+	if _, err := NewNodeFromParts(nd.RawData(), nd.Cid(), other); err == nil {
+		t.Fatal("expected a mismatched object to be refused")
+	}
+	wrong, err := WrapObject(other, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNodeFromParts(nd.RawData(), wrong.Cid(), obj); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+
+	if _, err := NewNodeFromPartsUnsafe(nd.RawData(), wrong.Cid(), other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	nd, err := WrapObject("link target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := nd.Cid()
+	in := map[interface{}]interface{}{
+		"list": []interface{}{map[interface{}]interface{}{"/": c.Bytes()}, 1},
+		"nested": map[string]interface{}{
+			"inner": map[interface{}]interface{}{"x": "y"},
+		},
+	}
+	out, err := Normalize(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"list": []interface{}{map[string]interface{}{"/": c}, 1},
+		"nested": map[string]interface{}{
+			"inner": map[string]interface{}{"x": "y"},
+		},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("got %#v, expected %#v", out, expected)
+	}
+
+	if _, err := Normalize(map[interface{}]interface{}{1: "a"}); err != ErrInvalidKeys {
+		t.Fatalf("expected ErrInvalidKeys, got %v", err)
+	}
+}
+
+type testOptionalLink struct {
+	Name  string
+	Link  cid.Cid
+	Links []cid.Cid
+}
+
+func TestUndefinedCidMode(t *testing.T) {
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &testOptionalLink{Name: "a", Links: []cid.Cid{target.Cid(), cid.Undef}}
+
+	_, err = DumpObject(obj)
+	if !errors.Is(err, ErrEmptyLink) || !strings.Contains(err.Error(), ".Link") {
+		t.Fatalf("expected an error naming the field, got %v", err)
+	}
+
+	defer SetUndefinedCidMode(UndefinedCidError)
+	for _, tc := range []struct {
+		mode     UndefinedCidMode
+		expected map[string]interface{}
+	}{
+		{UndefinedCidNull, map[string]interface{}{
+			"name": "a", "link": nil, "links": []interface{}{target.Cid(), nil},
+		}},
+		{UndefinedCidOmit, map[string]interface{}{
+			"name": "a", "links": []interface{}{target.Cid(), nil},
+		}},
+	} {
+		SetUndefinedCidMode(tc.mode)
+		b, err := DumpObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic map[string]interface{}
+		if err := DecodeInto(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(generic, tc.expected) {
+			t.Fatalf("mode %d: got %#v, expected %#v", tc.mode, generic, tc.expected)
+		}
+		var back testOptionalLink
+		if err := DecodeInto(b, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back.Link.Defined() || back.Links[1].Defined() || !back.Links[0].Equals(target.Cid()) {
+			t.Fatalf("mode %d: unexpected round trip %#v", tc.mode, back)
+		}
+
+		SetEncodeAudit(true)
+		_, err = DumpObject(obj)
+		SetEncodeAudit(false)
+		if err != nil {
+			t.Fatalf("mode %d: audit: %v", tc.mode, err)
+		}
+
+		nd, err := WrapObject(obj, DefaultMultihash, -1)
+		if err != nil {
+			t.Fatalf("mode %d: WrapObject: %v", tc.mode, err)
+		}
+		if !bytes.Equal(nd.RawData(), b) || len(nd.Links()) != 1 {
+			t.Fatalf("mode %d: unexpected node %x with links %v", tc.mode, nd.RawData(), nd.Links())
+		}
+		if v, _, err := nd.Resolve([]string{"links", "1"}); err != nil || v != nil {
+			t.Fatalf("mode %d: expected a null list item, got %#v %v", tc.mode, v, err)
+		}
+		c, err := NewMemCborStore().Put(context.Background(), obj)
+		if err != nil || !c.Equals(nd.Cid()) {
+			t.Fatalf("mode %d: Put gave %s %v, expected %s", tc.mode, c, err, nd.Cid())
+		}
+
+		// Decoding stays strict: only null decodes to an undefined CID.
+		emptyLink := []byte{0xd8, 0x2a, 0x40}
+		if _, err := Canonicalize(emptyLink); !errors.Is(err, ErrEmptyLink) {
+			t.Fatalf("mode %d: expected ErrEmptyLink from Canonicalize, got %v", tc.mode, err)
+		}
+		if _, err := ExtractLinks(emptyLink); !errors.Is(err, ErrEmptyLink) {
+			t.Fatalf("mode %d: expected ErrEmptyLink from ExtractLinks, got %v", tc.mode, err)
+		}
+		var link cid.Cid
+		if err := DecodeInto(emptyLink, &link); !errors.Is(err, ErrEmptyLink) {
+			t.Fatalf("mode %d: expected ErrEmptyLink from DecodeInto, got %v", tc.mode, err)
+		}
+	}
+
+	// The mode of an atlas is its own, whatever the package mode.
+	SetUndefinedCidMode(UndefinedCidError)
+	atl, err := NewAtlas(UndefinedCidAtlasEntry(UndefinedCidNull), findAtlasEntry(reflect.TypeOf(testOptionalLink{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewCborStore(newMockBlocks())
+	c, err := s.Put(WithAtlas(context.Background(), atl), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	if err := s.Get(context.Background(), c, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := generic["link"]; !ok || v != nil {
+		t.Fatalf("expected a null link, got %#v", generic)
+	}
+	if _, err := s.Put(context.Background(), obj); !errors.Is(err, ErrEmptyLink) {
+		t.Fatalf("expected the package mode to refuse undefined CIDs, got %v", err)
+	}
+}
+
+type testMaybeLink struct {
+	Parent MaybeCid
+}
+
+func TestMaybeCid(t *testing.T) {
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SomeCid(cid.Undef) != nil {
+		t.Fatal("expected an undefined cid to give an unset MaybeCid")
+	}
+
+	for _, m := range []MaybeCid{nil, SomeCid(target.Cid())} {
+		b, err := DumpObject(testMaybeLink{Parent: m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic map[string]interface{}
+		if err := DecodeInto(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			if c, ok := generic["parent"].(cid.Cid); !ok || !c.Equals(target.Cid()) {
+				t.Fatalf("expected a link, got %#v", generic["parent"])
+			}
+		} else if v, ok := generic["parent"]; !ok || v != nil {
+			t.Fatalf("expected null, got %#v", v)
+		}
+
+		var back testMaybeLink
+		if err := DecodeInto(b, &back); err != nil {
+			t.Fatal(err)
+		}
+		if (back.Parent == nil) != (m == nil) || (m != nil && !back.Parent.Equals(*m)) {
+			t.Fatalf("got %v, expected %v", back.Parent, m)
+		}
+	}
+}
+
+// testLossy gains a suffix on every encoding, so it never re-encodes to the
+// same bytes.
+type testLossy string
+
+func TestEncodeAudit(t *testing.T) {
+	defer SetEncodeAudit(false)
+	SetEncodeAudit(true)
+
+	if _, err := DumpObject(map[string]interface{}{"a": []interface{}{1, "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WrapObject(&testMaybeLink{}, mh.SHA2_256, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DumpObject(map[string]testLossy{"a": "x"})
+	if !errors.Is(err, ErrUnstableEncoding) || !strings.Contains(err.Error(), "offset") {
+		t.Fatalf("expected a detailed ErrUnstableEncoding, got %v", err)
+	}
+
+	SetEncodeAudit(false)
+	if _, err := DumpObject(map[string]testLossy{"a": "x"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBigRatAndUint256(t *testing.T) {
+	for _, tc := range []struct {
+		r   *big.Rat
+		hex string
+	}{
+		{big.NewRat(0, 1), "824041" + "01"},
+		{big.NewRat(6, 4), "82420003" + "4102"},
+		{big.NewRat(-1, 3), "82420101" + "4103"},
+	} {
+		b, err := DumpObject(tc.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(b) != tc.hex {
+			t.Fatalf("%s: got %x, expected %s", tc.r, b, tc.hex)
+		}
+		var back big.Rat
+		if err := DecodeInto(b, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back.Cmp(tc.r) != 0 {
+			t.Fatalf("got %s, expected %s", &back, tc.r)
+		}
+	}
+	for _, bad := range []string{
+		"8242000641" + "04", // not in lowest terms
+		"8240" + "4102",     // zero with a denominator
+		"824100" + "4101",   // sign byte without magnitude
+		"82420003" + "40",   // zero denominator
+	} {
+		b, _ := hex.DecodeString(bad)
+		var r big.Rat
+		if err := DecodeInto(b, &r); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	u, err := Uint256FromBig(max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Uint256FromBig(new(big.Int).Add(max, big.NewInt(1))); err != ErrNonCanonicalNumber {
+		t.Fatalf("expected an overflow error, got %v", err)
+	}
+	small, _ := Uint256FromBig(big.NewInt(258))
+	b, err := DumpObject(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != "420102" {
+		t.Fatalf("got %x", b)
+	}
+	for _, v := range []Uint256{u, small, {}} {
+		b, err := DumpObject(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back Uint256
+		if err := DecodeInto(b, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back != v || back.Big().Cmp(v.Big()) != 0 {
+			t.Fatalf("got %x, expected %x", back, v)
+		}
+	}
+	var back Uint256
+	if err := DecodeInto([]byte{0x42, 0x00, 0x01}, &back); err == nil {
+		t.Fatal("expected leading zeros to be rejected")
+	}
+}
+
+type testCollections struct {
+	List  []string
+	Dict  map[string]int
+	Bytes []byte
+	Inner *testCollections
+}
+
+func TestNilCollectionMode(t *testing.T) {
+	empty := &testCollections{
+		List:  []string{},
+		Dict:  map[string]int{},
+		Bytes: []byte{},
+		Inner: &testCollections{List: []string{}, Dict: map[string]int{}, Bytes: []byte{}},
+	}
+	nils := &testCollections{Inner: &testCollections{}}
+
+	emptyNd, err := WrapObject(empty, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertCid(emptyNd.Cid(), "bafyreiboc7r32e6prqylagwcocvbz5mauddnoa273mqmysvhhh3vwx23ce"); err != nil {
+		t.Fatal(err)
+	}
+	nilNd, err := WrapObject(nils, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertCid(nilNd.Cid(), "bafyreic47axqa3qadlhvaqdcy7pp7rrzrwxnbfwpgx6ygenhclnunauboe"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetNilCollectionMode(NilCollectionNull)
+	SetNilCollectionMode(NilCollectionEmpty)
+	for _, obj := range []interface{}{nils, empty, map[string]interface{}{
+		"bytes": []byte(nil),
+		"dict":  map[string]int(nil),
+		"inner": map[string]interface{}{
+			"bytes": []byte{}, "dict": map[string]int(nil), "inner": nil, "list": []string(nil),
+		},
+		"list": []string(nil),
+	}} {
+		nd, err := WrapObject(obj, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nd.Cid().Equals(emptyNd.Cid()) {
+			t.Fatalf("%#v: got %s, expected %s", obj, nd.Cid(), emptyNd.Cid())
+		}
+		b, err := DumpObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, emptyNd.RawData()) {
+			t.Fatalf("DumpObject disagrees with WrapObject: %x", b)
+		}
+	}
+	if nils.List != nil || nils.Inner.Dict != nil {
+		t.Fatal("encoding modified the object")
+	}
+
+	var back testCollections
+	if err := DecodeInto(nilNd.RawData(), &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.List != nil || back.Dict != nil || back.Bytes != nil {
+		t.Fatalf("expected null to decode to nil collections, got %#v", back)
+	}
+}
+
+func TestWrapRaw(t *testing.T) {
+	data, err := DumpObject(map[string]interface{}{"looks": "like cbor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := WrapRaw(data, mh.SHA2_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Codec() != cid.Raw {
+		t.Fatalf("expected a raw node, got codec %d", leaf.Codec())
+	}
+	exp, _ := cid.NewPrefixV1(cid.Raw, mh.SHA2_256).Sum(data)
+	if !leaf.Cid().Equals(exp) {
+		t.Fatalf("got %s, expected %s", leaf.Cid(), exp)
+	}
+	data[0] = 0
+	if leaf.RawData()[0] == 0 {
+		t.Fatal("WrapRaw kept a reference to its input")
+	}
+	if len(leaf.Links()) != 0 {
+		t.Fatal("raw nodes have no links")
+	}
+	v, rest, err := leaf.Resolve(nil)
+	if err != nil || len(rest) != 0 || !bytes.Equal(v.([]byte), leaf.RawData()) {
+		t.Fatalf("unexpected resolution %v %v %v", v, rest, err)
+	}
+
+	meta, err := WrapObject(map[string]interface{}{"leaf": leaf.Cid()}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec() != cid.DagCBOR {
+		t.Fatalf("expected a dag-cbor node, got codec %d", meta.Codec())
+	}
+	lnk, _, err := meta.ResolveLink([]string{"leaf"})
+	if err != nil || !lnk.Cid.Equals(leaf.Cid()) {
+		t.Fatalf("expected a link to the leaf, got %v %v", lnk, err)
+	}
+}
+
+func TestNodeImmutability(t *testing.T) {
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(map[string]interface{}{
+		"link":  target.Cid(),
+		"bytes": []byte("data"),
+		"list":  []interface{}{1, 2},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links := nd.Links()
+	links[0].Cid = nd.Cid()
+	links[0] = nil
+	if nd.Links()[0] == nil || !nd.Links()[0].Cid.Equals(target.Cid()) {
+		t.Fatal("Links returned the node's own links")
+	}
+
+	tree := nd.Tree("", -1)
+	tree[0] = "changed"
+	if nd.Tree("", -1)[0] == "changed" {
+		t.Fatal("Tree returned the node's own paths")
+	}
+
+	cp := nd.Copy().(*Node)
+	b, _, err := cp.Resolve([]string{"bytes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.([]byte)[0] = 'X'
+	orig, _, _ := nd.Resolve([]string{"bytes"})
+	if string(orig.([]byte)) != "data" {
+		t.Fatal("Copy shares byte slices with the original")
+	}
+	cp.LinksUnsafe()[0].Cid = nd.Cid()
+	if !nd.Links()[0].Cid.Equals(target.Cid()) {
+		t.Fatal("Copy shares links with the original")
+	}
+}
+
+type testOmitEmpty struct {
+	Name    string
+	Link    cid.Cid
+	Parent  *cid.Cid
+	Balance big.Int
+	Amount  *big.Int
+}
+
+func TestOmitEmptyCidsAndBigInts(t *testing.T) {
+	b, err := DumpObject(testOmitEmpty{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	if err := DecodeInto(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(generic, map[string]interface{}{"name": "a"}) {
+		t.Fatalf("expected empty fields to be omitted, got %v", generic)
+	}
+	var back testOmitEmpty
+	if err := DecodeInto(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Link.Defined() || back.Parent != nil || back.Amount != nil || back.Balance.Sign() != 0 {
+		t.Fatalf("unexpected decoded value %#v", back)
+	}
+
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := target.Cid()
+	full := testOmitEmpty{Name: "b", Link: c, Parent: &c, Amount: big.NewInt(0)}
+	full.Balance.SetInt64(7)
+	b, err = DumpObject(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	if err := DecodeInto(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if len(generic) != 5 {
+		t.Fatalf("expected every field to be encoded, got %v", generic)
+	}
+	back = testOmitEmpty{}
+	if err := DecodeInto(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Link.Equals(c) || !back.Parent.Equals(c) || back.Balance.Int64() != 7 || back.Amount == nil {
+		t.Fatalf("unexpected decoded value %#v", back)
+	}
+
+	// Without the option, undefined links still fail.
+	if _, err := DumpObject(testOptionalLink{Name: "a"}); !errors.Is(err, ErrEmptyLink) {
+		t.Fatalf("expected ErrEmptyLink, got %v", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s, err := CompileSchema(`
+		# A chain of blocks.
+		type Block struct {
+			parent nullable &Block
+			height Int
+			memo optional String
+			messages [&Any]
+			balances {String:Balance}
+			tags Tags
+		}
+		type Balance Int
+		type Tags [nullable String]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"parent":   nil,
+			"height":   1,
+			"messages": []interface{}{target.Cid()},
+			"balances": map[string]interface{}{"a": 2},
+			"tags":     []interface{}{"x", nil},
+		}
+	}
+	check := func(obj map[string]interface{}, expPath string) {
+		t.Helper()
+		nd, err := WrapObject(obj, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Validate(nd)
+		if expPath == "" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if !errors.Is(err, ErrSchemaViolation) || !strings.Contains(err.Error(), " at "+expPath+":") {
+			t.Fatalf("expected a violation at %s, got %v", expPath, err)
+		}
+	}
+
+	check(valid(), "")
+	obj := valid()
+	obj["parent"] = target.Cid()
+	obj["memo"] = "hi"
+	check(obj, "")
+
+	obj = valid()
+	delete(obj, "height")
+	check(obj, "/")
+	obj = valid()
+	obj["extra"] = true
+	check(obj, "/")
+	obj = valid()
+	obj["height"] = "one"
+	check(obj, "/height")
+	obj = valid()
+	obj["messages"] = []interface{}{"not a link"}
+	check(obj, "/messages/0")
+	obj = valid()
+	obj["balances"] = map[string]interface{}{"a": 1.5}
+	check(obj, "/balances/a")
+	obj = valid()
+	obj["memo"] = nil
+	check(obj, "/memo")
+
+	for _, bad := range []string{
+		"",
+		"type A struct { a Missing }",
+		"type A [&Missing]",
+		"type A Int type A String",
+		"type A {Int:String}",
+		"type A struct { a Int",
+	} {
+		if _, err := CompileSchema(bad); err == nil {
+			t.Fatalf("expected %q not to compile", bad)
+		}
+	}
+}
+
+func TestMarshalObjJSON(t *testing.T) {
+	target, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := testOmitEmpty{Name: "a", Link: target.Cid()}
+	obj.Balance.SetInt64(7)
+
+	js, err := MarshalObjJSON(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"balance":"Bw==","link":{"/":"` + target.Cid().String() + `"},"name":"a"}`
+	if string(js) != exp {
+		t.Fatalf("got %s, expected %s", js, exp)
+	}
+
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ndJSON, err := nd.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(js, ndJSON) {
+		t.Fatalf("MarshalObjJSON gave %s, Node.MarshalJSON %s", js, ndJSON)
+	}
+}
+
+type testIntegers struct {
+	Signed   int64
+	Unsigned uint64
+	Small    []int8
+	Float    float64
+	Any      interface{}
+}
+
+func TestDecodeIntegerBoundaries(t *testing.T) {
+	encode := func(v interface{}) []byte {
+		b, err := DumpObject(map[string]interface{}{"signed": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for _, v := range []interface{}{int64(math.MaxInt64), int64(math.MinInt64), 1 << 53, 1<<53 + 1} {
+		var out testIntegers
+		if err := DecodeInto(encode(v), &out); err != nil {
+			t.Fatalf("%v: %s", v, err)
+		}
+		if fmt.Sprint(out.Signed) != fmt.Sprint(v) {
+			t.Fatalf("decoded %d, expected %v", out.Signed, v)
+		}
+	}
+
+	var out testIntegers
+	err := DecodeInto(encode(uint64(math.MaxInt64)+1), &out)
+	if !errors.Is(err, ErrIntegerOverflow) {
+		t.Fatalf("expected ErrIntegerOverflow, got %v", err)
+	}
+
+	b, err := DumpObject(map[string]interface{}{"unsigned": uint64(math.MaxUint64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Unsigned != math.MaxUint64 {
+		t.Fatalf("decoded %d", out.Unsigned)
+	}
+
+	for _, v := range []int{127, -128} {
+		b, err := DumpObject(map[string]interface{}{"small": []int{0, v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := DecodeInto(b, &out); err != nil || int(out.Small[1]) != v {
+			t.Fatalf("%d: decoded %v (%v)", v, out.Small, err)
+		}
+	}
+	for _, v := range []int{128, -129, 300} {
+		b, err := DumpObject(map[string]interface{}{"small": []int{0, v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := DecodeInto(b, &out); !errors.Is(err, ErrIntegerOverflow) {
+			t.Fatalf("%d: expected ErrIntegerOverflow, got %v", v, err)
+		}
+		err = DecodeReader(bytes.NewReader(b), &out)
+		if !errors.Is(err, ErrIntegerOverflow) {
+			t.Fatalf("%d: expected ErrIntegerOverflow from DecodeReader, got %v", v, err)
+		}
+		if !strings.Contains(err.Error(), "/small/1") {
+			t.Fatalf("expected the error to name the path, got %v", err)
+		}
+	}
+
+	b, err = DumpObject(map[string]interface{}{"float": 1<<53 + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(b, &out); !errors.Is(err, ErrIntegerOverflow) {
+		t.Fatalf("expected ErrIntegerOverflow, got %v", err)
+	}
+	if err := DecodeIntoWithOptions(encode(uint64(math.MaxUint64)), &out, DecodeOptions{UnknownFields: UnknownFieldsIgnore}); !errors.Is(err, ErrIntegerOverflow) {
+		t.Fatalf("expected ErrIntegerOverflow from DecodeIntoWithOptions, got %v", err)
+	}
+
+	SetIntegerOverflowMode(IntegerOverflowWrap)
+	defer SetIntegerOverflowMode(IntegerOverflowError)
+	if err := DecodeInto(encode(uint64(math.MaxUint64)), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Signed != -1 {
+		t.Fatalf("expected wrapped value, got %d", out.Signed)
+	}
+}
+
+func TestDecodeLargeUintUntyped(t *testing.T) {
+	obj := map[string]interface{}{
+		"max":  uint64(math.MaxUint64),
+		"edge": uint64(math.MaxInt64) + 1,
+		"list": []interface{}{uint64(math.MaxUint64), int64(math.MinInt64)},
+	}
+	b, err := DumpObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic interface{}
+	if err := DecodeInto(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	m := generic.(map[string]interface{})
+	if m["max"] != uint64(math.MaxUint64) || m["edge"] != uint64(math.MaxInt64)+1 {
+		t.Fatalf("decoded %#v", m)
+	}
+	list := m["list"].([]interface{})
+	if list[0] != uint64(math.MaxUint64) || list[1] != math.MinInt64 {
+		t.Fatalf("decoded %#v", list)
+	}
+
+	var typed testIntegers
+	b, err = DumpObject(map[string]interface{}{"any": uint64(math.MaxUint64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(b, &typed); err != nil {
+		t.Fatal(err)
+	}
+	if typed.Any != uint64(math.MaxUint64) {
+		t.Fatalf("decoded %#v", typed.Any)
+	}
+
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := nd.Resolve([]string{"max"}); v != uint64(math.MaxUint64) {
+		t.Fatalf("resolved %#v", v)
+	}
+	back, err := Decode(nd.RawData(), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := back.Resolve([]string{"max"}); v != uint64(math.MaxUint64) {
+		t.Fatalf("resolved %#v after decoding", v)
+	}
+}
+
+type testFingerprinted struct {
+	Field string
+}
+
+func TestRegistryFingerprint(t *testing.T) {
+	fp := RegistryFingerprint()
+	if len(fp) != 64 {
+		t.Fatalf("unexpected fingerprint %q", fp)
+	}
+	if err := EnsureRegistryFingerprint(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterCborType(testFingerprinted{})
+	if err := EnsureRegistryFingerprint(fp); !errors.Is(err, ErrRegistryDrift) {
+		t.Fatalf("expected ErrRegistryDrift, got %v", err)
+	}
+
+	// Registration order doesn't matter.
+	saved := atlasEntries
+	defer func() { atlasEntries = saved }()
+	updated := RegistryFingerprint()
+	atlasEntries = append([]*atlas.AtlasEntry(nil), saved...)
+	for i, j := 0, len(atlasEntries)-1; i < j; i, j = i+1, j-1 {
+		atlasEntries[i], atlasEntries[j] = atlasEntries[j], atlasEntries[i]
+	}
+	if RegistryFingerprint() != updated {
+		t.Fatal("fingerprint depends on registration order")
+	}
+}
+
+type testCidMaps struct {
+	Refs map[cid.Cid]int
+	Meta map[cid.Cid]string
+}
+
+func TestCidMapAtlasEntry(t *testing.T) {
+	var links []cid.Cid
+	for _, s := range []string{"a", "b", "c"} {
+		nd, err := WrapObject(s, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, nd.Cid())
+	}
+	obj := testCidMaps{
+		Refs: map[cid.Cid]int{links[0]: 1, links[1]: 2, links[2]: 3},
+		Meta: map[cid.Cid]string{links[0]: "first", links[2]: "last"},
+	}
+
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := WrapObject(obj, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !again.Cid().Equals(nd.Cid()) {
+			t.Fatal("encoding of CID keyed maps is not deterministic")
+		}
+	}
+	if got := len(nd.Links()); got != len(obj.Refs) {
+		t.Fatalf("expected pair keys to be links, got %d links", got)
+	}
+	if v, _, err := nd.Resolve([]string{"meta", links[0].String()}); err != nil || v != "first" {
+		t.Fatalf("resolved %v (%v)", v, err)
+	}
+
+	var back testCidMaps
+	if err := DecodeInto(nd.RawData(), &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, obj) {
+		t.Fatalf("decoded %v, expected %v", back, obj)
+	}
+
+	var empty testCidMaps
+	if err := roundTripCidMaps(empty, &back); err != nil || back.Refs != nil || back.Meta != nil {
+		t.Fatalf("decoded %v (%v), expected nil maps", back, err)
+	}
+
+	dup, err := DumpObject(map[string]interface{}{
+		"refs": []interface{}{[]interface{}{links[0], 1}, []interface{}{links[0], 2}},
+		"meta": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(dup, &back); !errors.Is(err, ErrInvalidCidMap) {
+		t.Fatalf("expected ErrInvalidCidMap for duplicate keys, got %v", err)
+	}
+
+	v0 := cid.NewCidV0(links[0].Hash())
+	nonCanonical, err := DumpObject(map[string]interface{}{
+		"refs": nil,
+		"meta": map[string]string{"B" + strings.ToUpper(links[0].String()[1:]): "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(nonCanonical, &back); !errors.Is(err, ErrInvalidCidMap) {
+		t.Fatalf("expected ErrInvalidCidMap for a non-canonical key, got %v", err)
+	}
+	if err := roundTripCidMaps(testCidMaps{Meta: map[cid.Cid]string{v0: "v0"}}, &back); err != nil || back.Meta[v0] != "v0" {
+		t.Fatalf("decoded %v (%v)", back, err)
+	}
+}
+
+func roundTripCidMaps(obj testCidMaps, out *testCidMaps) error {
+	b, err := DumpObject(obj)
+	if err != nil {
+		return err
+	}
+	*out = testCidMaps{}
+	return DecodeInto(b, out)
+}
+
+func TestAppendToArray(t *testing.T) {
+	link, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := []interface{}{}
+	b, err := DumpObject(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cross the 1, 2 and 3 byte length header boundaries.
+	for i := 0; i < 300; i++ {
+		entry := map[string]interface{}{"seq": i, "link": link.Cid()}
+		if b, err = AppendToArray(b, entry); err != nil {
+			t.Fatal(err)
+		}
+		log = append(log, entry)
+		if i == 22 || i == 23 || i == 254 || i == 255 || i == 299 {
+			exp, err := DumpObject(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, exp) {
+				t.Fatalf("after %d appends, got %x, expected %x", i+1, b, exp)
+			}
+		}
+	}
+
+	b, err = AppendToArray(b, "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back []interface{}
+	if err := DecodeInto(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 302 || back[300] != "a" || back[301] != 1 {
+		t.Fatalf("unexpected tail %v", back[300:])
+	}
+
+	notArray, err := DumpObject(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendToArray(notArray, 1); err == nil {
+		t.Fatal("expected an error appending to a map")
+	}
+	if _, err := AppendToArray([]byte{0x9f, 0x01, 0xff}, 2); !errors.Is(err, ErrNotDagCBOR) {
+		t.Fatalf("expected ErrNotDagCBOR for an indefinite length array, got %v", err)
+	}
+	if _, err := AppendToArray(append(b, 0x01), 2); err == nil {
+		t.Fatal("expected an error with trailing bytes")
+	}
+}
+
+func TestResolveWithBudget(t *testing.T) {
+	leaf, err := WrapObject(map[string]interface{}{"value": "deep"}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := WrapObject(map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{"x", leaf.Cid()}},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	budget := &TraversalBudget{}
+	val, rest, err := root.ResolveWithBudget([]string{"a", "b", "1", "value"}, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, ok := val.(*node.Link)
+	if !ok || !lnk.Cid.Equals(leaf.Cid()) || len(rest) != 1 {
+		t.Fatalf("unexpected result %v %v", val, rest)
+	}
+	val, _, err = leaf.ResolveWithBudget(rest, budget)
+	if err != nil || val != "deep" {
+		t.Fatalf("unexpected result %v (%v)", val, err)
+	}
+	nodes, bytes := budget.Used()
+	// Both roots, a, b, b/1 and value.
+	if nodes != 6 || bytes != int64(len(root.RawData())+len(leaf.RawData())) {
+		t.Fatalf("used %d nodes and %d bytes", nodes, bytes)
+	}
+
+	if _, _, err := root.ResolveWithBudget([]string{"a", "b", "0"}, &TraversalBudget{MaxNodes: 3}); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	if _, _, err := root.ResolveWithBudget([]string{"a", "b", "0"}, &TraversalBudget{MaxNodes: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := root.ResolveWithBudget(nil, &TraversalBudget{MaxBytes: int64(len(root.RawData()) - 1)}); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	if _, _, err := root.ResolveWithBudget([]string{"a"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClonePoolSize(t *testing.T) {
+	SetClonerPoolSize(2)
+	defer SetClonerPoolSize(0)
+
+	orig := map[string]interface{}{"a": []interface{}{"b", 1}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cpy map[string]interface{}
+			if err := Clone(orig, &cpy); err != nil {
+				errs <- err
+				return
+			}
+			if !reflect.DeepEqual(cpy, orig) {
+				errs <- fmt.Errorf("cloned %v, expected %v", cpy, orig)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshalCanonicalJSON(t *testing.T) {
+	link, err := WrapObject("target", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{
+		"\U0001F600": 1,
+		"דּ":          2,
+		"b":          []interface{}{1e21, 1e-7, math.Copysign(0, -1), 0.1, 1.5, -2.0},
+		"a": map[string]interface{}{
+			"big":   uint64(math.MaxUint64),
+			"bytes": []byte{1, 2, 3, 4},
+			"link":  link.Cid(),
+			"str":   "<q\\\"\n\x01é>",
+			"null":  nil,
+			"t":     true,
+		},
+	}
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `{"a":{"big":18446744073709551615,"bytes":{"/":{"bytes":"AQIDBA"}},` +
+		`"link":{"/":"` + link.Cid().String() + `"},"null":null,"str":"<q\\\"\n\u0001é>","t":true},` +
+		`"b":[1e+21,1e-7,0,0.1,1.5,-2],"` + "\U0001F600" + `":1,"` + "דּ" + `":2}`
+	js, err := nd.MarshalCanonicalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != exp {
+		t.Fatalf("got      %s\nexpected %s", js, exp)
+	}
+
+	objJS, err := MarshalObjCanonicalJSON(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(objJS) != exp {
+		t.Fatalf("MarshalObjCanonicalJSON gave %s", objJS)
+	}
+
+	if _, err := MarshalObjCanonicalJSON(math.NaN()); err == nil {
+		t.Fatal("expected an error encoding NaN")
+	}
+}
+
+func TestStringLinks(t *testing.T) {
+	leaf, err := WrapObject("leaf", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := map[string]interface{}{
+		"l":     map[string]interface{}{"/": leaf.Cid().String()},
+		"list":  []interface{}{map[string]interface{}{"/": leaf.Cid().String()}},
+		"other": map[string]interface{}{"/": "not a cid"},
+	}
+	b, err := DumpObject(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := Decode(b, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nd.Links()) != 0 {
+		t.Fatalf("expected no links by default, got %v", nd.Links())
+	}
+
+	b2, err := DumpObject(map[string]interface{}{"l": legacy["l"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typed map[string]cid.Cid
+	if err := DecodeInto(b2, &typed); err == nil {
+		t.Fatal("expected string links not to decode into links by default")
+	}
+	if err := DecodeIntoWithOptions(b2, &typed, DecodeOptions{StringLinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !typed["l"].Equals(leaf.Cid()) {
+		t.Fatalf("expected %s, got %s", leaf.Cid(), typed["l"])
+	}
+
+	SetStringLinks(true)
+	defer SetStringLinks(false)
+
+	nd, err = Decode(b, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := nd.Links()
+	if len(links) != 2 || !links[0].Cid.Equals(leaf.Cid()) || !links[1].Cid.Equals(leaf.Cid()) {
+		t.Fatalf("expected two links to %s, got %v", leaf.Cid(), links)
+	}
+	lnk, rest, err := nd.ResolveLink([]string{"l", "x"})
+	if err != nil || !lnk.Cid.Equals(leaf.Cid()) || len(rest) != 1 {
+		t.Fatalf("unexpected resolution %v %v %v", lnk, rest, err)
+	}
+	other, _, err := nd.Resolve([]string{"other", "/"})
+	if err != nil || other != "not a cid" {
+		t.Fatalf("expected the invalid link to be kept, got %v %v", other, err)
+	}
+
+	var streamed interface{}
+	if err := DecodeReader(bytes.NewReader(b), &streamed); err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := streamed.(map[string]interface{})["l"].(cid.Cid); !ok || !l.Equals(leaf.Cid()) {
+		t.Fatalf("expected DecodeReader to normalize string links, got %v", streamed)
+	}
+}
+
+// testTuple stands in for a cbor-gen generated tuple type, which isn't
+// registered in the atlas.
+type testTuple struct {
+	Name  string
+	Count int
+}
+
+func (tt *testTuple) MarshalCBOR(w io.Writer) error {
+	return EncodeWriter([]interface{}{tt.Name, tt.Count}, w)
+}
+
+func (tt *testTuple) UnmarshalCBOR(r io.Reader) error {
+	var fields []interface{}
+	if err := DecodeReader(r, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 2 {
+		return fmt.Errorf("expected 2 fields, got %d", len(fields))
+	}
+	tt.Name, _ = fields[0].(string)
+	tt.Count, _ = fields[1].(int)
+	return nil
+}
+
+func TestCborGenObjects(t *testing.T) {
+	tuple := &testTuple{Name: "gen", Count: 3}
+	expected, err := Encode([]interface{}{"gen", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := DumpObject(tuple)
+	if err != nil || !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x %v", expected, b, err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWriter(tuple, &buf); err != nil || !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("expected %x, got %x %v", expected, buf.Bytes(), err)
+	}
+
+	nd, err := WrapObject(tuple, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nd.RawData(), expected) {
+		t.Fatalf("expected %x, got %x", expected, nd.RawData())
+	}
+	if name, _, err := nd.Resolve([]string{"0"}); err != nil || name != "gen" {
+		t.Fatalf("unexpected resolution %v %v", name, err)
+	}
+
+	var out testTuple
+	if err := DecodeInto(expected, &out); err != nil || out != *tuple {
+		t.Fatalf("unexpected decoding %+v %v", out, err)
+	}
+	out = testTuple{}
+	if err := DecodeReader(bytes.NewReader(expected), &out); err != nil || out != *tuple {
+		t.Fatalf("unexpected decoding %+v %v", out, err)
+	}
+	if err := DecodeInto([]byte{0x80}, &out); !errors.As(err, new(SerializationError)) {
+		t.Fatalf("expected a serialization error, got %v", err)
+	}
+}
+
+func TestUniqueLinks(t *testing.T) {
+	var leaves []cid.Cid
+	for _, s := range []string{"a", "b", "c"} {
+		nd, err := WrapObject(s, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, nd.Cid())
+	}
+	a, b, c := leaves[0], leaves[1], leaves[2]
+	nd, err := WrapObject(map[string]interface{}{
+		"zz":   a,
+		"y":    b,
+		"list": []interface{}{c, b},
+		"x":    map[string]interface{}{"self": c},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nd.Links()) != 5 {
+		t.Fatalf("expected Links to keep duplicates, got %d links", len(nd.Links()))
+	}
+
+	// Canonical key order is x, y, zz, list.
+	expected := []cid.Cid{c, b, a}
+	for i := 0; i < 10; i++ {
+		links := nd.UniqueLinks()
+		if len(links) != len(expected) {
+			t.Fatalf("expected %d links, got %d", len(expected), len(links))
+		}
+		for j, l := range links {
+			if !l.Cid.Equals(expected[j]) {
+				t.Fatalf("link %d: expected %s, got %s", j, expected[j], l.Cid)
+			}
+		}
+	}
+}
+
+type testColor int
+
+const (
+	testRed testColor = iota
+	testGreen
+	testBlue
+)
+
+func (c testColor) String() string {
+	switch c {
+	case testRed:
+		return "red"
+	case testGreen:
+		return "green"
+	case testBlue:
+		return "blue"
+	default:
+		return fmt.Sprintf("color(%d)", int(c))
+	}
+}
+
+func init() {
+	if err := RegisterEnum(testRed, testRed, testGreen, testBlue); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterEnum(t *testing.T) {
+	palette := map[string]testColor{"bg": testBlue, "fg": testRed}
+	b, err := Encode(palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Encode(map[string]interface{}{"bg": 2, "fg": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected enums to encode as ints, got %x", b)
+	}
+	var out map[string]testColor
+	if err := DecodeInto(b, &out); err != nil || out["bg"] != testBlue || out["fg"] != testRed {
+		t.Fatalf("unexpected decoding %v %v", out, err)
+	}
+
+	if _, err := Encode(map[string]testColor{"fg": 7}); !errors.Is(err, ErrUnknownEnumValue) || !strings.Contains(err.Error(), "color(7)") {
+		t.Fatalf("expected an unknown value to be refused, got %v", err)
+	}
+	bad, err := Encode(map[string]interface{}{"fg": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = nil
+	if err := DecodeInto(bad, &out); !errors.Is(err, ErrUnknownEnumValue) {
+		t.Fatalf("expected an unknown value to be refused, got %v", err)
+	}
+
+	if err := RegisterEnum(testRed, testRed); err == nil {
+		t.Fatal("expected a second registration to fail")
+	}
+	if err := RegisterEnum("red", "red"); err == nil {
+		t.Fatal("expected a string type to be refused")
+	}
+}
+
+type testHeaderV1 struct {
+	Height int
+	Miner  string
+}
+
+type testBlockV1 struct {
+	Header  testHeaderV1
+	Parents []cid.Cid
+	Memo    string
+}
+
+type testHeaderV2 struct {
+	Height int64
+	Miner  []byte
+}
+
+type testBlockV2 struct {
+	Header  *testHeaderV2
+	Parents []cid.Cid
+	Weight  int `refmt:",omitempty"`
+}
+
+// testHeaderSwapped encodes the fields of testHeaderV1 in declaration order
+// instead of canonical order.
+type testHeaderSwapped testHeaderV1
+
+func init() {
+	RegisterCborType(testHeaderV1{})
+	RegisterCborType(atlas.BuildEntry(testHeaderSwapped{}).StructMap().
+		AddField("Height", atlas.StructMapEntry{SerialName: "height"}).
+		AddField("Miner", atlas.StructMapEntry{SerialName: "miner"}).
+		Complete())
+}
+
+func TestCompatibleEncodings(t *testing.T) {
+	ok, diffs, err := CompatibleEncodings(testBlockV1{}, testBlockV1{})
+	if err != nil || !ok || len(diffs) != 0 {
+		t.Fatalf("expected a type to be compatible with itself, got %v %v %v", ok, diffs, err)
+	}
+
+	ok, diffs, err = CompatibleEncodings(testBlockV1{}, testBlockV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	expected := []string{
+		"memo: removed (string)",
+		"header.miner: type changed (string -> []uint8)",
+		"weight: added (int)",
+	}
+	if ok || strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected differences:\n%s", strings.Join(got, "\n"))
+	}
+
+	ok, diffs, err = CompatibleEncodings(testHeaderV1{}, testHeaderSwapped{})
+	if err != nil || ok || len(diffs) != 2 || diffs[0].Kind != FieldReordered {
+		t.Fatalf("expected a reordering, got %v %v %v", ok, diffs, err)
+	}
+
+	if _, _, err := CompatibleEncodings(testBlockV1{}, 1); err == nil {
+		t.Fatal("expected non-struct types to be refused")
+	}
+}
+
+func TestResolveInto(t *testing.T) {
+	leaf, err := WrapObject("leaf", mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(map[string]interface{}{
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"header":  map[string]interface{}{"height": 7, "miner": "m1"},
+				"parents": []cid.Cid{leaf.Cid()},
+			},
+		},
+		"tuple": []interface{}{"gen", 3},
+		"leaf":  leaf.Cid(),
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header testHeaderV1
+	if err := nd.ResolveInto([]string{"blocks", "0", "header"}, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Height != 7 || header.Miner != "m1" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	var parents []cid.Cid
+	if err := nd.ResolveInto([]string{"blocks", "0", "parents"}, &parents); err != nil || len(parents) != 1 || !parents[0].Equals(leaf.Cid()) {
+		t.Fatalf("unexpected parents %v %v", parents, err)
+	}
+	var tuple testTuple
+	if err := nd.ResolveInto([]string{"tuple"}, &tuple); err != nil || tuple.Name != "gen" || tuple.Count != 3 {
+		t.Fatalf("unexpected tuple %+v %v", tuple, err)
+	}
+	var c cid.Cid
+	if err := nd.ResolveInto([]string{"leaf"}, &c); err != nil || !c.Equals(leaf.Cid()) {
+		t.Fatalf("unexpected link %s %v", c, err)
+	}
+
+	if err := nd.ResolveInto([]string{"leaf", "x"}, new(interface{})); err == nil {
+		t.Fatal("expected a path crossing a link to fail")
+	}
+	if err := nd.ResolveInto([]string{"missing"}, new(interface{})); err != ErrNoSuchLink {
+		t.Fatalf("expected ErrNoSuchLink, got %v", err)
+	}
+	var height string
+	if err := nd.ResolveInto([]string{"blocks", "0", "header", "height"}, &height); err == nil {
+		t.Fatal("expected an integer not to decode into a string")
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	b, err := Encode(map[string]interface{}{
+		"header": map[string]interface{}{"height": 7, "miner": "m1"},
+		"big":    bytes.Repeat([]byte{1}, 1<<16),
+		"list":   []interface{}{1, []interface{}{2, 3}},
+		"name":   "block",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header testHeaderV1
+	var name string
+	missing := "untouched"
+	err = DecodeFields(b, []string{"header", "name", "missing"}, map[string]interface{}{
+		"header":  &header,
+		"name":    &name,
+		"missing": &missing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Height != 7 || header.Miner != "m1" || name != "block" || missing != "untouched" {
+		t.Fatalf("unexpected fields %+v %q %q", header, name, missing)
+	}
+
+	var list []interface{}
+	if err := DecodeFields(b, []string{"list"}, map[string]interface{}{"list": &list}); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected list %v %v", list, err)
+	}
+	if err := DecodeFields(b, []string{"name"}, map[string]interface{}{"name": new(int)}); err == nil {
+		t.Fatal("expected a string not to decode into an int")
+	}
+	if err := DecodeFields(b, []string{"name"}, nil); err == nil {
+		t.Fatal("expected a field without output to be refused")
+	}
+	arr, err := Encode([]interface{}{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeFields(arr, []string{"name"}, map[string]interface{}{"name": &name}); err == nil {
+		t.Fatal("expected a non-map value to be refused")
+	}
+
+	// Indefinite length maps end with a break instead of the next key.
+	indef := []byte{0xbf, 0x61, 'a', 0x01, 0x61, 'b', 0x82, 0x02, 0x03, 0xff}
+	var a int
+	var bl []int
+	if err := DecodeFields(indef, []string{"a", "b"}, map[string]interface{}{"a": &a, "b": &bl}); err != nil || a != 1 || len(bl) != 2 {
+		t.Fatalf("unexpected fields %d %v %v", a, bl, err)
+	}
+}
+
+// concurrentTypes numbers the types TestConcurrentRegistration registers,
+// which must be new on every run.
+var concurrentTypes int
+
+func TestConcurrentRegistration(t *testing.T) {
+	expected, err := WrapObject(testStruct(), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				nd, err := WrapObject(testStruct(), mh.SHA2_256, -1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !nd.Cid().Equals(expected.Cid()) {
+					t.Errorf("expected %s, got %s", expected.Cid(), nd.Cid())
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		concurrentTypes++
+		typ := reflect.StructOf([]reflect.StructField{{
+			Name: fmt.Sprintf("Concurrent%d", concurrentTypes),
+			Type: reflect.TypeOf(""),
+		}})
+		RegisterCborType(reflect.New(typ).Elem().Interface())
+		// Modes that don't change the encoding can be switched meanwhile
+		// too.
+		SetEncodeAudit(i%2 == 0)
+		SetLenientLinks(i%2 == 0)
+		SetCodecStats(i%2 == 0)
+	}
+	close(done)
+	wg.Wait()
+	SetEncodeAudit(false)
+	SetLenientLinks(false)
+	SetCodecStats(false)
+	ResetCodecStats()
+}
+
+func TestCodecStats(t *testing.T) {
+	SetCodecStats(true)
+	defer SetCodecStats(false)
+	ResetCodecStats()
+	defer ResetCodecStats()
+
+	for i := 0; i < 3; i++ {
+		if _, err := Encode("hot"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := EncodeWriter([]uint64{1, 2}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var out []uint64
+	if err := DecodeInto(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[reflect.Type]TypeStats)
+	for _, st := range CodecStats() {
+		got[st.Type] = st
+	}
+	if st := got[reflect.TypeOf("")]; st.Encodes != 3 || st.Decodes != 0 {
+		t.Fatalf("unexpected string stats %+v", st)
+	}
+	if st := got[reflect.TypeOf(out)]; st.Encodes != 1 || st.Decodes != 1 {
+		t.Fatalf("unexpected []uint64 stats %+v", st)
+	}
+
+	ResetCodecStats()
+	SetCodecStats(false)
+	if _, err := Encode("hot"); err != nil {
+		t.Fatal(err)
+	}
+	if st := CodecStats(); len(st) != 0 {
+		t.Fatalf("expected no stats, got %+v", st)
+	}
+}
@@ -0,0 +1,114 @@
+package cbornode
+
+import (
+	"errors"
+	"math/big"
+
+	atlas "github.com/polydawn/refmt/obj/atlas"
+)
+
+// ErrNonCanonicalNumber is returned when decoding a BigRatAtlasEntry or
+// Uint256 value that isn't in its canonical form, or doesn't fit.
+var ErrNonCanonicalNumber = errors.New("non-canonical number encoding")
+
+// BigRatAtlasEntry gives a canonical encoding for big.Rat. It is not included
+// in the entries by default.
+//
+// A rational is encoded in lowest terms as a two element array
+// [numerator, denominator] of byte strings. The numerator is empty for zero,
+// and otherwise a sign byte (0x00 for positive, 0x01 for negative) followed
+// by the big-endian magnitude without leading zeros. The denominator is the
+// positive big-endian magnitude without leading zeros. Anything else is
+// rejected with ErrNonCanonicalNumber when decoding.
+var BigRatAtlasEntry = atlas.BuildEntry(big.Rat{}).Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(
+		func(r big.Rat) ([][]byte, error) {
+			// big.Rat keeps itself normalized, so Num and Denom are already
+			// in lowest terms with a positive denominator.
+			var num []byte
+			switch r.Sign() {
+			case 1:
+				num = append([]byte{0}, r.Num().Bytes()...)
+			case -1:
+				num = append([]byte{1}, r.Num().Bytes()...)
+			default:
+				num = []byte{}
+			}
+			return [][]byte{num, r.Denom().Bytes()}, nil
+		})).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+		func(x [][]byte) (big.Rat, error) {
+			if len(x) != 2 {
+				return big.Rat{}, ErrNonCanonicalNumber
+			}
+			num, den := x[0], x[1]
+			if len(den) == 0 || den[0] == 0 {
+				return big.Rat{}, ErrNonCanonicalNumber
+			}
+			n := new(big.Int)
+			if len(num) > 0 {
+				if len(num) == 1 || num[1] == 0 || num[0] > 1 {
+					return big.Rat{}, ErrNonCanonicalNumber
+				}
+				n.SetBytes(num[1:])
+				if num[0] == 1 {
+					n.Neg(n)
+				}
+			}
+			d := new(big.Int).SetBytes(den)
+			if n.Sign() == 0 && d.Cmp(big.NewInt(1)) != 0 {
+				return big.Rat{}, ErrNonCanonicalNumber
+			}
+			if new(big.Int).GCD(nil, nil, new(big.Int).Abs(n), d).Cmp(big.NewInt(1)) > 0 {
+				return big.Rat{}, ErrNonCanonicalNumber
+			}
+			return *new(big.Rat).SetFrac(n, d), nil
+		})).
+	Complete()
+
+// Uint256 is a fixed-width 256-bit unsigned integer, stored big-endian.
+//
+// It is encoded as a byte string holding the big-endian value without
+// leading zeros, empty for zero, which is the same encoding BigIntAtlasEntry
+// uses for non-negative values. Decoding rejects leading zeros and values
+// wider than 32 bytes with ErrNonCanonicalNumber. Register Uint256AtlasEntry
+// to use it.
+type Uint256 [32]byte
+
+// Uint256AtlasEntry is the atlas entry for Uint256. It is not included in the
+// entries by default.
+var Uint256AtlasEntry = atlas.BuildEntry(Uint256{}).Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(
+		func(u Uint256) ([]byte, error) {
+			i := 0
+			for i < len(u) && u[i] == 0 {
+				i++
+			}
+			return append([]byte{}, u[i:]...), nil
+		})).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+		func(x []byte) (Uint256, error) {
+			var u Uint256
+			if len(x) > len(u) || (len(x) > 0 && x[0] == 0) {
+				return u, ErrNonCanonicalNumber
+			}
+			copy(u[len(u)-len(x):], x)
+			return u, nil
+		})).
+	Complete()
+
+// Uint256FromBig converts i to a Uint256. It fails with
+// ErrNonCanonicalNumber if i is negative or doesn't fit in 256 bits.
+func Uint256FromBig(i *big.Int) (Uint256, error) {
+	var u Uint256
+	if i.Sign() < 0 || i.BitLen() > 256 {
+		return u, ErrNonCanonicalNumber
+	}
+	i.FillBytes(u[:])
+	return u, nil
+}
+
+// Big returns u as a big.Int.
+func (u Uint256) Big() *big.Int {
+	return new(big.Int).SetBytes(u[:])
+}
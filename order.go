@@ -0,0 +1,78 @@
+package cbornode
+
+import (
+	"context"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// LinkOrder returns the links of n in the order they appear in its encoding,
+// including repeated links, which is the order a depth-first selector
+// traversal follows them in, such as the explore-all traversals of graphsync.
+// Unlike Links, the result only depends on the bytes of the Node.
+func LinkOrder(n *Node) []cid.Cid {
+	links, err := ExtractLinks(n.raw)
+	if err != nil {
+		// The Node decoded, so this only happens if the link modes changed
+		// since; fall back to its decoded data.
+		links = links[:0]
+		walkCanonical(n.obj, func(c cid.Cid) {
+			links = append(links, c)
+		})
+	}
+	out := links[:0]
+	for _, c := range links {
+		if c.Defined() {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// WalkOrdered calls visit on every block of the DAG rooted at root in
+// depth-first order, the parents before their children and the children in
+// LinkOrder, visiting each block once, where a remote selector traversal
+// first reaches it. Blocks are passed as stored, so that a block provider can
+// stream them in the order the requester will consume them. Blocks of other
+// codecs than dag-cbor are visited but their links aren't followed.
+func (s *BasicIpldStore) WalkOrdered(ctx context.Context, root cid.Cid, visit func(blk block.Block) error) error {
+	seen := cid.NewSet()
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if !seen.Visit(c) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pref := c.Prefix()
+		if err := s.checkPolicy(pref.Codec, pref.MhType); err != nil {
+			return err
+		}
+		blk, err := s.Blocks.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := s.verify(c, blk.RawData()); err != nil {
+			return err
+		}
+		if err := visit(blk); err != nil {
+			return err
+		}
+		if c.Type() != cid.DagCBOR {
+			return nil
+		}
+		nd, err := decodeBlock(blk)
+		if err != nil {
+			return err
+		}
+		for _, lnk := range LinkOrder(nd) {
+			if err := walk(lnk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
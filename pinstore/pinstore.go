@@ -0,0 +1,153 @@
+// Package pinstore adds reference counting and garbage collection to a
+// dag-cbor store, as a lightweight alternative to IPFS pinning.
+//
+// A Store counts, for every object written through it, the links pointing to
+// it from other objects written through it, plus the pins placed on it.
+// Objects whose count drops to zero are removed by GC, which in turn releases
+// the objects they link to.
+//
+// Counts are kept in memory: objects written before the Store was created, or
+// bypassing it, are neither tracked nor collected.
+package pinstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+// ErrNotPinned is returned by Unpin for objects that aren't pinned.
+var ErrNotPinned = errors.New("pinstore: object is not pinned")
+
+// Blockstore is a blockstore that can delete blocks.
+type Blockstore interface {
+	cbornode.IpldBlockstore
+	DeleteBlock(context.Context, cid.Cid) error
+}
+
+// Store is a reference counting IpldStore.
+type Store struct {
+	bs    Blockstore
+	inner *cbornode.BasicIpldStore
+
+	lk sync.Mutex
+	// links holds the links of every tracked object.
+	links map[cid.Cid][]cid.Cid
+	refs  map[cid.Cid]int
+	pins  map[cid.Cid]int
+}
+
+var _ cbornode.IpldStore = &Store{}
+
+// New returns a Store writing to bs.
+func New(bs Blockstore) *Store {
+	return &Store{
+		bs:    bs,
+		inner: cbornode.NewCborStore(bs),
+		links: make(map[cid.Cid][]cid.Cid),
+		refs:  make(map[cid.Cid]int),
+		pins:  make(map[cid.Cid]int),
+	}
+}
+
+// Get reads and unmarshals the content at `c` into `out`.
+func (s *Store) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	return s.inner.Get(ctx, c, out)
+}
+
+// Put writes `v` and counts a reference to each of its links, unless an
+// identical object was already written.
+func (s *Store) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	links, err := cbornode.LinksOf(v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := s.inner.Put(ctx, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, ok := s.links[c]; !ok {
+		s.links[c] = links
+		for _, l := range links {
+			s.refs[l]++
+		}
+	}
+	return c, nil
+}
+
+// Pin protects c, and everything it links to, from GC. Pins are counted: an
+// object pinned twice must be unpinned twice.
+func (s *Store) Pin(c cid.Cid) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.pins[c]++
+}
+
+// Unpin removes a pin placed on c by Pin.
+func (s *Store) Unpin(c cid.Cid) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.pins[c] == 0 {
+		return ErrNotPinned
+	}
+	s.pins[c]--
+	if s.pins[c] == 0 {
+		delete(s.pins, c)
+	}
+	return nil
+}
+
+// RefCount returns the number of tracked links to c plus its pins.
+func (s *Store) RefCount(c cid.Cid) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.refs[c] + s.pins[c]
+}
+
+// GC deletes the tracked objects that are neither pinned nor linked to by
+// another tracked object, and returns their CIDs. The store must not be
+// written to while GC runs.
+func (s *Store) GC(ctx context.Context) ([]cid.Cid, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var queue []cid.Cid
+	for c := range s.links {
+		if s.refs[c] == 0 && s.pins[c] == 0 {
+			queue = append(queue, c)
+		}
+	}
+
+	var removed []cid.Cid
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if err := s.bs.DeleteBlock(ctx, c); err != nil {
+			return removed, err
+		}
+		removed = append(removed, c)
+
+		links := s.links[c]
+		delete(s.links, c)
+		for _, l := range links {
+			s.refs[l]--
+			if s.refs[l] > 0 {
+				continue
+			}
+			delete(s.refs, l)
+			if _, tracked := s.links[l]; tracked && s.pins[l] == 0 {
+				queue = append(queue, l)
+			}
+		}
+	}
+	return removed, nil
+}
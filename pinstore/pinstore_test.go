@@ -0,0 +1,92 @@
+package pinstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+type memBlocks struct {
+	lk   sync.Mutex
+	data map[cid.Cid]block.Block
+}
+
+func newMemBlocks() *memBlocks {
+	return &memBlocks{data: make(map[cid.Cid]block.Block)}
+}
+
+func (mb *memBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+	if b, ok := mb.data[c]; ok {
+		return b, nil
+	}
+	return nil, errors.New("block not found")
+}
+
+func (mb *memBlocks) Put(ctx context.Context, b block.Block) error {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+	mb.data[b.Cid()] = b
+	return nil
+}
+
+func (mb *memBlocks) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+	delete(mb.data, c)
+	return nil
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	bs := newMemBlocks()
+	s := New(bs)
+
+	leaf, err := s.Put(ctx, "leaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid, err := s.Put(ctx, map[string]interface{}{"leaf": leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{"mid": mid, "leaf": leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing an object again doesn't count its links twice.
+	if _, err := s.Put(ctx, map[string]interface{}{"leaf": leaf}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.RefCount(leaf); n != 2 {
+		t.Fatalf("expected two references to the leaf, got %d", n)
+	}
+
+	s.Pin(root)
+	removed, err := s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("removed pinned objects: %v", removed)
+	}
+
+	if err := s.Unpin(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unpin(root); !errors.Is(err, ErrNotPinned) {
+		t.Fatalf("expected ErrNotPinned, got %v", err)
+	}
+	removed, err = s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 || len(bs.data) != 0 {
+		t.Fatalf("expected the whole graph to be removed, got %v", removed)
+	}
+}
@@ -0,0 +1,165 @@
+package cbornode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// The Cbor* types wrap primitive values so they can be stored on their own
+// or used as map values through the cbor-gen fast paths of IpldStore, which
+// is mostly handy in tests. Their Cid method returns the CID a
+// BasicIpldStore with default settings would assign them.
+
+// CborByteArray is a byte string.
+type CborByteArray []byte
+
+func (b CborByteArray) MarshalCBOR(w io.Writer) error {
+	return cbg.WriteByteArray(w, b)
+}
+
+func (b *CborByteArray) UnmarshalCBOR(r io.Reader) error {
+	maj, extra, err := cbg.CborReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte string, got major type %d", maj)
+	}
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("byte string too long: %d", extra)
+	}
+	// Reuse the existing buffer when it is large enough, but always resize
+	// it to the decoded length so no stale bytes remain.
+	if uint64(cap(*b)) < extra {
+		*b = make([]byte, extra)
+	}
+	*b = (*b)[:extra]
+	if _, err := io.ReadFull(r, *b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (b CborByteArray) Cid() (cid.Cid, error) {
+	return primitiveCid(b)
+}
+
+// CborString is a text string.
+type CborString string
+
+func (s CborString) MarshalCBOR(w io.Writer) error {
+	cw := cbg.NewCborWriter(w)
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := cw.WriteString(string(s))
+	return err
+}
+
+func (s *CborString) UnmarshalCBOR(r io.Reader) error {
+	str, err := cbg.ReadString(r)
+	if err != nil {
+		return err
+	}
+	*s = CborString(str)
+	return nil
+}
+
+func (s CborString) Cid() (cid.Cid, error) {
+	return primitiveCid(s)
+}
+
+// CborInt is a signed integer.
+type CborInt int64
+
+func (i CborInt) MarshalCBOR(w io.Writer) error {
+	return cbg.CborInt(i).MarshalCBOR(w)
+}
+
+func (i *CborInt) UnmarshalCBOR(r io.Reader) error {
+	return (*cbg.CborInt)(i).UnmarshalCBOR(r)
+}
+
+func (i CborInt) Cid() (cid.Cid, error) {
+	return primitiveCid(i)
+}
+
+// CborBool is a boolean.
+type CborBool bool
+
+func (b CborBool) MarshalCBOR(w io.Writer) error {
+	return cbg.CborBool(b).MarshalCBOR(w)
+}
+
+func (b *CborBool) UnmarshalCBOR(r io.Reader) error {
+	return (*cbg.CborBool)(b).UnmarshalCBOR(r)
+}
+
+func (b CborBool) Cid() (cid.Cid, error) {
+	return primitiveCid(b)
+}
+
+// CborCidList is a list of links, encoded in order, duplicates included. See
+// CborCidSet for an encoding that only depends on the set of links.
+type CborCidList []cid.Cid
+
+func (l CborCidList) MarshalCBOR(w io.Writer) error {
+	if err := cbg.WriteMajorTypeHeader(w, cbg.MajArray, uint64(len(l))); err != nil {
+		return err
+	}
+	for _, c := range l {
+		if err := cbg.WriteCid(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *CborCidList) UnmarshalCBOR(r io.Reader) error {
+	maj, extra, err := cbg.CborReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected array, got major type %d", maj)
+	}
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("list too long: %d", extra)
+	}
+	out := make(CborCidList, extra)
+	for i := range out {
+		if out[i], err = cbg.ReadCid(r); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	*l = out
+	return nil
+}
+
+func (l CborCidList) Cid() (cid.Cid, error) {
+	return primitiveCid(l)
+}
+
+func primitiveCid(v cbg.CBORMarshaler) (cid.Cid, error) {
+	buf := new(bytes.Buffer)
+	if err := v.MarshalCBOR(buf); err != nil {
+		return cid.Undef, err
+	}
+	cs := snapshot()
+	return cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   cs.storeMultihash,
+		MhLength: cs.defaultMhLen,
+	}.Sum(buf.Bytes())
+}
@@ -0,0 +1,97 @@
+package cbornode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	node "github.com/ipfs/go-ipld-format"
+)
+
+// ErrInvalidProof is returned by VerifyProof when a proof is incomplete or
+// contains blocks that don't match their CIDs.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// Proof is a Merkle proof of the value at a path inside a dag-cbor DAG: the
+// blocks traversed to resolve the path, starting with the root.
+type Proof struct {
+	Blocks []block.Block
+}
+
+// Prove resolves path, a slash separated path, starting at the node root and
+// returns a proof made of the blocks traversed on the way. Registered lenses
+// are not used: the proof follows the raw encoded structure.
+func Prove(ctx context.Context, store IpldStore, root cid.Cid, path string) (Proof, error) {
+	var proof Proof
+	cur, rest := root, splitProofPath(path)
+	for {
+		nd, err := GetNode(ctx, store, cur)
+		if err != nil {
+			return Proof{}, err
+		}
+		proof.Blocks = append(proof.Blocks, nd)
+
+		val, tail, err := nd.Resolve(rest)
+		if err != nil {
+			return Proof{}, err
+		}
+		lnk, ok := val.(*node.Link)
+		if !ok || len(tail) == 0 {
+			return proof, nil
+		}
+		cur, rest = lnk.Cid, tail
+	}
+}
+
+// VerifyProof checks that proof proves a value at path under root, and
+// returns that value as Node.Resolve would. Every block of the proof is
+// re-hashed, so the returned value can be trusted as long as root is.
+func VerifyProof(root cid.Cid, path string, proof Proof) (interface{}, error) {
+	blks := make(map[cid.Cid]block.Block, len(proof.Blocks))
+	for _, blk := range proof.Blocks {
+		actual, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		if !actual.Equals(blk.Cid()) {
+			return nil, fmt.Errorf("%w: block %s does not match its data", ErrInvalidProof, blk.Cid())
+		}
+		blks[blk.Cid()] = blk
+	}
+
+	cur, rest := root, splitProofPath(path)
+	for {
+		blk, ok := blks[cur]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing block %s", ErrInvalidProof, cur)
+		}
+		if cur.Type() != cid.DagCBOR {
+			return nil, fmt.Errorf("%w: block %s is not dag-cbor", ErrInvalidProof, cur)
+		}
+		nd, err := decodeBlock(blk)
+		if err != nil {
+			return nil, err
+		}
+
+		val, tail, err := nd.Resolve(rest)
+		if err != nil {
+			return nil, err
+		}
+		lnk, ok := val.(*node.Link)
+		if !ok || len(tail) == 0 {
+			return val, nil
+		}
+		cur, rest = lnk.Cid, tail
+	}
+}
+
+func splitProofPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,141 @@
+package cbornode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrQuotaExceeded is returned by a quota store when an access would exceed
+// a quota.
+var ErrQuotaExceeded = errors.New("store quota exceeded")
+
+// Quota limits the bytes and blocks written through a quota store. A zero
+// limit is unlimited. A Quota may be shared between stores and goroutines.
+type Quota struct {
+	MaxBytes  int64
+	MaxBlocks int64
+	// CountGets makes reads count against the quota too, for limiting
+	// bandwidth rather than storage.
+	CountGets bool
+
+	lk     sync.Mutex
+	bytes  int64
+	blocks int64
+}
+
+// Usage returns the bytes and blocks counted against the quota so far.
+func (q *Quota) Usage() (bytes, blocks int64) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.bytes, q.blocks
+}
+
+func (q *Quota) reserve(n int64) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.MaxBytes > 0 && q.bytes+n > q.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more requested", ErrQuotaExceeded, q.bytes, q.MaxBytes, n)
+	}
+	if q.MaxBlocks > 0 && q.blocks+1 > q.MaxBlocks {
+		return fmt.Errorf("%w: all %d blocks used", ErrQuotaExceeded, q.MaxBlocks)
+	}
+	q.bytes += n
+	q.blocks++
+	return nil
+}
+
+func (q *Quota) release(n int64) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.bytes -= n
+	q.blocks--
+}
+
+type quotaKey struct{}
+
+// WithQuota returns a context whose accesses through a quota store are
+// counted against q, in addition to the store's own quota.
+func WithQuota(ctx context.Context, q *Quota) context.Context {
+	return context.WithValue(ctx, quotaKey{}, q)
+}
+
+// NewQuotaStore returns an IpldStore counting the objects written to inner
+// against global, which may be nil, and against the quota attached to the
+// context of each call with WithQuota, if any. Calls exceeding either quota
+// fail with an ErrQuotaExceeded error without reaching inner.
+func NewQuotaStore(inner IpldStore, global *Quota) IpldStore {
+	return &quotaStore{inner: inner, global: global}
+}
+
+type quotaStore struct {
+	inner  IpldStore
+	global *Quota
+}
+
+// quotas returns the quotas applying to a call, keeping those counting gets
+// only if get is set.
+func (s *quotaStore) quotas(ctx context.Context, get bool) []*Quota {
+	var qs []*Quota
+	if s.global != nil && (!get || s.global.CountGets) {
+		qs = append(qs, s.global)
+	}
+	if q, ok := ctx.Value(quotaKey{}).(*Quota); ok && q != s.global && (!get || q.CountGets) {
+		qs = append(qs, q)
+	}
+	return qs
+}
+
+// charge counts n bytes against every quota in qs, or none of them.
+func charge(qs []*Quota, n int64) error {
+	for i, q := range qs {
+		if err := q.reserve(n); err != nil {
+			for _, r := range qs[:i] {
+				r.release(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *quotaStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	qs := s.quotas(ctx, true)
+	if len(qs) == 0 {
+		return s.inner.Get(ctx, c, out)
+	}
+	var raw rawCapture
+	if err := s.inner.Get(ctx, c, &raw); err != nil {
+		return err
+	}
+	if err := charge(qs, int64(len(raw))); err != nil {
+		return err
+	}
+	return decodeForStore(s.inner, raw, out)
+}
+
+func (s *quotaStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	qs := s.quotas(ctx, false)
+	if len(qs) == 0 {
+		return s.inner.Put(ctx, v)
+	}
+	data, c, err := encodeForStore(s.inner, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	n := int64(len(data))
+	if err := charge(qs, n); err != nil {
+		return cid.Undef, err
+	}
+	c, err = s.inner.Put(ctx, &rawObject{data: data, cid: c})
+	if err != nil {
+		for _, q := range qs {
+			q.release(n)
+		}
+		return cid.Undef, err
+	}
+	return c, nil
+}
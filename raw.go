@@ -0,0 +1,174 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+
+	"github.com/polydawn/refmt/obj/atlas"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// RawCBOR holds the encoding of a single CBOR item, like json.RawMessage does
+// for JSON. Fields of type RawCBOR capture the encoding of their value on
+// decode and embed it on encode, which allows deferring the decoding of
+// nested objects, or verifying signatures over them.
+//
+// Both are verbatim: decoding keeps the exact bytes the value was read from,
+// and encoding writes the bytes as they are, after checking that they hold a
+// single strictly encoded dag-cbor item. An empty RawCBOR encodes as null.
+// Decoding with an atlas of your own, as DecodeIntoWithOptions and
+// BasicIpldStore.Atlas allow, or with the fxamacker backend captures the
+// canonical encoding of the value instead.
+type RawCBOR []byte
+
+// rawSplice is what RawCBOR values marshal to: refmt's encoder cannot write
+// preset bytes, so it writes them as a byte string under rawSpliceTag, which
+// spliceRaw then strips.
+type rawSplice []byte
+
+// rawSpliceTag is a tag no dag-cbor data uses, encoding on four bytes to make
+// its header unlikely elsewhere.
+const rawSpliceTag = 0x63626f72
+
+var rawSpliceHeader = []byte{0xda, 0x63, 0x62, 0x6f, 0x72}
+
+// errRawSplice is returned when decoding or cloning meets a rawSplice, which
+// only exists between marshalling and spliceRaw. Cloners fail with it on
+// RawCBOR values, which are then copied by encoding and decoding them.
+var errRawSplice = errors.New("cbor: raw item placeholder outside an encoding")
+
+var rawCBORAtlasEntry = atlas.BuildEntry(RawCBOR{}).Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(marshalRawCBOR)).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+		func(v interface{}) (RawCBOR, error) {
+			return Encode(v)
+		})).
+	Complete()
+
+var rawSpliceAtlasEntry = atlas.BuildEntry(rawSplice{}).
+	UseTag(rawSpliceTag).
+	Transform().
+	TransformMarshal(atlas.MakeMarshalTransformFunc(
+		func(r rawSplice) ([]byte, error) {
+			return r, nil
+		})).
+	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+		func([]byte) (rawSplice, error) {
+			return nil, errRawSplice
+		})).
+	Complete()
+
+func marshalRawCBOR(r RawCBOR) (interface{}, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	if err := validateDagCBOR(r); err != nil {
+		return nil, err
+	}
+	return rawSplice(r), nil
+}
+
+// capturingAtlasEntry is the RawCBOR entry of the atlases built for
+// encoding.NewUnmarshallerCapturing, keeping the bytes the value was read
+// from.
+func capturingAtlasEntry(captured func() []byte) *atlas.AtlasEntry {
+	return atlas.BuildEntry(RawCBOR{}).Transform().
+		TransformMarshal(atlas.MakeMarshalTransformFunc(marshalRawCBOR)).
+		TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+			func(v interface{}) (RawCBOR, error) {
+				if b := captured(); b != nil {
+					return append(RawCBOR(nil), b...), nil
+				}
+				return Encode(v)
+			})).
+		Complete()
+}
+
+// spliceRaw replaces the tagged byte strings RawCBOR values marshal to with
+// their content.
+func spliceRaw(b []byte) ([]byte, error) {
+	if !bytes.Contains(b, rawSpliceHeader) {
+		return b, nil
+	}
+	var out []byte
+	last, tag := 0, -1
+	err := encoding.TokenWalk(b, func(tok encoding.Token) error {
+		switch {
+		case tag >= 0:
+			out = append(out, b[last:tag]...)
+			out = append(out, tok.Bytes...)
+			last = tok.Offset + headerLen(tok.Info) + len(tok.Bytes)
+			tag = -1
+		case tok.Major == encoding.MajTag && tok.Value == rawSpliceTag:
+			tag = tok.Offset
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return b, nil
+	}
+	return append(out, b[last:]...), nil
+}
+
+var (
+	rawCBORType   = reflect.TypeOf(RawCBOR{})
+	rawSpliceType = reflect.TypeOf(rawSplice{})
+)
+
+// holdsRaw reports whether obj may hold a RawCBOR, whose encoding needs
+// spliceRaw and so can't be streamed.
+func (cs *codecs) holdsRaw(obj interface{}) bool {
+	t := reflect.TypeOf(obj)
+	if t == nil {
+		return false
+	}
+	if h, ok := cs.rawTypes.Load(t); ok {
+		return h.(bool)
+	}
+	h := cs.typeHoldsRaw(t, make(map[reflect.Type]bool))
+	cs.rawTypes.Store(t, h)
+	return h
+}
+
+func (cs *codecs) typeHoldsRaw(t reflect.Type, seen map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawCBORType {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	if entry, ok := cs.atlas.Get(reflect.ValueOf(t).Pointer()); ok {
+		switch {
+		case entry.MarshalTransformTargetType != nil:
+			return cs.typeHoldsRaw(entry.MarshalTransformTargetType, seen)
+		case entry.StructMap != nil:
+			for _, f := range entry.StructMap.Fields {
+				if !f.Ignore && cs.typeHoldsRaw(f.Type, seen) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return cs.typeHoldsRaw(t.Elem(), seen)
+	}
+	return false
+}
+
+// Decode decodes the raw item into v, as DecodeInto does.
+func (r RawCBOR) Decode(v interface{}) error {
+	return DecodeInto(r, v)
+}
@@ -0,0 +1,202 @@
+package cbornode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrReplayMismatch is returned by a ReplayStore when a call doesn't match the
+// next entry of its trace.
+var ErrReplayMismatch = errors.New("store access does not match the recorded trace")
+
+// Trace operations.
+const (
+	TraceGet = "get"
+	TracePut = "put"
+)
+
+// TraceEntry is a single store access recorded by a RecordingStore.
+type TraceEntry struct {
+	Op   string
+	Cid  cid.Cid
+	Data []byte
+}
+
+// RecordingStore is an IpldStore logging every successful Get and Put made
+// through it, with the CID and encoded object, to a trace that a ReplayStore
+// can serve back. Failed calls are not recorded.
+//
+// The trace is a sequence of dag-cbor maps, one per access, in call order.
+type RecordingStore struct {
+	inner IpldStore
+
+	lk  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+var _ IpldStore = &RecordingStore{}
+
+// NewRecordingStore returns a RecordingStore reading from and writing to
+// inner, and writing its trace to w.
+func NewRecordingStore(inner IpldStore, w io.Writer) *RecordingStore {
+	return &RecordingStore{inner: inner, w: w}
+}
+
+// Get reads and unmarshals the content at `c` into `out`.
+func (s *RecordingStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	var raw rawCapture
+	if err := s.inner.Get(ctx, c, &raw); err != nil {
+		return err
+	}
+	if err := s.record(TraceEntry{Op: TraceGet, Cid: c, Data: raw}); err != nil {
+		return err
+	}
+	return decodeForStore(s.inner, raw, out)
+}
+
+// Put marshals and writes content `v` to the inner store returning its CID.
+func (s *RecordingStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	data, c, err := encodeForStore(s.inner, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err = s.inner.Put(ctx, &rawObject{data: data, cid: c})
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := s.record(TraceEntry{Op: TracePut, Cid: c, Data: data}); err != nil {
+		return cid.Undef, err
+	}
+	return c, nil
+}
+
+// Err returns the first error writing the trace, after which calls fail.
+func (s *RecordingStore) Err() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.err
+}
+
+func (s *RecordingStore) record(e TraceEntry) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.err = encodeTo(map[string]interface{}{
+		"op":   e.Op,
+		"cid":  e.Cid,
+		"data": e.Data,
+	}, s.w)
+	return s.err
+}
+
+// ReadTrace reads a trace written by a RecordingStore.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	br := bufio.NewReader(r)
+	var entries []TraceEntry
+	var item bytes.Buffer
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return entries, nil
+		}
+		item.Reset()
+		if err := readItem(br, &item, 0); err != nil {
+			return nil, err
+		}
+		var raw map[string]interface{}
+		if err := DecodeInto(item.Bytes(), &raw); err != nil {
+			return nil, err
+		}
+		op, okOp := raw["op"].(string)
+		c, okCid := raw["cid"].(cid.Cid)
+		data, okData := raw["data"].([]byte)
+		if !okOp || !okCid || !okData || len(raw) != 3 {
+			return nil, fmt.Errorf("invalid trace entry %d", len(entries))
+		}
+		entries = append(entries, TraceEntry{Op: op, Cid: c, Data: data})
+	}
+}
+
+// ReplayStore is an IpldStore serving exactly the accesses recorded in a
+// trace, in order, without a backing store. Any other call fails with an
+// ErrReplayMismatch error.
+type ReplayStore struct {
+	lk      sync.Mutex
+	entries []TraceEntry
+	next    int
+}
+
+var _ IpldStore = &ReplayStore{}
+
+// NewReplayStore returns a ReplayStore serving the trace read from r.
+func NewReplayStore(r io.Reader) (*ReplayStore, error) {
+	entries, err := ReadTrace(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayStore{entries: entries}, nil
+}
+
+// Get unmarshals the object recorded for the next access into out, if that
+// access was a Get of c.
+func (s *ReplayStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	e, err := s.advance(TraceGet, func(e TraceEntry) bool {
+		return e.Cid.Equals(c)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeForStore(nil, e.Data, out)
+}
+
+// Put returns the CID recorded for the next access, if that access was a Put
+// of an object with the same encoding.
+func (s *ReplayStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	data, _, err := encodeForStore(nil, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	e, err := s.advance(TracePut, func(e TraceEntry) bool {
+		return bytes.Equal(e.Data, data)
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return e.Cid, nil
+}
+
+// Done returns an ErrReplayMismatch error if part of the trace was not
+// replayed.
+func (s *ReplayStore) Done() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.next < len(s.entries) {
+		return fmt.Errorf("%w: %d of %d accesses not replayed", ErrReplayMismatch, len(s.entries)-s.next, len(s.entries))
+	}
+	return nil
+}
+
+// advance consumes the next entry of the trace if it is an op access
+// accepted by match.
+func (s *ReplayStore) advance(op string, match func(TraceEntry) bool) (TraceEntry, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.next >= len(s.entries) {
+		return TraceEntry{}, fmt.Errorf("%w: unexpected %s after the end of the trace", ErrReplayMismatch, op)
+	}
+	e := s.entries[s.next]
+	if e.Op != op || !match(e) {
+		return TraceEntry{}, fmt.Errorf("%w: access %d is a %s of %s, got another %s", ErrReplayMismatch, s.next, e.Op, e.Cid, op)
+	}
+	s.next++
+	return e, nil
+}
@@ -1,9 +1,15 @@
 package cbornode
 
 import (
+	"fmt"
 	"math/big"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
 
 	encoding "github.com/ipfs/go-ipld-cbor/encoding"
 
@@ -11,16 +17,41 @@ import (
 )
 
 // This atlas describes the CBOR Tag (42) for IPLD links, such that refmt can marshal and unmarshal them
-var cidAtlasEntry = atlas.BuildEntry(cid.Cid{}).
-	UseTag(CBORTagLink).
-	Transform().
-	TransformMarshal(atlas.MakeMarshalTransformFunc(
-		castCidToBytes,
-	)).
-	TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
-		castBytesToCid,
-	)).
-	Complete()
+var cidAtlasEntry = linkAtlasEntries[UndefinedCidError]
+
+// linkAtlasEntries holds the link entry of each undefined CID mode, see
+// UndefinedCidAtlasEntry.
+var linkAtlasEntries = [...]*atlas.AtlasEntry{
+	UndefinedCidError: newLinkAtlasEntry(UndefinedCidError),
+	UndefinedCidNull:  newLinkAtlasEntry(UndefinedCidNull),
+	UndefinedCidOmit:  newLinkAtlasEntry(UndefinedCidOmit),
+}
+
+func newLinkAtlasEntry(mode UndefinedCidMode) *atlas.AtlasEntry {
+	return atlas.BuildEntry(cid.Cid{}).
+		UseTag(CBORTagLink).
+		Transform().
+		TransformMarshal(atlas.MakeMarshalTransformFunc(
+			func(link cid.Cid) ([]byte, error) {
+				if !link.Defined() && mode != UndefinedCidError {
+					// Rewritten by rewriteUndefinedCids.
+					return []byte{}, nil
+				}
+				return castCidToBytes(link)
+			},
+		)).
+		TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(
+			func(x []byte) (cid.Cid, error) {
+				// refmt hands null over as nil bytes. Links with an empty
+				// payload are refused in every mode.
+				if x == nil && mode != UndefinedCidError {
+					return cid.Undef, nil
+				}
+				return castBytesToCid(x)
+			},
+		)).
+		Complete()
+}
 
 // BigIntAtlasEntry gives a reasonable default encoding for big.Int. It is not
 // included in the entries by default.
@@ -35,37 +66,272 @@ var BigIntAtlasEntry = atlas.BuildEntry(big.Int{}).Transform().
 		})).
 	Complete()
 
-// CborAtlas is the refmt.Atlas used by the CBOR IPLD decoder/encoder.
+// CborAtlas is the refmt.Atlas used by the CBOR IPLD decoder/encoder. It is
+// replaced by every registration; encoding functions don't read it but a
+// snapshot of the registry, see RegisterCborType.
 var CborAtlas atlas.Atlas
-var atlasEntries = []*atlas.AtlasEntry{cidAtlasEntry}
+var atlasEntries = []*atlas.AtlasEntry{cidAtlasEntry, rawCBORAtlasEntry, rawSpliceAtlasEntry, cidSetAtlasEntry}
+
+// settings are the package wide modes chosen with the Set, Enable and With
+// functions and the lenses registered with RegisterLens.
+type settings struct {
+	undefinedCids   UndefinedCidMode
+	nilCollections  NilCollectionMode
+	integerOverflow IntegerOverflowMode
+	// backend is the selected alternative backend, nil for refmt.
+	backend      codecBackend
+	interop      bool
+	encodeAudit  bool
+	lenientLinks bool
+	stringLinks  bool
+	codecStats   bool
+	wrapCache    *wrapCache
+	decodeCache  *decodeCache
+	// clonerPoolSize is the n passed to encoding.NewPooledCloner.
+	clonerPoolSize int
+	// wrapMultihash is the multihash used by WrapObject when passed
+	// math.MaxUint64 as the multihash type, storeMultihash the one used by
+	// BasicIpldStore.Put when the store does not set its own
+	// DefaultMultihash, and defaultMhLen the digest length used whenever a
+	// caller doesn't ask for a specific one.
+	wrapMultihash  uint64
+	storeMultihash uint64
+	defaultMhLen   int
+	lenses         []Lens
+}
+
+// codecs is an immutable snapshot of the registry: the entries registered so
+// far, the settings, the atlas built from the entries with the link entry of
+// undefinedCids and the pooled codecs using that atlas.
+// Every registration or change of settings builds a new snapshot and
+// publishes it atomically, so an operation that loads the snapshot once, such
+// as WrapObject, encodes and clones with the same atlas and modes whatever
+// happens meanwhile.
+type codecs struct {
+	settings
+	entries []*atlas.AtlasEntry
+	atlas   atlas.Atlas
+	marshaller    encoding.PooledMarshaller
+	unmarshaller  encoding.PooledUnmarshaller
+	cloner        encoding.PooledCloner
+	// intLimits caches the results of intLimit, rawTypes those of
+	// holdsRaw.
+	intLimits sync.Map
+	rawTypes  sync.Map
+}
+
+var currentCodecs atomic.Pointer[codecs]
+
+// snapshot returns the current registry snapshot.
+func snapshot() *codecs {
+	return currentCodecs.Load()
+}
 
 var (
-	cloner       encoding.PooledCloner
-	unmarshaller encoding.PooledUnmarshaller
-	marshaller   encoding.PooledMarshaller
+	// registryMu serializes the changes to atlasEntries and current.
+	registryMu sync.Mutex
+	// current holds the settings the next snapshot is built with.
+	current = settings{
+		wrapMultihash:  uint64(mh.SHA2_256),
+		storeMultihash: DefaultMultihash,
+		defaultMhLen:   -1,
+	}
 )
 
 func init() {
 	rebuildAtlas()
 }
 
+// updateSettings applies set to the settings and publishes a snapshot with
+// them.
+func updateSettings(set func(*settings)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	set(&current)
+	rebuildAtlas()
+}
+
+// SetClonerPoolSize bounds the number of idle cloners Clone, WrapObject and
+// the other functions copying objects keep for reuse to n. A value of 0, the
+// default, leaves idle cloners to a sync.Pool, which the garbage collector
+// may empty.
+//
+// Changing the size replaces the pool: cloners in use when it is called are
+// dropped once done rather than kept.
+func SetClonerPoolSize(n int) {
+	updateSettings(func(s *settings) {
+		s.clonerPoolSize = n
+	})
+}
+
+// rebuildAtlas publishes a snapshot of the registry as it is now. Callers
+// other than init hold registryMu.
 func rebuildAtlas() {
-	CborAtlas = atlas.MustBuild(atlasEntries...).
+	entries := append([]*atlas.AtlasEntry{linkAtlasEntries[current.undefinedCids]}, atlasEntries[1:]...)
+	atl := atlas.MustBuild(entries...).
 		WithMapMorphism(atlas.MapMorphism{KeySortMode: atlas.KeySortMode_RFC7049})
 
-	marshaller = encoding.NewPooledMarshaller(CborAtlas)
-	unmarshaller = encoding.NewPooledUnmarshaller(CborAtlas)
-	cloner = encoding.NewPooledCloner(CborAtlas)
+	CborAtlas = atl
+	currentCodecs.Store(&codecs{
+		settings:     current,
+		entries:      entries,
+		atlas:        atl,
+		marshaller:   encoding.NewPooledMarshaller(atl),
+		unmarshaller: encoding.NewPooledUnmarshallerCapturing(capturingAtlas(entries)),
+		cloner:       encoding.NewPooledCloner(atl, current.clonerPoolSize),
+	})
+}
+
+// capturingAtlas returns the atlas builder of the unmarshallers of a
+// snapshot, giving RawCBOR values the bytes they were decoded from.
+func capturingAtlas(entries []*atlas.AtlasEntry) func(captured func() []byte) atlas.Atlas {
+	return func(captured func() []byte) atlas.Atlas {
+		own := make([]*atlas.AtlasEntry, len(entries))
+		for i, e := range entries {
+			if e == rawCBORAtlasEntry {
+				e = capturingAtlasEntry(captured)
+			}
+			own[i] = e
+		}
+		return atlas.MustBuild(own...).
+			WithMapMorphism(atlas.MapMorphism{KeySortMode: atlas.KeySortMode_RFC7049})
+	}
+}
+
+// NewAtlas builds an atlas encoding like CborAtlas does, with links and map
+// key ordering, but with only the given type entries instead of the
+// registered ones. It is meant for WithAtlas and BasicIpldStore.Atlas.
+//
+// Undefined CIDs are refused, as in UndefinedCidError mode, unless entries
+// include an UndefinedCidAtlasEntry selecting another mode for this atlas.
+func NewAtlas(entries ...*atlas.AtlasEntry) (atlas.Atlas, error) {
+	link := cidAtlasEntry
+	for i, e := range entries {
+		if e.Type == cidAtlasEntry.Type {
+			link = e
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	all := append([]*atlas.AtlasEntry{link, rawCBORAtlasEntry, rawSpliceAtlasEntry, cidSetAtlasEntry}, entries...)
+	atl, err := atlas.Build(all...)
+	if err != nil {
+		return atlas.Atlas{}, err
+	}
+	return atl.WithMapMorphism(atlas.MapMorphism{KeySortMode: atlas.KeySortMode_RFC7049}), nil
+}
+
+// RegisterOption changes how RegisterCborType generates the entry of a
+// struct.
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	omitEmptyCidsAndBigInts bool
+}
+
+// OmitEmptyCidsAndBigInts makes RegisterCborType treat every cid.Cid,
+// *cid.Cid, big.Int and *big.Int field as if it were tagged
+// `refmt:",omitempty"`: undefined CIDs, zero big.Ints and nil pointers are
+// left out of the encoding instead of failing or encoding as null, and decode
+// back to their zero value. As with encoding/json, a non-nil pointer is
+// always encoded, even if it points to a zero value.
+func OmitEmptyCidsAndBigInts() RegisterOption {
+	return func(o *registerOptions) {
+		o.omitEmptyCidsAndBigInts = true
+	}
 }
 
 // RegisterCborType allows to register a custom cbor type
-func RegisterCborType(i interface{}) {
-	var entry *atlas.AtlasEntry
+//
+// Passing a struct value generates an entry mapping each exported field to a
+// map key; fields of embedded structs are promoted into the parent map as
+// encoding/json does. It panics if two fields map to the same key, or if a
+// field can never be encoded, such as a channel, a function or a map with
+// non-string keys. opts only apply to generated entries.
+//
+// Registering types while other goroutines encode, decode or clone values is
+// safe: each of those operations uses the types registered when it started,
+// and sees a registration once RegisterCborType returns. Registrations, with
+// this function and the other Register functions, may run concurrently with
+// each other.
+func RegisterCborType(i interface{}, opts ...RegisterOption) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	entries := []*atlas.AtlasEntry{nil}
 	if ae, ok := i.(*atlas.AtlasEntry); ok {
-		entry = ae
+		entries[0] = ae
 	} else {
-		entry = atlas.BuildEntry(i).StructMap().AutogenerateWithSortingScheme(atlas.KeySortMode_RFC7049).Complete()
+		var o registerOptions
+		for _, opt := range opts {
+			opt(&o)
+		}
+		entry, err := autogenerateEntry(reflect.TypeOf(i))
+		if err != nil {
+			panic(err)
+		}
+		if o.omitEmptyCidsAndBigInts {
+			omitEmptyCidsAndBigInts(entry)
+		}
+		entries = nilSafeEntries(entry)
 	}
-	atlasEntries = append(atlasEntries, entry)
+	atlasEntries = append(atlasEntries, entries...)
 	rebuildAtlas()
 }
+
+// RegisterUnion registers an interface type so that values of that type (for
+// example struct fields) can be encoded and decoded. iface must be a nil
+// pointer to the interface, e.g. (*Message)(nil), and members maps a
+// discriminant to each concrete type that may be stored in the interface.
+//
+// Union values are encoded as a single entry map from the decimal
+// discriminant to the value, e.g. {"1": {...}}, and decoding picks the
+// concrete type from that key. Members are stored in the interface by value;
+// members that aren't registered yet are registered as by RegisterCborType.
+func RegisterUnion(iface interface{}, members map[uint64]reflect.Type) error {
+	it := reflect.TypeOf(iface)
+	if it == nil || it.Kind() != reflect.Ptr || it.Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("union must be given as a pointer to an interface type, got %T", iface)
+	}
+	it = it.Elem()
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	var added []*atlas.AtlasEntry
+	elements := make(map[string]*atlas.AtlasEntry, len(members))
+	for disc, mt := range members {
+		if mt.Kind() == reflect.Ptr {
+			return fmt.Errorf("union member %s for %s must not be a pointer type", mt, it)
+		}
+		if !mt.Implements(it) {
+			return fmt.Errorf("union member %s does not implement %s", mt, it)
+		}
+		entry := findAtlasEntry(mt)
+		if entry == nil {
+			if mt.Kind() != reflect.Struct {
+				return fmt.Errorf("union member %s is not registered", mt)
+			}
+			generated, err := autogenerateEntry(mt)
+			if err != nil {
+				return err
+			}
+			entries := nilSafeEntries(generated)
+			entry = entries[0]
+			added = append(added, entries...)
+		}
+		elements[strconv.FormatUint(disc, 10)] = entry
+	}
+
+	atlasEntries = append(atlasEntries, added...)
+	atlasEntries = append(atlasEntries, atlas.BuildEntry(iface).KeyedUnion().Of(elements))
+	rebuildAtlas()
+	return nil
+}
+
+func findAtlasEntry(t reflect.Type) *atlas.AtlasEntry {
+	for _, e := range snapshot().entries {
+		if e.Type == t {
+			return e
+		}
+	}
+	return nil
+}
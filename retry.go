@@ -0,0 +1,68 @@
+package cbornode
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy describes how GetMany retries the CIDs it fails to read, see
+// BasicIpldStore.GetManyRetry. Each CID is retried on its own, so a
+// transient failure of one read doesn't fail the others.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a CID is tried before giving up,
+	// including the first. Values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles after each
+	// failed retry, up to MaxBackoff if set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable reports whether a read that failed with err may succeed
+	// when tried again. If nil, IsTransient is used. Blockstores fetching
+	// from the network may also retry a *CorruptBlockError.
+	Retryable func(err error) bool
+}
+
+// IsTransient reports whether err, or an error it wraps, reports itself as
+// temporary or as a timeout, as network errors do. Other errors, such as
+// missing blocks, hash mismatches or decoding errors, are considered
+// permanent.
+func IsTransient(err error) bool {
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// do calls fn until it succeeds, fails permanently, or the policy runs out
+// of attempts, and returns the number of attempts made and the last error.
+// A nil policy tries once.
+func (p *RetryPolicy) do(ctx context.Context, fn func() error) (int, error) {
+	err := fn()
+	if p == nil {
+		return 1, err
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	delay := p.Backoff
+	attempts := 1
+	for ; err != nil && attempts < p.MaxAttempts && retryable(err); attempts++ {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return attempts, err
+		}
+		delay *= 2
+		if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+		err = fn()
+	}
+	return attempts, err
+}
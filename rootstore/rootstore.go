@@ -0,0 +1,107 @@
+// Package rootstore tracks named roots, the CIDs of the current heads of
+// dag-cbor states, in a key-value datastore.
+//
+// Roots are updated with compare-and-swap, so that concurrent writers going
+// through the same Store can't lose each other's updates: each reads the
+// current root, builds the new state on top of it and swaps it in only if the
+// root didn't change meanwhile.
+package rootstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrNotFound is returned by Datastore.Get for missing keys.
+var ErrNotFound = errors.New("rootstore: key not found")
+
+// ErrNoRoot is returned by GetRoot for names that have no root.
+var ErrNoRoot = errors.New("rootstore: no root")
+
+// ErrRootChanged is returned by CompareAndSwap when the root isn't the
+// expected one.
+var ErrRootChanged = errors.New("rootstore: root changed")
+
+// Datastore is the key-value store roots are persisted in. Adapting a
+// go-datastore Datastore only takes converting keys and errors.
+type Datastore interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// Store reads and updates the roots kept in a Datastore. Compare-and-swap is
+// only atomic among the callers of the same Store: the datastore must not be
+// updated bypassing it.
+type Store struct {
+	ds     Datastore
+	prefix string
+
+	lk sync.Mutex
+}
+
+// New returns a Store keeping the roots in ds, under the "/roots/" prefix.
+func New(ds Datastore) *Store {
+	return &Store{ds: ds, prefix: "/roots/"}
+}
+
+// GetRoot returns the root of name, or ErrNoRoot if it has none.
+func (s *Store) GetRoot(ctx context.Context, name string) (cid.Cid, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.get(ctx, name)
+}
+
+// SetRoot sets the root of name to c, whatever it was.
+func (s *Store) SetRoot(ctx context.Context, name string, c cid.Cid) error {
+	if !c.Defined() {
+		return fmt.Errorf("rootstore: cannot set %q to an undefined cid", name)
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.ds.Put(ctx, s.prefix+name, c.Bytes())
+}
+
+// CompareAndSwap sets the root of name to next if it is old, and fails with
+// an ErrRootChanged error otherwise. An undefined old expects name to have
+// no root yet.
+func (s *Store) CompareAndSwap(ctx context.Context, name string, old, next cid.Cid) error {
+	if !next.Defined() {
+		return fmt.Errorf("rootstore: cannot set %q to an undefined cid", name)
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	cur, err := s.get(ctx, name)
+	switch {
+	case errors.Is(err, ErrNoRoot):
+		cur = cid.Undef
+	case err != nil:
+		return err
+	}
+	if !cur.Equals(old) {
+		if !cur.Defined() {
+			return fmt.Errorf("%w: %q has no root", ErrRootChanged, name)
+		}
+		return fmt.Errorf("%w: %q is %s", ErrRootChanged, name, cur)
+	}
+	return s.ds.Put(ctx, s.prefix+name, next.Bytes())
+}
+
+func (s *Store) get(ctx context.Context, name string) (cid.Cid, error) {
+	b, err := s.ds.Get(ctx, s.prefix+name)
+	if errors.Is(err, ErrNotFound) {
+		return cid.Undef, fmt.Errorf("%w: %q", ErrNoRoot, name)
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := cid.Cast(b)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("rootstore: root of %q: %w", name, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,138 @@
+package rootstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+)
+
+type memDatastore struct {
+	lk   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemDatastore() *memDatastore {
+	return &memDatastore{data: make(map[string][]byte)}
+}
+
+func (m *memDatastore) Get(ctx context.Context, key string) ([]byte, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	v, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *memDatastore) Put(ctx context.Context, key string, value []byte) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+func mustCid(t *testing.T, v interface{}) cid.Cid {
+	t.Helper()
+	nd, err := cbornode.WrapObject(v, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd.Cid()
+}
+
+func TestRoots(t *testing.T) {
+	ctx := context.Background()
+	ds := newMemDatastore()
+	s := New(ds)
+	a, b := mustCid(t, "a"), mustCid(t, "b")
+
+	if _, err := s.GetRoot(ctx, "head"); !errors.Is(err, ErrNoRoot) {
+		t.Fatalf("expected ErrNoRoot, got %v", err)
+	}
+	if err := s.CompareAndSwap(ctx, "head", a, b); !errors.Is(err, ErrRootChanged) {
+		t.Fatalf("expected ErrRootChanged, got %v", err)
+	}
+	if err := s.CompareAndSwap(ctx, "head", cid.Undef, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompareAndSwap(ctx, "head", cid.Undef, b); !errors.Is(err, ErrRootChanged) {
+		t.Fatalf("expected ErrRootChanged, got %v", err)
+	}
+	if err := s.CompareAndSwap(ctx, "head", a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roots are persisted in the datastore.
+	got, err := New(ds).GetRoot(ctx, "head")
+	if err != nil || !got.Equals(b) {
+		t.Fatalf("expected %s, got %s: %v", b, got, err)
+	}
+
+	if err := s.SetRoot(ctx, "head", a); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetRoot(ctx, "head"); !got.Equals(a) {
+		t.Fatalf("expected %s, got %s", a, got)
+	}
+	if _, err := s.GetRoot(ctx, "other"); !errors.Is(err, ErrNoRoot) {
+		t.Fatalf("expected ErrNoRoot, got %v", err)
+	}
+	if err := s.SetRoot(ctx, "head", cid.Undef); err == nil {
+		t.Fatal("expected setting an undefined root to fail")
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := New(newMemDatastore())
+	const writers, increments = 8, 10
+
+	// Counter states, indexed by value.
+	states := make([]cid.Cid, writers*increments+1)
+	values := make(map[cid.Cid]int)
+	for i := range states {
+		states[i] = mustCid(t, i)
+		values[states[i]] = i
+	}
+	if err := s.SetRoot(ctx, "counter", states[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				cur, err := s.GetRoot(ctx, "counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				err = s.CompareAndSwap(ctx, "counter", cur, states[values[cur]+1])
+				switch {
+				case err == nil:
+					done++
+				case !errors.Is(err, ErrRootChanged):
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := s.GetRoot(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[got] != writers*increments {
+		t.Fatalf("expected %d increments, got %d", writers*increments, values[got])
+	}
+}
@@ -0,0 +1,11 @@
+package cbornode_test
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-ipld-cbor/cbortest"
+)
+
+func TestRoundtripConformance(t *testing.T) {
+	cbortest.RoundtripCheck(t, cbortest.CborCodec)
+}
@@ -0,0 +1,430 @@
+package cbornode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrSchemaViolation is returned by Schema.Validate when a node doesn't match
+// its schema.
+var ErrSchemaViolation = errors.New("schema violation")
+
+// Schema is a compiled schema, see CompileSchema.
+type Schema struct {
+	root  string
+	types map[string]*schemaType
+}
+
+// CompileSchema compiles a schema written in a subset of the IPLD Schema
+// language. A schema is a list of type declarations, the first of which is
+// the type Validate checks nodes against:
+//
+//	type Block struct {
+//		parent nullable &Block
+//		height Int
+//		memo optional String
+//		messages [&Any]
+//		balances {String:Int}
+//	}
+//
+// The kinds Bool, Int, Float, String, Bytes, Link and Any are predeclared.
+// Types are either structs, which are closed maps with the given fields, or
+// a type expression: a kind or type name, a link &T, a list [T] or a map
+// {String:T}. The element types of lists and maps may be marked nullable.
+// The target type of a link must be declared, but linked blocks aren't
+// checked against it, as that would require loading them. Comments start
+// with # and run to the end of the line.
+func CompileSchema(schemaText string) (*Schema, error) {
+	p := &schemaParser{toks: tokenizeSchema(schemaText)}
+	s := &Schema{types: map[string]*schemaType{}}
+	for !p.done() {
+		if err := p.expect("type"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.types[name]; ok || schemaKinds[name] {
+			return nil, fmt.Errorf("schema: type %s declared twice", name)
+		}
+		var t *schemaType
+		if p.peek() == "struct" {
+			t, err = p.structType()
+		} else {
+			t, err = p.typeExpr()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == "struct" {
+			t.name = name
+		}
+		if s.root == "" {
+			s.root = name
+		}
+		s.types[name] = t
+	}
+	if s.root == "" {
+		return nil, errors.New("schema: no types declared")
+	}
+	for name, t := range s.types {
+		if err := s.checkRefs(t, name); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate checks that n matches the first type of the schema.
+func (s *Schema) Validate(n *Node) error {
+	return s.validate(s.types[s.root], n.obj, "", map[string]bool{})
+}
+
+var schemaKinds = map[string]bool{
+	"Bool": true, "Int": true, "Float": true, "String": true,
+	"Bytes": true, "Link": true, "Any": true,
+}
+
+type schemaType struct {
+	// kind is a predeclared kind, "struct", "list", "map", or "" for a
+	// reference to the type called name.
+	kind     string
+	name     string
+	elem     *schemaType
+	nullable bool // for the elements of lists and maps
+	fields   []schemaField
+}
+
+type schemaField struct {
+	name     string
+	typ      *schemaType
+	optional bool
+	nullable bool
+}
+
+func (s *Schema) checkRefs(t *schemaType, decl string) error {
+	switch t.kind {
+	case "":
+		if _, ok := s.types[t.name]; !ok {
+			return fmt.Errorf("schema: type %s refers to undeclared type %s", decl, t.name)
+		}
+	case "Link":
+		if _, ok := s.types[t.name]; !ok && !schemaKinds[t.name] {
+			return fmt.Errorf("schema: type %s links to undeclared type %s", decl, t.name)
+		}
+	case "list", "map":
+		return s.checkRefs(t.elem, decl)
+	case "struct":
+		for _, f := range t.fields {
+			if err := s.checkRefs(f.typ, decl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks v against t. resolving tracks the type names followed
+// without descending into a value, to reject cyclic aliases.
+func (s *Schema) validate(t *schemaType, v interface{}, path string, resolving map[string]bool) error {
+	if t.kind == "" {
+		if resolving[t.name] {
+			return fmt.Errorf("schema: type %s is defined in terms of itself", t.name)
+		}
+		resolving[t.name] = true
+		defer delete(resolving, t.name)
+		return s.validate(s.types[t.name], v, path, resolving)
+	}
+
+	fail := func(format string, args ...interface{}) error {
+		if path == "" {
+			path = "/"
+		}
+		return fmt.Errorf("%w at %s: %s", ErrSchemaViolation, path, fmt.Sprintf(format, args...))
+	}
+	switch t.kind {
+	case "Any":
+		return nil
+	case "Bool":
+		if _, ok := v.(bool); !ok {
+			return fail("expected Bool, got %s", schemaKindOf(v))
+		}
+	case "Int":
+		if schemaKindOf(v) != "Int" {
+			return fail("expected Int, got %s", schemaKindOf(v))
+		}
+	case "Float":
+		if k := schemaKindOf(v); k != "Float" {
+			return fail("expected Float, got %s", k)
+		}
+	case "String":
+		if _, ok := v.(string); !ok {
+			return fail("expected String, got %s", schemaKindOf(v))
+		}
+	case "Bytes":
+		if _, ok := v.([]byte); !ok {
+			return fail("expected Bytes, got %s", schemaKindOf(v))
+		}
+	case "Link":
+		if _, ok := v.(cid.Cid); !ok {
+			return fail("expected a link to %s, got %s", t.name, schemaKindOf(v))
+		}
+	case "list":
+		l, ok := v.([]interface{})
+		if !ok {
+			return fail("expected List, got %s", schemaKindOf(v))
+		}
+		for i, e := range l {
+			if e == nil && t.nullable {
+				continue
+			}
+			if err := s.validate(t.elem, e, fmt.Sprintf("%s/%d", path, i), map[string]bool{}); err != nil {
+				return err
+			}
+		}
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("expected Map, got %s", schemaKindOf(v))
+		}
+		for _, k := range sortedKeys(m) {
+			if m[k] == nil && t.nullable {
+				continue
+			}
+			if err := s.validate(t.elem, m[k], path+"/"+k, map[string]bool{}); err != nil {
+				return err
+			}
+		}
+	case "struct":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("expected a %s struct, got %s", t.name, schemaKindOf(v))
+		}
+		known := make(map[string]bool, len(t.fields))
+		for _, f := range t.fields {
+			known[f.name] = true
+			fv, present := m[f.name]
+			switch {
+			case !present && f.optional:
+			case !present:
+				return fail("missing field %q", f.name)
+			case fv == nil && f.nullable:
+			default:
+				if err := s.validate(f.typ, fv, path+"/"+f.name, map[string]bool{}); err != nil {
+					return err
+				}
+			}
+		}
+		for _, k := range sortedKeys(m) {
+			if !known[k] {
+				return fail("unexpected field %q", k)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// schemaKindOf returns the data model kind of a decoded value.
+func schemaKindOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "Null"
+	case bool:
+		return "Bool"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "Int"
+	case float32, float64:
+		return "Float"
+	case string:
+		return "String"
+	case []byte:
+		return "Bytes"
+	case cid.Cid:
+		return "Link"
+	case []interface{}:
+		return "List"
+	case map[string]interface{}:
+		return "Map"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// tokenizeSchema splits schema text into names and the punctuation { } [ ]
+// : and &, dropping comments.
+func tokenizeSchema(text string) []string {
+	var toks []string
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		start := -1
+		for i, r := range line {
+			isName := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+			if isName {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start >= 0 {
+				toks = append(toks, line[start:i])
+				start = -1
+			}
+			if !unicode.IsSpace(r) {
+				toks = append(toks, string(r))
+			}
+		}
+		if start >= 0 {
+			toks = append(toks, line[start:])
+		}
+	}
+	return toks
+}
+
+type schemaParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *schemaParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *schemaParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *schemaParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *schemaParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return p.unexpected(got, fmt.Sprintf("%q", tok))
+	}
+	return nil
+}
+
+func (p *schemaParser) unexpected(got, expected string) error {
+	if got == "" {
+		return fmt.Errorf("schema: unexpected end of schema, expected %s", expected)
+	}
+	return fmt.Errorf("schema: unexpected %q, expected %s", got, expected)
+}
+
+func (p *schemaParser) name() (string, error) {
+	tok := p.next()
+	if tok == "" || !(unicode.IsLetter(rune(tok[0])) || tok[0] == '_') {
+		return "", p.unexpected(tok, "a name")
+	}
+	return tok, nil
+}
+
+func (p *schemaParser) structType() (*schemaType, error) {
+	p.next()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	t := &schemaType{kind: "struct"}
+	seen := map[string]bool{}
+	for p.peek() != "}" {
+		var f schemaField
+		var err error
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if seen[f.name] {
+			return nil, fmt.Errorf("schema: field %s declared twice", f.name)
+		}
+		seen[f.name] = true
+		for {
+			if p.peek() == "optional" {
+				p.next()
+				f.optional = true
+			} else if p.peek() == "nullable" {
+				p.next()
+				f.nullable = true
+			} else {
+				break
+			}
+		}
+		if f.typ, err = p.typeExpr(); err != nil {
+			return nil, err
+		}
+		t.fields = append(t.fields, f)
+	}
+	p.next()
+	return t, nil
+}
+
+func (p *schemaParser) typeExpr() (*schemaType, error) {
+	switch tok := p.peek(); tok {
+	case "&":
+		p.next()
+		target, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return &schemaType{kind: "Link", name: target}, nil
+	case "[":
+		p.next()
+		nullable := p.nullable()
+		elem, err := p.typeExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &schemaType{kind: "list", elem: elem, nullable: nullable}, p.expect("]")
+	case "{":
+		p.next()
+		if err := p.expect("String"); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		nullable := p.nullable()
+		elem, err := p.typeExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &schemaType{kind: "map", elem: elem, nullable: nullable}, p.expect("}")
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if schemaKinds[name] {
+			return &schemaType{kind: name, name: name}, nil
+		}
+		return &schemaType{name: name}, nil
+	}
+}
+
+func (p *schemaParser) nullable() bool {
+	if p.peek() == "nullable" {
+		p.next()
+		return true
+	}
+	return false
+}
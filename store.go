@@ -3,7 +3,10 @@ package cbornode
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sync/atomic"
 
 	block "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
@@ -11,10 +14,27 @@ import (
 	recbor "github.com/polydawn/refmt/cbor"
 	atlas "github.com/polydawn/refmt/obj/atlas"
 	cbg "github.com/whyrusleeping/cbor-gen"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
 )
 
 const DefaultMultihash = uint64(mh.BLAKE2B_MIN + 31)
 
+// SetPackageDefaults sets the multihash type and length used by both
+// WrapObject (when passed math.MaxUint64 as mhType) and BasicIpldStore.Put
+// (when the store has no DefaultMultihash of its own). An mhLen of -1 selects
+// the default length for the hash function.
+//
+// Objects hashed before the call keep their CIDs, so set the defaults before
+// storing anything whose CID must be reproducible.
+func SetPackageDefaults(mhType uint64, mhLen int) {
+	updateSettings(func(s *settings) {
+		s.wrapMultihash = mhType
+		s.storeMultihash = mhType
+		s.defaultMhLen = mhLen
+	})
+}
+
 // IpldStore wraps a Blockstore and provides an interface for storing and retrieving CBOR encoded data.
 type IpldStore interface {
 	Get(ctx context.Context, c cid.Cid, out interface{}) error
@@ -37,6 +57,26 @@ type IpldBlockstoreViewer interface {
 	View(cid.Cid, func([]byte) error) error
 }
 
+// IpldBlockstoreLister is a trait of blockstores that can enumerate their
+// contents, as the go-ipfs-blockstore Blockstore does.
+type IpldBlockstoreLister interface {
+	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
+}
+
+// IpldBlockstoreHas is a trait of blockstores that can tell whether they hold
+// a block without reading it, as the go-ipfs-blockstore Blockstore does.
+type IpldBlockstoreHas interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+}
+
+// IpldBlockstoreSidecar is a trait of blockstores that can keep small values
+// alongside blocks, in a namespace separate from the blocks themselves.
+type IpldBlockstoreSidecar interface {
+	PutSidecar(ctx context.Context, c cid.Cid, data []byte) error
+	// GetSidecar returns nil, and no error, when nothing is stored for c.
+	GetSidecar(ctx context.Context, c cid.Cid) ([]byte, error)
+}
+
 // BasicIpldStore wraps and IpldBlockstore and implements the IpldStore interface.
 type BasicIpldStore struct {
 	Blocks IpldBlockstore
@@ -45,6 +85,105 @@ type BasicIpldStore struct {
 	Atlas *atlas.Atlas
 
 	DefaultMultihash uint64
+	// DefaultMhLength is the digest length Put uses, for example to truncate
+	// digests. -1 selects the full length of the hash function. 0 selects
+	// the package default length (see SetPackageDefaults) if the store uses
+	// the package hash function, that is if DefaultMultihash is 0, and the
+	// full length otherwise.
+	DefaultMhLength int
+
+	// VerifyHashes makes Get re-hash every block it reads and compare the
+	// result against the requested CID before decoding it. Use it when the
+	// backing blockstore is untrusted or may be corrupted.
+	VerifyHashes bool
+
+	// AllowedCodecs and AllowedMultihashes restrict the CIDs the store
+	// accepts. When set, Get refuses to read and Put refuses to write any
+	// block whose codec or multihash type isn't listed, returning an
+	// ErrCidNotAllowed error. A nil list allows everything.
+	AllowedCodecs      []uint64
+	AllowedMultihashes []uint64
+
+	// MaxAllocation, when set, makes Get check the length headers of every
+	// block before decoding it and refuse, with an ErrAllocationLimit error,
+	// blocks holding a string, array or map longer than MaxAllocation bytes
+	// or items, or longer than the rest of the block can hold. This bounds
+	// what decoders that preallocate from length headers, such as cbor-gen
+	// unmarshalers, may allocate on adversarial input.
+	MaxAllocation uint64
+
+	// GetManyRetry, when set, makes GetMany and GetManyTyped retry reads
+	// that fail with a retryable error, as classified by the policy.
+	GetManyRetry *RetryPolicy
+
+	// Profiler, when set, records the CIDs requested from Get so that the
+	// most frequently fetched ones can be listed with HotKeys.
+	Profiler *HotKeyProfiler
+
+	// CountDuplicates makes Put check whether the blockstore already holds
+	// each block before writing it, skipping the write if so, and count
+	// duplicates in Stats. It requires Blocks to implement
+	// IpldBlockstoreHas; otherwise every block is written and counted as new.
+	CountDuplicates bool
+
+	// PutRouter, when set, is consulted by PutMany for every block to choose
+	// the blockstore it is written to, for instance to send large blocks to
+	// cold storage and small ones to fast storage. Put always writes to
+	// Blocks.
+	PutRouter PutRouter
+
+	stats StoreStats
+}
+
+// PutRouter chooses where PutMany writes blocks, when Blocks is a composite
+// of several blockstores.
+type PutRouter interface {
+	// Route returns the blockstore blk is written to, or nil for Blocks.
+	Route(ctx context.Context, blk block.Block) (IpldBlockstore, error)
+}
+
+// StoreStats counts the blocks written by Put with CountDuplicates set.
+type StoreStats struct {
+	// Writes counts the blocks written to the blockstore.
+	Writes int64
+	// Duplicates counts the blocks that were already stored, and BytesSaved
+	// their total size.
+	Duplicates int64
+	BytesSaved int64
+}
+
+// Stats returns the write statistics of the store. They are only gathered
+// with CountDuplicates set.
+func (s *BasicIpldStore) Stats() StoreStats {
+	return StoreStats{
+		Writes:     atomic.LoadInt64(&s.stats.Writes),
+		Duplicates: atomic.LoadInt64(&s.stats.Duplicates),
+		BytesSaved: atomic.LoadInt64(&s.stats.BytesSaved),
+	}
+}
+
+// putBlock writes blk to bs, unless CountDuplicates is set and it is already
+// stored there.
+func (s *BasicIpldStore) putBlock(ctx context.Context, bs IpldBlockstore, blk block.Block) error {
+	if !s.CountDuplicates {
+		return bs.Put(ctx, blk)
+	}
+	if has, ok := bs.(IpldBlockstoreHas); ok {
+		found, err := has.Has(ctx, blk.Cid())
+		if err != nil {
+			return err
+		}
+		if found {
+			atomic.AddInt64(&s.stats.Duplicates, 1)
+			atomic.AddInt64(&s.stats.BytesSaved, int64(len(blk.RawData())))
+			return nil
+		}
+	}
+	if err := bs.Put(ctx, blk); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.stats.Writes, 1)
+	return nil
 }
 
 var _ IpldStore = &BasicIpldStore{}
@@ -57,10 +196,33 @@ func NewCborStore(bs IpldBlockstore) *BasicIpldStore {
 
 // Get reads and unmarshals the content at `c` into `out`.
 func (s *BasicIpldStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	return s.get(ctx, c, out, nil)
+}
+
+// get is Get, calling admit, if not nil, with the size of the block before
+// verifying and decoding it.
+func (s *BasicIpldStore) get(ctx context.Context, c cid.Cid, out interface{}, admit func(size int) error) error {
+	pref := c.Prefix()
+	if err := s.checkPolicy(pref.Codec, pref.MhType); err != nil {
+		return err
+	}
+	if s.Profiler != nil {
+		s.Profiler.record(c)
+	}
+
+	atl := s.atlasFor(ctx)
 	if s.Viewer != nil {
 		// zero-copy path.
 		return s.Viewer.View(c, func(b []byte) error {
-			return s.decode(b, out)
+			if admit != nil {
+				if err := admit(len(b)); err != nil {
+					return err
+				}
+			}
+			if err := s.verify(c, b); err != nil {
+				return err
+			}
+			return s.decodeAtlas(b, out, atl)
 		})
 	}
 
@@ -68,23 +230,454 @@ func (s *BasicIpldStore) Get(ctx context.Context, c cid.Cid, out interface{}) er
 	if err != nil {
 		return err
 	}
-	return s.decode(blk.RawData(), out)
+	if admit != nil {
+		if err := admit(len(blk.RawData())); err != nil {
+			return err
+		}
+	}
+	if err := s.verify(c, blk.RawData()); err != nil {
+		return err
+	}
+	return s.decodeAtlas(blk.RawData(), out, atl)
+}
+
+type atlasKey struct{}
+
+// WithAtlas returns a context making BasicIpldStore.Get and Put use atl
+// instead of the store's Atlas and the package atlas, so that callers with
+// different type registries can share a store. Use NewAtlas to build atl.
+func WithAtlas(ctx context.Context, atl atlas.Atlas) context.Context {
+	return context.WithValue(ctx, atlasKey{}, &atl)
+}
+
+// atlasFor returns the atlas to use for a call made with ctx, or nil for the
+// package atlas.
+func (s *BasicIpldStore) atlasFor(ctx context.Context) *atlas.Atlas {
+	if atl, ok := ctx.Value(atlasKey{}).(*atlas.Atlas); ok {
+		return atl
+	}
+	return s.Atlas
+}
+
+// AllDagCborKeys returns the CIDs of all the dag-cbor blocks in the backing
+// blockstore, which must implement IpldBlockstoreLister. The channel is closed
+// once all keys have been listed or ctx is canceled.
+func (s *BasicIpldStore) AllDagCborKeys(ctx context.Context) (<-chan cid.Cid, error) {
+	lister, ok := s.Blocks.(IpldBlockstoreLister)
+	if !ok {
+		return nil, fmt.Errorf("blockstore %T cannot list its keys", s.Blocks)
+	}
+	keys, err := lister.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for c := range keys {
+			if c.Type() != cid.DagCBOR {
+				continue
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Cursor is a single result of GetMany.
+type Cursor struct {
+	// Index is the position of Cid in the CIDs passed to GetMany, or -1 for
+	// the final entry reporting a context error.
+	Index int
+	Cid   cid.Cid
+	// Err is the error reading or decoding Cid, if any.
+	Err error
+	// Attempts is the number of times Cid was tried, which is more than one
+	// only when the store has a GetManyRetry policy.
+	Attempts int
+	// Value is the object Cid was decoded into by GetManyTyped.
+	Value interface{}
+}
+
+// GetMany reads and unmarshals the content of each of cs into the matching
+// entry of outs, in order, reporting each result on the returned channel. The
+// channel is closed once all CIDs have been processed.
+//
+// If ctx is canceled before all results are delivered, the work stops
+// promptly (even if the caller stopped reading the channel), undelivered
+// results are dropped and the last entry before the channel is closed carries
+// ctx.Err() with an Index of -1.
+func (s *BasicIpldStore) GetMany(ctx context.Context, cs []cid.Cid, outs []interface{}) <-chan *Cursor {
+	if len(cs) != len(outs) {
+		out := make(chan *Cursor, 1)
+		out <- &Cursor{Index: -1, Err: fmt.Errorf("GetMany called with %d cids and %d outs", len(cs), len(outs))}
+		close(out)
+		return out
+	}
+	return s.getMany(ctx, cs, func(i int, c cid.Cid) interface{} { return outs[i] }, false)
+}
+
+// GetManyTyped is like GetMany, but decodes each CID into a value returned by
+// factory, which is called just before the CID is read, and reports that
+// value in the Value field of its result. This lets callers pick the type of
+// each object as they go instead of allocating them all up front.
+func (s *BasicIpldStore) GetManyTyped(ctx context.Context, cs []cid.Cid, factory func(i int, c cid.Cid) interface{}) <-chan *Cursor {
+	return s.getMany(ctx, cs, factory, true)
+}
+
+// ErrByteBudgetExceeded is returned, wrapped in a ByteBudgetError, by
+// GetManyBudget when the blocks to read don't fit in its byte budget.
+var ErrByteBudgetExceeded = errors.New("read byte budget exceeded")
+
+// ByteBudgetError is returned by GetManyBudget when it stops reading before
+// the byte budget is exceeded.
+type ByteBudgetError struct {
+	// Remaining holds the CIDs that were not read, starting with the one
+	// that didn't fit in the budget.
+	Remaining []cid.Cid
+	// Size is the size of the block of Remaining[0].
+	Size int
+}
+
+func (e *ByteBudgetError) Error() string {
+	return fmt.Sprintf("%s: %d CIDs left, next block is %d bytes", ErrByteBudgetExceeded, len(e.Remaining), e.Size)
+}
+
+func (e *ByteBudgetError) Unwrap() error {
+	return ErrByteBudgetExceeded
+}
+
+// GetManyBudget is like GetMany, reading the CIDs in order and synchronously,
+// but stops before the total size of the blocks read goes over maxBytes. It
+// then returns a *ByteBudgetError listing the CIDs not read yet, whose outs
+// are untouched, so that callers on constrained memory can read large batches
+// in waves: process the outs read so far, release them and call again with
+// the remaining CIDs and outs. A block larger than maxBytes on its own can't
+// be read this way, which shows as an error with nothing read.
+//
+// Other errors stop the read and are returned as is.
+func (s *BasicIpldStore) GetManyBudget(ctx context.Context, cs []cid.Cid, outs []interface{}, maxBytes int) error {
+	if len(cs) != len(outs) {
+		return fmt.Errorf("GetManyBudget called with %d cids and %d outs", len(cs), len(outs))
+	}
+	used := 0
+	for i, c := range cs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var size int
+		admit := func(n int) error {
+			if used+n > maxBytes {
+				return &ByteBudgetError{Remaining: cs[i:], Size: n}
+			}
+			size = n
+			return nil
+		}
+		_, err := s.GetManyRetry.do(ctx, func() error {
+			return s.get(ctx, c, outs[i], admit)
+		})
+		if err != nil {
+			return err
+		}
+		used += size
+	}
+	return nil
+}
+
+func (s *BasicIpldStore) getMany(ctx context.Context, cs []cid.Cid, outFor func(i int, c cid.Cid) interface{}, report bool) <-chan *Cursor {
+	// A buffer of one lets the final context error always be delivered
+	// without blocking, see cancelCursor.
+	out := make(chan *Cursor, 1)
+	go func() {
+		defer close(out)
+		for i, c := range cs {
+			if ctx.Err() != nil {
+				cancelCursor(ctx, out)
+				return
+			}
+			v := outFor(i, c)
+			attempts, err := s.GetManyRetry.do(ctx, func() error {
+				return s.Get(ctx, c, v)
+			})
+			cur := &Cursor{Index: i, Cid: c, Err: err, Attempts: attempts}
+			if report {
+				cur.Value = v
+			}
+			select {
+			case out <- cur:
+			case <-ctx.Done():
+				cancelCursor(ctx, out)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// cancelCursor delivers the context error as the final entry of a GetMany
+// channel. As the GetMany goroutine is the only sender, dropping an
+// undelivered result frees the buffer for it.
+func cancelCursor(ctx context.Context, out chan *Cursor) {
+	final := &Cursor{Index: -1, Err: ctx.Err()}
+	for {
+		select {
+		case out <- final:
+			return
+		default:
+		}
+		select {
+		case <-out:
+		default:
+		}
+	}
+}
+
+// checkPolicy checks a codec and multihash type against the store's
+// allow-lists.
+func (s *BasicIpldStore) checkPolicy(codec, mhType uint64) error {
+	if s.AllowedCodecs != nil && !containsUint64(s.AllowedCodecs, codec) {
+		return fmt.Errorf("%w: codec 0x%x", ErrCidNotAllowed, codec)
+	}
+	if s.AllowedMultihashes != nil && !containsUint64(s.AllowedMultihashes, mhType) {
+		return fmt.Errorf("%w: multihash 0x%x", ErrCidNotAllowed, mhType)
+	}
+	return nil
+}
+
+func containsUint64(list []uint64, v uint64) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks that b hashes to c when VerifyHashes is set.
+func (s *BasicIpldStore) verify(c cid.Cid, b []byte) error {
+	if !s.VerifyHashes {
+		return nil
+	}
+	actual, err := c.Prefix().Sum(b)
+	if err != nil {
+		return err
+	}
+	if !actual.Equals(c) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, c, actual)
+	}
+	return nil
 }
 
 func (s *BasicIpldStore) decode(b []byte, out interface{}) error {
+	return s.decodeAtlas(b, out, s.Atlas)
+}
+
+func (s *BasicIpldStore) decodeAtlas(b []byte, out interface{}, atl *atlas.Atlas) error {
+	// rawCapture keeps the bytes without decoding them, and they need not
+	// be cbor, as with the blocks of encrypted stores.
+	if _, raw := out.(*rawCapture); !raw && s.MaxAllocation != 0 {
+		if err := checkAllocations(b, s.MaxAllocation); err != nil {
+			return err
+		}
+	}
+
 	cu, ok := out.(cbg.CBORUnmarshaler)
 	if ok {
 		if err := cu.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
-			return NewSerializationError(err)
+			return ClassifyDecodeError(b, out, NewSerializationError(err))
 		}
 		return nil
 	}
+	if err := checkUnmarshalerTarget(out); err != nil {
+		return err
+	}
 
-	if s.Atlas == nil {
-		return DecodeInto(b, out)
+	var err error
+	if atl == nil {
+		err = DecodeInto(b, out)
 	} else {
-		return recbor.UnmarshalAtlased(recbor.DecodeOptions{}, b, out, *s.Atlas)
+		err = recbor.UnmarshalAtlased(recbor.DecodeOptions{}, b, out, *atl)
+	}
+	return ClassifyDecodeError(b, out, err)
+}
+
+// checkAllocations checks that the length of every string, array and map in
+// b is at most max and fits in the rest of b.
+func checkAllocations(b []byte, max uint64) error {
+	return encoding.TokenWalk(b, func(tok encoding.Token) error {
+		switch tok.Major {
+		case encoding.MajByteString, encoding.MajTextString, encoding.MajArray, encoding.MajMap:
+		default:
+			return nil
+		}
+		if tok.Indefinite {
+			return nil
+		}
+		if tok.Value > max {
+			return fmt.Errorf("%w: length %d at offset %d", ErrAllocationLimit, tok.Value, tok.Offset)
+		}
+		// Every array item takes at least a byte, every map entry two.
+		need := tok.Value
+		switch tok.Major {
+		case encoding.MajMap:
+			need *= 2
+		case encoding.MajByteString, encoding.MajTextString:
+			// Checked by TokenWalk.
+			need = 0
+		}
+		if need > uint64(len(b)-tok.Offset) {
+			return fmt.Errorf("%w: length %d at offset %d exceeds the remaining data", ErrAllocationLimit, tok.Value, tok.Offset)
+		}
+		return nil
+	})
+}
+
+// decodeForStore decodes data read through a store wrapping inner into out,
+// the way inner.Get would.
+func decodeForStore(inner IpldStore, data []byte, out interface{}) error {
+	if bs, ok := asBasic(inner); ok {
+		return bs.decode(data, out)
+	}
+	if cu, ok := out.(cbg.CBORUnmarshaler); ok {
+		if err := cu.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return ClassifyDecodeError(data, out, NewSerializationError(err))
+		}
+		return nil
+	}
+	if err := checkUnmarshalerTarget(out); err != nil {
+		return err
+	}
+	return ClassifyDecodeError(data, out, DecodeInto(data, out))
+}
+
+var cborUnmarshalerType = reflect.TypeOf((*cbg.CBORUnmarshaler)(nil)).Elem()
+
+// checkUnmarshalerTarget refuses the outs that don't implement
+// cbg.CBORUnmarshaler themselves but wrap or point to a type that does, which
+// the generic decoder would fill without calling UnmarshalCBOR.
+func checkUnmarshalerTarget(out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if !rv.IsValid() {
+		return nil
+	}
+	t := rv.Type()
+	switch {
+	case t.Kind() != reflect.Ptr:
+		if reflect.PointerTo(t).Implements(cborUnmarshalerType) {
+			return &UnmarshalerTargetError{Type: t, Want: reflect.PointerTo(t), Reason: "passed by value"}
+		}
+	case t.Elem().Kind() == reflect.Ptr:
+		if t.Elem().Implements(cborUnmarshalerType) {
+			return &UnmarshalerTargetError{Type: t, Want: t.Elem(), Reason: "pointer to a pointer"}
+		}
+	case t.Elem().Kind() == reflect.Interface:
+		if rv.IsNil() || rv.Elem().IsNil() {
+			return nil
+		}
+		inner := rv.Elem().Elem()
+		if inner.Type().Implements(cborUnmarshalerType) {
+			return &UnmarshalerTargetError{Type: t, Want: inner.Type(), Reason: "pointer to an interface holding a cbg.CBORUnmarshaler"}
+		}
+	}
+	return nil
+}
+
+// UnmarshalerTargetError is returned by Get when out isn't a
+// cbg.CBORUnmarshaler but is related to one in a way that suggests a mistake,
+// such as a value whose pointer type implements it. Decoding such outs
+// without UnmarshalCBOR would silently lose or mangle data.
+type UnmarshalerTargetError struct {
+	// Type is the type of out, and Want the cbg.CBORUnmarshaler that
+	// should have been passed instead.
+	Type   reflect.Type
+	Want   reflect.Type
+	Reason string
+}
+
+func (e *UnmarshalerTargetError) Error() string {
+	return fmt.Sprintf("cannot decode into %s (%s): pass a %s so that its UnmarshalCBOR method is used", e.Type, e.Reason, e.Want)
+}
+
+// basicStore is implemented by the stores built on a BasicIpldStore without
+// changing how it reads and writes, such as MemCborStore, so that the stores
+// wrapping them use its settings and blockstore as they would for the
+// BasicIpldStore itself.
+type basicStore interface {
+	basic() *BasicIpldStore
+}
+
+// asBasic returns the BasicIpldStore store is, or is built on.
+func asBasic(store IpldStore) (*BasicIpldStore, bool) {
+	switch s := store.(type) {
+	case *BasicIpldStore:
+		return s, true
+	case basicStore:
+		return s.basic(), true
+	}
+	return nil, false
+}
+
+// storeHashParams returns the multihash type and length store uses for the
+// objects it writes, or the package defaults if store isn't a BasicIpldStore.
+func storeHashParams(store IpldStore) (uint64, int) {
+	cs := snapshot()
+	mhType, mhLen := cs.storeMultihash, cs.defaultMhLen
+	if bs, ok := asBasic(store); ok {
+		if bs.DefaultMultihash != 0 {
+			// The package length is meant for the package hash function.
+			mhType, mhLen = bs.DefaultMultihash, -1
+		}
+		if bs.DefaultMhLength != 0 {
+			mhLen = bs.DefaultMhLength
+		}
+	}
+	return mhType, mhLen
+}
+
+// encodeForStore serializes v the way inner.Put would, for stores wrapping
+// inner that need the encoded object.
+func encodeForStore(inner IpldStore, v interface{}) ([]byte, cid.Cid, error) {
+	mhType, mhLen := storeHashParams(inner)
+	pref := cid.Prefix{
+		Codec:    cid.DagCBOR,
+		MhType:   mhType,
+		MhLength: mhLen,
+		Version:  1,
+	}
+	var expCid cid.Cid
+	if cp, ok := v.(cidProvider); ok {
+		expCid = cp.Cid()
+		pref = expCid.Prefix()
+	}
+
+	if cm, ok := v.(cbg.CBORMarshaler); ok {
+		buf := new(bytes.Buffer)
+		if err := cm.MarshalCBOR(buf); err != nil {
+			return nil, cid.Undef, NewSerializationError(err)
+		}
+		c, err := pref.Sum(buf.Bytes())
+		if err != nil {
+			return nil, cid.Undef, err
+		}
+		if expCid != cid.Undef && c != expCid {
+			return nil, cid.Undef, fmt.Errorf("your object is not being serialized the way it expects to")
+		}
+		return buf.Bytes(), c, nil
+	}
+
+	nd, err := WrapObject(v, pref.MhType, pref.MhLength)
+	if err != nil {
+		return nil, cid.Undef, err
 	}
+	if expCid != cid.Undef && nd.Cid() != expCid {
+		return nil, cid.Undef, fmt.Errorf("your object is not being serialized the way it expects to")
+	}
+	return nd.RawData(), nd.Cid(), nil
 }
 
 type cidProvider interface {
@@ -93,12 +686,47 @@ type cidProvider interface {
 
 // Put marshals and writes content `v` to the backing blockstore returning its CID.
 func (s *BasicIpldStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
-	mhType := DefaultMultihash
-	if s.DefaultMultihash != 0 {
-		mhType = s.DefaultMultihash
+	blk, err := s.encodeBlock(ctx, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := s.putBlock(ctx, s.Blocks, blk); err != nil {
+		return cid.Undef, err
+	}
+	return blk.Cid(), nil
+}
+
+// PutMany marshals and writes every value of vs, returning their CIDs in the
+// same order. Each block is written to the blockstore chosen by PutRouter, or
+// to Blocks if it is nil. It stops at the first error.
+func (s *BasicIpldStore) PutMany(ctx context.Context, vs []interface{}) ([]cid.Cid, error) {
+	cids := make([]cid.Cid, len(vs))
+	for i, v := range vs {
+		blk, err := s.encodeBlock(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		bs := s.Blocks
+		if s.PutRouter != nil {
+			routed, err := s.PutRouter.Route(ctx, blk)
+			if err != nil {
+				return nil, err
+			}
+			if routed != nil {
+				bs = routed
+			}
+		}
+		if err := s.putBlock(ctx, bs, blk); err != nil {
+			return nil, err
+		}
+		cids[i] = blk.Cid()
 	}
+	return cids, nil
+}
 
-	mhLen := -1
+// encodeBlock marshals v into the block Put writes.
+func (s *BasicIpldStore) encodeBlock(ctx context.Context, v interface{}) (block.Block, error) {
+	mhType, mhLen := storeHashParams(s)
 	codec := uint64(cid.DagCBOR)
 
 	var expCid cid.Cid
@@ -110,11 +738,15 @@ func (s *BasicIpldStore) Put(ctx context.Context, v interface{}) (cid.Cid, error
 		codec = pref.Codec
 	}
 
+	if err := s.checkPolicy(codec, mhType); err != nil {
+		return nil, err
+	}
+
 	cm, ok := v.(cbg.CBORMarshaler)
 	if ok {
 		buf := new(bytes.Buffer)
 		if err := cm.MarshalCBOR(buf); err != nil {
-			return cid.Undef, NewSerializationError(err)
+			return nil, NewSerializationError(err)
 		}
 
 		pref := cid.Prefix{
@@ -125,42 +757,63 @@ func (s *BasicIpldStore) Put(ctx context.Context, v interface{}) (cid.Cid, error
 		}
 		c, err := pref.Sum(buf.Bytes())
 		if err != nil {
-			return cid.Undef, err
+			return nil, err
 		}
 
 		blk, err := block.NewBlockWithCid(buf.Bytes(), c)
 		if err != nil {
-			return cid.Undef, err
+			return nil, err
 		}
 
-		blkCid := blk.Cid()
-		if expCid != cid.Undef && blkCid != expCid {
-			return cid.Undef, fmt.Errorf("your object is not being serialized the way it expects to")
+		if expCid != cid.Undef && blk.Cid() != expCid {
+			return nil, fmt.Errorf("your object is not being serialized the way it expects to")
 		}
+		return blk, nil
+	}
 
-		if err := s.Blocks.Put(ctx, blk); err != nil {
-			return cid.Undef, err
+	if atl, ok := ctx.Value(atlasKey{}).(*atlas.Atlas); ok {
+		data, err := recbor.MarshalAtlased(v, *atl)
+		if err == nil {
+			data, err = spliceRaw(data)
 		}
-
-		return blkCid, nil
+		if err == nil {
+			data, err = rewriteUndefinedCids(data, undefinedCidModeOf(*atl))
+		}
+		if err != nil {
+			return nil, err
+		}
+		c, err := cid.Prefix{Codec: codec, MhType: mhType, MhLength: mhLen, Version: 1}.Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if expCid != cid.Undef && c != expCid {
+			return nil, fmt.Errorf("your object is not being serialized the way it expects to")
+		}
+		return block.NewBlockWithCid(data, c)
 	}
 
 	nd, err := WrapObject(v, mhType, mhLen)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
 
-	ndCid := nd.Cid()
-	if expCid != cid.Undef && ndCid != expCid {
-		return cid.Undef, fmt.Errorf("your object is not being serialized the way it expects to")
+	if expCid != cid.Undef && nd.Cid() != expCid {
+		return nil, fmt.Errorf("your object is not being serialized the way it expects to")
 	}
+	return nd, nil
+}
 
-	if err := s.Blocks.Put(ctx, nd); err != nil {
-		return cid.Undef, err
-	}
+// ErrHashMismatch is returned by Get when VerifyHashes is set and a block
+// doesn't hash to the CID it was requested with.
+var ErrHashMismatch = errors.New("block data does not match its CID")
 
-	return ndCid, nil
-}
+// ErrCidNotAllowed is returned when a CID is refused by the allow-lists of a
+// BasicIpldStore.
+var ErrCidNotAllowed = errors.New("cid not allowed by store policy")
+
+// ErrAllocationLimit is returned when a block is refused by the MaxAllocation
+// check of a BasicIpldStore.
+var ErrAllocationLimit = errors.New("cbor length header exceeds allocation limit")
 
 func NewSerializationError(err error) error {
 	return SerializationError{err}
@@ -183,8 +836,17 @@ func (se SerializationError) Is(o error) bool {
 	return ok
 }
 
+// NewMemCborStore returns an IpldStore keeping blocks in memory, meant for
+// tests.
 func NewMemCborStore() IpldStore {
-	return NewCborStore(newMockBlocks())
+	return NewDumpableMemCborStore()
+}
+
+// NewDumpableMemCborStore is like NewMemCborStore, returning the store as a
+// *MemCborStore whose content can be saved with Dump and restored with Load.
+func NewDumpableMemCborStore() *MemCborStore {
+	bs := newMockBlocks()
+	return &MemCborStore{BasicIpldStore: NewCborStore(bs), blocks: bs}
 }
 
 type mockBlocks struct {
@@ -207,3 +869,27 @@ func (mb *mockBlocks) Put(ctx context.Context, b block.Block) error {
 	mb.data[b.Cid()] = b
 	return nil
 }
+
+func (mb *mockBlocks) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, ok := mb.data[c]
+	return ok, nil
+}
+
+func (mb *mockBlocks) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	keys := make([]cid.Cid, 0, len(mb.data))
+	for c := range mb.data {
+		keys = append(keys, c)
+	}
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for _, c := range keys {
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
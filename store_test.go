@@ -0,0 +1,1995 @@
+package cbornode
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	atlas "github.com/polydawn/refmt/obj/atlas"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestVerifyHashes(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+	s.VerifyHashes = true
+
+	c, err := s.Put(ctx, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out map[string]string
+	if err := s.Get(ctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := WrapObject(map[string]string{"hello": "mars"}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := block.NewBlockWithCid(other.RawData(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.data[c] = bad
+
+	if err := s.Get(ctx, c, &out); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+
+	s.VerifyHashes = false
+	var unverified map[string]string
+	if err := s.Get(ctx, c, &unverified); err != nil || unverified["hello"] != "mars" {
+		t.Fatalf("expected unverified read to succeed, got %v %v", unverified, err)
+	}
+}
+
+func TestIngestCBOR(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+	s.DefaultMultihash = mh.SHA2_256
+
+	obj := map[string]interface{}{
+		"foo": "bar",
+		"baz": []interface{}{1, -1, 1.5, true, nil, []byte("x")},
+	}
+	exp, err := s.Put(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Encode(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewCborStore(newMockBlocks())
+	c, err := IngestCBOR(ctx, other, bytes.NewReader(data), exp.Prefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(exp) {
+		t.Fatalf("expected %s, got %s", exp, c)
+	}
+	var out map[string]interface{}
+	if err := other.Get(ctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	nonCanon, err := os.ReadFile("test_objects/non-canon.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IngestCBOR(ctx, other, bytes.NewReader(nonCanon), exp.Prefix()); !errors.Is(err, ErrNotDagCBOR) {
+		t.Fatalf("expected ErrNotDagCBOR, got %v", err)
+	}
+
+	// Input is read up to the store's MaxAllocation, or 2 MiB.
+	other.MaxAllocation = uint64(len(data)) - 1
+	if _, err := IngestCBOR(ctx, other, bytes.NewReader(data), exp.Prefix()); !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("expected ErrObjectTooLarge, got %v", err)
+	}
+	other.MaxAllocation = uint64(len(data))
+	if _, err := IngestCBOR(ctx, other, bytes.NewReader(data), exp.Prefix()); err != nil {
+		t.Fatal(err)
+	}
+	endless := io.MultiReader(bytes.NewReader(data), zeroReader{})
+	if _, err := IngestCBOR(ctx, NewMemCborStore(), endless, exp.Prefix()); !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("expected ErrObjectTooLarge, got %v", err)
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+func TestGetMany(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	var cs []cid.Cid
+	for i := 0; i < 10; i++ {
+		c, err := s.Put(ctx, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+
+	outs := make([]interface{}, len(cs))
+	ints := make([]int, len(cs))
+	for i := range outs {
+		outs[i] = &ints[i]
+	}
+	n := 0
+	for cur := range s.GetMany(ctx, cs, outs) {
+		if cur.Err != nil {
+			t.Fatal(cur.Err)
+		}
+		if cur.Index != n || !cur.Cid.Equals(cs[n]) {
+			t.Fatalf("unexpected cursor %d for %s", cur.Index, cur.Cid)
+		}
+		n++
+	}
+	for i, v := range ints {
+		if v != i {
+			t.Fatalf("expected %d, got %d", i, v)
+		}
+	}
+
+	// Cancel after reading a single entry, then stop reading entirely: the
+	// channel must still be closed with a final context error.
+	cctx, cancel := context.WithCancel(ctx)
+	ch := s.GetMany(cctx, cs, outs)
+	<-ch
+	cancel()
+	var last *Cursor
+	for cur := range ch {
+		last = cur
+	}
+	if last == nil || last.Index != -1 || !errors.Is(last.Err, context.Canceled) {
+		t.Fatalf("expected a final context error, got %+v", last)
+	}
+}
+
+type testTransientErr struct{}
+
+func (testTransientErr) Error() string   { return "try again" }
+func (testTransientErr) Temporary() bool { return true }
+
+// flakyBlocks fails the first reads of each block listed in failures.
+type flakyBlocks struct {
+	*mockBlocks
+	failures map[cid.Cid]int
+	err      error
+}
+
+func (fb *flakyBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	if fb.failures[c] > 0 {
+		fb.failures[c]--
+		return nil, fb.err
+	}
+	return fb.mockBlocks.Get(ctx, c)
+}
+
+func TestGetManyRetry(t *testing.T) {
+	ctx := context.Background()
+	bs := &flakyBlocks{mockBlocks: newMockBlocks(), failures: map[cid.Cid]int{}}
+	s := NewCborStore(bs)
+
+	var cs []cid.Cid
+	for i := 0; i < 3; i++ {
+		c, err := s.Put(ctx, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+	run := func() []*Cursor {
+		var curs []*Cursor
+		for cur := range s.GetManyTyped(ctx, cs, func(int, cid.Cid) interface{} { return new(int) }) {
+			curs = append(curs, cur)
+		}
+		return curs
+	}
+
+	bs.err = fmt.Errorf("fetching: %w", testTransientErr{})
+	bs.failures[cs[1]] = 1
+	if curs := run(); curs[1].Err == nil || curs[1].Attempts != 1 || curs[2].Err != nil {
+		t.Fatalf("expected only the flaky read to fail without a policy, got %+v", curs[1])
+	}
+
+	s.GetManyRetry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	bs.failures[cs[0]] = 2
+	bs.failures[cs[2]] = 5
+	curs := run()
+	if curs[0].Err != nil || curs[0].Attempts != 3 || *curs[0].Value.(*int) != 0 {
+		t.Fatalf("expected the read to succeed on the last attempt, got %+v", curs[0])
+	}
+	if curs[1].Err != nil || curs[1].Attempts != 1 {
+		t.Fatalf("unexpected result %+v", curs[1])
+	}
+	if !IsTransient(curs[2].Err) || curs[2].Attempts != 3 {
+		t.Fatalf("expected the read to fail after 3 attempts, got %+v", curs[2])
+	}
+
+	// Permanent errors aren't retried.
+	bs.err = errors.New("gone")
+	bs.failures[cs[0]] = 1
+	if curs := run(); curs[0].Err == nil || curs[0].Attempts != 1 {
+		t.Fatalf("expected a single attempt, got %+v", curs[0])
+	}
+}
+
+// countingBlocks counts the reads of each block.
+type countingBlocks struct {
+	*mockBlocks
+	mu    sync.Mutex
+	reads map[cid.Cid]int
+}
+
+func (cb *countingBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	cb.mu.Lock()
+	cb.reads[c]++
+	cb.mu.Unlock()
+	return cb.mockBlocks.Get(ctx, c)
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	bs := &countingBlocks{mockBlocks: newMockBlocks(), reads: map[cid.Cid]int{}}
+	s := NewCborStore(bs)
+
+	leaf, err := s.Put(ctx, "leaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mids []cid.Cid
+	for i := 0; i < 4; i++ {
+		// Every middle node links to the same leaf.
+		c, err := s.Put(ctx, map[string]interface{}{"i": i, "leaf": leaf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mids = append(mids, c)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{"mids": mids})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Prefetch(ctx, s, root, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.reads) != 5 || bs.reads[leaf] != 0 {
+		t.Fatalf("expected the root and middle nodes to be read, got %v", bs.reads)
+	}
+
+	bs.reads = map[cid.Cid]int{}
+	if err := Prefetch(ctx, s, root, -1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.reads) != 6 || bs.reads[leaf] != 1 {
+		t.Fatalf("expected every block to be read once, got %v", bs.reads)
+	}
+
+	missing, err := WrapObject(map[string]interface{}{"mids": []cid.Cid{mids[0], leaf}, "x": 1}, DefaultMultihash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Prefetch(ctx, s, missing.Cid(), -1, 2); err == nil {
+		t.Fatal("expected an error prefetching a missing block")
+	}
+}
+
+func TestLinkedListIterator(t *testing.T) {
+	ctx := context.Background()
+	bs := &countingBlocks{mockBlocks: newMockBlocks(), reads: map[cid.Cid]int{}}
+	s := NewCborStore(bs)
+
+	for _, n := range []int{0, 1, 3, 10} {
+		var items []interface{}
+		for i := 0; i < n; i++ {
+			items = append(items, i)
+		}
+		root, err := PutLinkedList(ctx, s, items, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs.reads = map[cid.Cid]int{}
+		it := NewLinkedListIterator(ctx, s, root)
+		var got []interface{}
+		for it.Next() {
+			got = append(got, it.Value())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, items) {
+			t.Fatalf("got %v, expected %v", got, items)
+		}
+		if chunks := (n + 2) / 3; len(bs.reads) != chunks && !(n == 0 && len(bs.reads) == 1) {
+			t.Fatalf("expected %d chunks to be read, got %d", chunks, len(bs.reads))
+		}
+	}
+
+	bad, err := s.Put(ctx, map[string]interface{}{"items": []int{1}, "next": "nope"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := NewLinkedListIterator(ctx, s, bad)
+	if it.Next() || !errors.Is(it.Err(), ErrInvalidChunk) {
+		t.Fatalf("expected an invalid chunk error, got %v", it.Err())
+	}
+}
+
+func TestGetManyBudget(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	// Each string encodes to 8 bytes.
+	var cs []cid.Cid
+	for i := 0; i < 5; i++ {
+		c, err := s.Put(ctx, fmt.Sprintf("value %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+	outs := make([]interface{}, len(cs))
+	strs := make([]string, len(cs))
+	for i := range outs {
+		outs[i] = &strs[i]
+	}
+
+	var waves []int
+	remCs, remOuts := cs, outs
+	for len(remCs) > 0 {
+		err := s.GetManyBudget(ctx, remCs, remOuts, 20)
+		var budget *ByteBudgetError
+		switch {
+		case err == nil:
+			waves = append(waves, len(remCs))
+			remCs = nil
+		case errors.As(err, &budget) && errors.Is(err, ErrByteBudgetExceeded):
+			if budget.Size != 8 {
+				t.Fatalf("expected an 8 byte block, got %d", budget.Size)
+			}
+			read := len(remCs) - len(budget.Remaining)
+			waves = append(waves, read)
+			remCs, remOuts = budget.Remaining, remOuts[read:]
+		default:
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(waves) != "[2 2 1]" {
+		t.Fatalf("unexpected waves %v", waves)
+	}
+	for i, v := range strs {
+		if v != fmt.Sprintf("value %d", i) {
+			t.Fatalf("expected value %d, got %q", i, v)
+		}
+	}
+
+	err := s.GetManyBudget(ctx, cs, outs, 5)
+	var budget *ByteBudgetError
+	if !errors.As(err, &budget) || len(budget.Remaining) != len(cs) {
+		t.Fatalf("expected nothing to be read, got %v", err)
+	}
+}
+
+func TestDecodeErrorClassification(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+	put := func(data []byte) cid.Cid {
+		c, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: mh.SHA2_256, MhLength: -1}.Sum(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := block.NewBlockWithCid(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	truncated := put([]byte{0x82, 0x01})
+	badLink := put([]byte{0xd8, 0x2a, 0x43, 0x01, 0x02, 0x03})
+	text := put([]byte{0x64, 't', 'e', 'x', 't'})
+
+	var corrupt *CorruptBlockError
+	var link *LinkFormatError
+	var schema *SchemaMismatchError
+	if err := s.Get(ctx, truncated, new(interface{})); !errors.As(err, &corrupt) {
+		t.Fatalf("expected a corrupt block error, got %v", err)
+	}
+	var gen testCborGen
+	err := s.Get(ctx, truncated, &gen)
+	if !errors.As(err, &corrupt) || !errors.As(err, new(SerializationError)) {
+		t.Fatalf("expected a corrupt block serialization error, got %v", err)
+	}
+	if err := s.Get(ctx, badLink, new(interface{})); !errors.As(err, &link) {
+		t.Fatalf("expected a link format error, got %v", err)
+	}
+	err = s.Get(ctx, text, new(int))
+	if !errors.As(err, &schema) || schema.Type != reflect.TypeOf(new(int)) {
+		t.Fatalf("expected a schema mismatch error, got %v", err)
+	}
+	if err := s.Get(ctx, text, &gen); err != nil || gen != "text" {
+		t.Fatalf("unexpected decoding %q %v", gen, err)
+	}
+
+	s.GetManyRetry = &RetryPolicy{
+		MaxAttempts: 3,
+		Retryable: func(err error) bool {
+			return errors.As(err, new(*CorruptBlockError))
+		},
+	}
+	for cur := range s.GetManyTyped(ctx, []cid.Cid{truncated, text}, func(int, cid.Cid) interface{} { return new(int) }) {
+		if cur.Err == nil {
+			t.Fatalf("expected %s to fail", cur.Cid)
+		}
+		if expected := map[cid.Cid]int{truncated: 3, text: 1}[cur.Cid]; cur.Attempts != expected {
+			t.Fatalf("expected %d attempts for %s, got %d", expected, cur.Cid, cur.Attempts)
+		}
+	}
+}
+
+func TestGetManyTyped(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	var cs []cid.Cid
+	for _, v := range []interface{}{1, "two", 3} {
+		c, err := s.Put(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+
+	factory := func(i int, c cid.Cid) interface{} {
+		if i%2 == 0 {
+			return new(int)
+		}
+		return new(string)
+	}
+	var got []interface{}
+	for cur := range s.GetManyTyped(ctx, cs, factory) {
+		if cur.Err != nil {
+			t.Fatal(cur.Err)
+		}
+		got = append(got, reflect.ValueOf(cur.Value).Elem().Interface())
+	}
+	if !reflect.DeepEqual(got, []interface{}{1, "two", 3}) {
+		t.Fatalf("unexpected values %v", got)
+	}
+}
+
+func TestCollectBlocks(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+
+	shared, err := s.Put(ctx, map[string]interface{}{"shared": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Put(ctx, map[string]interface{}{"s": shared, "name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Put(ctx, map[string]interface{}{"s": shared, "again": []interface{}{shared}, "name": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blks, err := CollectBlocks(ctx, bs, []cid.Cid{a, b, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []cid.Cid
+	for _, blk := range blks {
+		got = append(got, blk.Cid())
+	}
+	if len(got) != 3 || !got[0].Equals(a) || !got[1].Equals(shared) || !got[2].Equals(b) {
+		t.Fatalf("unexpected blocks: %v", got)
+	}
+
+	// Long chains are walked without recursion.
+	tip := shared
+	for i := 0; i < 5000; i++ {
+		tip, err = s.Put(ctx, map[string]interface{}{"prev": tip})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	blks, err = CollectBlocks(ctx, bs, []cid.Cid{tip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 5001 || !blks[0].Cid().Equals(tip) || !blks[5000].Cid().Equals(shared) {
+		t.Fatalf("unexpected chain walk: %d blocks", len(blks))
+	}
+}
+
+// testShardLens presents a node of the form {"shards": [link, ...]} as the
+// union of the maps it links to.
+type testShardLens struct{}
+
+func (testShardLens) Match(n *Node) bool {
+	m, ok := n.AsMap()
+	if !ok || len(m) != 1 {
+		return false
+	}
+	_, ok = m["shards"].([]interface{})
+	return ok
+}
+
+func (testShardLens) shards(n *Node) []cid.Cid {
+	m, _ := n.AsMap()
+	var out []cid.Cid
+	for _, s := range m["shards"].([]interface{}) {
+		if c, ok := s.(cid.Cid); ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (l testShardLens) Resolve(ctx context.Context, store IpldStore, n *Node, path []string) (interface{}, []string, error) {
+	for _, c := range l.shards(n) {
+		shard, err := GetNode(ctx, store, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if val, rest, err := shard.Resolve(path); err == nil {
+			return val, rest, nil
+		}
+	}
+	return nil, nil, ErrNoSuchLink
+}
+
+func (l testShardLens) Links(ctx context.Context, store IpldStore, n *Node) ([]cid.Cid, error) {
+	var out []cid.Cid
+	for _, c := range l.shards(n) {
+		shard, err := GetNode(ctx, store, c)
+		if err != nil {
+			return nil, err
+		}
+		for _, lnk := range shard.Links() {
+			out = append(out, lnk.Cid)
+		}
+	}
+	return out, nil
+}
+
+func TestLensResolvePath(t *testing.T) {
+	RegisterLens(testShardLens{})
+	defer updateSettings(func(s *settings) { s.lenses = nil })
+
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	leaf, err := s.Put(ctx, map[string]interface{}{"value": 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := s.Put(ctx, map[string]interface{}{"a": leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := s.Put(ctx, map[string]interface{}{"b": "plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded, err := s.Put(ctx, map[string]interface{}{"shards": []interface{}{s1, s2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{"dir": sharded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := ResolvePath(ctx, s, root, []string{"dir", "a", "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 42 {
+		t.Fatalf("expected 42, got %v", val)
+	}
+	val, err = ResolvePath(ctx, s, root, []string{"dir", "b"})
+	if err != nil || val != "plain" {
+		t.Fatalf("expected plain, got %v %v", val, err)
+	}
+	if _, err := ResolvePath(ctx, s, root, []string{"dir", "shards"}); err == nil {
+		t.Fatal("expected the internal layout to be hidden")
+	}
+
+	var visited []cid.Cid
+	err = WalkGraph(ctx, s, root, func(c cid.Cid, n *Node) error {
+		visited = append(visited, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 || !visited[0].Equals(root) || !visited[1].Equals(sharded) || !visited[2].Equals(leaf) {
+		t.Fatalf("unexpected walk: %v", visited)
+	}
+
+	tip := leaf
+	for i := 0; i < 5000; i++ {
+		tip, err = s.Put(ctx, map[string]interface{}{"prev": tip})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	err = WalkGraph(ctx, s, tip, func(c cid.Cid, nd *Node) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 5001 {
+		t.Fatalf("unexpected chain walk: %d nodes, %v", n, err)
+	}
+}
+
+func TestCidAllowList(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+	s.AllowedCodecs = []uint64{cid.DagCBOR}
+	s.AllowedMultihashes = []uint64{mh.SHA2_256}
+
+	if _, err := s.Put(ctx, map[string]string{"a": "b"}); !errors.Is(err, ErrCidNotAllowed) {
+		t.Fatalf("expected ErrCidNotAllowed, got %v", err)
+	}
+
+	s.DefaultMultihash = mh.SHA2_256
+	c, err := s.Put(ctx, map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]string
+	if err := s.Get(ctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	s.AllowedMultihashes = []uint64{mh.BLAKE2B_MIN + 31}
+	if err := s.Get(ctx, c, &out); !errors.Is(err, ErrCidNotAllowed) {
+		t.Fatalf("expected ErrCidNotAllowed, got %v", err)
+	}
+	pref := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: mh.SHA2_256, MhLength: -1}
+	if _, err := IngestCBOR(ctx, s, bytes.NewReader([]byte{0xa0}), pref); !errors.Is(err, ErrCidNotAllowed) {
+		t.Fatalf("expected ErrCidNotAllowed, got %v", err)
+	}
+}
+
+func TestMaxAllocation(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+	s.MaxAllocation = 4
+
+	put := func(data []byte) cid.Cid {
+		hash, err := mh.Sum(data, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := block.NewBlockWithCid(data, cid.NewCidV1(cid.DagCBOR, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+		return blk.Cid()
+	}
+
+	var out interface{}
+	if err := s.Get(ctx, put([]byte{0x84, 1, 2, 3, 4}), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{
+		// A five byte string.
+		{0x45, 1, 2, 3, 4, 5},
+		// An array announcing four items but holding one.
+		{0x84, 1},
+		// A map announcing 2^32-1 entries.
+		{0xba, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if err := s.Get(ctx, put(data), &out); !errors.Is(err, ErrAllocationLimit) {
+			t.Fatalf("%x: expected ErrAllocationLimit, got %v", data, err)
+		}
+	}
+}
+
+func TestWrapStore(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	logging := func(name string) StoreMiddleware {
+		return StoreMiddleware{
+			Get: func(ctx context.Context, c cid.Cid, out interface{}, next GetFunc) error {
+				calls = append(calls, name+" get")
+				return next(ctx, c, out)
+			},
+			Put: func(ctx context.Context, v interface{}, next PutFunc) (cid.Cid, error) {
+				calls = append(calls, name+" put")
+				return next(ctx, v)
+			},
+		}
+	}
+	errReadOnly := errors.New("read only")
+	readOnly := StoreMiddleware{
+		Put: func(ctx context.Context, v interface{}, next PutFunc) (cid.Cid, error) {
+			return cid.Undef, errReadOnly
+		},
+	}
+
+	inner := NewCborStore(newMockBlocks())
+	c, err := inner.Put(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := WrapStore(inner, logging("outer"), logging("inner"), readOnly)
+	var out string
+	if err := s.Get(ctx, c, &out); err != nil || out != "hello" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err := s.Put(ctx, "world"); err != errReadOnly {
+		t.Fatalf("expected the middleware error, got %v", err)
+	}
+	expected := []string{"outer get", "inner get", "outer put", "inner put"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("got calls %v, expected %v", calls, expected)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	inner := NewCborStore(newMockBlocks())
+	inner.DefaultMultihash = mh.SHA2_256
+	existing, err := inner.Put(ctx, map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trace bytes.Buffer
+	rec := NewRecordingStore(inner, &trace)
+	var out map[string]int
+	if err := rec.Get(ctx, existing, &out); err != nil {
+		t.Fatal(err)
+	}
+	put, err := rec.Put(ctx, map[string]interface{}{"b": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Get(ctx, put, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["b"] != 2 {
+		t.Fatalf("unexpected object %v", out)
+	}
+
+	replay, err := NewReplayStore(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Get(ctx, put, &out); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("expected ErrReplayMismatch out of order, got %v", err)
+	}
+	out = nil
+	if err := replay.Get(ctx, existing, &out); err != nil || out["a"] != 1 {
+		t.Fatalf("got %v, %v", out, err)
+	}
+	if err := replay.Done(); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("expected an incomplete replay, got %v", err)
+	}
+	if _, err := replay.Put(ctx, map[string]interface{}{"b": 3}); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("expected ErrReplayMismatch for another object, got %v", err)
+	}
+	replayed, err := replay.Put(ctx, map[string]interface{}{"b": 2})
+	if err != nil || !replayed.Equals(put) {
+		t.Fatalf("got %s, %v, expected %s", replayed, err, put)
+	}
+	out = nil
+	if err := replay.Get(ctx, put, &out); err != nil || out["b"] != 2 {
+		t.Fatalf("got %v, %v", out, err)
+	}
+	if err := replay.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaStore(t *testing.T) {
+	ctx := context.Background()
+	inner := NewCborStore(newMockBlocks())
+	global := &Quota{MaxBlocks: 3}
+	s := NewQuotaStore(inner, global)
+
+	c, err := s.Put(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := &Quota{MaxBytes: 3, CountGets: true}
+	tctx := WithQuota(ctx, tenant)
+	if _, err := s.Put(tctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	// "c" takes two more bytes, over the tenant's three.
+	if _, err := s.Put(tctx, "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if bytes, blocks := global.Usage(); bytes != 4 || blocks != 2 {
+		t.Fatalf("a refused put was counted: %d bytes, %d blocks", bytes, blocks)
+	}
+
+	var out string
+	if err := s.Get(ctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get(tctx, c, &out); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected gets to count against the tenant quota, got %v", err)
+	}
+
+	if _, err := s.Put(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "e"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+}
+
+type testTenantObj struct {
+	Value int
+}
+
+func TestWithAtlas(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+	s.DefaultMultihash = mh.SHA2_256
+
+	entry := atlas.BuildEntry(testTenantObj{}).StructMap().
+		AddField("Value", atlas.StructMapEntry{SerialName: "v"}).
+		Complete()
+	atl, err := NewAtlas(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx := WithAtlas(ctx, atl)
+
+	// testTenantObj isn't registered with the package atlas.
+	if _, err := s.Put(ctx, &testTenantObj{Value: 1}); err == nil {
+		t.Fatal("expected an unregistered type to be refused")
+	}
+	c, err := s.Put(tctx, &testTenantObj{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := WrapObject(map[string]int{"v": 1}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(expected.Cid()) {
+		t.Fatalf("got %s, expected %s", c, expected.Cid())
+	}
+
+	var out testTenantObj
+	if err := s.Get(tctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 1 {
+		t.Fatalf("unexpected object %+v", out)
+	}
+}
+
+// testCborGen stands in for a cbor-gen generated type.
+type testCborGen string
+
+func (g testCborGen) MarshalCBOR(w io.Writer) error {
+	return EncodeWriter(string(g), w)
+}
+
+func (g *testCborGen) UnmarshalCBOR(r io.Reader) error {
+	var s string
+	if err := DecodeReader(r, &s); err != nil {
+		return err
+	}
+	*g = testCborGen(s)
+	return nil
+}
+
+func TestGetUnmarshalerTarget(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+	c, err := s.Put(ctx, testCborGen("gen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var val testCborGen
+	ptr := &val
+	var iface cbg.CBORUnmarshaler = &val
+	for _, out := range []interface{}{val, &ptr, &iface} {
+		var target *UnmarshalerTargetError
+		if err := s.Get(ctx, c, out); !errors.As(err, &target) {
+			t.Fatalf("%T: expected an UnmarshalerTargetError, got %v", out, err)
+		}
+		if target.Want != reflect.TypeOf(ptr) {
+			t.Fatalf("%T: error suggests %s", out, target.Want)
+		}
+	}
+
+	if err := s.Get(ctx, c, iface); err != nil || val != "gen" {
+		t.Fatalf("unexpected read %q %v", val, err)
+	}
+}
+
+func TestDefaultMhLength(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+	s.DefaultMultihash = mh.BLAKE2B_MIN + 31
+	s.DefaultMhLength = 20
+
+	for _, v := range []interface{}{"refmt", testCborGen("cbor-gen")} {
+		c, err := s.Put(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pref := c.Prefix()
+		if pref.MhType != mh.BLAKE2B_MIN+31 || pref.MhLength != 20 {
+			t.Fatalf("%T: unexpected prefix %+v", v, pref)
+		}
+		back, err := cid.Decode(c.String())
+		if err != nil || !back.Equals(c) {
+			t.Fatalf("%T: cid did not round trip: %s, %v", v, back, err)
+		}
+		var out testCborGen
+		if err := s.Get(ctx, back, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncBlocks is a blockstore safe for concurrent use, optionally failing
+// every write.
+type syncBlocks struct {
+	lk   sync.Mutex
+	mb   *mockBlocks
+	fail error
+}
+
+func (sb *syncBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	return sb.mb.Get(ctx, c)
+}
+
+func (sb *syncBlocks) Put(ctx context.Context, b block.Block) error {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	if sb.fail != nil {
+		return sb.fail
+	}
+	return sb.mb.Put(ctx, b)
+}
+
+func TestPrimitives(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	link, err := CborString("target").Cid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		v     interface{ Cid() (cid.Cid, error) }
+		plain interface{}
+		out   interface{}
+	}{
+		{CborByteArray("bytes"), []byte("bytes"), new(CborByteArray)},
+		{CborString("text"), "text", new(CborString)},
+		{CborInt(-42), -42, new(CborInt)},
+		{CborBool(true), true, new(CborBool)},
+		{CborCidList{link, link}, []cid.Cid{link, link}, new(CborCidList)},
+	} {
+		c, err := s.Put(ctx, tc.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err := tc.v.Cid()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Equals(exp) {
+			t.Fatalf("%v: stored as %s, Cid returned %s", tc.v, c, exp)
+		}
+		if err := s.Get(ctx, c, tc.out); err != nil {
+			t.Fatal(err)
+		}
+		if got := reflect.ValueOf(tc.out).Elem().Interface(); !reflect.DeepEqual(got, tc.v) {
+			t.Fatalf("got %v, expected %v", got, tc.v)
+		}
+		// The refmt encoding of the plain value must agree.
+		nd, err := WrapObject(tc.plain, DefaultMultihash, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nd.Cid().Equals(c) {
+			t.Fatalf("%v: refmt encoding differs", tc.v)
+		}
+	}
+
+	// Decoding into a buffer with spare capacity must not keep stale bytes.
+	buf := make(CborByteArray, 8, 16)
+	copy(buf, "stalestu")
+	if err := buf.UnmarshalCBOR(bytes.NewReader([]byte{0x43, 'n', 'e', 'w'})); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "new" {
+		t.Fatalf("got %q", buf)
+	}
+}
+
+func TestWrappedMemCborStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemCborStore()
+	s.(*MemCborStore).DefaultMultihash = mh.SHA2_256
+	s.(*MemCborStore).AllowedMultihashes = []uint64{mh.SHA2_256}
+
+	direct, err := s.Put(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direct.Prefix().MhType != mh.SHA2_256 {
+		t.Fatalf("expected a sha2-256 CID, got %s", direct)
+	}
+	async := NewAsyncStore(s, 2)
+	c, err := async.Put(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != direct {
+		t.Fatalf("expected the async store to use the store settings: %s, got %s", direct, c)
+	}
+	if err := async.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Encode("world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pref := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: mh.SHA2_512, MhLength: -1}
+	if _, err := IngestCBOR(ctx, s, bytes.NewReader(data), pref); !errors.Is(err, ErrCidNotAllowed) {
+		t.Fatalf("expected ErrCidNotAllowed, got %v", err)
+	}
+}
+
+func TestMemCborStoreDumpLoad(t *testing.T) {
+	ctx := context.Background()
+	build := func(order []string) (*MemCborStore, cid.Cid) {
+		s := NewDumpableMemCborStore()
+		var links []cid.Cid
+		for _, v := range order {
+			c, err := s.Put(ctx, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			links = append(links, c)
+		}
+		sort.Slice(links, func(i, j int) bool {
+			return bytes.Compare(links[i].Bytes(), links[j].Bytes()) < 0
+		})
+		root, err := s.Put(ctx, map[string]interface{}{"leaves": links})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, root
+	}
+	s, root := build([]string{"a", "b", "c"})
+	var dump bytes.Buffer
+	if err := s.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := build([]string{"c", "a", "b"})
+	var otherDump bytes.Buffer
+	if err := other.Dump(&otherDump); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dump.Bytes(), otherDump.Bytes()) {
+		t.Fatal("expected dumps of the same content to be identical")
+	}
+
+	var rooted bytes.Buffer
+	if err := s.Dump(&rooted, root); err != nil {
+		t.Fatal(err)
+	}
+	header, err := readCarSection(bufio.NewReader(&rooted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h map[string]interface{}
+	if err := DecodeInto(header, &h); err != nil {
+		t.Fatal(err)
+	}
+	if roots, _ := h["roots"].([]interface{}); len(roots) != 1 || roots[0] != root {
+		t.Fatalf("expected the header to list %s, got %v", root, roots)
+	}
+
+	loaded := NewDumpableMemCborStore()
+	if err := loaded.Load(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = WalkGraph(ctx, loaded, root, func(c cid.Cid, nd *Node) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 4 {
+		t.Fatalf("expected to walk 4 nodes, walked %d: %v", n, err)
+	}
+
+	// Corrupt the last byte of the last block.
+	corrupt := append([]byte(nil), dump.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := NewDumpableMemCborStore().Load(bytes.NewReader(corrupt)); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+	if err := NewDumpableMemCborStore().Load(bytes.NewReader(dump.Bytes()[:dump.Len()-1])); !errors.Is(err, ErrInvalidCar) {
+		t.Fatalf("expected a truncated file to be refused, got %v", err)
+	}
+}
+
+func TestCborCidSet(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	var cs []cid.Cid
+	for _, v := range []string{"a", "b", "c"} {
+		c, err := CborString(v).Cid()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+	sorted := append([]cid.Cid(nil), cs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Bytes(), sorted[j].Bytes()) < 0
+	})
+
+	// Unsorted and duplicated links encode like the sorted set.
+	set := CborCidSet{cs[2], cs[0], cs[1], cs[0]}
+	c, err := s.Put(ctx, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := NewCborCidSet(sorted...).Cid()
+	if err != nil || !c.Equals(exp) {
+		t.Fatalf("expected %s, got %s %v", exp, c, err)
+	}
+	var out CborCidSet
+	if err := s.Get(ctx, c, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]cid.Cid(out), sorted) || !out.Has(cs[1]) {
+		t.Fatalf("unexpected set %v", out)
+	}
+	other, err := CborString("d").Cid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Has(other) {
+		t.Fatalf("unexpected member %s", other)
+	}
+
+	// Sets nested in refmt encoded values are canonical too.
+	b, err := Encode(map[string]CborCidSet{"s": set})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Encode(map[string][]cid.Cid{"s": sorted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+	var nested map[string]CborCidSet
+	if err := DecodeInto(b, &nested); err != nil || !reflect.DeepEqual([]cid.Cid(nested["s"]), sorted) {
+		t.Fatalf("unexpected set %v %v", nested, err)
+	}
+
+	unsorted := []cid.Cid{sorted[1], sorted[0]}
+	bad, err := Encode(map[string][]cid.Cid{"s": unsorted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested = nil
+	if err := DecodeInto(bad, &nested); !errors.Is(err, ErrInvalidCidSet) {
+		t.Fatalf("expected an unsorted set to be refused, got %v", err)
+	}
+	if bad, err = Encode(unsorted); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.UnmarshalCBOR(bytes.NewReader(bad)); !errors.Is(err, ErrInvalidCidSet) {
+		t.Fatalf("expected an unsorted set to be refused, got %v", err)
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+	if s.HotKeys(1) != nil {
+		t.Fatal("expected no hot keys without a profiler")
+	}
+
+	now := time.Unix(1000, 0)
+	s.Profiler = NewHotKeyProfiler(8*time.Second, 1)
+	s.Profiler.now = func() time.Time { return now }
+
+	var cs []cid.Cid
+	for _, v := range []string{"a", "b", "c"} {
+		c, err := s.Put(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+	get := func(c cid.Cid, times int) {
+		for i := 0; i < times; i++ {
+			var out string
+			if err := s.Get(ctx, c, &out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	get(cs[0], 3)
+	now = now.Add(5 * time.Second)
+	get(cs[1], 2)
+	get(cs[2], 1)
+
+	exp := []CidCount{{cs[0], 3}, {cs[1], 2}}
+	if got := s.HotKeys(2); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+
+	// The fetches of a fall out of the window first.
+	now = now.Add(4 * time.Second)
+	exp = []CidCount{{cs[1], 2}, {cs[2], 1}}
+	if got := s.HotKeys(5); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+	now = now.Add(8 * time.Second)
+	if got := s.HotKeys(5); len(got) != 0 {
+		t.Fatalf("expected the window to be empty, got %v", got)
+	}
+
+	s.Profiler = NewHotKeyProfiler(time.Minute, 2)
+	get(cs[2], 4)
+	exp = []CidCount{{cs[2], 4}}
+	if got := s.HotKeys(5); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+}
+
+func TestAsyncStore(t *testing.T) {
+	ctx := context.Background()
+	bs := &syncBlocks{mb: newMockBlocks()}
+	inner := NewCborStore(bs)
+	s := NewAsyncStore(inner, 4)
+
+	var cs []cid.Cid
+	for i := 0; i < 50; i++ {
+		c, err := s.Put(ctx, map[string]int{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+
+		var out map[string]int
+		if err := s.Get(ctx, c, &out); err != nil || out["i"] != i {
+			t.Fatalf("expected to read back %d, got %v %v", i, out, err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cs {
+		var out map[string]int
+		if err := inner.Get(ctx, c, &out); err != nil || out["i"] != i {
+			t.Fatalf("expected %d in the inner store, got %v %v", i, out, err)
+		}
+	}
+
+	failure := errors.New("disk full")
+	bs.fail = failure
+	if _, err := s.Put(ctx, map[string]int{"i": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); !errors.Is(err, failure) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("expected the error to be reported once, got %v", err)
+	}
+}
+
+// slowBlocks takes a millisecond to write each block.
+type slowBlocks struct {
+	syncBlocks
+}
+
+func (sb *slowBlocks) Put(ctx context.Context, b block.Block) error {
+	time.Sleep(time.Millisecond)
+	return sb.syncBlocks.Put(ctx, b)
+}
+
+func TestAsyncStoreFlushWhilePutting(t *testing.T) {
+	ctx := context.Background()
+	s := NewAsyncStore(NewCborStore(&slowBlocks{syncBlocks{mb: newMockBlocks()}}), 4)
+
+	// Keep every worker busy, so that some write is always in flight.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := s.Put(ctx, map[string]int{"stream": i}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	c, err := s.Put(ctx, map[string]int{"i": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.Flush(fctx); err != nil {
+		t.Fatalf("expected Flush to return once the earlier writes are done, got %v", err)
+	}
+	var out map[string]int
+	if err := s.inner.Get(ctx, c, &out); err != nil || out["i"] != 1 {
+		t.Fatalf("expected the object in the inner store, got %v %v", out, err)
+	}
+}
+
+// testBlockService serves blocks from a local store, falling back to a
+// "remote" one.
+type testBlockService struct {
+	local, remote *mockBlocks
+	fetched       int
+}
+
+func (bs *testBlockService) GetBlock(ctx context.Context, c cid.Cid) (block.Block, error) {
+	if blk, err := bs.local.Get(ctx, c); err == nil {
+		return blk, nil
+	}
+	blk, err := bs.remote.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	bs.fetched++
+	return blk, bs.local.Put(ctx, blk)
+}
+
+func (bs *testBlockService) AddBlock(ctx context.Context, blk block.Block) error {
+	return bs.local.Put(ctx, blk)
+}
+
+func TestBlockServiceStore(t *testing.T) {
+	ctx := context.Background()
+	bsvc := &testBlockService{local: newMockBlocks(), remote: newMockBlocks()}
+	s := NewBlockServiceStore(bsvc)
+
+	remote, err := NewCborStore(bsvc.remote).Put(ctx, map[string]string{"from": "network"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := s.Put(ctx, map[string]string{"from": "disk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out map[string]string
+	if err := s.Get(ctx, local, &out); err != nil || out["from"] != "disk" {
+		t.Fatalf("unexpected local read %v %v", out, err)
+	}
+	var fetched map[string]string
+	if err := s.Get(ctx, remote, &fetched); err != nil || fetched["from"] != "network" {
+		t.Fatalf("unexpected remote read %v %v", fetched, err)
+	}
+	if bsvc.fetched != 1 {
+		t.Fatalf("expected a single network fetch, got %d", bsvc.fetched)
+	}
+}
+
+func TestProof(t *testing.T) {
+	ctx := context.Background()
+	s := NewCborStore(newMockBlocks())
+
+	leaf, err := s.Put(ctx, map[string]interface{}{"balance": 100, "other": "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid, err := s.Put(ctx, map[string]interface{}{"accounts": []interface{}{leaf}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{"state": mid, "unrelated": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := Prove(ctx, s, root, "state/accounts/0/balance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.Blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(proof.Blocks))
+	}
+	val, err := VerifyProof(root, "state/accounts/0/balance", proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 100 {
+		t.Fatalf("expected 100, got %v", val)
+	}
+
+	if _, err := VerifyProof(root, "state/accounts/0/balance", Proof{Blocks: proof.Blocks[:2]}); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected an incomplete proof to fail, got %v", err)
+	}
+
+	forged, err := WrapObject(map[string]interface{}{"balance": 1000000, "other": "data"}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := block.NewBlockWithCid(forged.RawData(), leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyProof(root, "state/accounts/0/balance", Proof{Blocks: []block.Block{proof.Blocks[0], proof.Blocks[1], bad}}); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected a forged proof to fail, got %v", err)
+	}
+}
+
+func TestShardedMemCborStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemCborStore(8)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				c, err := s.Put(ctx, map[string]int{"w": w, "i": i})
+				if err != nil {
+					errs <- err
+					return
+				}
+				var out map[string]int
+				if err := s.Get(ctx, c, &out); err != nil || out["w"] != w || out["i"] != i {
+					errs <- fmt.Errorf("unexpected read %v %v", out, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkShardedMemCborStoreParallel(b *testing.B) {
+	ctx := context.Background()
+	s := NewShardedMemCborStore(0)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c, err := s.Put(ctx, map[string]int{"i": i})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var out map[string]int
+			if err := s.Get(ctx, c, &out); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func TestAllDagCborKeys(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+
+	a, err := s.Put(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Put(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := block.NewBlock([]byte("not cbor"))
+	if err := bs.Put(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.AllDagCborKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := cid.NewSet()
+	for c := range keys {
+		found.Add(c)
+	}
+	if found.Len() != 2 || !found.Has(a) || !found.Has(b) {
+		t.Fatalf("unexpected keys %v", found.Keys())
+	}
+
+	if _, err := NewCborStore(&syncBlocks{mb: bs}).AllDagCborKeys(ctx); err == nil {
+		t.Fatal("expected an error for a blockstore that can't list its keys")
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	inner := NewCborStore(bs)
+
+	newAEAD := func(key byte) cipher.AEAD {
+		blk, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aead
+	}
+	s := NewEncryptedStore(inner, newAEAD(1))
+
+	c, err := s.Put(ctx, map[string]string{"secret": "plans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Type() != cid.Raw {
+		t.Fatalf("expected a raw cid, got codec %d", c.Type())
+	}
+	if bytes.Contains(bs.data[c].RawData(), []byte("plans")) {
+		t.Fatal("expected the stored block to be encrypted")
+	}
+
+	var out map[string]string
+	if err := s.Get(ctx, c, &out); err != nil || out["secret"] != "plans" {
+		t.Fatalf("unexpected read %v %v", out, err)
+	}
+
+	var wrongKey map[string]string
+	if err := NewEncryptedStore(inner, newAEAD(2)).Get(ctx, c, &wrongKey); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+
+	// The plaintext is decoded with the settings of the inner store.
+	inner.MaxAllocation = 4
+	if err := s.Get(ctx, c, &out); !errors.Is(err, ErrAllocationLimit) {
+		t.Fatalf("expected ErrAllocationLimit, got %v", err)
+	}
+}
+
+func TestChecksumBlockstore(t *testing.T) {
+	ctx := context.Background()
+	corrupt := func(blk block.Block) block.Block {
+		data := append([]byte(nil), blk.RawData()...)
+		data[len(data)-1] ^= 1
+		out, err := block.NewBlockWithCid(data, blk.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// Inline checksums.
+	bs := newMockBlocks()
+	s := NewCborStore(NewChecksumBlockstore(bs))
+	c, err := s.Put(ctx, "inline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var str string
+	if err := s.Get(ctx, c, &str); err != nil || str != "inline" {
+		t.Fatalf("unexpected read %q %v", str, err)
+	}
+	if stored := bs.data[c].RawData(); stored[0] != checksumMarker {
+		t.Fatalf("expected an inline checksum, got %x", stored)
+	}
+	bs.data[c] = corrupt(bs.data[c])
+	if err := s.Get(ctx, c, &str); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	// Blocks written before wrapping are returned unchecked.
+	plain, err := NewCborStore(bs).Put(ctx, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get(ctx, plain, &str); err != nil || str != "plain" {
+		t.Fatalf("unexpected read %q %v", str, err)
+	}
+
+	// Raw blocks can start with the marker byte; they carry no inline
+	// checksum.
+	cbs := NewChecksumBlockstore(bs)
+	raw := block.NewBlock([]byte{checksumMarker, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	if err := bs.Put(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cbs.Get(ctx, raw.Cid())
+	if err != nil || !bytes.Equal(got.RawData(), raw.RawData()) {
+		t.Fatalf("unexpected raw read %x %v", got, err)
+	}
+	raw2 := block.NewBlock([]byte{checksumMarker, 9, 8})
+	if err := cbs.Put(ctx, raw2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs.data[raw2.Cid()].RawData(), raw2.RawData()) {
+		t.Fatal("expected the raw block to be stored as is")
+	}
+
+	// Sidecar checksums leave blocks unchanged.
+	sb := newShardedBlocks(4)
+	s = NewCborStore(NewChecksumBlockstore(sb))
+	c, err = s.Put(ctx, "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject("sidecar", DefaultMultihash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := sb.Get(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blk.RawData(), nd.RawData()) {
+		t.Fatalf("expected the block to be stored unchanged, got %x", blk.RawData())
+	}
+	if err := s.Get(ctx, c, &str); err != nil || str != "sidecar" {
+		t.Fatalf("unexpected read %q %v", str, err)
+	}
+	if err := sb.Put(ctx, corrupt(blk)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get(ctx, c, &str); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestCountDuplicates(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(bs)
+	s.CountDuplicates = true
+
+	nd, err := WrapObject("dup", DefaultMultihash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{"dup", "other", "dup", testCborGen("dup")} {
+		if _, err := s.Put(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := StoreStats{Writes: 2, Duplicates: 2, BytesSaved: 2 * int64(len(nd.RawData()))}
+	if stats := s.Stats(); stats != exp {
+		t.Fatalf("got %+v, expected %+v", stats, exp)
+	}
+
+	// Without Has, every block is written.
+	s = NewCborStore(&syncBlocks{mb: bs})
+	s.CountDuplicates = true
+	if _, err := s.Put(ctx, "dup"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats != (StoreStats{Writes: 1}) {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestCompressedBlockstore(t *testing.T) {
+	ctx := context.Background()
+	bs := newMockBlocks()
+	s := NewCborStore(NewCompressedBlockstore(bs, FlateCompressor{Level: flate.BestCompression}))
+	s.VerifyHashes = true
+
+	big := map[string]string{"repeated": strings.Repeat("state ", 200)}
+	c, err := s.Put(ctx, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := WrapObject(big, DefaultMultihash, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := len(bs.data[c].RawData()); stored >= len(nd.RawData()) {
+		t.Fatalf("expected the stored block to be compressed, got %d bytes for %d", stored, len(nd.RawData()))
+	}
+
+	var out map[string]string
+	if err := s.Get(ctx, c, &out); err != nil || out["repeated"] != big["repeated"] {
+		t.Fatalf("unexpected read %v", err)
+	}
+
+	// Blocks written before wrapping and small blocks are stored as is.
+	plain, err := NewCborStore(bs).Put(ctx, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := s.Put(ctx, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var str string
+	if err := s.Get(ctx, plain, &str); err != nil || str != "plain" {
+		t.Fatalf("unexpected read %q %v", str, err)
+	}
+	if err := NewCborStore(bs).Get(ctx, small, &str); err != nil || str != "small" {
+		t.Fatalf("unexpected read %q %v", str, err)
+	}
+
+	// Raw blocks can start with the marker byte; they are never compressed.
+	cbs := NewCompressedBlockstore(bs, FlateCompressor{Level: flate.BestCompression})
+	raw := block.NewBlock(append([]byte{compressedMarker}, bytes.Repeat([]byte{0x13}, 100)...))
+	if err := cbs.Put(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs.data[raw.Cid()].RawData(), raw.RawData()) {
+		t.Fatal("expected the raw block to be stored as is")
+	}
+	got, err := cbs.Get(ctx, raw.Cid())
+	if err != nil || !bytes.Equal(got.RawData(), raw.RawData()) {
+		t.Fatalf("unexpected raw read %x %v", got, err)
+	}
+}
+
+func TestExportImportJSONL(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemCborStore()
+	leaf, err := s.Put(ctx, map[string]interface{}{
+		"bytes": []byte{1, 2, 3},
+		"float": 2.0,
+		"neg":   -7,
+		"big":   uint64(math.MaxUint64),
+		"str":   "a\n\"b\"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{
+		"leaves": []cid.Cid{leaf, leaf},
+		"empty":  []interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ExportJSONL(ctx, s, root, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], `{"cid":"`+root.String()+`"`) {
+		t.Fatalf("expected the root first, got %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"float":2.0`) || !strings.Contains(lines[1], `{"/":{"bytes":"AQID"}}`) {
+		t.Fatalf("unexpected leaf line %s", lines[1])
+	}
+
+	other := NewDumpableMemCborStore()
+	got, err := ImportJSONL(ctx, other, bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(root) {
+		t.Fatalf("expected root %s, got %s", root, got)
+	}
+	for _, c := range []cid.Cid{root, leaf} {
+		if ok, _ := other.blocks.Has(ctx, c); !ok {
+			t.Fatalf("expected %s to be imported", c)
+		}
+	}
+
+	tampered := strings.Replace(out.String(), `"neg":-7`, `"neg":-8`, 1)
+	if _, err := ImportJSONL(ctx, NewMemCborStore(), strings.NewReader(tampered)); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	if _, err := ImportJSONL(ctx, NewMemCborStore(), strings.NewReader("{")); !errors.Is(err, ErrInvalidJSONL) {
+		t.Fatalf("expected ErrInvalidJSONL, got %v", err)
+	}
+}
+
+// tieredBlocks reads from its hot store first, then from the cold one.
+type tieredBlocks struct {
+	hot, cold *mockBlocks
+}
+
+func (tb *tieredBlocks) Get(ctx context.Context, c cid.Cid) (block.Block, error) {
+	if blk, err := tb.hot.Get(ctx, c); err == nil {
+		return blk, nil
+	}
+	return tb.cold.Get(ctx, c)
+}
+
+func (tb *tieredBlocks) Put(ctx context.Context, b block.Block) error {
+	return tb.hot.Put(ctx, b)
+}
+
+type sizeRouter struct {
+	tiers *tieredBlocks
+	max   int
+}
+
+func (r sizeRouter) Route(ctx context.Context, blk block.Block) (IpldBlockstore, error) {
+	if len(blk.RawData()) > r.max {
+		return r.tiers.cold, nil
+	}
+	return nil, nil
+}
+
+func TestPutManyRouter(t *testing.T) {
+	ctx := context.Background()
+	tiers := &tieredBlocks{hot: newMockBlocks(), cold: newMockBlocks()}
+	s := NewCborStore(tiers)
+	s.PutRouter = sizeRouter{tiers: tiers, max: 16}
+
+	small, big := "hot", strings.Repeat("cold", 10)
+	cids, err := s.PutMany(ctx, []interface{}{small, big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tiers.hot.Has(ctx, cids[0]); !ok {
+		t.Fatal("expected the small block in the hot store")
+	}
+	if ok, _ := tiers.cold.Has(ctx, cids[1]); !ok {
+		t.Fatal("expected the large block in the cold store")
+	}
+	if ok, _ := tiers.hot.Has(ctx, cids[1]); ok {
+		t.Fatal("expected the large block not to be in the hot store")
+	}
+	var got string
+	if err := s.Get(ctx, cids[1], &got); err != nil || got != big {
+		t.Fatalf("expected %q, got %q: %v", big, got, err)
+	}
+
+	s.PutRouter = routerFunc(func(context.Context, block.Block) (IpldBlockstore, error) {
+		return nil, errors.New("no tier")
+	})
+	if _, err := s.PutMany(ctx, []interface{}{small}); err == nil {
+		t.Fatal("expected the routing error")
+	}
+}
+
+type routerFunc func(ctx context.Context, blk block.Block) (IpldBlockstore, error)
+
+func (f routerFunc) Route(ctx context.Context, blk block.Block) (IpldBlockstore, error) {
+	return f(ctx, blk)
+}
+
+func TestWalkOrdered(t *testing.T) {
+	ctx := context.Background()
+	s := NewDumpableMemCborStore()
+	raw := block.NewBlock([]byte("raw leaf"))
+	if err := s.Blocks.Put(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Put(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Put(ctx, map[string]interface{}{"raw": raw.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.Put(ctx, map[string]interface{}{
+		"zz":   a,
+		"y":    b,
+		"list": []interface{}{a, b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := s.Blocks.Get(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := DecodeBlock(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encoded key order is y, zz, list.
+	order := LinkOrder(nd.(*Node))
+	expected := []cid.Cid{b, a, a, b}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %d links, got %d", len(expected), len(order))
+	}
+	for i, c := range order {
+		if !c.Equals(expected[i]) {
+			t.Fatalf("link %d: expected %s, got %s", i, expected[i], c)
+		}
+	}
+
+	var visited []cid.Cid
+	err = s.WalkOrdered(ctx, root, func(blk block.Block) error {
+		visited = append(visited, blk.Cid())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []cid.Cid{root, b, raw.Cid(), a}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), len(visited))
+	}
+	for i, c := range visited {
+		if !c.Equals(expected[i]) {
+			t.Fatalf("block %d: expected %s, got %s", i, expected[i], c)
+		}
+	}
+
+	stop := errors.New("stop")
+	err = s.WalkOrdered(ctx, root, func(block.Block) error { return stop })
+	if err != stop {
+		t.Fatalf("expected the visit error, got %v", err)
+	}
+}
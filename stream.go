@@ -0,0 +1,176 @@
+package cbornode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// maxStreamDepth bounds the nesting of the elements DecodeArrayStream reads.
+const maxStreamDepth = 1024
+
+// DecodeArrayStream decodes the top-level CBOR array read from r one element
+// at a time, without holding the whole array in memory. Each element is
+// decoded into a fresh value from elemFactory, which must return a pointer, and
+// sent on the first channel; if elemFactory is nil, elements are decoded into
+// interface{} values and sent as is.
+//
+// Both channels are closed once the array has been read. The error channel
+// receives at most one error, after which no more elements are sent. Callers
+// must keep receiving elements until the element channel is closed.
+func DecodeArrayStream(r io.Reader, elemFactory func() interface{}) (<-chan interface{}, <-chan error) {
+	out := make(chan interface{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(out)
+		if err := decodeArrayStream(bufio.NewReader(r), elemFactory, out); err != nil {
+			errc <- err
+		}
+	}()
+	return out, errc
+}
+
+func decodeArrayStream(r *bufio.Reader, elemFactory func() interface{}, out chan<- interface{}) error {
+	hdr, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if encoding.MajorType(hdr>>5) != encoding.MajArray {
+		return fmt.Errorf("cbor: expected an array, got major type %d", hdr>>5)
+	}
+	indefinite := hdr&0x1f == 31
+	var n uint64
+	if !indefinite {
+		var scratch bytes.Buffer
+		n, err = readArgument(r, hdr, &scratch)
+		if err != nil {
+			return err
+		}
+	}
+
+	var item bytes.Buffer
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite {
+			next, err := r.Peek(1)
+			if err != nil {
+				return noEOF(err)
+			}
+			if next[0] == 0xff {
+				_, _ = r.ReadByte()
+				return nil
+			}
+		}
+
+		item.Reset()
+		if err := readItem(r, &item, 0); err != nil {
+			return err
+		}
+		if elemFactory == nil {
+			var v interface{}
+			if err := DecodeInto(item.Bytes(), &v); err != nil {
+				return err
+			}
+			out <- v
+			continue
+		}
+		v := elemFactory()
+		if err := DecodeInto(item.Bytes(), v); err != nil {
+			return err
+		}
+		out <- v
+	}
+	return nil
+}
+
+// readItem copies the encoding of a single CBOR data item from r to buf.
+func readItem(r *bufio.Reader, buf *bytes.Buffer, depth int) error {
+	if depth > maxStreamDepth {
+		return encoding.ErrMaxDepth
+	}
+	hdr, err := r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	if hdr == 0xff {
+		return encoding.ErrUnexpectedBreak
+	}
+	buf.WriteByte(hdr)
+
+	major := encoding.MajorType(hdr >> 5)
+	if hdr&0x1f == 31 {
+		switch major {
+		case encoding.MajByteString, encoding.MajTextString, encoding.MajArray, encoding.MajMap:
+		default:
+			return fmt.Errorf("cbor: invalid indefinite length for major type %d", major)
+		}
+		for {
+			next, err := r.Peek(1)
+			if err != nil {
+				return noEOF(err)
+			}
+			if next[0] == 0xff {
+				_, _ = r.ReadByte()
+				buf.WriteByte(0xff)
+				return nil
+			}
+			if err := readItem(r, buf, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	v, err := readArgument(r, hdr, buf)
+	if err != nil {
+		return err
+	}
+	var items uint64
+	switch major {
+	case encoding.MajByteString, encoding.MajTextString:
+		if _, err := io.CopyN(buf, r, int64(v)); err != nil {
+			return noEOF(err)
+		}
+		return nil
+	case encoding.MajArray:
+		items = v
+	case encoding.MajMap:
+		items = v * 2
+	case encoding.MajTag:
+		items = 1
+	}
+	for i := uint64(0); i < items; i++ {
+		if err := readItem(r, buf, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArgument reads the argument of the header hdr from r, copying it to buf.
+func readArgument(r *bufio.Reader, hdr byte, buf *bytes.Buffer) (uint64, error) {
+	info := hdr & 0x1f
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, fmt.Errorf("cbor: invalid additional info %d", info)
+	}
+	var b [8]byte
+	n := 1 << (info - 24)
+	if _, err := io.ReadFull(r, b[8-n:]); err != nil {
+		return 0, noEOF(err)
+	}
+	buf.Write(b[8-n:])
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package cbornode
+
+import (
+	"fmt"
+
+	"github.com/polydawn/refmt/obj/atlas"
+)
+
+// RegisterCborTag registers a handler for values tagged with the CBOR tag
+// `tag`, such as tag 0 or 1 timestamps or tag 37 UUIDs. Tagged values then
+// decode into typ, including when decoding into an interface{} (and thus in
+// Nodes), and values of typ encode back under the same tag.
+//
+// marshal must be a func(T) (U, error) and unmarshal a func(U) (T, error),
+// where T is the type of typ and U a type that encodes to the tag's content,
+// as for atlas.MakeMarshalTransformFunc.
+//
+// Tags other than 42 are not part of dag-cbor: objects using them still
+// encode, but are rejected by strict dag-cbor checks such as IngestCBOR.
+//
+// Registering a tag is safe while other goroutines encode and decode, which
+// handle it once RegisterCborTag returns.
+func RegisterCborTag(tag int, typ interface{}, marshal, unmarshal interface{}) (err error) {
+	if tag == CBORTagLink {
+		return fmt.Errorf("cbor tag %d is reserved for links", tag)
+	}
+	if tag < 0 {
+		return fmt.Errorf("invalid cbor tag %d", tag)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, e := range atlasEntries {
+		if e.Tagged && e.Tag == tag {
+			return fmt.Errorf("cbor tag %d is already registered for %s", tag, e.Type)
+		}
+	}
+
+	// The atlas builders panic on malformed transform functions.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot register cbor tag %d: %v", tag, r)
+		}
+	}()
+	entry := atlas.BuildEntry(typ).
+		UseTag(tag).
+		Transform().
+		TransformMarshal(atlas.MakeMarshalTransformFunc(marshal)).
+		TransformUnmarshal(atlas.MakeUnmarshalTransformFunc(unmarshal)).
+		Complete()
+
+	atlasEntries = append(atlasEntries, entry)
+	rebuildAtlas()
+	return nil
+}
+
+// findTagEntry returns the atlas entry registered for tag, if any.
+func findTagEntry(tag uint64) *atlas.AtlasEntry {
+	for _, e := range snapshot().entries {
+		if e.Tagged && uint64(e.Tag) == tag {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cbornode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/polydawn/refmt/obj/atlas"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// UndefinedCidMode selects how undefined (zero value) CIDs are encoded.
+type UndefinedCidMode int
+
+const (
+	// UndefinedCidError fails encoding with an ErrEmptyLink error naming the
+	// path of the first undefined CID. This is the default.
+	UndefinedCidError UndefinedCidMode = iota
+	// UndefinedCidNull encodes undefined CIDs as null. Decoding null into a
+	// cid.Cid then yields cid.Undef.
+	UndefinedCidNull
+	// UndefinedCidOmit leaves map entries and struct fields holding an
+	// undefined CID out of the encoding. Undefined CIDs in lists are encoded
+	// as null, as in UndefinedCidNull mode.
+	UndefinedCidOmit
+)
+
+// undefinedCidMarker is the encoding of an undefined CID outside of
+// UndefinedCidError mode, which marshal then rewrites. Valid links always
+// have at least the multibase prefix byte, so it is never produced
+// otherwise.
+var undefinedCidMarker = []byte{0xd8, CBORTagLink, 0x40}
+
+// SetUndefinedCidMode selects how the package level encoding functions and
+// stores without an Atlas of their own encode undefined CIDs. It applies to
+// the default refmt encoder only. Use UndefinedCidAtlasEntry to select the
+// mode of an atlas built with NewAtlas instead.
+//
+// The mode is part of the atlas snapshot: an encoding running when it changes
+// finishes with the mode it started with.
+func SetUndefinedCidMode(mode UndefinedCidMode) {
+	updateSettings(func(s *settings) {
+		s.undefinedCids = mode
+	})
+}
+
+// UndefinedCidAtlasEntry returns the link entry encoding undefined CIDs
+// according to mode. Passing it to NewAtlas selects the mode of that atlas,
+// whatever SetUndefinedCidMode selected for the package.
+func UndefinedCidAtlasEntry(mode UndefinedCidMode) *atlas.AtlasEntry {
+	return linkAtlasEntries[mode]
+}
+
+// undefinedCidModeOf returns the undefined CID mode of atl.
+func undefinedCidModeOf(atl atlas.Atlas) UndefinedCidMode {
+	if e, ok := atl.GetEntryByTag(CBORTagLink); ok {
+		for mode, le := range linkAtlasEntries {
+			if e == le {
+				return UndefinedCidMode(mode)
+			}
+		}
+	}
+	return UndefinedCidError
+}
+
+// rewriteUndefinedCids rewrites the undefined CID markers in b according to
+// mode.
+func rewriteUndefinedCids(b []byte, mode UndefinedCidMode) ([]byte, error) {
+	if mode == UndefinedCidError || !bytes.Contains(b, undefinedCidMarker) {
+		return b, nil
+	}
+	root, err := parseCanonItem(b)
+	if err != nil {
+		return nil, err
+	}
+	root = root.rewriteUndefinedCids(mode == UndefinedCidOmit)
+	var buf bytes.Buffer
+	if err := root.encode(&buf, &CanonicalizeReport{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (it *canonItem) isUndefinedCid() bool {
+	return it.tok.Major == encoding.MajTag && it.tok.Value == CBORTagLink &&
+		len(it.children) == 1 && it.children[0].tok.Major == encoding.MajByteString &&
+		len(it.children[0].data) == 0
+}
+
+func (it *canonItem) rewriteUndefinedCids(omit bool) *canonItem {
+	if it.isUndefinedCid() {
+		return &canonItem{tok: encoding.Token{Major: encoding.MajOther, Info: 22, Value: 22}}
+	}
+	if it.tok.Major == encoding.MajMap && omit {
+		kept := it.children[:0]
+		for i := 0; i+1 < len(it.children); i += 2 {
+			if it.children[i+1].isUndefinedCid() {
+				continue
+			}
+			kept = append(kept, it.children[i], it.children[i+1])
+		}
+		it.children = kept
+	}
+	for i, c := range it.children {
+		it.children[i] = c.rewriteUndefinedCids(omit)
+	}
+	return it
+}
+
+// undefinedCidPath returns the path of the first undefined CID found in v, in
+// Go syntax, or "" if there is none.
+func undefinedCidPath(v reflect.Value, path string) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if v.Type() == reflect.TypeOf(cid.Cid{}) {
+		if !v.Interface().(cid.Cid).Defined() {
+			if path == "" {
+				return "."
+			}
+			return path
+		}
+		return ""
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return ""
+		}
+		return undefinedCidPath(v.Elem(), path)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if p := undefinedCidPath(v.Field(i), path+"."+f.Name); p != "" {
+				return p
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return ""
+		}
+		for i := 0; i < v.Len(); i++ {
+			if p := undefinedCidPath(v.Index(i), path+"["+strconv.Itoa(i)+"]"); p != "" {
+				return p
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if p := undefinedCidPath(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key())); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
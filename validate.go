@@ -0,0 +1,115 @@
+package cbornode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	encoding "github.com/ipfs/go-ipld-cbor/encoding"
+)
+
+// ErrNotDagCBOR is returned when data is valid CBOR but doesn't follow the
+// strict dag-cbor encoding rules.
+var ErrNotDagCBOR = errors.New("data is not strict dag-cbor")
+
+// validateDagCBOR checks that b holds a single, strictly encoded dag-cbor
+// object: definite lengths only, minimally encoded integers and lengths,
+// string map keys in canonical order without duplicates, 64-bit floats and no
+// tags other than 42, which must wrap a valid link.
+func validateDagCBOR(b []byte) error {
+	type frame struct {
+		tok     encoding.Token
+		n       int
+		lastKey []byte
+	}
+	var stack []frame
+
+	return encoding.TokenWalk(b, func(tok encoding.Token) error {
+		// Pop the items we're done with; the parent of tok is at Depth-1.
+		for len(stack) > tok.Depth {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 {
+			parent := &stack[len(stack)-1]
+			switch parent.tok.Major {
+			case encoding.MajMap:
+				if parent.n%2 == 0 {
+					if tok.Major != encoding.MajTextString {
+						return fmt.Errorf("%w: map key at offset %d is not a string", ErrNotDagCBOR, tok.Offset)
+					}
+					if parent.n > 0 && !canonicalKeyLess(parent.lastKey, tok.Bytes) {
+						return fmt.Errorf("%w: map key %q at offset %d is duplicated or out of order", ErrNotDagCBOR, tok.Bytes, tok.Offset)
+					}
+					parent.lastKey = tok.Bytes
+				}
+			case encoding.MajTag:
+				if tok.Major != encoding.MajByteString {
+					return fmt.Errorf("%w: link at offset %d is not a byte string", ErrNotDagCBOR, tok.Offset)
+				}
+				if _, err := parseLinkBytes(tok.Bytes, false); err != nil {
+					return err
+				}
+			}
+			parent.n++
+		}
+
+		if tok.Indefinite {
+			return fmt.Errorf("%w: indefinite length item at offset %d", ErrNotDagCBOR, tok.Offset)
+		}
+		switch tok.Major {
+		case encoding.MajOther:
+			switch {
+			case tok.IsFloat():
+				if tok.Info != 27 {
+					return fmt.Errorf("%w: float at offset %d is not 64 bits wide", ErrNotDagCBOR, tok.Offset)
+				}
+			case tok.Value == 20, tok.Value == 21, tok.Value == 22:
+				if tok.Info >= 24 {
+					return fmt.Errorf("%w: non-minimal simple value at offset %d", ErrNotDagCBOR, tok.Offset)
+				}
+			default:
+				return fmt.Errorf("%w: unsupported simple value %d at offset %d", ErrNotDagCBOR, tok.Value, tok.Offset)
+			}
+		case encoding.MajTag:
+			if tok.Value != CBORTagLink {
+				return fmt.Errorf("%w: unsupported tag %d at offset %d", ErrNotDagCBOR, tok.Value, tok.Offset)
+			}
+			fallthrough
+		default:
+			if !minimalHeader(tok) {
+				return fmt.Errorf("%w: non-minimal encoding at offset %d", ErrNotDagCBOR, tok.Offset)
+			}
+		}
+
+		if tok.Major == encoding.MajMap || tok.Major == encoding.MajArray || tok.Major == encoding.MajTag {
+			stack = append(stack, frame{tok: tok})
+		}
+		return nil
+	})
+}
+
+// minimalHeader reports whether the argument of tok is encoded in the fewest
+// bytes possible.
+func minimalHeader(tok encoding.Token) bool {
+	switch tok.Info {
+	case 24:
+		return tok.Value >= 24
+	case 25:
+		return tok.Value > 0xff
+	case 26:
+		return tok.Value > 0xffff
+	case 27:
+		return tok.Value > 0xffffffff
+	default:
+		return true
+	}
+}
+
+// canonicalKeyLess orders keys as RFC 7049 canonical CBOR does: shorter keys
+// first, then bytewise.
+func canonicalKeyLess(a, b []byte) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return bytes.Compare(a, b) < 0
+}
@@ -0,0 +1,131 @@
+// Package versioned encodes dag-cbor payloads alongside a schema version, so
+// that protocols can evolve their formats while still reading older data.
+//
+// A versioned object is a dag-cbor map holding the version number and the
+// encoded payload:
+//
+//	{"v": <version>, "payload": <payload>}
+//
+// Each payload type is registered with the version it encodes as and a
+// factory for the values its payloads decode into. Decode reads the version
+// and dispatches to the matching factory, leaving callers to convert older
+// versions to the current one.
+package versioned
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+// ErrUnknownVersion is returned when decoding an object whose version has no
+// registered decoder.
+var ErrUnknownVersion = errors.New("versioned: unknown version")
+
+// ErrUnregisteredType is returned when encoding a value whose type has no
+// registered version.
+var ErrUnregisteredType = errors.New("versioned: unregistered type")
+
+type object struct {
+	V       uint64
+	Payload cbornode.RawCBOR
+}
+
+func init() {
+	cbornode.RegisterCborType(object{})
+}
+
+// Registry maps payload types to versions and back. Protocols that may share
+// a process with others should use their own Registry, as version numbers are
+// only unique within one.
+type Registry struct {
+	versions  map[reflect.Type]uint64
+	factories map[uint64]func() interface{}
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		versions:  make(map[reflect.Type]uint64),
+		factories: make(map[uint64]func() interface{}),
+	}
+}
+
+// RegisterVersion registers that values of the type of typeHint, or pointers
+// to it, encode as the given version, and that payloads of that version decode
+// into the values factory returns, which must be pointers. The type must be
+// encodable, typically through cbornode.RegisterCborType. It panics if the
+// type or the version is already registered.
+//
+// Like cbornode.RegisterCborType, this is not thread-safe and should be called
+// during initialization.
+func (r *Registry) RegisterVersion(typeHint interface{}, version uint64, factory func() interface{}) {
+	t := baseType(reflect.TypeOf(typeHint))
+	if _, ok := r.versions[t]; ok {
+		panic(fmt.Sprintf("versioned: type %s is already registered", t))
+	}
+	if _, ok := r.factories[version]; ok {
+		panic(fmt.Sprintf("versioned: version %d is already registered", version))
+	}
+	r.versions[t] = version
+	r.factories[version] = factory
+}
+
+// Encode encodes obj along with the version registered for its type.
+func (r *Registry) Encode(obj interface{}) ([]byte, error) {
+	version, ok := r.versions[baseType(reflect.TypeOf(obj))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnregisteredType, obj)
+	}
+	payload, err := cbornode.Encode(obj)
+	if err != nil {
+		return nil, err
+	}
+	return cbornode.Encode(object{V: version, Payload: payload})
+}
+
+// Decode decodes the versioned object b into a value returned by the factory
+// registered for its version, and returns that value with the version.
+func (r *Registry) Decode(b []byte) (interface{}, uint64, error) {
+	var obj object
+	if err := cbornode.DecodeInto(b, &obj); err != nil {
+		return nil, 0, fmt.Errorf("versioned: %w", err)
+	}
+	factory, ok := r.factories[obj.V]
+	if !ok {
+		return nil, obj.V, fmt.Errorf("%w: %d", ErrUnknownVersion, obj.V)
+	}
+	out := factory()
+	if err := obj.Payload.Decode(out); err != nil {
+		return nil, obj.V, fmt.Errorf("versioned: version %d: %w", obj.V, err)
+	}
+	return out, obj.V, nil
+}
+
+func baseType(t reflect.Type) reflect.Type {
+	if t != nil && t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// DefaultRegistry is the Registry used by the package level functions.
+var DefaultRegistry = NewRegistry()
+
+// RegisterVersion registers a version in DefaultRegistry, as
+// Registry.RegisterVersion does.
+func RegisterVersion(typeHint interface{}, version uint64, factory func() interface{}) {
+	DefaultRegistry.RegisterVersion(typeHint, version, factory)
+}
+
+// Encode encodes obj with DefaultRegistry.
+func Encode(obj interface{}) ([]byte, error) {
+	return DefaultRegistry.Encode(obj)
+}
+
+// Decode decodes b with DefaultRegistry.
+func Decode(b []byte) (interface{}, uint64, error) {
+	return DefaultRegistry.Decode(b)
+}
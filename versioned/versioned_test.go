@@ -0,0 +1,62 @@
+package versioned
+
+import (
+	"errors"
+	"testing"
+
+	cbornode "github.com/ipfs/go-ipld-cbor"
+)
+
+type profileV1 struct {
+	Name string
+}
+
+type profileV2 struct {
+	First string
+	Last  string
+}
+
+func init() {
+	cbornode.RegisterCborType(profileV1{})
+	cbornode.RegisterCborType(profileV2{})
+}
+
+func TestEncodeDecode(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterVersion(profileV1{}, 1, func() interface{} { return new(profileV1) })
+	r.RegisterVersion(profileV2{}, 2, func() interface{} { return new(profileV2) })
+
+	old, err := r.Encode(&profileV1{Name: "Ada Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := r.Encode(profileV2{First: "Ada", Last: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]interface{}
+	if err := cbornode.DecodeInto(cur, &m); err != nil || m["v"] != 2 {
+		t.Fatalf("unexpected encoding %v %v", m, err)
+	}
+
+	v, version, err := r.Decode(old)
+	if err != nil || version != 1 || v.(*profileV1).Name != "Ada Lovelace" {
+		t.Fatalf("unexpected decoding %v %d %v", v, version, err)
+	}
+	v, version, err = r.Decode(cur)
+	if err != nil || version != 2 || v.(*profileV2).Last != "Lovelace" {
+		t.Fatalf("unexpected decoding %v %d %v", v, version, err)
+	}
+
+	if _, err := r.Encode("profile"); !errors.Is(err, ErrUnregisteredType) {
+		t.Fatalf("expected an unregistered type to be refused, got %v", err)
+	}
+	future, err := cbornode.Encode(map[string]interface{}{"v": 3, "payload": "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, version, err := r.Decode(future); !errors.Is(err, ErrUnknownVersion) || version != 3 {
+		t.Fatalf("expected an unknown version to be refused, got %d %v", version, err)
+	}
+}
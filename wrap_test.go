@@ -61,27 +61,31 @@ func BenchmarkDecodeBlock(b *testing.B) {
 	}
 }
 
+// BenchmarkWrapObjectParallel reports the time per WrapObject call with 100
+// goroutines per CPU, so that it stays flat as CPUs are added if the shared
+// pools don't contend.
 func BenchmarkWrapObjectParallel(b *testing.B) {
+	benchmarkWrapObjectParallel(b)
+}
+
+func BenchmarkWrapObjectParallelBoundedPool(b *testing.B) {
+	SetClonerPoolSize(64)
+	defer SetClonerPoolSize(0)
+	benchmarkWrapObjectParallel(b)
+}
+
+func benchmarkWrapObjectParallel(b *testing.B) {
 	obj := testStruct()
+	b.SetParallelism(100)
 	b.ResetTimer()
-	var wg sync.WaitGroup
-	wg.Add(100)
-	errors := make(chan error, 100)
-	for j := 0; j < 100; j++ {
-		go func() {
-			defer wg.Done()
-			for i := 0; i < b.N; i++ {
-				if _, err := WrapObject(obj, mh.SHA2_256, -1); err != nil {
-					errors <- err
-				}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := WrapObject(obj, mh.SHA2_256, -1); err != nil {
+				b.Error(err)
+				return
 			}
-		}()
-	}
-	wg.Wait()
-	close(errors)
-	for e := range errors {
-		b.Fatal(e)
-	}
+		}
+	})
 }
 
 func BenchmarkDecodeBlockParallel(b *testing.B) {
@@ -120,3 +124,62 @@ func BenchmarkEncode(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkDecode(b *testing.B) {
+	data, err := Encode(testStruct())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out MyStruct
+		if err := DecodeInto(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExtractLinks(b *testing.B) {
+	obj := testStruct()
+	nd, err := WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		b.Fatal(err, nd)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ExtractLinks(nd.RawData()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrapObjectCached(b *testing.B) {
+	EnableWrapCache(16)
+	defer EnableWrapCache(0)
+	obj := testStruct()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nd, err := WrapObject(obj, mh.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err, nd)
+		}
+	}
+}
+
+func BenchmarkDecodeLargeInts(b *testing.B) {
+	ints := make([]int64, 64)
+	for i := range ints {
+		ints[i] = 1<<40 + int64(i)
+	}
+	data, err := Encode(ints)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []int64
+		if err := DecodeInto(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
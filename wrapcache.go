@@ -0,0 +1,76 @@
+package cbornode
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sync"
+)
+
+// wrapCache memoizes the nodes built by WrapObject, keyed by their encoding.
+//
+// Objects are still encoded on every call, as pointer identity says nothing
+// about whether an object was mutated since it was last wrapped; a hit only
+// saves hashing the encoding and copying the object into a node.
+type wrapCache struct {
+	lk    sync.Mutex
+	seed  maphash.Seed
+	size  int
+	nodes map[wrapCacheKey]*Node
+	order []wrapCacheKey
+}
+
+type wrapCacheKey struct {
+	sum    uint64
+	mhType uint64
+	mhLen  int
+}
+
+// EnableWrapCache makes WrapObject remember the last size distinct nodes it
+// built and return the cached node when asked to wrap an object with the same
+// encoding and hash function again. A size of 0 disables the cache, which is
+// the default.
+//
+// Cached nodes are shared between callers, so they must be treated as
+// immutable, including the values returned by Resolve.
+//
+// Every call starts a new, empty cache, which WrapObject calls starting after
+// it returns use.
+func EnableWrapCache(size int) {
+	var wc *wrapCache
+	if size > 0 {
+		wc = &wrapCache{
+			seed:  maphash.MakeSeed(),
+			size:  size,
+			nodes: make(map[wrapCacheKey]*Node, size),
+		}
+	}
+	updateSettings(func(s *settings) {
+		s.wrapCache = wc
+	})
+}
+func (wc *wrapCache) key(data []byte, mhType uint64, mhLen int) wrapCacheKey {
+	return wrapCacheKey{sum: maphash.Bytes(wc.seed, data), mhType: mhType, mhLen: mhLen}
+}
+
+func (wc *wrapCache) get(k wrapCacheKey, data []byte) *Node {
+	wc.lk.Lock()
+	defer wc.lk.Unlock()
+	// The sum is not cryptographic, so only trust a hit on identical bytes.
+	if nd, ok := wc.nodes[k]; ok && bytes.Equal(nd.raw, data) {
+		return nd
+	}
+	return nil
+}
+
+func (wc *wrapCache) add(k wrapCacheKey, nd *Node) {
+	wc.lk.Lock()
+	defer wc.lk.Unlock()
+	if _, ok := wc.nodes[k]; !ok {
+		if len(wc.order) >= wc.size {
+			delete(wc.nodes, wc.order[0])
+			wc.order = wc.order[1:]
+		}
+		wc.order = append(wc.order, k)
+	}
+	wc.nodes[k] = nd
+}